@@ -0,0 +1,205 @@
+package throttled
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RateLimitBatch checks whether any of several keys has exceeded its
+// rate limit and, if none has, updates all of them by the supplied
+// quantity. This is useful to charge a single action against several
+// buckets at once, such as a per-user, a per-tenant and a global one.
+// It returns a RateLimitResult for each key, in the same order, and
+// whether the action is limited, which is the case if any of the keys
+// is limited. The keys must be distinct.
+//
+// The update is all-or-nothing: when the action is limited, none of
+// the keys is charged and the results describe their current state.
+// If the store implements GCRABatchReader, all keys are read at once.
+// If the store implements GCRABatchStore, all keys are compared and
+// updated in a single atomic operation. Otherwise they are updated one
+// after the other and, should one of the updates fail because of a
+// concurrent change, the keys already updated are restored to their
+// previous values before retrying. Such a rollback is best effort: a
+// key modified by another client in the meantime, or a store error,
+// can leave some keys charged.
+//
+// Quantities are checked as by RateLimit: a negative quantity returns
+// an error wrapping ErrInvalidQuantity, a quantity of 0 only reads the
+// keys, and a quantity greater than the limit is limited without
+// updating the keys and returns ErrQuantityExceedsLimit.
+func (g *GCRARateLimiter) RateLimitBatch(keys []string, quantity int) ([]RateLimitResult, bool, error) {
+	params := make([]*gcra, len(keys))
+	for i := range keys {
+		params[i] = &g.gcra
+	}
+	return g.rateLimitBatch(context.Background(), keys, params, quantity)
+}
+
+// rateLimitBatch implements RateLimitBatch with separate parameters for
+// each key.
+func (g *GCRARateLimiter) rateLimitBatch(ctx context.Context, keys []string, params []*gcra, quantity int) ([]RateLimitResult, bool, error) {
+	results := make([]RateLimitResult, len(keys))
+	for i, p := range params {
+		results[i] = RateLimitResult{Limit: p.limit, RetryAfter: -1}
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			return results, false, fmt.Errorf("Duplicate key %s in rate limit batch", key)
+		}
+		seen[key] = true
+	}
+
+	var quantityErr error
+	for _, p := range params {
+		switch err := checkQuantity(quantity, p.limit); err {
+		case nil:
+		case ErrQuantityExceedsLimit:
+			quantityErr = err
+		default:
+			return results, false, err
+		}
+	}
+
+	values := make([]int64, len(keys))
+	times := make([]time.Time, len(keys))
+
+	if quantity == 0 || quantityErr != nil {
+		if err := g.getBatch(ctx, keys, values, times); err != nil {
+			return results, false, err
+		}
+		limited := quantityErr != nil
+		for j := range keys {
+			d := params[j].decide(values[j], times[j], 0)
+			results[j] = d.result
+			limited = limited || d.limited
+		}
+		return results, limited, quantityErr
+	}
+
+	decisions := make([]gcraDecision, len(keys))
+
+	i := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return results, false, err
+		}
+		if err := g.getBatch(ctx, keys, values, times); err != nil {
+			return results, false, err
+		}
+
+		limited := false
+		for j := range keys {
+			decisions[j] = params[j].decide(values[j], times[j], quantity)
+			limited = limited || decisions[j].limited
+		}
+
+		if limited {
+			for j, d := range decisions {
+				if d.limited {
+					results[j] = g.jitter(d.result)
+				} else {
+					results[j] = params[j].decide(values[j], times[j], 0).result
+				}
+			}
+			return results, true, nil
+		}
+
+		updated, err := g.updateBatch(ctx, keys, values, times, decisions)
+		if err != nil {
+			return results, false, err
+		}
+		if updated {
+			for j, d := range decisions {
+				results[j] = d.result
+			}
+			return results, false, nil
+		}
+
+		i++
+		if !g.retry(ctx, i) {
+			return results, false, ErrCASExhausted
+		}
+	}
+}
+
+// getBatch reads the value of each key and the time it was read at
+// into values and times, in a single operation if the store implements
+// GCRABatchReader.
+func (g *GCRARateLimiter) getBatch(ctx context.Context, keys []string, values []int64, times []time.Time) error {
+	if br, ok := g.store.(GCRABatchReader); ok {
+		v, now, err := br.BatchGetWithTime(keys)
+		if err != nil {
+			return err
+		}
+		if len(v) != len(keys) {
+			return fmt.Errorf("Store %T returned %d values for %d keys", g.store, len(v), len(keys))
+		}
+		copy(values, v)
+		for j := range times {
+			times[j] = g.now(now)
+		}
+		return nil
+	}
+
+	for j, key := range keys {
+		v, now, err := g.storeCtx.GetWithTimeCtx(ctx, key)
+		if err != nil {
+			return err
+		}
+		values[j], times[j] = v, g.now(now)
+	}
+	return nil
+}
+
+// updateBatch stores the new values of all keys, reporting false if
+// one of them was modified since it was read.
+func (g *GCRARateLimiter) updateBatch(ctx context.Context, keys []string, values []int64, times []time.Time, decisions []gcraDecision) (bool, error) {
+	newValues := make([]int64, len(keys))
+	ttls := make([]time.Duration, len(keys))
+	for j, d := range decisions {
+		newValues[j], ttls[j] = d.newTat.UnixNano(), g.storeTTL(d.ttl)
+	}
+
+	if bs, ok := g.store.(GCRABatchStore); ok {
+		return bs.CompareAndSwapMultiWithTTL(keys, values, newValues, ttls)
+	}
+
+	for j, key := range keys {
+		var updated bool
+		var err error
+		if values[j] == -1 {
+			updated, err = g.storeCtx.SetIfNotExistsWithTTLCtx(ctx, key, newValues[j], ttls[j])
+		} else {
+			updated, err = g.storeCtx.CompareAndSwapWithTTLCtx(ctx, key, values[j], newValues[j], ttls[j])
+		}
+
+		if err != nil || !updated {
+			g.rollbackBatch(keys[:j], values, times, newValues)
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// rollbackBatch restores keys to the values they had before being
+// updated to newValues, ignoring any failure.
+func (g *GCRARateLimiter) rollbackBatch(keys []string, values []int64, times []time.Time, newValues []int64) {
+	for j, key := range keys {
+		// A key that didn't exist can't be deleted, but a theoretical
+		// arrival time of now is equivalent. It is given a TTL as by
+		// Refund so that it still expires.
+		old, ttl := values[j], g.emissionInterval
+		if old == -1 {
+			old = times[j].UnixNano()
+		} else if d := time.Unix(0, old).Sub(times[j]); d > 0 {
+			ttl = d
+		}
+
+		g.store.CompareAndSwapWithTTL(key, newValues[j], old, g.storeTTL(ttl))
+	}
+}
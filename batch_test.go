@@ -0,0 +1,143 @@
+package throttled_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestRateLimitBatch(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	now := time.Unix(1000, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// testStore doesn't implement GCRABatchStore, and so exercises the
+	// sequential fallback.
+	stores := map[string]throttled.GCRAStore{
+		"batch":      mst,
+		"sequential": &testStore{store: mst, clock: now},
+	}
+
+	for name, st := range stores {
+		rl, err := throttled.NewGCRARateLimiter(st, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl.SetClock(func() time.Time { return now })
+		prefix := name + ":"
+
+		// Exhaust the second key
+		for i := 0; i < 2; i++ {
+			if _, _, err := rl.RateLimit(prefix+"b", 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys := []string{prefix + "a", prefix + "b"}
+		results, limited, err := rl.RateLimitBatch(keys, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limited {
+			t.Fatalf("%s: expected the batch to be limited", name)
+		}
+		if have, want := results[0].Remaining, 2; have != want {
+			t.Errorf("%s: expected the unlimited key to have %d remaining but got %d", name, want, have)
+		}
+		if have, want := results[1].RetryAfter, time.Minute; have != want {
+			t.Errorf("%s: expected RetryAfter to be %s but got %s", name, want, have)
+		}
+
+		// Nothing was charged, so the first key still has its whole burst
+		if have, _, err := st.GetWithTime(prefix + "a"); err != nil {
+			t.Fatal(err)
+		} else if have != -1 {
+			t.Errorf("%s: expected a limited batch not to store the first key", name)
+		}
+
+		keys = []string{prefix + "a", prefix + "c"}
+		results, limited, err = rl.RateLimitBatch(keys, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited {
+			t.Fatalf("%s: expected the batch not to be limited", name)
+		}
+		for i, r := range results {
+			if have, want := r.Remaining, 1; have != want {
+				t.Errorf("%s: expected key %d to have %d remaining but got %d", name, i, want, have)
+			}
+		}
+	}
+}
+
+func TestRateLimitBatchDuplicateKeys(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := rl.RateLimitBatch([]string{"foo", "foo"}, 1); err == nil {
+		t.Error("expected an error for duplicate keys")
+	}
+}
+
+// failSetStore never creates the key fail. It only implements
+// GCRAStore, so that batches are updated one key after the other.
+type failSetStore struct {
+	st *memstore.MemStore
+}
+
+func (s *failSetStore) GetWithTime(key string) (int64, time.Time, error) {
+	return s.st.GetWithTime(key)
+}
+
+func (s *failSetStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	if key == "fail" {
+		return false, nil
+	}
+	return s.st.SetIfNotExistsWithTTL(key, value, ttl)
+}
+
+func (s *failSetStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.st.CompareAndSwapWithTTL(key, old, new, ttl)
+}
+
+func TestRateLimitBatchRollbackExpires(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mst.SetClock(func() time.Time { return now })
+	rl, err := throttled.NewGCRARateLimiter(&failSetStore{mst}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetMaxCASAttempts(1)
+
+	if _, _, err := rl.RateLimitBatch([]string{"foo", "fail"}, 1); err != throttled.ErrCASExhausted {
+		t.Fatalf("expected ErrCASExhausted but got %v", err)
+	}
+
+	// The key created by the batch is rolled back with a TTL rather
+	// than kept forever
+	now = now.Add(2 * time.Second)
+	if v, _, err := mst.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	} else if v != -1 {
+		t.Errorf("expected the rolled back key to expire but got %d", v)
+	}
+}
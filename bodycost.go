@@ -0,0 +1,41 @@
+package throttled
+
+import "net/http"
+
+// ContentLengthCost returns a Cost function for an HTTPRateLimiter
+// limiting the bytes of request bodies rather than the number of
+// requests, such as on upload endpoints. Its quota is then expressed
+// in bytes: PerSec(1<<20) with a MaxBurst of 8<<20 permits a sustained
+// megabyte per second in bursts of up to 8 megabytes, and the Limit
+// and Remaining of the RateLimitResult are bytes.
+//
+// Each request costs its Content-Length, or floor if its length is
+// unknown, as with chunked bodies, or lower than floor. A request
+// whose length exceeds the Limit of a GCRARateLimiter is denied, since
+// it can never be permitted. Use BodyReadCost as the ResponseCost to
+// charge the bytes the handler actually read once it has run.
+func ContentLengthCost(floor int) func(*http.Request) int {
+	return func(r *http.Request) int {
+		if r.ContentLength < int64(floor) {
+			return floor
+		}
+		if r.ContentLength > int64(maxInt) {
+			return maxInt
+		}
+		return int(r.ContentLength)
+	}
+}
+
+// BodyReadCost is a ResponseCost function for an HTTPRateLimiter
+// whose Cost is given by ContentLengthCost. It charges the bytes of
+// the request body read by the handler, so the floor charged for a
+// body of unknown length is reconciled with its actual length, and
+// bytes the handler didn't read are given back.
+func BodyReadCost(r *http.Request, meta ResponseMeta) int {
+	if meta.BodyRead > int64(maxInt) {
+		return maxInt
+	}
+	return int(meta.BodyRead)
+}
+
+const maxInt = int(^uint(0) >> 1)
@@ -0,0 +1,91 @@
+package throttled_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestContentLengthCost(t *testing.T) {
+	cost := throttled.ContentLengthCost(10)
+	for i, c := range []struct {
+		length int64
+		cost   int
+	}{
+		0: {100, 100},
+		1: {10, 10},
+		// Below the floor
+		2: {1, 10},
+		3: {0, 10},
+		// Unknown
+		4: {-1, 10},
+	} {
+		if have := cost(&http.Request{ContentLength: c.length}); have != c.cost {
+			t.Errorf("%d: expected a cost of %d but got %d", i, c.cost, have)
+		}
+	}
+}
+
+func TestHTTPRateLimiterBodyBytes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter:  rl,
+		Cost:         throttled.ContentLengthCost(10),
+		ResponseCost: throttled.BodyReadCost,
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ignore" {
+			ioutil.ReadAll(r.Body)
+		}
+	}))
+
+	cases := []struct {
+		path      string
+		body      string
+		chunked   bool
+		code      int
+		remaining string
+	}{
+		0: {"/", strings.Repeat("a", 40), false, 200, "60"},
+		// The floor is charged up front, then the bytes read
+		1: {"/", strings.Repeat("a", 30), true, 200, "50"},
+		// Larger than the whole limit
+		2: {"/", strings.Repeat("a", 200), false, 429, "30"},
+		3: {"/", strings.Repeat("a", 40), false, 429, "30"},
+		// Bytes the handler doesn't read are given back
+		4: {"/ignore", strings.Repeat("a", 30), false, 200, "0"},
+		5: {"/", strings.Repeat("a", 30), false, 200, "0"},
+	}
+
+	for i, c := range cases {
+		req := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+		if c.chunked {
+			req.ContentLength = -1
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%d: expected %d but got %d", i, c.code, rr.Code)
+		}
+		if have := rr.Header().Get("X-Ratelimit-Remaining"); have != c.remaining {
+			t.Errorf("%d: expected %s bytes remaining but got %s", i, c.remaining, have)
+		}
+	}
+}
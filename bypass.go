@@ -0,0 +1,45 @@
+package throttled
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewBypassToken creates a token letting requests skip the limits of
+// an HTTPRateLimiter whose BypassSecret is secret until expires, when
+// sent in its BypassHeader. The token holds its expiry time and an
+// HMAC-SHA256 signature of it, so it can't be extended or forged
+// without the secret.
+func NewBypassToken(secret []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + hex.EncodeToString(signBypass(secret, exp))
+}
+
+// validBypassToken reports whether token was created by NewBypassToken
+// with secret and hasn't expired at now. The signatures are compared
+// in constant time.
+func validBypassToken(secret []byte, token string, now time.Time) bool {
+	i := strings.IndexByte(token, '.')
+	if i == -1 {
+		return false
+	}
+	exp, sig := token[:i], token[i+1:]
+
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signBypass(secret, exp)) {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	return err == nil && now.Unix() < expires
+}
+
+func signBypass(secret []byte, exp string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(exp))
+	return mac.Sum(nil)
+}
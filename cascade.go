@@ -0,0 +1,125 @@
+package throttled
+
+import "context"
+
+// CascadeLevel identifies a level of a CascadingLimiter.
+type CascadeLevel int
+
+const (
+	// CascadeParent is the broader level, such as a tenant.
+	CascadeParent CascadeLevel = iota
+
+	// CascadeChild is the narrower level, such as an endpoint of a
+	// tenant.
+	CascadeChild
+)
+
+func (l CascadeLevel) String() string {
+	switch l {
+	case CascadeParent:
+		return "parent"
+	case CascadeChild:
+		return "child"
+	}
+	return "unknown"
+}
+
+// CascadeResult is the result of CascadingLimiter.RateLimitCascade.
+type CascadeResult struct {
+	RateLimitResult
+
+	// Level is the level that limited the request or, if neither did,
+	// the level whose RateLimitResult is reported.
+	Level CascadeLevel
+}
+
+// CascadingLimiter is a RateLimiter for nested buckets, such as a
+// tenant permitted 10,000 requests per minute in total and, within
+// that, 1,000 per minute on each endpoint. A request is charged to
+// both its parent and its child bucket, or to neither if either
+// limits it.
+//
+// Unlike with a CompositeRateLimiter, the child bucket is only
+// checked once the parent permits the request, so a request limited by
+// its parent never touches the limits of the child, and the result
+// tells which level limited the request.
+type CascadingLimiter struct {
+	parent, child RateLimiter
+	parentKey     func(key string) string
+}
+
+// NewCascadingLimiter creates a CascadingLimiter. The key passed to
+// RateLimit identifies the child bucket, such as "tenant:endpoint",
+// and is passed to child unchanged, while parentKey derives the key
+// passed to parent from it, such as "tenant".
+func NewCascadingLimiter(parent RateLimiter, parentKey func(key string) string, child RateLimiter) *CascadingLimiter {
+	return &CascadingLimiter{parent: parent, child: child, parentKey: parentKey}
+}
+
+// RateLimit is like RateLimitCascade without the level of the result.
+func (c *CascadingLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return c.RateLimitCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCtx is the context-aware version of RateLimit.
+func (c *CascadingLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	limited, result, err := c.RateLimitCascadeCtx(ctx, key, quantity)
+	return limited, result.RateLimitResult, err
+}
+
+// RateLimitCascade charges quantity to the parent bucket of key and,
+// if the parent permits it, to the child bucket. If the child limits
+// the request or returns an error, quantity is given back to the
+// parent, so that the request isn't charged at all. The result is
+// that of the level that limited the request or, if neither did, that
+// of the level with the fewest requests remaining.
+//
+// Giving quantity back is best effort: it requires the parent
+// RateLimiter to implement Refunder, as GCRARateLimiter does, and its
+// errors are ignored, so a store error can leave the parent charged
+// for a request the child limited. The parent then under-admits
+// slightly, which errs on the side of its quota.
+func (c *CascadingLimiter) RateLimitCascade(key string, quantity int) (bool, CascadeResult, error) {
+	return c.RateLimitCascadeCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCascadeCtx is the context-aware version of
+// RateLimitCascade. ctx is passed to the RateLimiters implementing
+// RateLimiterCtx, and the others are called with RateLimit.
+func (c *CascadingLimiter) RateLimitCascadeCtx(ctx context.Context, key string, quantity int) (bool, CascadeResult, error) {
+	pk := c.parentKey(key)
+
+	limited, parent, err := rateLimitCtx(ctx, c.parent, pk, quantity)
+	if err != nil || limited {
+		return limited, CascadeResult{RateLimitResult: parent, Level: CascadeParent}, err
+	}
+
+	limited, child, err := rateLimitCtx(ctx, c.child, key, quantity)
+	if err != nil || limited {
+		if r, ok := c.parent.(Refunder); ok && quantity > 0 {
+			r.Refund(pk, quantity)
+		}
+		return limited, CascadeResult{RateLimitResult: child, Level: CascadeChild}, err
+	}
+
+	if parent.Remaining < child.Remaining {
+		return false, CascadeResult{RateLimitResult: parent, Level: CascadeParent}, nil
+	}
+	return false, CascadeResult{RateLimitResult: child, Level: CascadeChild}, nil
+}
+
+// Refund gives quantity back to both buckets of key, for the
+// RateLimiters implementing Refunder. It returns the first error,
+// after trying both.
+func (c *CascadingLimiter) Refund(key string, quantity int) error {
+	var first error
+	if r, ok := c.parent.(Refunder); ok {
+		first = r.Refund(c.parentKey(key), quantity)
+	}
+	if r, ok := c.child.(Refunder); ok {
+		if err := r.Refund(key, quantity); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,91 @@
+package throttled_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestCascadingLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants.SetClock(clock)
+
+	endpoints, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints.SetClock(clock)
+
+	tenant := func(key string) string { return "tenant:" + strings.SplitN(key, ":", 2)[0] }
+	rl := throttled.NewCascadingLimiter(tenants, tenant, endpoints)
+
+	cases := []struct {
+		key       string
+		limited   bool
+		level     throttled.CascadeLevel
+		limit     int
+		remaining int
+	}{
+		// The endpoint has the fewest remaining
+		0: {"t:a", false, throttled.CascadeChild, 2, 1},
+		1: {"t:a", false, throttled.CascadeChild, 2, 0},
+		// The endpoint is exhausted and the tenant isn't charged
+		2: {"t:a", true, throttled.CascadeChild, 2, 0},
+		// The tenant has the fewest remaining
+		3: {"t:b", false, throttled.CascadeParent, 3, 0},
+		// The tenant is exhausted
+		4: {"t:c", true, throttled.CascadeParent, 3, 0},
+		// Other tenants are independent
+		5: {"u:a", false, throttled.CascadeChild, 2, 1},
+	}
+
+	for i, c := range cases {
+		limited, result, err := rl.RateLimitCascade(c.key, 1)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected limited to be %t but got %t", i, c.limited, limited)
+		}
+		if result.Level != c.level {
+			t.Errorf("%d: expected the %s level but got %s", i, c.level, result.Level)
+		}
+		if result.Limit != c.limit {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, c.limit, result.Limit)
+		}
+		if result.Remaining != c.remaining {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, c.remaining, result.Remaining)
+		}
+	}
+
+	// The request limited by the tenant never reached the endpoint
+	if result, err := endpoints.Peek("t:c"); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 2 {
+		t.Errorf("expected t:c not to be charged but it has %d remaining", result.Remaining)
+	}
+
+	// Refund gives back to both levels
+	if err := rl.Refund("t:a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if limited, _, err := rl.RateLimit("t:a", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Error("expected a request after a refund to be permitted")
+	}
+}
@@ -0,0 +1,98 @@
+package throttled
+
+import "context"
+
+// A CompositeLimit is one of the limits enforced by a
+// CompositeRateLimiter.
+type CompositeLimit struct {
+	// RateLimiter enforces the limit.
+	RateLimiter RateLimiter
+
+	// KeyFunc derives the key passed to RateLimiter from the key passed
+	// to the CompositeRateLimiter. For example, a global limit would
+	// return the same key for all requests. If it is nil, the key is
+	// passed unchanged.
+	KeyFunc func(key string) string
+}
+
+// CompositeRateLimiter is a RateLimiter charging each request against
+// several limits, such as a per-client limit and a global one, and
+// limiting it if any of them does.
+type CompositeRateLimiter struct {
+	limits []CompositeLimit
+}
+
+// NewCompositeRateLimiter creates a CompositeRateLimiter enforcing
+// limits in order.
+func NewCompositeRateLimiter(limits ...CompositeLimit) *CompositeRateLimiter {
+	return &CompositeRateLimiter{limits: limits}
+}
+
+// RateLimit calls each RateLimiter in order with quantity until one of
+// them limits the request or returns an error. The limiters called
+// before it then get quantity back, so that a limited request isn't
+// charged. The returned RateLimitResult is that of the limiter that
+// limited the request or, if none did, that of the limiter with the
+// fewest requests remaining.
+//
+// Giving quantity back is best effort: it requires the RateLimiter to
+// implement Refunder, as GCRARateLimiter does, and its errors are
+// ignored, so a store error can still leave earlier limits charged.
+func (c *CompositeRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return c.RateLimitCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCtx is the context-aware version of RateLimit. ctx is
+// passed to the RateLimiters implementing RateLimiterCtx, and the
+// others are called with RateLimit.
+func (c *CompositeRateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	result := RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1}
+
+	for i, l := range c.limits {
+		limited, r, err := rateLimitCtx(ctx, l.RateLimiter, l.key(key), quantity)
+		if err != nil || limited {
+			c.refund(key, quantity, c.limits[:i])
+			return limited, r, err
+		}
+
+		if i == 0 || r.Remaining < result.Remaining {
+			result = r
+		}
+	}
+
+	return false, result, nil
+}
+
+// Refund gives quantity back to key in each limit whose RateLimiter
+// implements Refunder. It returns the first error, after trying all
+// of them.
+func (c *CompositeRateLimiter) Refund(key string, quantity int) error {
+	var first error
+	for _, l := range c.limits {
+		if r, ok := l.RateLimiter.(Refunder); ok {
+			if err := r.Refund(l.key(key), quantity); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// refund gives quantity back to the keys of limits.
+func (c *CompositeRateLimiter) refund(key string, quantity int, limits []CompositeLimit) {
+	if quantity <= 0 {
+		return
+	}
+	for _, l := range limits {
+		if r, ok := l.RateLimiter.(Refunder); ok {
+			r.Refund(l.key(key), quantity)
+		}
+	}
+}
+
+func (l *CompositeLimit) key(key string) string {
+	if l.KeyFunc == nil {
+		return key
+	}
+	return l.KeyFunc(key)
+}
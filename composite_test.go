@@ -0,0 +1,171 @@
+package throttled_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestCompositeRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perKey, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	perKey.SetClock(clock)
+
+	global, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.SetClock(clock)
+
+	rl := throttled.NewCompositeRateLimiter(
+		throttled.CompositeLimit{RateLimiter: perKey},
+		throttled.CompositeLimit{RateLimiter: global, KeyFunc: func(string) string { return "global" }},
+	)
+
+	cases := []struct {
+		key       string
+		limited   bool
+		limit     int
+		remaining int
+	}{
+		// The per-key limit has the fewest remaining
+		0: {"a", false, 2, 1},
+		1: {"a", false, 2, 0},
+		// The per-key limit is exhausted
+		2: {"a", true, 2, 0},
+		// The global limit is exhausted after one more request
+		3: {"b", false, 3, 0},
+		4: {"c", true, 3, 0},
+	}
+
+	for i, c := range cases {
+		limited, result, err := rl.RateLimit(c.key, 1)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected limited to be %t but got %t", i, c.limited, limited)
+		}
+		if result.Limit != c.limit {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, c.limit, result.Limit)
+		}
+		if result.Remaining != c.remaining {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, c.remaining, result.Remaining)
+		}
+	}
+
+	// The request limited by the global limit wasn't charged to c
+	if result, err := perKey.Peek("c"); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 2 {
+		t.Errorf("expected c to be refunded but it has %d remaining", result.Remaining)
+	}
+
+	// Refund gives back to every limit
+	if err := rl.Refund("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := perKey.Peek("a"); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 1 {
+		t.Errorf("expected a to be refunded but it has %d remaining", result.Remaining)
+	}
+	if result, err := global.Peek("global"); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 1 {
+		t.Errorf("expected the global limit to be refunded but it has %d remaining", result.Remaining)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	if _, _, err := rl.RateLimit("foo", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		refund, remaining int
+	}{
+		0: {2, 3},
+		// Refunds don't exceed the burst
+		1: {10, 5},
+		2: {1, 5},
+	}
+
+	for i, c := range cases {
+		if err := rl.Refund("foo", c.refund); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if result, err := rl.Peek("foo"); err != nil {
+			t.Fatal(err)
+		} else if result.Remaining != c.remaining {
+			t.Errorf("%d: expected %d remaining but got %d", i, c.remaining, result.Remaining)
+		}
+	}
+
+	if err := rl.Refund("missing", 1); err != nil {
+		t.Errorf("expected a refund of a missing key to succeed but got %v", err)
+	}
+}
+
+func TestRefundConcurrent(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 19})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetMaxCASAttempts(100)
+	rl.SetClock(func() time.Time { return now })
+
+	if _, _, err := rl.RateLimit("foo", 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// No refund is lost to a concurrent one
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rl.Refund("foo", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if result, err := rl.Peek("foo"); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 10 {
+		t.Errorf("expected 10 remaining but got %d", result.Remaining)
+	}
+}
@@ -0,0 +1,135 @@
+package throttled
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimiter caps the number of requests of each key in
+// flight at once, as a bulkhead complementing a RateLimiter: a rate
+// limit doesn't prevent a client from piling up requests when the
+// service slows down, but a concurrency limit does.
+type ConcurrencyLimiter struct {
+	store CounterStore
+	limit int
+	ttl   time.Duration
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter permitting limit
+// requests per key in flight at once. The count of a key is kept in st
+// and expires after ttl without any request starting, so that requests
+// of a process that crashed before releasing them aren't counted
+// forever. ttl must therefore be longer than the longest request,
+// otherwise the count could expire while requests are in flight and
+// permit more than limit of them.
+func NewConcurrencyLimiter(st CounterStore, limit int, ttl time.Duration) (*ConcurrencyLimiter, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("Invalid limit %d. Limit must be greater than zero.", limit)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("Invalid TTL %s. TTL must be greater than zero.", ttl)
+	}
+
+	return &ConcurrencyLimiter{
+		store: st,
+		limit: limit,
+		ttl:   ttl,
+	}, nil
+}
+
+// Acquire starts a request for key. If fewer than the limit of the
+// requests of key are in flight, it returns true and a function that
+// must be called once the request completes, typically with defer.
+// Calling it more than once has no effect. Otherwise, it returns false
+// and a nil function.
+func (c *ConcurrencyLimiter) Acquire(key string) (bool, func() error, error) {
+	n, err := c.store.IncrementWithTTL(key, 1, c.ttl)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if n > int64(c.limit) {
+		_, err := c.store.IncrementWithTTL(key, -1, c.ttl)
+		return false, nil, err
+	}
+
+	var once sync.Once
+	release := func() error {
+		var err error
+		once.Do(func() {
+			_, err = c.store.IncrementWithTTL(key, -1, c.ttl)
+		})
+		return err
+	}
+
+	return true, release, nil
+}
+
+// HTTPConcurrencyLimiter facilitates using a ConcurrencyLimiter to cap
+// the number of HTTP requests in flight.
+type HTTPConcurrencyLimiter struct {
+	// DeniedHandler is called if the request is disallowed. If it is
+	// nil, the DefaultDeniedHandler variable is used.
+	DeniedHandler http.Handler
+
+	// Error is called if the ConcurrencyLimiter returns an error. If
+	// it is nil, the DefaultError is used.
+	Error func(w http.ResponseWriter, r *http.Request, err error)
+
+	// ConcurrencyLimiter is called for each request to determine
+	// whether the request is permitted. It must be set.
+	ConcurrencyLimiter *ConcurrencyLimiter
+
+	// VaryBy is called for each request to generate a key for the
+	// limiter. If it is nil, all requests use an empty string key.
+	VaryBy interface {
+		Key(*http.Request) string
+	}
+}
+
+// Limit wraps an http.Handler to cap the number of incoming requests
+// in flight. Permitted requests are passed to the handler unchanged
+// and released once it returns, even if it panics. Denied requests
+// are passed to the DeniedHandler.
+func (t *HTTPConcurrencyLimiter) Limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.ConcurrencyLimiter == nil {
+			t.error(w, r, errors.New("You must set a ConcurrencyLimiter on HTTPConcurrencyLimiter"))
+			return
+		}
+
+		var k string
+		if t.VaryBy != nil {
+			k = t.VaryBy.Key(r)
+		}
+
+		ok, release, err := t.ConcurrencyLimiter.Acquire(k)
+		if err != nil {
+			t.error(w, r, err)
+			return
+		}
+
+		if !ok {
+			dh := t.DeniedHandler
+			if dh == nil {
+				dh = DefaultDeniedHandler
+			}
+			dh.ServeHTTP(w, r)
+			return
+		}
+
+		defer release()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (t *HTTPConcurrencyLimiter) error(w http.ResponseWriter, r *http.Request, err error) {
+	e := t.Error
+	if e == nil {
+		e = DefaultError
+	}
+	e(w, r, err)
+}
@@ -0,0 +1,111 @@
+package throttled_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := throttled.NewConcurrencyLimiter(st, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var releases []func() error
+	for i, want := range []bool{true, true, false} {
+		ok, release, err := cl.Acquire("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("%d: expected Acquire to return %t but got %t", i, want, ok)
+		}
+		if ok {
+			releases = append(releases, release)
+		}
+	}
+
+	// Other keys have their own limit
+	if ok, _, err := cl.Acquire("bar"); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Error("expected another key to be permitted")
+	}
+
+	// Releasing twice only frees one request
+	releases[0]()
+	releases[0]()
+
+	for i, want := range []bool{true, false} {
+		if ok, _, err := cl.Acquire("foo"); err != nil {
+			t.Fatal(err)
+		} else if ok != want {
+			t.Errorf("%d: expected Acquire after a release to return %t but got %t", i, want, ok)
+		}
+	}
+
+	if _, err := throttled.NewConcurrencyLimiter(st, 0, time.Minute); err == nil {
+		t.Error("expected an error for a limit of 0")
+	}
+}
+
+func TestHTTPConcurrencyLimiter(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := throttled.NewConcurrencyLimiter(st, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPConcurrencyLimiter{ConcurrencyLimiter: cl}
+
+	var handler http.Handler
+	var nested int
+	handler = limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "nested":
+			// Make another request while this one is in flight
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+			nested = rr.Code
+		case "panic":
+			panic("handler failed")
+		}
+		w.WriteHeader(200)
+	}))
+
+	serve := func(path string) int {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("nested"); code != 200 || nested != 429 {
+		t.Errorf("expected the outer request to pass and the nested one to be denied but got %d and %d", code, nested)
+	}
+
+	// A panic still releases the request
+	func() {
+		defer func() { recover() }()
+		serve("panic")
+	}()
+
+	if code := serve("other"); code != 200 {
+		t.Errorf("expected a request after a panic to pass but got %d", code)
+	}
+}
@@ -0,0 +1,85 @@
+package throttled
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// ConnectionRateLimiter facilitates limiting long-lived connections,
+// such as WebSockets and server-sent event streams, which are opened
+// by a single HTTP request and then exchange many messages. It is
+// configured like an HTTPRateLimiter, whose RateLimiter limits the
+// rate at which connections are opened, and can also limit the rate
+// of the messages of each connection.
+type ConnectionRateLimiter struct {
+	HTTPRateLimiter
+
+	// MessageRateLimiter, if not nil, limits the messages of each
+	// connection through the Connection available to the wrapped
+	// handler with ConnectionFromContext. It is keyed by the ID of the
+	// connection, so that each connection has its own limit.
+	MessageRateLimiter RateLimiter
+}
+
+// RateLimit wraps an http.Handler serving long-lived connections. The
+// request opening a connection is limited as described by
+// HTTPRateLimiter.RateLimit, before the handler upgrades or hijacks
+// it, so that a limited client gets a regular response from the
+// DeniedHandler. If MessageRateLimiter is set, the context of the
+// requests passed to the handler carries a new Connection.
+func (t *ConnectionRateLimiter) RateLimit(h http.Handler) http.Handler {
+	return t.HTTPRateLimiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.MessageRateLimiter != nil {
+			id, err := newConnectionID()
+			if err != nil {
+				t.error(w, r, err)
+				return
+			}
+
+			conn := &Connection{ID: id, rateLimiter: t.MessageRateLimiter}
+			r = r.WithContext(context.WithValue(r.Context(), connectionKey{}, conn))
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// A Connection limits the messages of a connection opened through a
+// ConnectionRateLimiter.
+type Connection struct {
+	// ID is the random identifier of the connection, used as the key
+	// of the MessageRateLimiter.
+	ID string
+
+	rateLimiter RateLimiter
+}
+
+// RateLimitMessage checks whether the connection has exceeded its
+// message rate limit, charging quantity to it as RateLimiter does.
+// The state of the connection is left to expire in the store of the
+// MessageRateLimiter once it is closed.
+func (c *Connection) RateLimitMessage(quantity int) (bool, RateLimitResult, error) {
+	return c.rateLimiter.RateLimit(c.ID, quantity)
+}
+
+type connectionKey struct{}
+
+// ConnectionFromContext returns the Connection stored in ctx by a
+// ConnectionRateLimiter with a MessageRateLimiter, and whether there
+// was one. Call it with the context of the request passed to the
+// wrapped handler.
+func ConnectionFromContext(ctx context.Context) (*Connection, bool) {
+	conn, ok := ctx.Value(connectionKey{}).(*Connection)
+	return conn, ok
+}
+
+// newConnectionID returns a random identifier, so that connections
+// opened by different processes sharing a store have distinct keys.
+func newConnectionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
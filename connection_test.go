@@ -0,0 +1,75 @@
+package throttled_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestConnectionRateLimiter(t *testing.T) {
+	newLimiter := func(burst int) *throttled.GCRARateLimiter {
+		st, err := memstore.New(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: burst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rl
+	}
+
+	limiter := throttled.ConnectionRateLimiter{
+		HTTPRateLimiter:    throttled.HTTPRateLimiter{RateLimiter: newLimiter(1)},
+		MessageRateLimiter: newLimiter(2),
+	}
+
+	ids := make(map[string]bool)
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, ok := throttled.ConnectionFromContext(r.Context())
+		if !ok {
+			t.Fatal("expected a Connection in the context")
+		}
+		if ids[conn.ID] {
+			t.Errorf("expected a new connection ID but got %s again", conn.ID)
+		}
+		ids[conn.ID] = true
+
+		// Each connection has its own message limit
+		for i := 0; i < 4; i++ {
+			limited, _, err := conn.RateLimitMessage(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := i >= 3; limited != want {
+				t.Errorf("expected message %d to have limited %v but got %v", i, want, limited)
+			}
+		}
+		w.WriteHeader(200)
+	}))
+
+	req, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int{200, 200, 429} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("%d: expected %d but got %d", i, want, rr.Code)
+		}
+	}
+
+	// Without a MessageRateLimiter, there is no Connection
+	limiter = throttled.ConnectionRateLimiter{HTTPRateLimiter: throttled.HTTPRateLimiter{RateLimiter: newLimiter(1)}}
+	handler = limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := throttled.ConnectionFromContext(r.Context()); ok {
+			t.Error("expected no Connection in the context")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
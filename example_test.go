@@ -1,6 +1,7 @@
 package throttled_test
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,6 +14,18 @@ var myHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("hi there!"))
 })
 
+var myEvents = func(ctx context.Context) <-chan string {
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		select {
+		case events <- "hello":
+		case <-ctx.Done():
+		}
+	}()
+	return events
+}
+
 // ExampleHTTPRateLimiter demonstrates the usage of HTTPRateLimiter
 // for rate-limiting access to an http.Handler to 20 requests per path
 // per minute with a maximum burst of 5 requests.
@@ -38,6 +51,56 @@ func ExampleHTTPRateLimiter() {
 	http.ListenAndServe(":8080", httpRateLimiter.RateLimit(myHandler))
 }
 
+// Demonstrates limiting both the rate at which clients open server-sent
+// event streams and the rate of the events sent on each stream.
+func ExampleConnectionRateLimiter() {
+	store, err := memstore.New(65536)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each client may open 5 streams at once and one more per minute.
+	streams, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 4})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Each stream may send 10 events per second.
+	events, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerSec(10), MaxBurst: 9})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	connRateLimiter := throttled.ConnectionRateLimiter{
+		HTTPRateLimiter: throttled.HTTPRateLimiter{
+			RateLimiter: streams,
+			VaryBy:      &throttled.VaryBy{RemoteAddr: true},
+		},
+		MessageRateLimiter: events,
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := throttled.ConnectionFromContext(r.Context())
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		for event := range myEvents(r.Context()) {
+			// Drop the events a stream sends too fast.
+			limited, _, err := conn.RateLimitMessage(1)
+			if err != nil {
+				return
+			}
+			if limited {
+				continue
+			}
+
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	http.ListenAndServe(":8080", connRateLimiter.RateLimit(handler))
+}
+
 // Demonstrates direct use of GCRARateLimiter's RateLimit function (and the
 // more general RateLimiter interface). This should be used anywhere where
 // granular control over rate limiting is required.
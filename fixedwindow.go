@@ -0,0 +1,107 @@
+package throttled
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// FixedWindowRateLimiter is a RateLimiter that counts the requests
+// made by each key in consecutive windows of fixed length, resetting
+// the count when a new window starts. It is simpler to reason about
+// than GCRARateLimiter but permits up to twice the limit in a short
+// time when requests cluster around the start of a window.
+type FixedWindowRateLimiter struct {
+	store  CounterStore
+	limit  int
+	window time.Duration
+
+	clock func() time.Time
+}
+
+// NewFixedWindowRateLimiter creates a FixedWindowRateLimiter
+// permitting the number of requests in rate during each window of
+// that length. For example, PerMin(1000) permits 1000 requests per
+// minute. Windows are aligned to multiples of their length since the
+// zero time, so minute and hour windows roll over on UTC minute and
+// hour boundaries.
+func NewFixedWindowRateLimiter(st CounterStore, rate Rate) (*FixedWindowRateLimiter, error) {
+	if rate.count <= 0 || rate.period <= 0 {
+		return nil, fmt.Errorf("Invalid Rate %#v. Rate must be greater than zero.", rate)
+	}
+
+	// Undo the rounding of the period so that PerMin(7) has a window
+	// of exactly one minute.
+	window := (rate.period * time.Duration(rate.count)).Round(time.Millisecond)
+	if window <= 0 {
+		return nil, fmt.Errorf("Invalid Rate %#v. The window must be at least one millisecond.", rate)
+	}
+
+	return &FixedWindowRateLimiter{
+		store:  st,
+		limit:  rate.count,
+		window: window,
+	}, nil
+}
+
+// SetClock sets the function used to get the current time, which
+// determines the window of each request. It defaults to the local time
+// of the machine, so all the limiters sharing a store should have
+// synchronized clocks. SetClock must not be called concurrently with
+// other methods of the limiter.
+func (f *FixedWindowRateLimiter) SetClock(clock func() time.Time) {
+	f.clock = clock
+}
+
+// RateLimit checks whether a particular key has exceeded a rate
+// limit. It also returns a RateLimitResult to provide additional
+// information about the state of the RateLimiter. ResetAfter is the
+// time until the current window ends.
+//
+// If the rate limit has not been exceeded, the count of the current
+// window is increased by quantity. If quantity is 0, the count is
+// unchanged allowing you to "peek" at the state of the RateLimiter for
+// a given key. A quantity greater than the limit is always limited. A
+// negative quantity returns an error wrapping ErrInvalidQuantity.
+func (f *FixedWindowRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	now := time.Now()
+	if f.clock != nil {
+		now = f.clock()
+	}
+
+	start := now.Truncate(f.window)
+	reset := start.Add(f.window).Sub(now)
+	rlc := RateLimitResult{Limit: f.limit, ResetAfter: reset, RetryAfter: -1}
+
+	if err := checkQuantity(quantity, f.limit); err != nil && err != ErrQuantityExceedsLimit {
+		return false, rlc, err
+	}
+
+	key = key + ":" + strconv.FormatInt(start.UnixNano(), 10)
+
+	n, err := f.store.IncrementWithTTL(key, int64(quantity), reset)
+	if err != nil {
+		return false, rlc, err
+	}
+
+	if n <= int64(f.limit) {
+		rlc.Remaining = f.limit - int(n)
+		return false, rlc, nil
+	}
+
+	// Refund the denied quantity, which ought not to count against the
+	// limit.
+	n, err = f.store.IncrementWithTTL(key, -int64(quantity), reset)
+	if err != nil {
+		return true, rlc, err
+	}
+
+	if n < int64(f.limit) {
+		rlc.Remaining = f.limit - int(n)
+	}
+	if quantity <= f.limit {
+		rlc.RetryAfter = reset
+	}
+
+	return true, rlc, nil
+}
@@ -0,0 +1,75 @@
+package throttled_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestFixedWindowRateLimit(t *testing.T) {
+	start := time.Unix(1200, 0)
+	now := start
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetClock(func() time.Time { return now })
+
+	rl, err := throttled.NewFixedWindowRateLimiter(st, throttled.PerMin(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	cases := []struct {
+		now               time.Time
+		volume, remaining int
+		reset, retry      time.Duration
+		limited           bool
+	}{
+		0: {start, 1, 2, time.Minute, -1, false},
+		1: {start.Add(10 * time.Second), 2, 0, 50 * time.Second, -1, false},
+		2: {start.Add(20 * time.Second), 1, 0, 40 * time.Second, 40 * time.Second, true},
+		3: {start.Add(20 * time.Second), 0, 0, 40 * time.Second, -1, false},
+		4: {start.Add(time.Minute), 3, 0, time.Minute, -1, false},
+		5: {start.Add(2 * time.Minute), 4, 3, time.Minute, -1, true},
+		6: {start.Add(2 * time.Minute), 3, 0, time.Minute, -1, false},
+	}
+
+	for i, c := range cases {
+		now = c.now
+
+		limited, result, err := rl.RateLimit("foo", c.volume)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+		if have, want := result.Limit, 3; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+	}
+
+	// A negative quantity can't give back the count of the window
+	if _, _, err := rl.RateLimit("foo", -3); !errors.Is(err, throttled.ErrInvalidQuantity) {
+		t.Errorf("expected ErrInvalidQuantity but got %v", err)
+	}
+	if limited, _, err := rl.RateLimit("foo", 1); err != nil || !limited {
+		t.Errorf("expected the window to remain limited but got %t, %v", limited, err)
+	}
+}
@@ -0,0 +1,45 @@
+package throttled
+
+import "context"
+
+// HierarchicalLimiter is a RateLimiter checking a local limiter, such
+// as a GCRARateLimiter backed by a memstore, before a shared one, such
+// as a GCRARateLimiter backed by Redis. Requests that the local
+// limiter permits are admitted without contacting the shared store,
+// which saves a round trip to it for most requests of hot keys.
+//
+// The local limiter should be given an over-provisioned share of the
+// global quota, enough for the traffic an instance normally serves.
+// Since the local limits are independent of each other and of the
+// shared one, the number of requests admitted for a key can exceed
+// the shared quota by up to the sum of the local quotas of all the
+// instances: with N instances, up to N times the local quota on top
+// of the shared quota over any period.
+type HierarchicalLimiter struct {
+	local, shared RateLimiter
+}
+
+// NewHierarchicalLimiter creates a HierarchicalLimiter checking local
+// before shared.
+func NewHierarchicalLimiter(local, shared RateLimiter) *HierarchicalLimiter {
+	return &HierarchicalLimiter{local: local, shared: shared}
+}
+
+// RateLimit charges quantity to key in the local limiter and, only if
+// it limits the request or returns an error, in the shared limiter.
+// The returned values are those of the limiter that made the
+// decision, so the RateLimitResult of a request admitted locally
+// describes the local limit.
+func (h *HierarchicalLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return h.RateLimitCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCtx is the context-aware version of RateLimit. ctx is
+// passed to the RateLimiters implementing RateLimiterCtx, and the
+// others are called with RateLimit.
+func (h *HierarchicalLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	if limited, result, err := rateLimitCtx(ctx, h.local, key, quantity); err == nil && !limited {
+		return false, result, nil
+	}
+	return rateLimitCtx(ctx, h.shared, key, quantity)
+}
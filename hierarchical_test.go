@@ -0,0 +1,57 @@
+package throttled_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestHierarchicalLimiter(t *testing.T) {
+	newLimiter := func(burst int) (*throttled.GCRARateLimiter, *memstore.MemStore) {
+		st, err := memstore.New(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.SetClock(func() time.Time { return time.Unix(1000, 0) })
+
+		rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: burst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rl, st
+	}
+
+	local, _ := newLimiter(1)
+	shared, sharedStore := newLimiter(0)
+	hl := throttled.NewHierarchicalLimiter(local, shared)
+
+	cases := []struct {
+		limited   bool
+		remaining int
+	}{
+		// The local limit admits requests without the shared store
+		0: {false, 1},
+		1: {false, 0},
+		// The shared limit is consulted once the local one is exhausted
+		2: {false, 0},
+		3: {true, 0},
+	}
+
+	for i, c := range cases {
+		limited, result, err := hl.RateLimit("foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited != c.limited || result.Remaining != c.remaining {
+			t.Errorf("%d: expected limited %v with %d remaining but got %v and %#v", i, c.limited, c.remaining, limited, result)
+		}
+
+		if v, _, err := sharedStore.GetWithTime("foo"); err != nil {
+			t.Fatal(err)
+		} else if (v != -1) != (i >= 2) {
+			t.Errorf("%d: expected the shared store to be used from the third request but got %d", i, v)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package throttled
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -22,6 +30,91 @@ var (
 	}
 )
 
+// HeaderMode selects the names of the headers describing the state of
+// the rate limit in the responses of an HTTPRateLimiter.
+type HeaderMode int
+
+const (
+	// LegacyHeaders writes X-RateLimit-Limit, X-RateLimit-Remaining
+	// and X-RateLimit-Reset headers. It is the default.
+	LegacyHeaders HeaderMode = iota
+
+	// StandardHeaders writes RateLimit-Limit, RateLimit-Remaining and
+	// RateLimit-Reset headers as defined by the IETF draft "RateLimit
+	// Header Fields for HTTP".
+	StandardHeaders
+
+	// BothHeaders writes both the legacy and the standard headers.
+	BothHeaders
+)
+
+// FailureMode selects how an HTTPRateLimiter handles requests for
+// which the RateLimiter returns an error, typically because its store
+// is unreachable.
+type FailureMode int
+
+const (
+	// FailWithError passes the request to the Error function. It is
+	// the default.
+	FailWithError FailureMode = iota
+
+	// FailOpen logs the error with the standard logger and passes the
+	// request to the wrapped handler as if it wasn't limited, so that
+	// an outage of the store doesn't take down the service.
+	FailOpen
+
+	// FailClosed rejects the request with a 503 Service Unavailable
+	// status code.
+	FailClosed
+)
+
+// EmptyKeyMode selects how an HTTPRateLimiter handles requests whose
+// key is empty, because KeyFunc returned an empty string or all the
+// fields of VaryBy are empty or missing. For example, VaryBy reading
+// an API key header gives the same empty key to all requests without
+// one.
+type EmptyKeyMode int
+
+const (
+	// EmptyKeyShared limits all the requests with an empty key as one
+	// bucket, whose key is the empty key itself. It is the default.
+	EmptyKeyShared EmptyKeyMode = iota
+
+	// EmptyKeyGlobal limits all the requests with an empty key as one
+	// bucket named by GlobalKey.
+	EmptyKeyGlobal
+
+	// EmptyKeyError passes the requests with an empty key to the Error
+	// function with ErrEmptyKey, for limiters that require every
+	// request to be identified.
+	EmptyKeyError
+)
+
+// DefaultGlobalKey is the key of the requests with an empty key when
+// HTTPRateLimiter.EmptyKey is EmptyKeyGlobal and GlobalKey is empty.
+const DefaultGlobalKey = "global"
+
+// ErrEmptyKey is passed to the Error function of an HTTPRateLimiter
+// whose EmptyKey is EmptyKeyError for requests with an empty key.
+var ErrEmptyKey = errors.New("Empty rate limit key")
+
+// A Logger records structured log lines. Its methods take a message
+// followed by alternating field names and values, so a *slog.Logger
+// can be used directly.
+//
+// HTTPRateLimiter logs decisions with the fields key, limit,
+// remaining, reset_after and retry_after, taken from the request key
+// and its RateLimitResult, and shadow when ShadowMode is set. Nothing
+// else about the request is logged, so the lines only contain personal
+// data if the keys do. Errors that don't fail the request, such as
+// those of the RateLimiter with FailOpen, are logged at the Error
+// level with the field error.
+type Logger interface {
+	Info(msg string, keyvals ...interface{})
+	Debug(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
 // HTTPRateLimiter faciliates using a Limiter to limit HTTP requests.
 type HTTPRateLimiter struct {
 	// DeniedHandler is called if the request is disallowed. If it is
@@ -34,6 +127,11 @@ type HTTPRateLimiter struct {
 
 	// Limiter is call for each request to determine whether the
 	// request is permitted and update internal state. It must be set.
+	// If it implements RateLimiterCtx, it is passed the context of the
+	// request, so that the store operations of a request cancelled by
+	// its client are abandoned. If it is a SoftLimitRateLimiter,
+	// requests over the soft limit are served with a SoftLimitWarning
+	// header.
 	RateLimiter RateLimiter
 
 	// VaryBy is called for each request to generate a key for the
@@ -41,35 +139,268 @@ type HTTPRateLimiter struct {
 	VaryBy interface {
 		Key(*http.Request) string
 	}
+
+	// KeyFunc is called for each request to generate a key for the
+	// limiter, for example from a user ID stored in the request context
+	// by authentication middleware. If it is set, it takes precedence
+	// over VaryBy. If it returns an error, the request is passed to
+	// Error. See KeyFromContext for a KeyFunc reading the key set by
+	// an upstream middleware.
+	KeyFunc func(*http.Request) (string, error)
+
+	// Skip is called for each request before its key is generated. If
+	// it returns true, the request is passed to the wrapped handler
+	// without consuming quota: the RateLimiter isn't called, no headers
+	// are written and the DeniedHandler is never invoked. This is
+	// useful to exempt health checks or internal callers.
+	Skip func(*http.Request) bool
+
+	// BypassHeader, if not empty, names a header whose value lets a
+	// request skip limiting if it is a valid token created by
+	// NewBypassToken with BypassSecret, which must then be set. This
+	// gives internal tools and on-call engineers an escape hatch. A
+	// request bypassing its limit is passed to the wrapped handler like
+	// a skipped one, without computing its key, and its method and path
+	// are logged, with Logger if it is set or else with the standard
+	// logger. Invalid or expired tokens are ignored and the request is
+	// limited as usual.
+	BypassHeader string
+
+	// BypassSecret is the secret used to validate the tokens of
+	// BypassHeader. It should be long and random, such as 32 bytes read
+	// from crypto/rand.
+	BypassSecret []byte
+
+	// Cost is called for each request to get the quantity passed to
+	// the RateLimiter, so that expensive endpoints can consume more
+	// quota. A cost of 0 only checks the limit, as described by
+	// RateLimiter, while a negative cost passes the request to Error.
+	// A cost for which the RateLimiter returns ErrQuantityExceedsLimit
+	// is denied. If it is nil, every request costs 1.
+	Cost func(*http.Request) int
+
+	// QuotaProvider, if not nil, is called with the key of each
+	// request to look up its quota, for example from the plan of the
+	// tenant it belongs to. If it returns true, the request is checked
+	// against that quota with RateLimitWithQuota, which the RateLimiter
+	// must implement like GCRARateLimiter does, or the request is
+	// passed to Error. Otherwise the RateLimiter applies its own quota.
+	// Nothing is cached, so a provider that is slow to look up quotas
+	// should cache them itself.
+	QuotaProvider func(key string) (RateQuota, bool)
+
+	// Probe, if true, makes requests with one of ProbeMethods report
+	// the state of their rate limit without consuming quota, so that
+	// clients can discover their remaining budget before making an
+	// expensive request. The rate limit headers are written from the
+	// result of Peek, or of PeekWithQuota with the quota of the
+	// QuotaProvider, which the RateLimiter must implement like
+	// GCRARateLimiter does, and the request is always passed to the
+	// wrapped handler, even if the next request would be limited.
+	Probe bool
+
+	// ProbeMethods lists the methods of the requests treated as probes
+	// when Probe is true. Defaults to HEAD if empty.
+	ProbeMethods []string
+
+	// ResponseCost, if not nil, is called after the wrapped handler
+	// serves a permitted request to get its actual cost, for endpoints
+	// whose cost is only known once they have run, such as the number
+	// of records returned. The cost charged up front by Cost is then
+	// reconciled: a lower actual cost is given back if the RateLimiter
+	// implements Refunder and a higher one is charged, up to what the
+	// limit still permits if the RateLimiter is a GCRARateLimiter. With
+	// a QuotaProvider, the difference is reconciled under the quota of
+	// the key, so a lower cost is only given back if the RateLimiter
+	// implements RefundWithQuotaCtx like GCRARateLimiter does. The
+	// context of the request is passed to the RateLimiter when it
+	// supports it, as for the provisional charge.
+	//
+	// Since the final charge is only made after the response, a client
+	// may get more concurrent requests permitted than its limit allows
+	// until they complete, so Cost should return a reasonable estimate.
+	// The rate limit headers reflect the provisional charge, and errors
+	// while reconciling are logged with Logger, or else with the
+	// standard logger.
+	ResponseCost func(r *http.Request, meta ResponseMeta) int
+
+	// Headers selects the names of the headers written to responses.
+	// Regardless of this field, the Retry-After header is written to
+	// the responses of limited requests whose RateLimitResult has a
+	// RetryAfter, in delta-seconds rounded up to at least 1, and never
+	// to those of permitted requests.
+	Headers HeaderMode
+
+	// FailureMode selects how requests are handled when the
+	// RateLimiter returns an error. Errors from KeyFunc or Cost are
+	// always passed to Error.
+	FailureMode FailureMode
+
+	// EmptyKey selects how requests whose key is empty are handled.
+	// Note that all keys are empty if neither KeyFunc nor VaryBy is
+	// set.
+	EmptyKey EmptyKeyMode
+
+	// GlobalKey is the key of the requests with an empty key when
+	// EmptyKey is EmptyKeyGlobal, or DefaultGlobalKey if it is empty.
+	// It must differ from the keys of other requests. The keys made by
+	// a VaryBy without Custom end with its separator unless they are
+	// hashed, so a name that doesn't, like the default, is safe.
+	GlobalKey string
+
+	// Logger, if not nil, is given a line for each decision, at the
+	// Info level for limited requests and at the Debug level for
+	// permitted ones, with the fields described by Logger. It is also
+	// given the errors that would otherwise be written to the standard
+	// logger.
+	Logger Logger
+
+	// ShadowMode, if true, makes the HTTPRateLimiter pass limited
+	// requests to the wrapped handler instead of the DeniedHandler, so
+	// that a new limit can be observed against real traffic before it
+	// is enforced. Requests are still checked and charged as usual and
+	// the rate limit headers are written, except Retry-After. Denials
+	// that would have happened are reported as limited decisions to
+	// the Observer of the RateLimiter, such as the one set with
+	// GCRARateLimiter.SetObserver.
+	ShadowMode bool
 }
 
 // RateLimit wraps an http.Handler to limit incoming requests.
 // Requests that are not limited will be passed to the handler
 // unchanged.  Limited requests will be passed to the DeniedHandler.
 // X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset and
-// Retry-After headers will be written to the response based on the
-// values in the RateLimitResult.
+// Retry-After headers, or the RateLimit- headers selected by Headers,
+// will be written to the response based on the values in the
+// RateLimitResult. The RateLimitResult is also available to both
+// handlers through RateLimitResultFromContext, for example to render
+// a structured error with the exact RetryAfter.
 func (t *HTTPRateLimiter) RateLimit(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if t.RateLimiter == nil {
 			t.error(w, r, errors.New("You must set a RateLimiter on HTTPRateLimiter"))
+			return
+		}
+
+		if t.Skip != nil && t.Skip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if t.bypass(r) {
+			if t.Logger != nil {
+				t.Logger.Info("throttled: request bypassed limit", "method", r.Method, "path", r.URL.Path)
+			} else {
+				log.Printf("throttled: %s %s bypassed limit with a token", r.Method, r.URL.Path)
+			}
+			h.ServeHTTP(w, r)
+			return
 		}
 
 		var k string
-		if t.VaryBy != nil {
+		if t.KeyFunc != nil {
+			var err error
+			if k, err = t.KeyFunc(r); err != nil {
+				t.error(w, r, err)
+				return
+			}
+		} else if t.VaryBy != nil {
 			k = t.VaryBy.Key(r)
 		}
 
-		limited, context, err := t.RateLimiter.RateLimit(k, 1)
+		if t.EmptyKey != EmptyKeyShared && t.isEmptyKey(k) {
+			if t.EmptyKey == EmptyKeyError {
+				t.error(w, r, ErrEmptyKey)
+				return
+			}
+			k = t.globalKey()
+		}
+
+		if t.isProbe(r) {
+			var context RateLimitResult
+			var err error
+			if quota, ok := t.quota(k); !ok {
+				pk, ok := t.RateLimiter.(peeker)
+				if !ok {
+					t.error(w, r, fmt.Errorf("RateLimiter %T must implement Peek to answer probes", t.RateLimiter))
+					return
+				}
+				context, err = pk.Peek(k)
+			} else if qp, ok := t.RateLimiter.(quotaPeeker); ok {
+				context, err = qp.PeekWithQuota(k, quota)
+			} else {
+				t.error(w, r, fmt.Errorf("RateLimiter %T must implement PeekWithQuota to answer probes with a QuotaProvider", t.RateLimiter))
+				return
+			}
+			if err != nil {
+				t.fail(w, r, h, err)
+				return
+			}
+
+			setRateLimitHeaders(w, t.Headers, false, context)
+			h.ServeHTTP(w, r.WithContext(contextWithRateLimitResult(r.Context(), context)))
+			return
+		}
+
+		quantity := 1
+		if t.Cost != nil {
+			if quantity = t.Cost(r); quantity < 0 {
+				t.error(w, r, fmt.Errorf("Invalid negative cost %d for HTTPRateLimiter", quantity))
+				return
+			}
+		}
+
+		var limited, softLimited bool
+		var context RateLimitResult
+		var err error
+		quota, hasQuota := t.quota(k)
+		if !hasQuota {
+			if sl, ok := t.RateLimiter.(softRateLimiterCtx); ok {
+				var result SoftLimitResult
+				limited, result, err = sl.RateLimitSoftCtx(r.Context(), k, quantity)
+				context, softLimited = result.RateLimitResult, result.SoftLimited
+			} else if sl, ok := t.RateLimiter.(softRateLimiter); ok {
+				var result SoftLimitResult
+				limited, result, err = sl.RateLimitSoft(k, quantity)
+				context, softLimited = result.RateLimitResult, result.SoftLimited
+			} else {
+				limited, context, err = rateLimitCtx(r.Context(), t.RateLimiter, k, quantity)
+			}
+		} else if ql, ok := t.RateLimiter.(quotaRateLimiterCtx); ok {
+			limited, context, err = ql.RateLimitWithQuotaCtx(r.Context(), k, quantity, quota)
+		} else if ql, ok := t.RateLimiter.(quotaRateLimiter); ok {
+			limited, context, err = ql.RateLimitWithQuota(k, quantity, quota)
+		} else {
+			t.error(w, r, fmt.Errorf("RateLimiter %T must implement RateLimitWithQuota to use a QuotaProvider", t.RateLimiter))
+			return
+		}
 
+		// A quantity that can never be permitted is denied rather than
+		// handled as a failure of the RateLimiter.
+		if limited && errors.Is(err, ErrQuantityExceedsLimit) {
+			err = nil
+		}
 		if err != nil {
-			t.error(w, r, err)
+			t.fail(w, r, h, err)
 			return
 		}
 
-		setRateLimitHeaders(w, context)
+		t.log(k, limited, context)
+		setRateLimitHeaders(w, t.Headers, limited && !t.ShadowMode, context)
+		if softLimited {
+			w.Header().Add("Warning", SoftLimitWarning)
+		}
+		r = r.WithContext(contextWithRateLimitResult(r.Context(), context))
 
-		if !limited {
+		if !limited && t.ResponseCost != nil {
+			rw := &responseMetaWriter{ResponseWriter: w}
+			if r.Body != nil {
+				rw.body = &countingBody{ReadCloser: r.Body}
+				r.Body = rw.body
+			}
+			h.ServeHTTP(rw, r)
+			t.reconcile(r.Context(), k, quota, hasQuota, quantity, t.ResponseCost(r, rw.meta()))
+		} else if !limited || t.ShadowMode {
 			h.ServeHTTP(w, r)
 		} else {
 			dh := t.DeniedHandler
@@ -81,6 +412,378 @@ func (t *HTTPRateLimiter) RateLimit(h http.Handler) http.Handler {
 	})
 }
 
+// log records the decision about key with Logger, if set.
+func (t *HTTPRateLimiter) log(key string, limited bool, result RateLimitResult) {
+	if t.Logger == nil {
+		return
+	}
+
+	keyvals := []interface{}{
+		"key", key,
+		"limit", result.Limit,
+		"remaining", result.Remaining,
+		"reset_after", result.ResetAfter,
+		"retry_after", result.RetryAfter,
+	}
+	if t.ShadowMode {
+		keyvals = append(keyvals, "shadow", true)
+	}
+
+	if limited {
+		t.Logger.Info("throttled: request limited", keyvals...)
+	} else {
+		t.Logger.Debug("throttled: request permitted", keyvals...)
+	}
+}
+
+// logError records err with Logger if set, or else with the standard
+// logger.
+func (t *HTTPRateLimiter) logError(msg string, err error) {
+	if t.Logger != nil {
+		t.Logger.Error(msg, "error", err)
+	} else {
+		log.Printf("%s: %v", msg, err)
+	}
+}
+
+// bypass reports whether r carries a valid bypass token.
+func (t *HTTPRateLimiter) bypass(r *http.Request) bool {
+	if t.BypassHeader == "" || len(t.BypassSecret) == 0 {
+		return false
+	}
+	token := r.Header.Get(t.BypassHeader)
+	return token != "" && validBypassToken(t.BypassSecret, token, time.Now())
+}
+
+// fail handles an error returned by the RateLimiter as selected by
+// FailureMode.
+func (t *HTTPRateLimiter) fail(w http.ResponseWriter, r *http.Request, h http.Handler, err error) {
+	switch t.FailureMode {
+	case FailOpen:
+		t.logError("throttled: allowing request after rate limiter error", err)
+		h.ServeHTTP(w, r)
+	case FailClosed:
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	default:
+		t.error(w, r, err)
+	}
+}
+
+// emptyKeyer is implemented by the VaryBy types whose keys can be
+// empty without being the empty string.
+type emptyKeyer interface {
+	isEmptyKey(key string) bool
+}
+
+func (t *HTTPRateLimiter) isEmptyKey(k string) bool {
+	if k == "" {
+		return true
+	}
+	if ek, ok := t.VaryBy.(emptyKeyer); ok && t.KeyFunc == nil {
+		return ek.isEmptyKey(k)
+	}
+	return false
+}
+
+func (t *HTTPRateLimiter) globalKey() string {
+	if t.GlobalKey == "" {
+		return DefaultGlobalKey
+	}
+	return t.GlobalKey
+}
+
+// peeker is implemented by rate limiters that can report the state of
+// a key without consuming quota.
+type peeker interface {
+	Peek(key string) (RateLimitResult, error)
+}
+
+// quotaPeeker is implemented by rate limiters that can report the
+// state of a key under a quota given with each request.
+type quotaPeeker interface {
+	PeekWithQuota(key string, quota RateQuota) (RateLimitResult, error)
+}
+
+// isProbe reports whether r is a probe as selected by Probe and
+// ProbeMethods.
+func (t *HTTPRateLimiter) isProbe(r *http.Request) bool {
+	if !t.Probe {
+		return false
+	}
+	if len(t.ProbeMethods) == 0 {
+		return r.Method == "HEAD"
+	}
+	for _, m := range t.ProbeMethods {
+		if strings.EqualFold(r.Method, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// softRateLimiter is implemented by rate limiters that permit requests
+// over a soft limit with a warning, such as SoftLimitRateLimiter.
+type softRateLimiter interface {
+	RateLimitSoft(key string, quantity int) (bool, SoftLimitResult, error)
+}
+
+type softRateLimiterCtx interface {
+	RateLimitSoftCtx(ctx context.Context, key string, quantity int) (bool, SoftLimitResult, error)
+}
+
+// quotaRateLimiter is implemented by rate limiters that can check a
+// key against a quota given with each request.
+type quotaRateLimiter interface {
+	RateLimitWithQuota(key string, quantity int, quota RateQuota) (bool, RateLimitResult, error)
+}
+
+type quotaRateLimiterCtx interface {
+	RateLimitWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) (bool, RateLimitResult, error)
+}
+
+type refunderCtx interface {
+	RefundCtx(ctx context.Context, key string, quantity int) error
+}
+
+type quotaRefunder interface {
+	RefundWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) error
+}
+
+type partialRateLimiter interface {
+	RateLimitPartial(key string, requested int) (int, RateLimitResult, error)
+}
+
+type partialRateLimiterCtx interface {
+	RateLimitPartialCtx(ctx context.Context, key string, requested int) (int, RateLimitResult, error)
+}
+
+type quotaPartialRateLimiter interface {
+	RateLimitPartialWithQuotaCtx(ctx context.Context, key string, requested int, quota RateQuota) (int, RateLimitResult, error)
+}
+
+// quota returns the quota given by QuotaProvider for key, if any.
+func (t *HTTPRateLimiter) quota(key string) (RateQuota, bool) {
+	if t.QuotaProvider == nil {
+		return RateQuota{}, false
+	}
+	return t.QuotaProvider(key)
+}
+
+// ResponseMeta describes the response written by the handler wrapped
+// by an HTTPRateLimiter, as passed to its ResponseCost function.
+type ResponseMeta struct {
+	// StatusCode is the status code of the response, which is 200 if
+	// the handler didn't call WriteHeader.
+	StatusCode int
+
+	// Written is the number of bytes of the body written, not counting
+	// those written to a hijacked connection.
+	Written int64
+
+	// Header is the header of the response, which the handler can use
+	// to report its cost.
+	Header http.Header
+
+	// BodyRead is the number of bytes of the request body read by the
+	// handler.
+	BodyRead int64
+}
+
+type responseMetaWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	body    *countingBody
+}
+
+func (w *responseMetaWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseMetaWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush flushes the wrapped ResponseWriter if it is an http.Flusher,
+// so that streaming handlers keep working with ResponseCost.
+func (w *responseMetaWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the connection of the wrapped ResponseWriter if it is
+// an http.Hijacker, so that handlers upgrading to WebSocket keep
+// working with ResponseCost.
+func (w *responseMetaWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter %T does not implement http.Hijacker", w.ResponseWriter)
+	}
+	return hj.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController.
+func (w *responseMetaWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseMetaWriter) meta() ResponseMeta {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	meta := ResponseMeta{StatusCode: status, Written: w.written, Header: w.Header()}
+	if w.body != nil {
+		meta.BodyRead = w.body.read
+	}
+	return meta
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// reconcile charges or gives back the difference between the actual
+// cost of a request and the provisional quantity charged for it, under
+// quota if hasQuota is true.
+func (t *HTTPRateLimiter) reconcile(ctx context.Context, key string, quota RateQuota, hasQuota bool, provisional, actual int) {
+	var err error
+	switch diff := actual - provisional; {
+	case diff < 0 && hasQuota:
+		if r, ok := t.RateLimiter.(quotaRefunder); ok {
+			err = r.RefundWithQuotaCtx(ctx, key, -diff, quota)
+		} else if _, ok := t.RateLimiter.(Refunder); ok {
+			err = fmt.Errorf("RateLimiter %T must implement RefundWithQuotaCtx to give back costs with a QuotaProvider", t.RateLimiter)
+		}
+	case diff < 0:
+		if r, ok := t.RateLimiter.(refunderCtx); ok {
+			err = r.RefundCtx(ctx, key, -diff)
+		} else if r, ok := t.RateLimiter.(Refunder); ok {
+			err = r.Refund(key, -diff)
+		}
+	case diff > 0 && hasQuota:
+		if p, ok := t.RateLimiter.(quotaPartialRateLimiter); ok {
+			_, _, err = p.RateLimitPartialWithQuotaCtx(ctx, key, diff, quota)
+		} else if ql, ok := t.RateLimiter.(quotaRateLimiterCtx); ok {
+			_, _, err = ql.RateLimitWithQuotaCtx(ctx, key, diff, quota)
+		} else if ql, ok := t.RateLimiter.(quotaRateLimiter); ok {
+			_, _, err = ql.RateLimitWithQuota(key, diff, quota)
+		}
+	case diff > 0:
+		if p, ok := t.RateLimiter.(partialRateLimiterCtx); ok {
+			_, _, err = p.RateLimitPartialCtx(ctx, key, diff)
+		} else if p, ok := t.RateLimiter.(partialRateLimiter); ok {
+			_, _, err = p.RateLimitPartial(key, diff)
+		} else {
+			_, _, err = rateLimitCtx(ctx, t.RateLimiter, key, diff)
+		}
+	}
+
+	if err != nil {
+		t.logError("throttled: failed to reconcile the cost of a request", err)
+	}
+}
+
+type rateLimitResultKey struct{}
+
+func contextWithRateLimitResult(ctx context.Context, result RateLimitResult) context.Context {
+	return context.WithValue(ctx, rateLimitResultKey{}, result)
+}
+
+// RateLimitResultFromContext returns the RateLimitResult stored in ctx
+// by HTTPRateLimiter, and whether there was one. Call it with the
+// context of the request passed to the DeniedHandler or the wrapped
+// handler.
+func RateLimitResultFromContext(ctx context.Context) (RateLimitResult, bool) {
+	result, ok := ctx.Value(rateLimitResultKey{}).(RateLimitResult)
+	return result, ok
+}
+
+// RateLimitStateHeader is the header written by SetRateLimitState.
+const RateLimitStateHeader = "X-RateLimit-State"
+
+// SetRateLimitState sets the RateLimitStateHeader of h to the JSON
+// encoding of result, for example so that a gateway can forward the
+// state of the limit of a request to the services behind it, which
+// read it with RateLimitStateFromHeader.
+func SetRateLimitState(h http.Header, result RateLimitResult) {
+	b, _ := result.MarshalJSON() // Can't fail on ints
+	h.Set(RateLimitStateHeader, string(b))
+}
+
+// RateLimitStateFromHeader returns the RateLimitResult set in h by
+// SetRateLimitState, and whether there was a valid one.
+func RateLimitStateFromHeader(h http.Header) (RateLimitResult, bool) {
+	v := h.Get(RateLimitStateHeader)
+	if v == "" {
+		return RateLimitResult{}, false
+	}
+
+	var result RateLimitResult
+	if err := result.UnmarshalJSON([]byte(v)); err != nil {
+		return RateLimitResult{}, false
+	}
+	return result, true
+}
+
+// ErrNoContextKey is wrapped by the error of the functions returned by
+// KeyFromContext when the request has no key in its context.
+var ErrNoContextKey = errors.New("No rate limit key in the request context")
+
+// KeyFromContext returns a function to use as the KeyFunc of an
+// HTTPRateLimiter, which reads the key of each request from the value
+// stored in its context under ctxKey by an upstream middleware, such
+// as the ID of the user set by authentication middleware. The value
+// must be a non-empty string or a fmt.Stringer returning one.
+// Otherwise the request is passed to the Error handler with an error
+// wrapping ErrNoContextKey, rather than sharing an empty key with every
+// other request.
+//
+// The middleware setting the key must run first, so the handler
+// returned by RateLimit must be wrapped by it rather than wrap it:
+//
+//	handler := auth(limiter.RateLimit(h))
+//
+// With a router applying the middleware of a chain outermost first,
+// the limiter is listed after the authentication middleware. A
+// missing key then points to a limiter placed before it, or to a route
+// the authentication middleware doesn't cover.
+func KeyFromContext(ctxKey interface{}) func(*http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		var k string
+		switch v := r.Context().Value(ctxKey).(type) {
+		case string:
+			k = v
+		case fmt.Stringer:
+			k = v.String()
+		}
+		if k == "" {
+			return "", fmt.Errorf("%w under %v, which the middleware setting it must add before HTTPRateLimiter runs", ErrNoContextKey, ctxKey)
+		}
+		return k, nil
+	}
+}
+
 func (t *HTTPRateLimiter) error(w http.ResponseWriter, r *http.Request, err error) {
 	e := t.Error
 	if e == nil {
@@ -89,22 +792,39 @@ func (t *HTTPRateLimiter) error(w http.ResponseWriter, r *http.Request, err erro
 	e(w, r, err)
 }
 
-func setRateLimitHeaders(w http.ResponseWriter, context RateLimitResult) {
-	if v := context.Limit; v >= 0 {
-		w.Header().Add("X-RateLimit-Limit", strconv.Itoa(v))
+func setRateLimitHeaders(w http.ResponseWriter, mode HeaderMode, limited bool, context RateLimitResult) {
+	var prefixes []string
+	switch mode {
+	case StandardHeaders:
+		prefixes = []string{"RateLimit-"}
+	case BothHeaders:
+		prefixes = []string{"X-RateLimit-", "RateLimit-"}
+	default:
+		prefixes = []string{"X-RateLimit-"}
 	}
 
-	if v := context.Remaining; v >= 0 {
-		w.Header().Add("X-RateLimit-Remaining", strconv.Itoa(v))
-	}
+	for _, prefix := range prefixes {
+		if v := context.Limit; v >= 0 {
+			w.Header().Add(prefix+"Limit", strconv.Itoa(v))
+		}
 
-	if v := context.ResetAfter; v >= 0 {
-		vi := int(math.Ceil(v.Seconds()))
-		w.Header().Add("X-RateLimit-Reset", strconv.Itoa(vi))
+		if v := context.Remaining; v >= 0 {
+			w.Header().Add(prefix+"Remaining", strconv.Itoa(v))
+		}
+
+		if v := context.ResetAfter; v >= 0 {
+			vi := int(math.Ceil(v.Seconds()))
+			w.Header().Add(prefix+"Reset", strconv.Itoa(vi))
+		}
 	}
 
-	if v := context.RetryAfter; v >= 0 {
+	if v := context.RetryAfter; limited && v >= 0 {
+		// A delay of 0 would make clients retry immediately, only to be
+		// limited again until the fraction of a second has passed.
 		vi := int(math.Ceil(v.Seconds()))
+		if vi < 1 {
+			vi = 1
+		}
 		w.Header().Add("Retry-After", strconv.Itoa(vi))
 	}
 }
@@ -1,19 +1,33 @@
 package throttled_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
 )
 
 type stubLimiter struct {
+	quantities []int
 }
 
 func (sl *stubLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	sl.quantities = append(sl.quantities, quantity)
 	switch key {
 	case "limit":
 		result := throttled.RateLimitResult{
@@ -23,6 +37,12 @@ func (sl *stubLimiter) RateLimit(key string, quantity int) (bool, throttled.Rate
 			RetryAfter: time.Minute,
 		}
 		return true, result, nil
+	case "limit-soon":
+		result := throttled.RateLimitResult{Limit: 1, ResetAfter: -1, RetryAfter: time.Millisecond}
+		return true, result, nil
+	case "ok-retry":
+		result := throttled.RateLimitResult{Limit: 1, ResetAfter: -1, RetryAfter: time.Second}
+		return false, result, nil
 	case "error":
 		result := throttled.RateLimitResult{}
 		return false, result, errors.New("stubLimiter error")
@@ -66,6 +86,873 @@ func TestHTTPRateLimiter(t *testing.T) {
 	})
 }
 
+func TestHTTPRateLimiterRetryAfter(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		// Never less than a second
+		{"limit-soon", 429, map[string]string{"Retry-After": "1"}},
+		// Never on permitted requests
+		{"ok-retry", 200, map[string]string{"Retry-After": ""}},
+	})
+}
+
+func TestHTTPRateLimiterHeaders(t *testing.T) {
+	for _, c := range []struct {
+		mode                    throttled.HeaderMode
+		legacy, standard, reset string
+	}{
+		{throttled.LegacyHeaders, "1", "", ""},
+		{throttled.StandardHeaders, "", "1", "60"},
+		{throttled.BothHeaders, "1", "1", "60"},
+	} {
+		limiter := throttled.HTTPRateLimiter{
+			RateLimiter: &stubLimiter{},
+			VaryBy:      &pathGetter{},
+			Headers:     c.mode,
+		}
+
+		handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+		runHTTPTestCases(t, handler, []httpTestCase{
+			{"ok", 200, map[string]string{
+				"X-Ratelimit-Limit": c.legacy,
+				"Ratelimit-Limit":   c.standard,
+				"Ratelimit-Reset":   c.reset,
+			}},
+			{"limit", 429, map[string]string{"Retry-After": "60"}},
+		})
+	}
+}
+
+func TestRateLimitResultFromContext(t *testing.T) {
+	var denied, allowed throttled.RateLimitResult
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		DeniedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, ok := throttled.RateLimitResultFromContext(r.Context())
+			if !ok {
+				t.Error("expected the DeniedHandler to find a RateLimitResult")
+			}
+			denied = result
+			w.WriteHeader(429)
+		}),
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, _ = throttled.RateLimitResultFromContext(r.Context())
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{}},
+		{"limit", 429, map[string]string{}},
+	})
+
+	if denied.RetryAfter != time.Minute {
+		t.Errorf("expected the denied request's RetryAfter to be %s but got %s", time.Minute, denied.RetryAfter)
+	}
+	if allowed.Remaining != 2 {
+		t.Errorf("expected the allowed request's Remaining to be 2 but got %d", allowed.Remaining)
+	}
+
+	if _, ok := throttled.RateLimitResultFromContext(context.Background()); ok {
+		t.Error("expected no RateLimitResult in an empty context")
+	}
+}
+
+func TestHTTPRateLimiterKeyFunc(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		KeyFunc: func(r *http.Request) (string, error) {
+			user := r.URL.Query().Get("user")
+			if user == "" {
+				return "", errors.New("unauthenticated")
+			}
+			return user, nil
+		},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"limit?user=ok", 200, map[string]string{}},
+		{"ok?user=limit", 429, map[string]string{}},
+		{"ok", 500, map[string]string{}},
+	})
+}
+
+func TestHTTPRateLimiterWithoutRateLimiter(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{VaryBy: &pathGetter{}}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 500, map[string]string{}},
+	})
+}
+
+type userKey struct{}
+
+func (userKey) String() string { return "userKey" }
+
+func TestHTTPRateLimiterKeyFromContext(t *testing.T) {
+	var errs []error
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		KeyFunc:     throttled.KeyFromContext(userKey{}),
+		Error: func(w http.ResponseWriter, r *http.Request, err error) {
+			errs = append(errs, err)
+			w.WriteHeader(401)
+		},
+	}
+
+	// The authentication middleware sets the user from the query
+	auth := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.URL.Query().Get("user"); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+
+	handler := auth(limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok?user=ok", 200, map[string]string{}},
+		{"ok?user=limit", 429, map[string]string{}},
+		{"ok", 401, map[string]string{}},
+	})
+
+	if len(errs) != 1 || !errors.Is(errs[0], throttled.ErrNoContextKey) {
+		t.Errorf("expected one ErrNoContextKey but got %v", errs)
+	} else if !strings.Contains(errs[0].Error(), "userKey") {
+		t.Errorf("expected the error to name the context key but got %q", errs[0])
+	}
+}
+
+// slowStore blocks reads until their context is done.
+type slowStore struct {
+	*memstore.MemStore
+}
+
+func (s *slowStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	select {
+	case <-ctx.Done():
+		return 0, time.Time{}, ctx.Err()
+	case <-time.After(10 * time.Second):
+		return s.GetWithTime(key)
+	}
+}
+
+func (s *slowStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	return s.SetIfNotExistsWithTTL(key, value, ttl)
+}
+
+func (s *slowStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.CompareAndSwapWithTTL(key, old, new, ttl)
+}
+
+func TestHTTPRateLimiterCancel(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(&slowStore{mst}, throttled.RateQuota{MaxRate: throttled.PerSec(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: rl,
+		Error: func(w http.ResponseWriter, r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the handler of a cancelled request not to be called")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the store read to be abandoned but it took %s", elapsed)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("expected one context.Canceled error but got %v", errs)
+	}
+}
+
+func TestHTTPRateLimiterSoftLimit(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: newSoftLimitRateLimiter(t),
+		VaryBy:      &throttled.VaryBy{Path: true},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"/a", 200, map[string]string{"Warning": "", "X-Ratelimit-Remaining": "1"}},
+		{"/a", 200, map[string]string{"Warning": "", "X-Ratelimit-Remaining": "0"}},
+		{"/a", 200, map[string]string{"Warning": throttled.SoftLimitWarning, "X-Ratelimit-Limit": "2"}},
+		{"/a", 200, map[string]string{"Warning": throttled.SoftLimitWarning}},
+		{"/a", 429, map[string]string{"Warning": "", "X-Ratelimit-Limit": "4"}},
+		{"/b", 200, map[string]string{"Warning": ""}},
+	})
+}
+
+func TestHTTPRateLimiterSkip(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		Skip: func(r *http.Request) bool {
+			return r.Header.Get("X-Internal") != ""
+		},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	req, err := http.NewRequest("GET", "limit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Internal", "1")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 200 {
+		t.Errorf("expected a skipped request to pass through but got %d", rr.Code)
+	}
+	if have := rr.HeaderMap.Get("Retry-After"); have != "" {
+		t.Errorf("expected a skipped request not to have rate limit headers but got Retry-After %s", have)
+	}
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"limit", 429, map[string]string{"Retry-After": "60"}},
+	})
+}
+
+func TestHTTPRateLimiterCost(t *testing.T) {
+	sl := &stubLimiter{}
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: sl,
+		Cost: func(r *http.Request) int {
+			switch r.URL.Path {
+			case "report":
+				return 10
+			case "status":
+				return 0
+			case "bad":
+				return -1
+			}
+			return 1
+		},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"report", 200, map[string]string{}},
+		{"status", 200, map[string]string{}},
+		{"other", 200, map[string]string{}},
+		{"bad", 500, map[string]string{}},
+	})
+
+	if have, want := sl.quantities, []int{10, 0, 1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected quantities %v but got %v", want, have)
+	}
+}
+
+func TestHTTPRateLimiterCostExceedsLimit(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: rl,
+		FailureMode: throttled.FailOpen,
+		Cost:        func(r *http.Request) int { return 3 },
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	// Denied rather than failed open, with nothing consumed
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"upload", 429, map[string]string{"X-Ratelimit-Remaining": "2", "Retry-After": ""}},
+	})
+}
+
+func TestHTTPRateLimiterQuotaProvider(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: rl,
+		VaryBy:      &pathGetter{},
+		QuotaProvider: func(key string) (throttled.RateQuota, bool) {
+			if key == "premium" {
+				return throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2}, true
+			}
+			return throttled.RateQuota{}, false
+		},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"free", 200, map[string]string{"X-Ratelimit-Limit": "1"}},
+		{"free", 429, map[string]string{}},
+		{"premium", 200, map[string]string{"X-Ratelimit-Limit": "3"}},
+		{"premium", 200, map[string]string{}},
+		{"premium", 200, map[string]string{}},
+		{"premium", 429, map[string]string{}},
+	})
+
+	// A RateLimiter without RateLimitWithQuota can't apply quotas
+	limiter.RateLimiter = &stubLimiter{}
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"free", 200, map[string]string{}},
+		{"premium", 500, map[string]string{}},
+	})
+}
+
+func TestHTTPRateLimiterEmptyKey(t *testing.T) {
+	type request struct {
+		apiKey string // Sent in the Api-Key header if not empty
+		code   int
+	}
+
+	cases := []struct {
+		mode     throttled.EmptyKeyMode
+		requests []request
+	}{
+		0: {throttled.EmptyKeyShared, []request{
+			{"", 200},
+			{"", 429},
+			{"global", 200},
+		}},
+		// Requests without a key share the global bucket, which is not
+		// that of the clients whose key is "global"
+		1: {throttled.EmptyKeyGlobal, []request{
+			{"", 200},
+			{"", 429},
+			{"global", 200},
+			{"global", 429},
+		}},
+		2: {throttled.EmptyKeyError, []request{
+			{"", 500},
+			{"global", 200},
+		}},
+	}
+
+	for i, c := range cases {
+		st, err := memstore.New(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var errs []error
+		limiter := throttled.HTTPRateLimiter{
+			RateLimiter: rl,
+			VaryBy:      &throttled.VaryBy{Headers: []string{"Api-Key"}},
+			EmptyKey:    c.mode,
+			Error: func(w http.ResponseWriter, r *http.Request, err error) {
+				errs = append(errs, err)
+				w.WriteHeader(500)
+			},
+		}
+
+		handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+		for j, req := range c.requests {
+			r := httptest.NewRequest("GET", "/", nil)
+			if req.apiKey != "" {
+				r.Header.Set("Api-Key", req.apiKey)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+			if have, want := rr.Code, req.code; have != want {
+				t.Errorf("%d: expected request %d to return %d but got %d", i, j, want, have)
+			}
+		}
+
+		for _, err := range errs {
+			if err != throttled.ErrEmptyKey {
+				t.Errorf("%d: expected error %v but got %v", i, throttled.ErrEmptyKey, err)
+			}
+		}
+	}
+}
+
+func TestHTTPRateLimiterProbe(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPRateLimiter{RateLimiter: rl, Probe: true}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	cases := []struct {
+		method    string
+		code      int
+		remaining string
+	}{
+		0: {"HEAD", 200, "2"},
+		1: {"GET", 200, "1"},
+		2: {"GET", 200, "0"},
+		// Probes are never denied and don't consume quota
+		3: {"HEAD", 200, "0"},
+		4: {"HEAD", 200, "0"},
+		5: {"GET", 429, "0"},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest(c.method, "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%d: expected %d but got %d", i, c.code, rr.Code)
+		}
+		if have := rr.HeaderMap.Get("X-Ratelimit-Remaining"); have != c.remaining {
+			t.Errorf("%d: expected %s remaining but got '%s'", i, c.remaining, have)
+		}
+		if have := rr.HeaderMap.Get("Retry-After"); c.method == "HEAD" && have != "" {
+			t.Errorf("%d: expected no Retry-After for a probe but got '%s'", i, have)
+		}
+	}
+
+	// Probes report the quota of the QuotaProvider
+	limiter.QuotaProvider = func(key string) (throttled.RateQuota, bool) {
+		return throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 9}, true
+	}
+	req, err := http.NewRequest("HEAD", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if have, want := rr.HeaderMap.Get("X-Ratelimit-Limit"), "10"; have != want {
+		t.Errorf("expected a probe to report a limit of %s but got '%s'", want, have)
+	}
+	if have, want := rr.HeaderMap.Get("X-Ratelimit-Remaining"), "8"; have != want {
+		t.Errorf("expected a probe to report %s remaining but got '%s'", want, have)
+	}
+	limiter.QuotaProvider = nil
+
+	// A RateLimiter without Peek can't answer probes
+	limiter.RateLimiter = &stubLimiter{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 500 {
+		t.Errorf("expected 500 but got %d", rr.Code)
+	}
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Info(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprint("INFO ", msg, keyvals))
+}
+
+func (l *testLogger) Debug(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprint("DEBUG ", msg, keyvals))
+}
+
+func (l *testLogger) Error(msg string, keyvals ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprint("ERROR ", msg, keyvals))
+}
+
+func TestHTTPRateLimiterLogger(t *testing.T) {
+	logger := &testLogger{}
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		Logger:      logger,
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{}},
+		{"limit", 429, map[string]string{}},
+		{"error", 500, map[string]string{}},
+	})
+
+	want := []string{
+		"DEBUG throttled: request permitted[key ok limit 1 remaining 2 reset_after 1m0s retry_after -1ns]",
+		"INFO throttled: request limited[key limit limit -1 remaining -1 reset_after -1ns retry_after 1m0s]",
+	}
+	if !reflect.DeepEqual(logger.lines, want) {
+		t.Errorf("expected lines %q but got %q", want, logger.lines)
+	}
+
+	// A nil Logger logs nothing
+	limiter.Logger = nil
+	runHTTPTestCases(t, handler, []httpTestCase{{"limit", 429, map[string]string{}}})
+}
+
+func TestHTTPRateLimiterBypassToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	logger := &testLogger{}
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter:  &stubLimiter{},
+		VaryBy:       &pathGetter{},
+		BypassHeader: "X-Ratelimit-Bypass",
+		BypassSecret: secret,
+		Logger:       logger,
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	valid := throttled.NewBypassToken(secret, time.Now().Add(time.Hour))
+	cases := []struct {
+		token string
+		code  int
+	}{
+		0: {"", 429},
+		1: {valid, 200},
+		// Invalid tokens are ignored
+		2: {throttled.NewBypassToken(secret, time.Now().Add(-time.Second)), 429},
+		3: {throttled.NewBypassToken([]byte("other secret"), time.Now().Add(time.Hour)), 429},
+		4: {"9999999999" + valid[strings.IndexByte(valid, '.'):], 429},
+		5: {"garbage", 429},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", "limit", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("X-Ratelimit-Bypass", c.token)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%d: expected %d but got %d", i, c.code, rr.Code)
+		}
+	}
+
+	bypassed := 0
+	for _, line := range logger.lines {
+		if strings.Contains(line, "bypassed") {
+			bypassed++
+		}
+	}
+	if bypassed != 1 {
+		t.Errorf("expected one bypass to be logged but got %q", logger.lines)
+	}
+
+	// The key of a bypassing request isn't computed, so a KeyFunc
+	// failing before authentication doesn't reject it
+	keys := 0
+	limiter.KeyFunc = func(r *http.Request) (string, error) {
+		keys++
+		return "", errors.New("no user")
+	}
+	req, err := http.NewRequest("GET", "limit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Ratelimit-Bypass", valid)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != 200 || keys != 0 {
+		t.Errorf("expected a bypass without a key but got %d after %d calls to KeyFunc", rr.Code, keys)
+	}
+}
+
+func TestHTTPRateLimiterResponseCost(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerHour(10), MaxBurst: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status int
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: rl,
+		ResponseCost: func(r *http.Request, meta throttled.ResponseMeta) int {
+			status = meta.StatusCode
+			n, _ := strconv.Atoi(meta.Header.Get("X-Records"))
+			return n
+		},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Records", r.URL.Query().Get("records"))
+		w.Write([]byte("ok"))
+	}))
+
+	cases := []struct {
+		records, remaining int
+	}{
+		// Charge the difference with the provisional cost of 1
+		0: {5, 5},
+		// Give it back
+		1: {0, 5},
+		2: {1, 4},
+		// Charge only what is left
+		3: {20, 0},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest("GET", "/?records="+strconv.Itoa(c.records), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if status != 200 {
+			t.Errorf("%d: expected ResponseCost to get the status 200 but got %d", i, status)
+		}
+
+		result, err := rl.Peek("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected %d remaining but got %d", i, want, have)
+		}
+	}
+}
+
+func TestHTTPRateLimiterResponseCostWithQuota(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerSec(1000), MaxBurst: 999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := throttled.RateQuota{MaxRate: throttled.PerHour(10), MaxBurst: 9}
+
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter:   rl,
+		QuotaProvider: func(key string) (throttled.RateQuota, bool) { return quota, true },
+		ResponseCost: func(r *http.Request, meta throttled.ResponseMeta) int {
+			n, _ := strconv.Atoi(r.URL.Query().Get("records"))
+			return n
+		},
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// The difference is reconciled under the quota of the provider
+	// rather than the default one of the limiter
+	for i, c := range []struct {
+		records, remaining int
+	}{
+		0: {5, 5},
+		1: {0, 5},
+		2: {20, 0},
+	} {
+		req, err := http.NewRequest("GET", "/?records="+strconv.Itoa(c.records), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		result, err := rl.PeekWithQuota("", quota)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected %d remaining but got %d", i, want, have)
+		}
+	}
+}
+
+// hijackRecorder is a ResponseRecorder whose connection can be
+// hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func TestHTTPRateLimiterResponseCostStreaming(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter:  &stubLimiter{},
+		VaryBy:       &pathGetter{},
+		ResponseCost: func(r *http.Request, meta throttled.ResponseMeta) int { return 1 },
+	}
+
+	// Streaming handlers and WebSocket upgrades reach the Flusher and
+	// Hijacker of the ResponseWriter
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	req, err := http.NewRequest("GET", "ok", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(rr, req)
+
+	if !rr.Flushed || !rr.hijacked {
+		t.Errorf("expected the response to be flushed and hijacked but got %t and %t", rr.Flushed, rr.hijacked)
+	}
+}
+
+func TestHTTPRateLimiterFailureMode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	cases := []struct {
+		mode throttled.FailureMode
+		code int
+	}{
+		{throttled.FailWithError, 500},
+		{throttled.FailOpen, 200},
+		{throttled.FailClosed, 503},
+	}
+
+	for _, c := range cases {
+		limiter := throttled.HTTPRateLimiter{
+			RateLimiter: &stubLimiter{},
+			VaryBy:      &pathGetter{},
+			FailureMode: c.mode,
+		}
+
+		handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+		runHTTPTestCases(t, handler, []httpTestCase{
+			{"error", c.code, map[string]string{}},
+			{"limit", 429, map[string]string{}},
+		})
+	}
+
+	// With a Logger, the errors of FailOpen aren't written to the
+	// standard logger
+	logger := &testLogger{}
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		FailureMode: throttled.FailOpen,
+		Logger:      logger,
+	}
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	runHTTPTestCases(t, handler, []httpTestCase{{"error", 200, map[string]string{}}})
+
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "ERROR ") {
+		t.Errorf("expected one error to be logged but got %q", logger.lines)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing on the standard logger but got %q", buf.String())
+	}
+}
+
+func TestHTTPRateLimiterShadowMode(t *testing.T) {
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &stubLimiter{},
+		VaryBy:      &pathGetter{},
+		ShadowMode:  true,
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"ok", 200, map[string]string{"X-Ratelimit-Limit": "1", "X-Ratelimit-Remaining": "2"}},
+		{"limit", 200, map[string]string{"Retry-After": ""}},
+		{"limit-soon", 200, map[string]string{"X-Ratelimit-Limit": "1", "Retry-After": ""}},
+		{"error", 500, map[string]string{}},
+	})
+}
+
 func TestCustomHTTPRateLimiterHandlers(t *testing.T) {
 	limiter := throttled.HTTPRateLimiter{
 		RateLimiter: &stubLimiter{},
@@ -110,3 +997,24 @@ func runHTTPTestCases(t *testing.T, h http.Handler, cs []httpTestCase) {
 		}
 	}
 }
+
+func TestRateLimitState(t *testing.T) {
+	h := http.Header{}
+	if _, ok := throttled.RateLimitStateFromHeader(h); ok {
+		t.Error("expected no state in an empty header")
+	}
+
+	want := throttled.RateLimitResult{Limit: 10, Remaining: 0, ResetAfter: time.Second, RetryAfter: 100 * time.Millisecond}
+	throttled.SetRateLimitState(h, want)
+	if have := h.Get(throttled.RateLimitStateHeader); have != `{"limit":10,"remaining":0,"reset_after_ms":1000,"retry_after_ms":100}` {
+		t.Errorf("unexpected header %s", have)
+	}
+	if have, ok := throttled.RateLimitStateFromHeader(h); !ok || have != want {
+		t.Errorf("expected %+v but got %+v (%v)", want, have, ok)
+	}
+
+	h.Set(throttled.RateLimitStateHeader, "garbage")
+	if _, ok := throttled.RateLimitStateFromHeader(h); ok {
+		t.Error("expected no state in an invalid header")
+	}
+}
@@ -0,0 +1,58 @@
+package throttled
+
+import "net/http"
+
+// HTTPMethodRateLimiter facilitates limiting HTTP requests with a
+// different RateLimiter per method, for example to allow many more
+// GETs than POSTs on the same paths. It is configured like an
+// HTTPRateLimiter, whose RateLimiter limits the methods that aren't
+// listed in Methods. If that RateLimiter is nil, requests with the
+// other methods are passed to the wrapped handler unlimited.
+type HTTPMethodRateLimiter struct {
+	HTTPRateLimiter
+
+	// Methods maps upper case method names, such as "POST", to the
+	// RateLimiter limiting requests with that method. The keys passed
+	// to these limiters are prefixed with the method and a colon, so
+	// that they don't share state with the limiters of other methods
+	// even if they share a store.
+	Methods map[string]RateLimiter
+
+	// Bypass lists the methods, such as "OPTIONS" or "HEAD", whose
+	// requests are passed to the wrapped handler without consulting
+	// any RateLimiter, as with HTTPRateLimiter.Skip.
+	Bypass []string
+}
+
+// RateLimit wraps an http.Handler to limit incoming requests with the
+// RateLimiter of their method, as described by
+// HTTPRateLimiter.RateLimit. Changes to Methods and Bypass after
+// RateLimit is called have no effect on the returned handler.
+func (t *HTTPMethodRateLimiter) RateLimit(h http.Handler) http.Handler {
+	bypass := make(map[string]bool, len(t.Bypass))
+	for _, m := range t.Bypass {
+		bypass[m] = true
+	}
+
+	handlers := make(map[string]http.Handler, len(t.Methods))
+	for m, rl := range t.Methods {
+		limiter := t.HTTPRateLimiter
+		limiter.RateLimiter = &prefixRateLimiter{limiter: rl, prefix: m + ":"}
+		handlers[m] = limiter.RateLimit(h)
+	}
+
+	def := h
+	if t.HTTPRateLimiter.RateLimiter != nil {
+		def = t.HTTPRateLimiter.RateLimit(h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bypass[r.Method] {
+			h.ServeHTTP(w, r)
+		} else if mh, ok := handlers[r.Method]; ok {
+			mh.ServeHTTP(w, r)
+		} else {
+			def.ServeHTTP(w, r)
+		}
+	})
+}
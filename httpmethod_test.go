@@ -0,0 +1,140 @@
+package throttled_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+// keyLimiter records the keys it is called with and limits every
+// request if limit is set.
+type keyLimiter struct {
+	limit bool
+	keys  []string
+}
+
+func (kl *keyLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	kl.keys = append(kl.keys, key)
+	return kl.limit, throttled.RateLimitResult{Limit: 1, RetryAfter: -1}, nil
+}
+
+func TestHTTPMethodRateLimiter(t *testing.T) {
+	def := &keyLimiter{}
+	post := &keyLimiter{limit: true}
+
+	limiter := throttled.HTTPMethodRateLimiter{
+		HTTPRateLimiter: throttled.HTTPRateLimiter{
+			RateLimiter: def,
+			VaryBy:      &pathGetter{},
+		},
+		Methods: map[string]throttled.RateLimiter{"POST": post},
+		Bypass:  []string{"OPTIONS"},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	cases := []struct {
+		method string
+		code   int
+	}{
+		0: {"GET", 200},
+		1: {"POST", 429},
+		2: {"PUT", 200},
+		3: {"OPTIONS", 200},
+	}
+
+	for i, c := range cases {
+		req, err := http.NewRequest(c.method, "path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%d: expected %s to return %d but got %d", i, c.method, c.code, rr.Code)
+		}
+	}
+
+	if have, want := def.keys, []string{"path", "path"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected the default limiter to get keys %v but got %v", want, have)
+	}
+	if have, want := post.keys, []string{"POST:path"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected the POST limiter to get keys %v but got %v", want, have)
+	}
+}
+
+func TestHTTPMethodRateLimiterWithoutDefault(t *testing.T) {
+	post := &keyLimiter{limit: true}
+
+	limiter := throttled.HTTPMethodRateLimiter{
+		HTTPRateLimiter: throttled.HTTPRateLimiter{VaryBy: &pathGetter{}},
+		Methods:         map[string]throttled.RateLimiter{"POST": post},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	// Methods without a RateLimiter aren't limited
+	for method, code := range map[string]int{"GET": 200, "POST": 429} {
+		req, err := http.NewRequest(method, "path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("expected %s to return %d but got %d", method, code, rr.Code)
+		}
+	}
+}
+
+func TestHTTPMethodRateLimiterProbe(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := throttled.HTTPMethodRateLimiter{
+		HTTPRateLimiter: throttled.HTTPRateLimiter{
+			VaryBy:       &pathGetter{},
+			Probe:        true,
+			ProbeMethods: []string{"POST"},
+		},
+		Methods: map[string]throttled.RateLimiter{"POST": rl},
+	}
+
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	// Probes with a listed method are answered by the Peek of its
+	// RateLimiter without being charged
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != 200 {
+			t.Errorf("%d: expected a probe to return 200 but got %d", i, rr.Code)
+		}
+		if have, want := rr.Header().Get("X-RateLimit-Remaining"), "1"; have != want {
+			t.Errorf("%d: expected %s remaining but got %s", i, want, have)
+		}
+	}
+}
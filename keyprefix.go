@@ -0,0 +1,118 @@
+package throttled
+
+import (
+	"context"
+	"fmt"
+)
+
+// prefixRateLimiter is a RateLimiter prefixing the keys passed to
+// another one, so that several routes or methods can share a limiter
+// without sharing state. Unlike a CompositeRateLimiter, it forwards
+// the optional methods of the limiter used by HTTPRateLimiter, such as
+// Peek and RateLimitWithQuota.
+type prefixRateLimiter struct {
+	limiter RateLimiter
+	prefix  string
+}
+
+func (p *prefixRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return p.limiter.RateLimit(p.prefix+key, quantity)
+}
+
+func (p *prefixRateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	return rateLimitCtx(ctx, p.limiter, p.prefix+key, quantity)
+}
+
+func (p *prefixRateLimiter) RateLimitWithQuota(key string, quantity int, quota RateQuota) (bool, RateLimitResult, error) {
+	ql, ok := p.limiter.(quotaRateLimiter)
+	if !ok {
+		return false, RateLimitResult{}, fmt.Errorf("RateLimiter %T must implement RateLimitWithQuota to use a QuotaProvider", p.limiter)
+	}
+	return ql.RateLimitWithQuota(p.prefix+key, quantity, quota)
+}
+
+func (p *prefixRateLimiter) RateLimitWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) (bool, RateLimitResult, error) {
+	if ql, ok := p.limiter.(quotaRateLimiterCtx); ok {
+		return ql.RateLimitWithQuotaCtx(ctx, p.prefix+key, quantity, quota)
+	}
+	return p.RateLimitWithQuota(key, quantity, quota)
+}
+
+func (p *prefixRateLimiter) Peek(key string) (RateLimitResult, error) {
+	pk, ok := p.limiter.(peeker)
+	if !ok {
+		return RateLimitResult{}, fmt.Errorf("RateLimiter %T must implement Peek to answer probes", p.limiter)
+	}
+	return pk.Peek(p.prefix + key)
+}
+
+func (p *prefixRateLimiter) PeekWithQuota(key string, quota RateQuota) (RateLimitResult, error) {
+	qp, ok := p.limiter.(quotaPeeker)
+	if !ok {
+		return RateLimitResult{}, fmt.Errorf("RateLimiter %T must implement PeekWithQuota to answer probes with a QuotaProvider", p.limiter)
+	}
+	return qp.PeekWithQuota(p.prefix+key, quota)
+}
+
+// Refund does nothing if the limiter doesn't implement Refunder.
+func (p *prefixRateLimiter) Refund(key string, quantity int) error {
+	if r, ok := p.limiter.(Refunder); ok {
+		return r.Refund(p.prefix+key, quantity)
+	}
+	return nil
+}
+
+func (p *prefixRateLimiter) RefundCtx(ctx context.Context, key string, quantity int) error {
+	if r, ok := p.limiter.(refunderCtx); ok {
+		return r.RefundCtx(ctx, p.prefix+key, quantity)
+	}
+	return p.Refund(key, quantity)
+}
+
+func (p *prefixRateLimiter) RefundWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) error {
+	if r, ok := p.limiter.(quotaRefunder); ok {
+		return r.RefundWithQuotaCtx(ctx, p.prefix+key, quantity, quota)
+	}
+	if _, ok := p.limiter.(Refunder); ok {
+		return fmt.Errorf("RateLimiter %T must implement RefundWithQuotaCtx to give back quantities with a QuotaProvider", p.limiter)
+	}
+	return nil
+}
+
+// RateLimitPartial and its variants grant all or nothing of requested
+// with RateLimit if the limiter doesn't implement them.
+func (p *prefixRateLimiter) RateLimitPartial(key string, requested int) (int, RateLimitResult, error) {
+	if pl, ok := p.limiter.(partialRateLimiter); ok {
+		return pl.RateLimitPartial(p.prefix+key, requested)
+	}
+	limited, result, err := p.limiter.RateLimit(p.prefix+key, requested)
+	return grantAll(requested, limited, result, err)
+}
+
+func (p *prefixRateLimiter) RateLimitPartialCtx(ctx context.Context, key string, requested int) (int, RateLimitResult, error) {
+	if pl, ok := p.limiter.(partialRateLimiterCtx); ok {
+		return pl.RateLimitPartialCtx(ctx, p.prefix+key, requested)
+	}
+	if _, ok := p.limiter.(partialRateLimiter); ok {
+		return p.RateLimitPartial(key, requested)
+	}
+	limited, result, err := rateLimitCtx(ctx, p.limiter, p.prefix+key, requested)
+	return grantAll(requested, limited, result, err)
+}
+
+func (p *prefixRateLimiter) RateLimitPartialWithQuotaCtx(ctx context.Context, key string, requested int, quota RateQuota) (int, RateLimitResult, error) {
+	if pl, ok := p.limiter.(quotaPartialRateLimiter); ok {
+		return pl.RateLimitPartialWithQuotaCtx(ctx, p.prefix+key, requested, quota)
+	}
+	limited, result, err := p.RateLimitWithQuotaCtx(ctx, key, requested, quota)
+	return grantAll(requested, limited, result, err)
+}
+
+// grantAll converts a decision of RateLimit on requested to the
+// quantity granted by RateLimitPartial, all or nothing.
+func grantAll(requested int, limited bool, result RateLimitResult, err error) (int, RateLimitResult, error) {
+	if err != nil || limited {
+		return 0, result, err
+	}
+	return requested, result, nil
+}
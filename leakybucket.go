@@ -0,0 +1,148 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWaitExceeded is returned by LeakyBucketLimiter.Wait and WaitN when
+// the quantity wouldn't be permitted before the deadline of the context
+// or, for WaitN, within the maximum wait.
+var ErrWaitExceeded = errors.New("Rate limit wouldn't permit the quantity before the deadline")
+
+// LeakyBucketLimiter is a limiter that delays callers instead of
+// rejecting them, which suits background jobs that must merely stay
+// within a rate. It shares its state and algorithm with
+// GCRARateLimiter: a store used by both limits the same keys in the
+// same way, except that callers of Wait queue up behind each other.
+type LeakyBucketLimiter struct {
+	limiter *GCRARateLimiter
+}
+
+// NewLeakyBucketLimiter creates a LeakyBucketLimiter. quota is
+// interpreted as by NewGCRARateLimiter: MaxBurst requests beyond the
+// first are permitted without waiting, after which callers wait for
+// the rate.
+func NewLeakyBucketLimiter(st GCRAStore, quota RateQuota) (*LeakyBucketLimiter, error) {
+	limiter, err := NewGCRARateLimiter(st, quota)
+	if err != nil {
+		return nil, err
+	}
+	return &LeakyBucketLimiter{limiter: limiter}, nil
+}
+
+// SetClock sets the function used to get the current time, as
+// described by GCRARateLimiter.SetClock. It doesn't affect how long
+// Wait sleeps.
+func (l *LeakyBucketLimiter) SetClock(clock func() time.Time) {
+	l.limiter.SetClock(clock)
+}
+
+// Wait reserves quantity for key and blocks until the reservation is
+// due, which is immediately if the burst isn't exhausted. It returns
+// how long it waited. Reservations are made in the order the calls
+// reach the store, so concurrent callers are served in turn.
+//
+// If ctx has a deadline before the reservation would be due, Wait
+// returns ErrWaitExceeded immediately without reserving anything. If
+// ctx is done while waiting, Wait returns its error, but the
+// reservation is kept. A negative quantity returns an error wrapping
+// ErrInvalidQuantity.
+func (l *LeakyBucketLimiter) Wait(ctx context.Context, key string, quantity int) (time.Duration, error) {
+	return l.wait(ctx, key, quantity, -1)
+}
+
+// WaitN is like Wait, but returns ErrWaitExceeded immediately without
+// reserving anything if the reservation wouldn't be due within maxWait,
+// so that a caller such as a worker pool can bound its latency when key
+// is saturated. A maxWait of 0 only permits quantity if it doesn't have
+// to wait at all. If ctx has a deadline before maxWait, the deadline
+// applies instead.
+func (l *LeakyBucketLimiter) WaitN(ctx context.Context, key string, quantity int, maxWait time.Duration) (time.Duration, error) {
+	if maxWait < 0 {
+		maxWait = 0
+	}
+	return l.wait(ctx, key, quantity, maxWait)
+}
+
+// wait implements Wait and WaitN, without a maximum wait if maxWait is
+// negative.
+func (l *LeakyBucketLimiter) wait(ctx context.Context, key string, quantity int, maxWait time.Duration) (time.Duration, error) {
+	if quantity < 0 {
+		return 0, fmt.Errorf("%w %d", ErrInvalidQuantity, quantity)
+	}
+
+	delay, err := l.reserve(ctx, key, quantity, maxWait)
+	if err != nil || delay <= 0 {
+		return 0, err
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// reserve advances the theoretical arrival time of key by quantity
+// regardless of the limit and returns how long the caller must wait
+// for it to be within the limit, unless the caller would have to wait
+// longer than maxWait, if not negative, or past the deadline of ctx.
+func (l *LeakyBucketLimiter) reserve(ctx context.Context, key string, quantity int, maxWait time.Duration) (time.Duration, error) {
+	g := l.limiter
+
+	i := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		tatVal, now, err := g.storeCtx.GetWithTimeCtx(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		now = g.now(now)
+
+		tat := now
+		if t := time.Unix(0, tatVal); tatVal != -1 && t.After(now) {
+			tat = t
+		}
+		newTat := tat.Add(g.increment(quantity))
+
+		delay := newTat.Add(-g.delayVariationTolerance).Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return 0, ErrWaitExceeded
+		}
+		if maxWait >= 0 && delay > maxWait {
+			return 0, ErrWaitExceeded
+		}
+
+		var updated bool
+		if tatVal == -1 {
+			updated, err = g.storeCtx.SetIfNotExistsWithTTLCtx(ctx, key, newTat.UnixNano(), g.storeTTL(newTat.Sub(now)))
+		} else {
+			updated, err = g.storeCtx.CompareAndSwapWithTTLCtx(ctx, key, tatVal, newTat.UnixNano(), g.storeTTL(newTat.Sub(now)))
+		}
+
+		if err != nil {
+			return 0, err
+		}
+		if updated {
+			return delay, nil
+		}
+
+		i++
+		if !g.retry(ctx, i) {
+			return 0, ErrCASExhausted
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package throttled_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestLeakyBucketLimiterWait(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(20), MaxBurst: 1}
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := throttled.NewLeakyBucketLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetClock(func() time.Time { return now })
+
+	ctx := context.Background()
+	cases := []struct {
+		quantity int
+		wait     time.Duration
+	}{
+		// The burst doesn't wait
+		0: {2, 0},
+		// Each further request waits for the previous ones
+		1: {1, 50 * time.Millisecond},
+		2: {2, 150 * time.Millisecond},
+	}
+
+	for i, c := range cases {
+		start := time.Now()
+		waited, err := l.Wait(ctx, "foo", c.quantity)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if waited != c.wait {
+			t.Errorf("%d: expected to wait %s but waited %s", i, c.wait, waited)
+		}
+		if elapsed := time.Since(start); elapsed < c.wait {
+			t.Errorf("%d: expected Wait to block for %s but it returned after %s", i, c.wait, elapsed)
+		}
+	}
+
+	// A deadline before the reservation fails without reserving
+	before, _, _ := st.GetWithTime("foo")
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.Wait(deadlineCtx, "foo", 1); err != throttled.ErrWaitExceeded {
+		t.Errorf("expected ErrWaitExceeded but got %v", err)
+	}
+	if after, _, _ := st.GetWithTime("foo"); after != before {
+		t.Error("expected a failed Wait not to modify the store")
+	}
+
+	// A negative quantity would give back reserved time
+	if _, err := l.Wait(ctx, "foo", -10); !errors.Is(err, throttled.ErrInvalidQuantity) {
+		t.Errorf("expected ErrInvalidQuantity but got %v", err)
+	}
+	if after, _, _ := st.GetWithTime("foo"); after != before {
+		t.Error("expected a negative quantity not to modify the store")
+	}
+
+	// A context cancelled while waiting returns its error
+	cancelCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := l.Wait(cancelCtx, "foo", 1); err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+}
+
+func TestLeakyBucketLimiterWaitN(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(20), MaxBurst: 1}
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := throttled.NewLeakyBucketLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetClock(func() time.Time { return now })
+
+	ctx := context.Background()
+	cases := []struct {
+		quantity int
+		maxWait  time.Duration
+		wait     time.Duration
+		err      error
+	}{
+		// The burst doesn't wait, even with no maximum wait
+		0: {2, 0, 0, nil},
+		1: {1, 0, 0, throttled.ErrWaitExceeded},
+		2: {1, 50 * time.Millisecond, 50 * time.Millisecond, nil},
+		// A reservation beyond the maximum wait isn't made
+		3: {2, 100 * time.Millisecond, 0, throttled.ErrWaitExceeded},
+		4: {2, 150 * time.Millisecond, 150 * time.Millisecond, nil},
+		5: {-1, time.Hour, 0, throttled.ErrInvalidQuantity},
+	}
+
+	for i, c := range cases {
+		before, _, _ := st.GetWithTime("foo")
+		waited, err := l.WaitN(ctx, "foo", c.quantity, c.maxWait)
+		if !errors.Is(err, c.err) || (c.err == nil && err != nil) {
+			t.Errorf("%d: expected error %v but got %v", i, c.err, err)
+		}
+		if waited != c.wait {
+			t.Errorf("%d: expected to wait %s but waited %s", i, c.wait, waited)
+		}
+		if after, _, _ := st.GetWithTime("foo"); err != nil && after != before {
+			t.Errorf("%d: expected a failed WaitN not to modify the store", i)
+		}
+	}
+
+	// The deadline of the context takes precedence over a longer
+	// maximum wait
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.WaitN(deadlineCtx, "foo", 1, time.Hour); err != throttled.ErrWaitExceeded {
+		t.Errorf("expected ErrWaitExceeded but got %v", err)
+	}
+}
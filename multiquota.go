@@ -0,0 +1,88 @@
+package throttled
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// MultiQuotaRateLimiter is a RateLimiter enforcing several quotas on
+// each key at once, such as a short-term burst limit combined with a
+// long-term cap. A request is limited if it exceeds any of the quotas,
+// in which case none of them is charged.
+type MultiQuotaRateLimiter struct {
+	limiter *GCRARateLimiter
+	params  []*gcra
+}
+
+// NewMultiQuotaRateLimiter creates a MultiQuotaRateLimiter enforcing
+// every quota in quotas, which must not be empty. Each quota is stored
+// under its own key, made of the key passed to RateLimit followed by a
+// colon and the index of the quota, so the order of quotas must not
+// change between deployments sharing a store.
+func NewMultiQuotaRateLimiter(st GCRAStore, quotas []RateQuota) (*MultiQuotaRateLimiter, error) {
+	if len(quotas) == 0 {
+		return nil, errors.New("NewMultiQuotaRateLimiter requires at least one RateQuota")
+	}
+
+	limiter, err := NewGCRARateLimiter(st, quotas[0])
+	if err != nil {
+		return nil, err
+	}
+
+	params := make([]*gcra, len(quotas))
+	for i, quota := range quotas {
+		p, err := newGCRA(quota)
+		if err != nil {
+			return nil, err
+		}
+		params[i] = &p
+	}
+
+	return &MultiQuotaRateLimiter{limiter: limiter, params: params}, nil
+}
+
+// SetClock sets the function used to get the current time, as
+// described by GCRARateLimiter.SetClock.
+func (m *MultiQuotaRateLimiter) SetClock(clock func() time.Time) {
+	m.limiter.SetClock(clock)
+}
+
+// RateLimit checks whether key has exceeded any of the quotas and, if
+// it hasn't, charges quantity against all of them, using
+// GCRARateLimiter.RateLimitBatch. The RateLimitResult is that of the
+// most restrictive quota: the limited one with the longest RetryAfter
+// if the request is limited, or else the one with the fewest requests
+// remaining. A quantity greater than the limit of one of the quotas
+// returns ErrQuantityExceedsLimit with the result of the quota with the
+// smallest limit.
+func (m *MultiQuotaRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return m.RateLimitCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCtx is the context-aware version of RateLimit. ctx is
+// passed to the store if it implements GCRAStoreCtx, except for the
+// operations on several keys at once.
+func (m *MultiQuotaRateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	keys := make([]string, len(m.params))
+	for i := range keys {
+		keys[i] = key + ":" + strconv.Itoa(i)
+	}
+
+	results, limited, err := m.limiter.rateLimitBatch(ctx, keys, m.params, quantity)
+	if err != nil && err != ErrQuantityExceedsLimit {
+		return false, results[0], err
+	}
+
+	result := results[0]
+	for _, r := range results[1:] {
+		if err != nil && r.Limit < result.Limit ||
+			err == nil && limited && r.RetryAfter > result.RetryAfter ||
+			!limited && r.Remaining < result.Remaining {
+			result = r
+		}
+	}
+
+	return limited, result, err
+}
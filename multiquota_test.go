@@ -0,0 +1,69 @@
+package throttled_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestMultiQuotaRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	quotas := []throttled.RateQuota{
+		{MaxRate: throttled.PerSec(1), MaxBurst: 2},
+		{MaxRate: throttled.PerHour(4), MaxBurst: 3},
+	}
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewMultiQuotaRateLimiter(st, quotas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	cases := []struct {
+		advance   time.Duration
+		quantity  int
+		limited   bool
+		limit     int
+		remaining int
+		retry     time.Duration
+	}{
+		// The burst tier has the fewest remaining
+		0: {0, 2, false, 3, 1, -1},
+		// The burst tier limits the request
+		1: {0, 2, true, 3, 1, time.Second},
+		// The hourly tier has the fewest remaining
+		2: {10 * time.Second, 1, false, 4, 1, -1},
+		// The hourly tier limits the request
+		3: {10 * time.Second, 2, true, 4, 1, 15*time.Minute - 20*time.Second},
+	}
+
+	for i, c := range cases {
+		now = now.Add(c.advance)
+		limited, result, err := rl.RateLimit("foo", c.quantity)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected limited to be %t but got %t", i, c.limited, limited)
+		}
+		if result.Limit != c.limit {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, c.limit, result.Limit)
+		}
+		if result.Remaining != c.remaining {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, c.remaining, result.Remaining)
+		}
+		if result.RetryAfter != c.retry {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, c.retry, result.RetryAfter)
+		}
+	}
+
+	if _, err := throttled.NewMultiQuotaRateLimiter(st, nil); err == nil {
+		t.Error("expected an error without quotas")
+	}
+}
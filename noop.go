@@ -0,0 +1,53 @@
+package throttled
+
+import "context"
+
+// NoopRateLimiter is a RateLimiter that permits every request, to
+// disable rate limiting without changing the code using it, for
+// example in development or behind a feature flag.
+type NoopRateLimiter struct {
+	// Limit is reported as both the Limit and the Remaining of every
+	// RateLimitResult. If it is zero or negative, both are -1, so that
+	// HTTPRateLimiter writes no rate limit headers.
+	Limit int
+}
+
+// RateLimit returns false and a RateLimitResult with the remaining
+// quantity at the full Limit.
+func (l *NoopRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return false, l.result(), nil
+}
+
+// RateLimitCtx returns the same as RateLimit.
+func (l *NoopRateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	return false, l.result(), nil
+}
+
+// RateLimitWithQuota returns the same as RateLimit, ignoring quota, so
+// that an HTTPRateLimiter with a QuotaProvider permits every request.
+func (l *NoopRateLimiter) RateLimitWithQuota(key string, quantity int, quota RateQuota) (bool, RateLimitResult, error) {
+	return false, l.result(), nil
+}
+
+// Peek returns the same RateLimitResult as RateLimit.
+func (l *NoopRateLimiter) Peek(key string) (RateLimitResult, error) {
+	return l.result(), nil
+}
+
+// PeekWithQuota returns the same RateLimitResult as RateLimit,
+// ignoring quota.
+func (l *NoopRateLimiter) PeekWithQuota(key string, quota RateQuota) (RateLimitResult, error) {
+	return l.result(), nil
+}
+
+// Refund does nothing.
+func (l *NoopRateLimiter) Refund(key string, quantity int) error {
+	return nil
+}
+
+func (l *NoopRateLimiter) result() RateLimitResult {
+	if l.Limit <= 0 {
+		return RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1}
+	}
+	return RateLimitResult{Limit: l.Limit, Remaining: l.Limit, ResetAfter: 0, RetryAfter: -1}
+}
@@ -0,0 +1,40 @@
+package throttled_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/throttled/throttled"
+)
+
+func TestNoopRateLimiter(t *testing.T) {
+	var _ throttled.Refunder = &throttled.NoopRateLimiter{}
+	var _ throttled.RateLimiterCtx = &throttled.NoopRateLimiter{}
+
+	limiter := throttled.HTTPRateLimiter{
+		RateLimiter: &throttled.NoopRateLimiter{Limit: 10},
+		Cost:        func(*http.Request) int { return 100 },
+	}
+	handler := limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"foo", 200, map[string]string{"X-Ratelimit-Limit": "10", "X-Ratelimit-Remaining": "10", "X-Ratelimit-Reset": "0"}},
+		{"foo", 200, map[string]string{"X-Ratelimit-Remaining": "10"}},
+	})
+
+	limiter.RateLimiter = &throttled.NoopRateLimiter{}
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"foo", 200, map[string]string{"X-Ratelimit-Limit": "", "X-Ratelimit-Remaining": ""}},
+	})
+
+	// The quotas of a QuotaProvider are ignored
+	limiter.QuotaProvider = func(key string) (throttled.RateQuota, bool) {
+		return throttled.RateQuota{MaxRate: throttled.PerMin(1)}, true
+	}
+	runHTTPTestCases(t, handler, []httpTestCase{
+		{"foo", 200, map[string]string{}},
+		{"foo", 200, map[string]string{}},
+	})
+}
@@ -0,0 +1,57 @@
+package throttled
+
+import "time"
+
+// An Observer is notified of the decisions of a rate limiter, for
+// example to export metrics. See SetObserver on GCRARateLimiter.
+type Observer interface {
+	// ObserveRateLimit is called after each decision about key with
+	// whether it was limited and how long the decision took, including
+	// any store operations. If the decision failed, err is the error
+	// returned to the caller and limited is false.
+	//
+	// It is called synchronously by the goroutine checking the rate
+	// limit, so it should be fast and safe for concurrent use.
+	ObserveRateLimit(key string, limited bool, latency time.Duration, err error)
+}
+
+// CASPath identifies the way a store made an atomic update.
+type CASPath int
+
+const (
+	// CASPathEval is an update made by a Lua script with EVAL.
+	CASPathEval CASPath = iota
+
+	// CASPathWatch is an update made in a transaction with WATCH, a
+	// fallback for servers that don't support EVAL that is slower and
+	// retried whenever the key is modified concurrently.
+	CASPathWatch
+)
+
+func (p CASPath) String() string {
+	switch p {
+	case CASPathEval:
+		return "eval"
+	case CASPathWatch:
+		return "watch"
+	}
+	return "unknown"
+}
+
+// A CASObserver is notified of the way a store makes its atomic
+// updates, for example to export metrics showing that it fell back to
+// a slower path, which often follows a change of the configuration of
+// the server. See the CASObserver option of redigostore.
+//
+// Its methods are called synchronously by the goroutine using the
+// store, so they should be fast and safe for concurrent use.
+type CASObserver interface {
+	// ObserveCAS is called after each atomic update, such as a
+	// compare-and-swap, with the path it took. err is the error of the
+	// update, if any.
+	ObserveCAS(path CASPath, err error)
+
+	// ObserveEvalDisabled is called once if the store stops using
+	// EVAL because the server rejected it.
+	ObserveEvalDisabled()
+}
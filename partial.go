@@ -0,0 +1,90 @@
+package throttled
+
+import "context"
+
+// RateLimitPartial charges key with as much of requested as its rate
+// limit currently permits instead of all or nothing, which suits
+// bandwidth-style limits where partial progress is useful. It returns
+// the quantity granted, between 0 and requested, and the
+// RateLimitResult after charging it. When nothing is granted,
+// RetryAfter is the time until a quantity of 1 would be. A negative
+// quantity returns an error wrapping ErrInvalidQuantity, and a quantity
+// of 0 only reads the key.
+//
+// The granted quantity is computed from the state read at each
+// attempt and committed with a compare-and-swap, so concurrent callers
+// never consume more than the limit between them.
+func (g *GCRARateLimiter) RateLimitPartial(key string, requested int) (int, RateLimitResult, error) {
+	return g.rateLimitPartial(context.Background(), &g.gcra, key, requested)
+}
+
+// RateLimitPartialCtx is the context-aware version of
+// RateLimitPartial, passing ctx as RateLimitCtx does.
+func (g *GCRARateLimiter) RateLimitPartialCtx(ctx context.Context, key string, requested int) (int, RateLimitResult, error) {
+	return g.rateLimitPartial(ctx, &g.gcra, key, requested)
+}
+
+// RateLimitPartialWithQuotaCtx is like RateLimitPartialCtx but charges
+// key under quota in place of the quota the limiter was created with,
+// as RateLimitWithQuota does.
+func (g *GCRARateLimiter) RateLimitPartialWithQuotaCtx(ctx context.Context, key string, requested int, quota RateQuota) (int, RateLimitResult, error) {
+	p, err := newGCRA(quota)
+	if err != nil {
+		return 0, RateLimitResult{Limit: quota.MaxBurst + 1, RetryAfter: -1}, err
+	}
+	return g.rateLimitPartial(ctx, &p, key, requested)
+}
+
+func (g *GCRARateLimiter) rateLimitPartial(ctx context.Context, p *gcra, key string, requested int) (int, RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+	if err := checkQuantity(requested, p.limit); err != nil && err != ErrQuantityExceedsLimit {
+		return 0, rlc, err
+	}
+
+	if requested == 0 {
+		_, rlc, err := g.peekUnobserved(ctx, p, key, nil)
+		return 0, rlc, err
+	}
+
+	i := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, rlc, err
+		}
+
+		tatVal, now, err := g.storeCtx.GetWithTimeCtx(ctx, key)
+		if err != nil {
+			return 0, rlc, err
+		}
+		now = g.now(now)
+
+		granted := requested
+		if available := p.decide(tatVal, now, 0).result.Remaining; available < granted {
+			granted = available
+		}
+		if granted == 0 && requested > 0 {
+			return 0, g.jitter(p.decide(tatVal, now, 1).result), nil
+		}
+
+		d := p.decide(tatVal, now, granted)
+
+		var updated bool
+		if tatVal == -1 {
+			updated, err = g.storeCtx.SetIfNotExistsWithTTLCtx(ctx, key, d.newTat.UnixNano(), g.storeTTL(d.ttl))
+		} else {
+			updated, err = g.storeCtx.CompareAndSwapWithTTLCtx(ctx, key, tatVal, d.newTat.UnixNano(), g.storeTTL(d.ttl))
+		}
+
+		if err != nil {
+			return 0, rlc, err
+		}
+		if updated {
+			return granted, d.result, nil
+		}
+
+		i++
+		if !g.retry(ctx, i) {
+			return 0, rlc, ErrCASExhausted
+		}
+	}
+}
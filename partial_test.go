@@ -0,0 +1,95 @@
+package throttled_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestRateLimitPartial(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 4}
+	start := time.Unix(1000, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: start}
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		now                           time.Time
+		requested, granted, remaining int
+		retry                         time.Duration
+	}{
+		0: {start, 3, 3, 2, -1},
+		// Only 2 of the 10 requested fit
+		1: {start, 10, 2, 0, -1},
+		2: {start, 1, 0, 0, time.Second},
+		3: {start.Add(1500 * time.Millisecond), 4, 1, 0, -1},
+		4: {start.Add(1500 * time.Millisecond), 0, 0, 0, -1},
+	}
+
+	for i, c := range cases {
+		st.clock = c.now
+		granted, result, err := rl.RateLimitPartial("foo", c.requested)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if granted != c.granted {
+			t.Errorf("%d: expected %d to be granted but got %d", i, c.granted, granted)
+		}
+		if result.Remaining != c.remaining {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, c.remaining, result.Remaining)
+		}
+		if result.RetryAfter != c.retry {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, c.retry, result.RetryAfter)
+		}
+	}
+
+	if _, _, err := rl.RateLimitPartial("foo", -1); err == nil {
+		t.Error("expected an error for a negative quantity")
+	}
+}
+
+func TestRateLimitPartialConcurrent(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 4}
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetMaxCASAttempts(100)
+	now := time.Unix(1000, 0)
+	rl.SetClock(func() time.Time { return now })
+
+	var wg sync.WaitGroup
+	var total int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			granted, _, err := rl.RateLimitPartial("foo", 3)
+			if err != nil {
+				t.Error(err)
+			}
+			atomic.AddInt64(&total, int64(granted))
+		}()
+	}
+	wg.Wait()
+
+	if total != 5 {
+		t.Errorf("expected the limit of 5 to be granted in total but got %d", total)
+	}
+}
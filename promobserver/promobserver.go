@@ -0,0 +1,81 @@
+// Package promobserver offers a throttled.Observer exporting
+// Prometheus metrics.
+package promobserver // import "github.com/throttled/throttled/promobserver"
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of the result label.
+const (
+	ResultAllowed = "allowed"
+	ResultLimited = "limited"
+	ResultError   = "error"
+)
+
+// Observer is a throttled.Observer that counts rate limit decisions
+// by result and records their latency. It implements
+// prometheus.Collector and must be registered to be exported. Keys are
+// not used as labels since they usually have an unbounded cardinality.
+type Observer struct {
+	decisions *prometheus.CounterVec
+	latency   prometheus.Histogram
+}
+
+// New creates an Observer whose metrics are named with the given
+// namespace, which may be an empty string:
+//
+//	<namespace>_throttled_decisions_total{result="allowed|limited|error"}
+//	<namespace>_throttled_decision_duration_seconds
+func New(namespace string) *Observer {
+	o := &Observer{
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "throttled",
+			Name:      "decisions_total",
+			Help:      "Number of rate limit decisions by result.",
+		}, []string{"result"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "throttled",
+			Name:      "decision_duration_seconds",
+			Help:      "Time taken to make rate limit decisions, including store operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+	}
+
+	// Initialize the results so that they are exported before the
+	// first decision of each kind, which simplifies alerting on rates.
+	for _, result := range []string{ResultAllowed, ResultLimited, ResultError} {
+		o.decisions.WithLabelValues(result)
+	}
+
+	return o
+}
+
+// ObserveRateLimit implements throttled.Observer.
+func (o *Observer) ObserveRateLimit(key string, limited bool, latency time.Duration, err error) {
+	result := ResultAllowed
+	if err != nil {
+		result = ResultError
+	} else if limited {
+		result = ResultLimited
+	}
+
+	o.decisions.WithLabelValues(result).Inc()
+	o.latency.Observe(latency.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (o *Observer) Describe(ch chan<- *prometheus.Desc) {
+	o.decisions.Describe(ch)
+	o.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (o *Observer) Collect(ch chan<- prometheus.Metric) {
+	o.decisions.Collect(ch)
+	o.latency.Collect(ch)
+}
@@ -0,0 +1,67 @@
+package promobserver_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/promobserver"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+// Demonstrates how to export metrics about the decisions of a
+// GCRARateLimiter.
+func ExampleNew() {
+	store, err := memstore.New(65536)
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota{
+		MaxRate:  throttled.PerMin(20),
+		MaxBurst: 5,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	observer := promobserver.New("myapp")
+	prometheus.MustRegister(observer)
+	rateLimiter.SetObserver(observer)
+}
+
+func TestObserver(t *testing.T) {
+	o := promobserver.New("test")
+
+	o.ObserveRateLimit("foo", false, time.Millisecond, nil)
+	o.ObserveRateLimit("foo", true, time.Millisecond, nil)
+	o.ObserveRateLimit("foo", true, time.Millisecond, nil)
+	o.ObserveRateLimit("foo", false, time.Millisecond, errors.New("store down"))
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(o); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := testutil.GatherAndCount(reg, "test_throttled_decision_duration_seconds"); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected a latency histogram but got %d metrics", n)
+	}
+
+	expected := `
+# HELP test_throttled_decisions_total Number of rate limit decisions by result.
+# TYPE test_throttled_decisions_total counter
+test_throttled_decisions_total{result="allowed"} 1
+test_throttled_decisions_total{result="error"} 1
+test_throttled_decisions_total{result="limited"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "test_throttled_decisions_total"); err != nil {
+		t.Error(err)
+	}
+}
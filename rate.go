@@ -1,16 +1,38 @@
 package throttled
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"time"
 )
 
 const (
-	// Maximum number of times to retry SetIfNotExists/CompareAndSwap operations
-	// before returning an error.
-	maxCASAttempts = 10
+	// DefaultMaxCASAttempts is the number of times a GCRARateLimiter
+	// attempts SetIfNotExists/CompareAndSwap operations before
+	// returning ErrCASExhausted, unless changed with SetMaxCASAttempts.
+	DefaultMaxCASAttempts = 10
 )
 
+// ErrCASExhausted is returned by a GCRARateLimiter when it could not
+// update the store within the maximum number of attempts because of
+// concurrent updates to the same key. The request is neither permitted
+// nor denied, so callers should decide how to handle it.
+var ErrCASExhausted = errors.New("Failed to store updated rate limit data after the maximum number of attempts")
+
+// ErrInvalidQuantity is returned by the rate limiters for a negative
+// quantity, which would give back quota that was never charged.
+var ErrInvalidQuantity = errors.New("Invalid negative rate limit quantity")
+
+// ErrQuantityExceedsLimit is returned by a GCRARateLimiter for a
+// quantity greater than the Limit of its quota, which can never be
+// permitted, along with a limited decision and the state of the key as
+// for a quantity of 0, with a RetryAfter of -1.
+var ErrQuantityExceedsLimit = errors.New("Rate limit quantity exceeds the limit")
+
 // A RateLimiter manages limiting the rate of actions by key.
 type RateLimiter interface {
 	// RateLimit checks whether a particular key has exceeded a rate
@@ -26,6 +48,34 @@ type RateLimiter interface {
 	RateLimit(key string, quantity int) (bool, RateLimitResult, error)
 }
 
+// Refunder is an optional interface that a RateLimiter can implement
+// to give back a quantity previously charged with RateLimit.
+type Refunder interface {
+	// Refund restores up to quantity to key, never making more
+	// available than an unused key has.
+	Refund(key string, quantity int) error
+}
+
+// A RateLimiterCtx is a RateLimiter that also supports passing a
+// context.Context through to its underlying storage.
+type RateLimiterCtx interface {
+	RateLimiter
+
+	// RateLimitCtx is the context-aware version of RateLimit. The
+	// context is passed to any store operations so that they can be
+	// cancelled or bounded by a deadline.
+	RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error)
+}
+
+// rateLimitCtx calls rl.RateLimitCtx with ctx if rl implements
+// RateLimiterCtx, or else rl.RateLimit.
+func rateLimitCtx(ctx context.Context, rl RateLimiter, key string, quantity int) (bool, RateLimitResult, error) {
+	if lc, ok := rl.(RateLimiterCtx); ok {
+		return lc.RateLimitCtx(ctx, key, quantity)
+	}
+	return rl.RateLimit(key, quantity)
+}
+
 // RateLimitResult represents the state of the RateLimiter for a
 // given key at the time of the query. This state can be used, for
 // example, to communicate information to the client via HTTP
@@ -49,7 +99,9 @@ type RateLimitResult struct {
 	// initial state for a given key. For example, if a rate limiter
 	// manages requests per second and received one request 200ms ago,
 	// Reset would return 800ms. You can also think of this as the time
-	// until Limit and Remaining will be equal.
+	// until Limit and Remaining will be equal, that is until the whole
+	// burst is available again, as opposed to RetryAfter which only
+	// waits for a single request.
 	ResetAfter time.Duration
 
 	// RetryAfter is the time until the next request will be permitted.
@@ -57,6 +109,74 @@ type RateLimitResult struct {
 	RetryAfter time.Duration
 }
 
+// rateLimitResultJSON is the JSON encoding of a RateLimitResult.
+type rateLimitResultJSON struct {
+	Limit        int   `json:"limit"`
+	Remaining    int   `json:"remaining"`
+	ResetAfterMS int64 `json:"reset_after_ms"`
+	RetryAfterMS int64 `json:"retry_after_ms"`
+}
+
+// MarshalJSON encodes r as an object with the fields limit,
+// remaining, reset_after_ms and retry_after_ms. The durations are
+// integer milliseconds, rounded up so that a client waiting for them
+// never retries too early. A negative duration, such as the RetryAfter
+// of a request that wasn't limited, is encoded as -1, as are the
+// negative Limit and Remaining of a limiter that doesn't report them.
+func (r RateLimitResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rateLimitResultJSON{
+		Limit:        unsetIfNegative(r.Limit),
+		Remaining:    unsetIfNegative(r.Remaining),
+		ResetAfterMS: durationToMS(r.ResetAfter),
+		RetryAfterMS: durationToMS(r.RetryAfter),
+	})
+}
+
+// UnmarshalJSON decodes r from the encoding of MarshalJSON. A negative
+// duration is decoded as -1 like the unset durations of a
+// RateLimitResult, so that the encoding round-trips.
+func (r *RateLimitResult) UnmarshalJSON(b []byte) error {
+	var v rateLimitResultJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = RateLimitResult{
+		Limit:      unsetIfNegative(v.Limit),
+		Remaining:  unsetIfNegative(v.Remaining),
+		ResetAfter: msToDuration(v.ResetAfterMS),
+		RetryAfter: msToDuration(v.RetryAfterMS),
+	}
+	return nil
+}
+
+func unsetIfNegative(n int) int {
+	if n < 0 {
+		return -1
+	}
+	return n
+}
+
+func durationToMS(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	ms := int64(d / time.Millisecond)
+	if d%time.Millisecond != 0 {
+		ms++
+	}
+	return ms
+}
+
+func msToDuration(ms int64) time.Duration {
+	if ms < 0 {
+		return -1
+	}
+	if ms > int64(math.MaxInt64/time.Millisecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type limitResult struct {
 	limited bool
 }
@@ -109,6 +229,68 @@ type RateQuota struct {
 	MaxBurst int
 }
 
+// Validate returns an error describing why quota can't be used by a
+// rate limiter, or nil. MaxRate must have been created by one of the
+// Per functions with a count small enough for its period not to round
+// down to zero, such as PerSec(1) but not the zero Rate, and MaxBurst
+// must be greater than or equal to zero. The burst is also rejected if
+// the time taken to emit it at MaxRate doesn't fit in a time.Duration.
+func (q RateQuota) Validate() error {
+	if q.MaxRate.period <= 0 {
+		return fmt.Errorf("Invalid RateQuota %#v. MaxRate must be greater than zero; use PerSec, PerMin, PerHour, PerDay or PerDuration to create it.", q)
+	}
+	if q.MaxBurst < 0 {
+		return fmt.Errorf("Invalid RateQuota %#v. MaxBurst must be greater than or equal to zero.", q)
+	}
+	if time.Duration(q.MaxBurst) >= math.MaxInt64/q.MaxRate.period {
+		return fmt.Errorf("Invalid RateQuota %#v. MaxBurst is too large for MaxRate; the burst would take longer than %s to emit.", q, time.Duration(math.MaxInt64))
+	}
+	return nil
+}
+
+// Scale returns a copy of q whose sustained rate and burst are
+// multiplied by factor, for example 1.5 to allow 50% more requests
+// during an incident. The burst is scaled so that the number of
+// requests permitted at once, MaxBurst+1, is multiplied by factor and
+// rounded down, but at least one request is always permitted. A factor
+// that isn't positive, or so large that the interval between requests
+// rounds down to zero, gives a quota rejected by Validate.
+func (q RateQuota) Scale(factor float64) RateQuota {
+	if !(factor > 0) || q.MaxRate.period <= 0 {
+		return RateQuota{MaxBurst: q.MaxBurst}
+	}
+
+	period := math.Min(float64(q.MaxRate.period)/factor, math.MaxInt64)
+	count := math.Max(math.Floor(float64(q.MaxRate.count)*factor), 1)
+	burst := math.Floor(float64(q.MaxBurst+1)*factor) - 1
+	if burst < 0 {
+		burst = 0
+	}
+
+	return RateQuota{
+		MaxRate:  Rate{period: time.Duration(period), count: int(math.Min(count, math.MaxInt32))},
+		MaxBurst: int(math.Min(burst, math.MaxInt32)),
+	}
+}
+
+// WithBurst returns a copy of q with a MaxBurst of n.
+func (q RateQuota) WithBurst(n int) RateQuota {
+	q.MaxBurst = n
+	return q
+}
+
+// NewRateQuota creates a RateQuota with the sustained rate rate and a
+// MaxBurst permitting one period's worth of requests at once. For
+// example, NewRateQuota(PerDuration(150, 5*time.Minute)) permits 150
+// requests in a burst followed by one every two seconds.
+func NewRateQuota(rate Rate) RateQuota {
+	burst := rate.count - 1
+	if burst < 0 {
+		burst = 0
+	}
+	return RateQuota{MaxRate: rate, MaxBurst: burst}
+}
+
 // PerSec represents a number of requests per second.
 func PerSec(n int) Rate { return Rate{time.Second / time.Duration(n), n} }
 
@@ -121,11 +303,37 @@ func PerHour(n int) Rate { return Rate{time.Hour / time.Duration(n), n} }
 // PerDay represents a number of requests per day.
 func PerDay(n int) Rate { return Rate{24 * time.Hour / time.Duration(n), n} }
 
+// PerDuration represents a number of requests per arbitrary period,
+// such as PerDuration(150, 5*time.Minute). If n or d isn't positive,
+// it returns the zero Rate, which NewGCRARateLimiter rejects.
+func PerDuration(n int, d time.Duration) Rate {
+	if n <= 0 || d <= 0 {
+		return Rate{}
+	}
+	return Rate{d / time.Duration(n), n}
+}
+
 // GCRARateLimiter is a RateLimiter that users the generic cell-rate
 // algorithm. The algorithm has been slightly modified from its usual
 // form to support limiting with an additional quantity parameter, such
 // as for limiting the number of bytes uploaded.
 type GCRARateLimiter struct {
+	gcra
+
+	store    GCRAStore
+	storeCtx GCRAStoreCtx
+
+	clock    func() time.Time
+	observer Observer
+
+	maxCASAttempts int
+	casBackoff     time.Duration
+	retryJitter    time.Duration
+	ttlPadding     time.Duration
+}
+
+// gcra holds the parameters of the algorithm derived from a RateQuota.
+type gcra struct {
 	limit int
 
 	// Think of the DVT as our flexibility:
@@ -137,8 +345,71 @@ type GCRARateLimiter struct {
 	// in the nominal equally spaced schedule. If you like leaky buckets,
 	// think of it as how frequently the bucket leaks one unit.
 	emissionInterval time.Duration
+}
 
-	store GCRAStore
+// A gcraDecision is the outcome of applying a quantity to the state of
+// a key.
+type gcraDecision struct {
+	limited bool
+
+	// newTat is the value to store for the key if it isn't limited.
+	newTat time.Time
+	ttl    time.Duration
+
+	result RateLimitResult
+}
+
+// decide applies quantity to a key whose stored value is tatVal, or -1
+// if it doesn't exist, at the time now.
+func (p *gcra) decide(tatVal int64, now time.Time, quantity int) gcraDecision {
+	var tat, newTat time.Time
+	d := gcraDecision{result: RateLimitResult{Limit: p.limit, RetryAfter: -1}}
+
+	// tat refers to the theoretical arrival time that would be expected
+	// from equally spaced requests at exactly the rate limit.
+	if tatVal == -1 {
+		tat = now
+	} else {
+		tat = time.Unix(0, tatVal)
+	}
+
+	increment := p.increment(quantity)
+	if now.After(tat) {
+		newTat = now.Add(increment)
+	} else {
+		newTat = tat.Add(increment)
+	}
+	d.newTat = newTat
+
+	// Block the request if the next permitted time is in the future
+	allowAt := newTat.Add(-(p.delayVariationTolerance))
+	if diff := now.Sub(allowAt); diff < 0 {
+		if increment <= p.delayVariationTolerance {
+			d.result.RetryAfter = -diff
+		}
+		d.ttl = tat.Sub(now)
+		d.limited = true
+	} else {
+		d.ttl = newTat.Sub(now)
+	}
+
+	next := p.delayVariationTolerance - d.ttl
+	if next > -p.emissionInterval {
+		d.result.Remaining = int(next / p.emissionInterval)
+	}
+	d.result.ResetAfter = d.ttl
+
+	return d
+}
+
+// increment returns the time taken to emit quantity requests at the
+// emission interval, capped to the largest time.Duration instead of
+// overflowing for very large quantities.
+func (p *gcra) increment(quantity int) time.Duration {
+	if quantity > 0 && time.Duration(quantity) > math.MaxInt64/p.emissionInterval {
+		return math.MaxInt64
+	}
+	return time.Duration(quantity) * p.emissionInterval
 }
 
 // NewGCRARateLimiter creates a GCRARateLimiter. quota.Count defines
@@ -148,21 +419,55 @@ type GCRARateLimiter struct {
 // followed by one request per second indefinitely whereas PerSec(1)
 // only permits one request per second with no tolerance for bursts.
 func NewGCRARateLimiter(st GCRAStore, quota RateQuota) (*GCRARateLimiter, error) {
-	if quota.MaxBurst < 0 {
-		return nil, fmt.Errorf("Invalid RateQuota %#v. MaxBurst must be greater than zero.", quota)
-	}
-	if quota.MaxRate.period <= 0 {
-		return nil, fmt.Errorf("Invalid RateQuota %#v. MaxRate must be greater than zero.", quota)
+	p, err := newGCRA(quota)
+	if err != nil {
+		return nil, err
 	}
 
 	return &GCRARateLimiter{
+		gcra:     p,
+		store:    st,
+		storeCtx: WrapStoreWithContext(st),
+	}, nil
+}
+
+// newGCRA validates quota and computes the parameters it implies.
+func newGCRA(quota RateQuota) (gcra, error) {
+	if err := quota.Validate(); err != nil {
+		return gcra{}, err
+	}
+
+	return gcra{
 		delayVariationTolerance: quota.MaxRate.period * (time.Duration(quota.MaxBurst) + 1),
 		emissionInterval:        quota.MaxRate.period,
 		limit:                   quota.MaxBurst + 1,
-		store:                   st,
 	}, nil
 }
 
+// SetClock sets the function used to get the current time when the
+// store doesn't provide an authoritative one, which makes it possible
+// to control time in tests or to correct for a known clock skew. The
+// store's time takes precedence unless the store implements
+// LocalClockStore and reports that it uses the local clock, as the
+// in-memory store does. A nil clock restores the default behavior of
+// always using the store's time. SetClock must not be called
+// concurrently with other methods of the limiter.
+func (g *GCRARateLimiter) SetClock(clock func() time.Time) {
+	g.clock = clock
+}
+
+// now returns the time to use for a decision given the time returned
+// by the store.
+func (g *GCRARateLimiter) now(storeTime time.Time) time.Time {
+	if g.clock == nil {
+		return storeTime
+	}
+	if lc, ok := g.store.(LocalClockStore); ok && lc.UsesLocalClock() {
+		return g.clock()
+	}
+	return storeTime
+}
+
 // RateLimit checks whether a particular key has exceeded a rate
 // limit. It also returns a RateLimitResult to provide additional
 // information about the state of the RateLimiter.
@@ -173,78 +478,495 @@ func NewGCRARateLimiter(st GCRAStore, quota RateQuota) (*GCRARateLimiter, error)
 // quantity could rate limit based on the size of a file upload in
 // megabytes. If quantity is 0, no update is performed allowing you
 // to "peek" at the state of the RateLimiter for a given key.
+//
+// A negative quantity returns an error wrapping ErrInvalidQuantity. A
+// quantity greater than the Limit of the quota can never be permitted,
+// so it is limited without updating the store and returns
+// ErrQuantityExceedsLimit.
 func (g *GCRARateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
-	var tat, newTat, now time.Time
-	var ttl time.Duration
-	rlc := RateLimitResult{Limit: g.limit, RetryAfter: -1}
-	limited := false
+	return g.RateLimitCtx(context.Background(), key, quantity)
+}
 
-	i := 0
-	for {
-		var err error
-		var tatVal int64
-		var updated bool
+// RateLimitCtx is the context-aware version of RateLimit. If the
+// store implements GCRAStoreCtx, ctx is passed to each of its
+// operations so that they can be cancelled or bounded by a deadline.
+// Otherwise ctx is only checked before each attempt to update the
+// store.
+//
+// If the store implements GCRAAtomicStore, the decision is made in a
+// single store operation with no retries, unless the store uses the
+// local clock and a clock was set with SetClock.
+func (g *GCRARateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	return g.rateLimit(ctx, &g.gcra, key, quantity, nil)
+}
+
+// RateLimitWithQuota is like RateLimit but applies quota to key in
+// place of the quota the limiter was created with. This allows a
+// single limiter to serve keys on different plans, looking up each
+// caller's quota at request time.
+//
+// The store only records the key's theoretical arrival time, which
+// doesn't depend on the quota, so a key can switch quotas between
+// calls. The backlog accumulated under the previous quota carries
+// over: the key is limited until it drains within the burst of the
+// new quota.
+func (g *GCRARateLimiter) RateLimitWithQuota(key string, quantity int, quota RateQuota) (bool, RateLimitResult, error) {
+	return g.RateLimitWithQuotaCtx(context.Background(), key, quantity, quota)
+}
+
+// RateLimitWithQuotaCtx is the context-aware version of
+// RateLimitWithQuota, passing ctx as RateLimitCtx does.
+func (g *GCRARateLimiter) RateLimitWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) (bool, RateLimitResult, error) {
+	p, err := newGCRA(quota)
+	if err != nil {
+		return false, RateLimitResult{Limit: quota.MaxBurst + 1, RetryAfter: -1}, err
+	}
+	return g.rateLimit(ctx, &p, key, quantity, nil)
+}
+
+// GCRADebugInfo describes the internal state behind a decision of a
+// GCRARateLimiter. It is only meant to help understand and tune a
+// limiter: its fields are implementation details of the algorithm and
+// may change or disappear in any release.
+type GCRADebugInfo struct {
+	// Now is the time at which the decision was made.
+	Now time.Time
+
+	// StoredTAT is the theoretical arrival time read from the store, or
+	// the zero time if the key did not exist. It may be in the past.
+	StoredTAT time.Time
+
+	// NewTAT is the theoretical arrival time that was stored if the
+	// request was permitted, or that would have been otherwise.
+	NewTAT time.Time
+
+	// EmissionInterval is the time between requests at the sustained
+	// rate.
+	EmissionInterval time.Duration
+
+	// DelayVariationTolerance is how far ahead of Now the theoretical
+	// arrival time may get before requests are limited.
+	DelayVariationTolerance time.Duration
+}
+
+// DebugRateLimit is like RateLimit but also returns the internal state
+// used to make the decision. It is intended for debugging only.
+func (g *GCRARateLimiter) DebugRateLimit(key string, quantity int) (bool, RateLimitResult, GCRADebugInfo, error) {
+	var info GCRADebugInfo
+	limited, rlc, err := g.rateLimit(context.Background(), &g.gcra, key, quantity, &info)
+	return limited, rlc, info, err
+}
+
+// SetMaxCASAttempts sets the number of times the limiter attempts to
+// update the store when a concurrent update to the same key makes its
+// SetIfNotExists or CompareAndSwap operation fail, after which it
+// returns ErrCASExhausted. It defaults to DefaultMaxCASAttempts, and
+// values lower than 1 restore the default.
+//
+// Every GCRAStore update is a compare-and-swap of the value read at
+// the start of the attempt, so even stores swapping atomically in a
+// script, like the Redis ones, fail when another client updated the
+// key in between. Attempts only run out when many clients update the
+// same key at once. SetMaxCASAttempts must not be called concurrently
+// with other methods of the limiter.
+func (g *GCRARateLimiter) SetMaxCASAttempts(attempts int) {
+	g.maxCASAttempts = attempts
+}
+
+// SetCASBackoff sets the base of the exponential backoff between
+// attempts to update the store. Before retry n, the limiter sleeps for
+// a random duration of up to backoff * 2^(n-1), which spreads out
+// clients contending for a hot key. The default of 0 retries
+// immediately. RateLimitCtx stops sleeping when its context is done.
+// SetCASBackoff must not be called concurrently with other methods of
+// the limiter.
+func (g *GCRARateLimiter) SetCASBackoff(backoff time.Duration) {
+	g.casBackoff = backoff
+}
+
+// retry waits before retry i of an update and reports whether it
+// should be attempted.
+func (g *GCRARateLimiter) retry(ctx context.Context, i int) bool {
+	attempts := g.maxCASAttempts
+	if attempts < 1 {
+		attempts = DefaultMaxCASAttempts
+	}
+	if i >= attempts {
+		return false
+	}
+
+	if g.casBackoff <= 0 {
+		return true
+	}
 
-		// tat refers to the theoretical arrival time that would be expected
-		// from equally spaced requests at exactly the rate limit.
-		tatVal, now, err = g.store.GetWithTime(key)
+	max := g.casBackoff << uint(i-1)
+	if max <= 0 || max > time.Second {
+		max = time.Second
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(max)) + 1))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// SetRetryAfterJitter sets the maximum of a random duration added to
+// the RetryAfter of limited results, so that clients limited at the
+// same time don't all retry at the same instant. Each result gets its
+// own random duration between 0 and jitter. Only the advertised
+// RetryAfter changes: a client retrying before the unjittered time is
+// still limited. The default of 0 disables jitter.
+// SetRetryAfterJitter must not be called concurrently with other
+// methods of the limiter.
+func (g *GCRARateLimiter) SetRetryAfterJitter(jitter time.Duration) {
+	g.retryJitter = jitter
+}
+
+// jitter adds a random duration to the RetryAfter of result as
+// configured by SetRetryAfterJitter.
+func (g *GCRARateLimiter) jitter(result RateLimitResult) RateLimitResult {
+	if g.retryJitter > 0 && result.RetryAfter >= 0 {
+		result.RetryAfter += time.Duration(rand.Int63n(int64(g.retryJitter) + 1))
+	}
+	return result
+}
+
+// SetTTLPadding sets a duration added to the TTL of every key written
+// to the store, beyond the theoretical arrival time the key holds.
+// Stores that round TTLs down, such as cassandrastore which rounds them
+// to the second, may otherwise expire a key before its bucket has
+// drained, giving the client back its burst slightly early. A padding
+// of at least the rounding unit prevents it at the cost of keeping
+// keys in the store that much longer, which matters for stores
+// holding many keys. It doesn't apply to a GCRAAtomicStore, which
+// sets TTLs itself. The default is 0. SetTTLPadding must not be called
+// concurrently with other methods of the limiter.
+func (g *GCRARateLimiter) SetTTLPadding(padding time.Duration) {
+	g.ttlPadding = padding
+}
+
+// storeTTL returns the TTL to store a key expiring after ttl with.
+func (g *GCRARateLimiter) storeTTL(ttl time.Duration) time.Duration {
+	return ttl + g.ttlPadding
+}
+
+// SetObserver sets an Observer to be notified of every decision made
+// by RateLimit, RateLimitCtx, RateLimitWithQuota and DebugRateLimit.
+// A nil observer, the default, disables notifications. SetObserver
+// must not be called concurrently with other methods of the limiter.
+func (g *GCRARateLimiter) SetObserver(observer Observer) {
+	g.observer = observer
+}
+
+// atomicStore returns the store as a GCRAAtomicStore if it implements
+// it and its time isn't overridden by the limiter's clock.
+func (g *GCRARateLimiter) atomicStore() (GCRAAtomicStore, bool) {
+	as, ok := g.store.(GCRAAtomicStore)
+	if !ok {
+		return nil, false
+	}
+	if lc, isLocal := g.store.(LocalClockStore); g.clock != nil && isLocal && lc.UsesLocalClock() {
+		return nil, false
+	}
+	return as, true
+}
+
+// rateLimit implements RateLimitCtx with the parameters p and notifies
+// the observer, if any. If info is not nil it is filled in with the
+// state behind the last attempt.
+func (g *GCRARateLimiter) rateLimit(ctx context.Context, p *gcra, key string, quantity int, info *GCRADebugInfo) (bool, RateLimitResult, error) {
+	if g.observer == nil {
+		limited, rlc, err := g.rateLimitUnobserved(ctx, p, key, quantity, info)
+		return limited, g.jitter(rlc), err
+	}
+
+	start := time.Now()
+	limited, rlc, err := g.rateLimitUnobserved(ctx, p, key, quantity, info)
+	g.observer.ObserveRateLimit(key, limited, time.Since(start), err)
+
+	return limited, g.jitter(rlc), err
+}
+
+// checkQuantity returns an error wrapping ErrInvalidQuantity if
+// quantity is negative, or ErrQuantityExceedsLimit if it is greater
+// than limit. Callers treat a quantity of 0 as read-only.
+func checkQuantity(quantity, limit int) error {
+	if quantity < 0 {
+		return fmt.Errorf("%w %d", ErrInvalidQuantity, quantity)
+	}
+	if quantity > limit {
+		return ErrQuantityExceedsLimit
+	}
+	return nil
+}
+
+func (g *GCRARateLimiter) rateLimitUnobserved(ctx context.Context, p *gcra, key string, quantity int, info *GCRADebugInfo) (bool, RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+
+	switch err := checkQuantity(quantity, p.limit); err {
+	case nil:
+	case ErrQuantityExceedsLimit:
+		_, rlc, err := g.peekUnobserved(ctx, p, key, info)
 		if err != nil {
 			return false, rlc, err
 		}
+		return true, rlc, ErrQuantityExceedsLimit
+	default:
+		return false, rlc, err
+	}
+	if quantity == 0 {
+		return g.peekUnobserved(ctx, p, key, info)
+	}
 
-		if tatVal == -1 {
-			tat = now
-		} else {
-			tat = time.Unix(0, tatVal)
+	if as, ok := g.atomicStore(); ok {
+		if err := ctx.Err(); err != nil {
+			return false, rlc, err
 		}
 
-		increment := time.Duration(quantity) * g.emissionInterval
-		if now.After(tat) {
-			newTat = now.Add(increment)
-		} else {
-			newTat = tat.Add(increment)
+		tatVal, now, err := as.RateLimitAtomic(ctx, key, quantity, p.emissionInterval, p.delayVariationTolerance)
+		if err != nil {
+			return false, rlc, err
+		}
+
+		// The store applied the same decision, so only the result needs
+		// to be computed.
+		d := p.decide(tatVal, now, quantity)
+		p.fillDebugInfo(info, tatVal, now, d)
+		return d.limited, d.result, nil
+	}
+
+	i := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, rlc, err
 		}
 
-		// Block the request if the next permitted time is in the future
-		allowAt := newTat.Add(-(g.delayVariationTolerance))
-		if diff := now.Sub(allowAt); diff < 0 {
-			if increment <= g.delayVariationTolerance {
-				rlc.RetryAfter = -diff
-			}
-			ttl = tat.Sub(now)
-			limited = true
-			break
+		attemptCtx := ctx
+		if i > 0 {
+			attemptCtx = context.WithValue(ctx, retryKey{}, i)
+		}
+
+		tatVal, now, err := g.storeCtx.GetWithTimeCtx(attemptCtx, key)
+		if err != nil {
+			return false, rlc, err
 		}
+		now = g.now(now)
 
-		ttl = newTat.Sub(now)
+		d := p.decide(tatVal, now, quantity)
+		p.fillDebugInfo(info, tatVal, now, d)
+		if d.limited {
+			return true, d.result, nil
+		}
 
+		var updated bool
 		if tatVal == -1 {
-			updated, err = g.store.SetIfNotExistsWithTTL(key, newTat.UnixNano(), ttl)
+			updated, err = g.storeCtx.SetIfNotExistsWithTTLCtx(attemptCtx, key, d.newTat.UnixNano(), g.storeTTL(d.ttl))
 		} else {
-			updated, err = g.store.CompareAndSwapWithTTL(key, tatVal, newTat.UnixNano(), ttl)
+			updated, err = g.storeCtx.CompareAndSwapWithTTLCtx(attemptCtx, key, tatVal, d.newTat.UnixNano(), g.storeTTL(d.ttl))
 		}
 
 		if err != nil {
 			return false, rlc, err
 		}
 		if updated {
-			break
+			return false, d.result, nil
+		}
+
+		i++
+		if !g.retry(ctx, i) {
+			return false, rlc, ErrCASExhausted
+		}
+	}
+}
+
+// peekUnobserved makes the decision for a quantity of 0, which never
+// updates the store.
+func (g *GCRARateLimiter) peekUnobserved(ctx context.Context, p *gcra, key string, info *GCRADebugInfo) (bool, RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
+	if err := ctx.Err(); err != nil {
+		return false, rlc, err
+	}
+
+	tatVal, now, err := g.storeCtx.GetWithTimeCtx(ctx, key)
+	if err != nil {
+		return false, rlc, err
+	}
+	now = g.now(now)
+
+	d := p.decide(tatVal, now, 0)
+	p.fillDebugInfo(info, tatVal, now, d)
+	return d.limited, d.result, nil
+}
+
+// fillDebugInfo sets info, if not nil, to describe the decision d.
+func (p *gcra) fillDebugInfo(info *GCRADebugInfo, tatVal int64, now time.Time, d gcraDecision) {
+	if info == nil {
+		return
+	}
+
+	*info = GCRADebugInfo{
+		Now:                     now,
+		NewTAT:                  d.newTat,
+		EmissionInterval:        p.emissionInterval,
+		DelayVariationTolerance: p.delayVariationTolerance,
+	}
+	if tatVal != -1 {
+		info.StoredTAT = time.Unix(0, tatVal)
+	}
+}
+
+type retryKey struct{}
+
+// RetryFromContext returns the number of times a GCRARateLimiter has
+// already tried and failed to update the store because of concurrent
+// changes, when called with the context passed to a GCRAStoreCtx
+// during RateLimitCtx. It returns 0 for the first attempt or for any
+// other context. This lets store wrappers report contention.
+func RetryFromContext(ctx context.Context) int {
+	i, _ := ctx.Value(retryKey{}).(int)
+	return i
+}
+
+// ResetRateLimit forgets the state of key, so that the next call to
+// RateLimit behaves as if the key had never been limited and has the
+// full burst available. This is useful to manually lift a limit or to
+// isolate test cases. The store must implement Resetter.
+func (g *GCRARateLimiter) ResetRateLimit(key string) error {
+	rs, ok := g.store.(Resetter)
+	if !ok {
+		return fmt.Errorf("Store %T does not support resetting keys", g.store)
+	}
+	return rs.Reset(key)
+}
+
+// Refund gives quantity back to key, as if that much of the quantities
+// charged by earlier calls to RateLimit hadn't been. The key never
+// gets more than its full burst back. This suits requests that were
+// permitted but failed before doing any work, such as when the client
+// disconnects. The theoretical arrival time is moved back with a
+// compare-and-swap, retried as by RateLimit, so concurrent refunds and
+// charges are never lost.
+func (g *GCRARateLimiter) Refund(key string, quantity int) error {
+	return g.refund(context.Background(), &g.gcra, key, quantity)
+}
+
+// RefundCtx is the context-aware version of Refund, passing ctx as
+// RateLimitCtx does.
+func (g *GCRARateLimiter) RefundCtx(ctx context.Context, key string, quantity int) error {
+	return g.refund(ctx, &g.gcra, key, quantity)
+}
+
+// RefundWithQuotaCtx is like RefundCtx but gives quantity back under
+// quota in place of the quota the limiter was created with, for keys
+// charged by RateLimitWithQuota.
+func (g *GCRARateLimiter) RefundWithQuotaCtx(ctx context.Context, key string, quantity int, quota RateQuota) error {
+	p, err := newGCRA(quota)
+	if err != nil {
+		return err
+	}
+	return g.refund(ctx, &p, key, quantity)
+}
+
+func (g *GCRARateLimiter) refund(ctx context.Context, p *gcra, key string, quantity int) error {
+	if err := checkQuantity(quantity, p.limit); err != nil && err != ErrQuantityExceedsLimit {
+		return err
+	}
+
+	i := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tatVal, now, err := g.storeCtx.GetWithTimeCtx(ctx, key)
+		if err != nil {
+			return err
+		}
+		now = g.now(now)
+
+		tat := time.Unix(0, tatVal)
+		if tatVal == -1 || !tat.After(now) {
+			return nil
+		}
+
+		newTat := tat.Add(-p.increment(quantity))
+		if newTat.Before(now) {
+			newTat = now
+		}
+		// A theoretical arrival time of now is equivalent to a missing
+		// key, so it may expire at any time.
+		ttl := newTat.Sub(now)
+		if ttl <= 0 {
+			ttl = p.emissionInterval
+		}
+
+		updated, err := g.storeCtx.CompareAndSwapWithTTLCtx(ctx, key, tatVal, newTat.UnixNano(), g.storeTTL(ttl))
+		if err != nil || updated {
+			return err
 		}
 
 		i++
-		if i > maxCASAttempts {
-			return false, rlc, fmt.Errorf(
-				"Failed to store updated rate limit data for key %s after %d attempts",
-				key, i,
-			)
+		if !g.retry(ctx, i) {
+			return ErrCASExhausted
 		}
 	}
+}
+
+// Peek returns the state of the RateLimiter for key without
+// consuming any quantity. Like RateLimit with a quantity of 0, Peek
+// only reads from the store, which makes it suitable for status
+// endpoints and other displays of the remaining budget, but it also
+// reports when the next request would be permitted. A key that has
+// never been limited reports the full limit as remaining. RetryAfter
+// is the time until a request with a quantity of 1 would be permitted,
+// or -1 if it would be permitted now.
+func (g *GCRARateLimiter) Peek(key string) (RateLimitResult, error) {
+	return g.peek(&g.gcra, key)
+}
+
+// PeekWithQuota is like Peek but reports the state of key under quota
+// in place of the quota the limiter was created with, as
+// RateLimitWithQuota does.
+func (g *GCRARateLimiter) PeekWithQuota(key string, quota RateQuota) (RateLimitResult, error) {
+	p, err := newGCRA(quota)
+	if err != nil {
+		return RateLimitResult{Limit: quota.MaxBurst + 1, RetryAfter: -1}, err
+	}
+	return g.peek(&p, key)
+}
+
+// peek implements Peek with the parameters p.
+func (g *GCRARateLimiter) peek(p *gcra, key string) (RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: p.limit, RetryAfter: -1}
 
-	next := g.delayVariationTolerance - ttl
-	if next > -g.emissionInterval {
-		rlc.Remaining = int(next / g.emissionInterval)
+	tatVal, now, err := g.store.GetWithTime(key)
+	if err != nil {
+		return rlc, err
+	}
+	now = g.now(now)
+
+	tat := now
+	if tatVal != -1 {
+		if t := time.Unix(0, tatVal); t.After(now) {
+			tat = t
+		}
+	}
+
+	ttl := tat.Sub(now)
+	next := p.delayVariationTolerance - ttl
+	if next > -p.emissionInterval {
+		rlc.Remaining = int(next / p.emissionInterval)
 	}
 	rlc.ResetAfter = ttl
 
-	return limited, rlc, nil
+	allowAt := tat.Add(p.emissionInterval - p.delayVariationTolerance)
+	if diff := now.Sub(allowAt); diff < 0 {
+		rlc.RetryAfter = -diff
+	}
+
+	return rlc, nil
 }
@@ -1,6 +1,12 @@
 package throttled_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
 	"testing"
 	"time"
 
@@ -15,6 +21,7 @@ type testStore struct {
 
 	clock       time.Time
 	failUpdates bool
+	updates     int
 }
 
 func (ts *testStore) GetWithTime(key string) (int64, time.Time, error) {
@@ -23,6 +30,7 @@ func (ts *testStore) GetWithTime(key string) (int64, time.Time, error) {
 }
 
 func (ts *testStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	ts.updates++
 	if ts.failUpdates {
 		return false, nil
 	}
@@ -30,6 +38,7 @@ func (ts *testStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Dur
 }
 
 func (ts *testStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	ts.updates++
 	if ts.failUpdates {
 		return false, nil
 	}
@@ -84,6 +93,9 @@ func TestRateLimit(t *testing.T) {
 		st.clock = c.now
 
 		limited, context, err := rl.RateLimit("foo", c.volume)
+		if c.volume > limit && errors.Is(err, throttled.ErrQuantityExceedsLimit) {
+			err = nil
+		}
 		if err != nil {
 			t.Fatalf("%d: %#v", i, err)
 		}
@@ -110,6 +122,159 @@ func TestRateLimit(t *testing.T) {
 	}
 }
 
+func TestRateLimitQuantity(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 4}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(1000, 0)}
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		quantity, remaining int
+		limited             bool
+		err                 error
+		updates             int
+	}{
+		0: {1, 4, false, nil, 1},
+		// A quantity of 0 only reads the store
+		1: {0, 4, false, nil, 0},
+		2: {-1, 0, false, throttled.ErrInvalidQuantity, 0},
+		// A quantity that fits in the limit but not in what remains
+		3: {5, 4, true, nil, 0},
+		// A quantity that can never be permitted
+		4: {6, 4, true, throttled.ErrQuantityExceedsLimit, 0},
+		5: {4, 0, false, nil, 1},
+	}
+
+	for i, c := range cases {
+		st.updates = 0
+		limited, result, err := rl.RateLimit("foo", c.quantity)
+		if !errors.Is(err, c.err) || (c.err == nil && err != nil) {
+			t.Errorf("%d: expected error %v but got %v", i, c.err, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected limited to be %t but got %t", i, c.limited, limited)
+		}
+		if result.Limit != 5 || result.Remaining != c.remaining {
+			t.Errorf("%d: expected %d of 5 remaining but got %d of %d", i, c.remaining, result.Remaining, result.Limit)
+		}
+		if c.err != nil && result.RetryAfter != -1 {
+			t.Errorf("%d: expected a RetryAfter of -1 but got %s", i, result.RetryAfter)
+		}
+		if st.updates != c.updates {
+			t.Errorf("%d: expected %d updates of the store but got %d", i, c.updates, st.updates)
+		}
+	}
+}
+
+func TestRateLimitQuantityEntryPoints(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(1000, 0)}
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := throttled.NewMultiQuotaRateLimiter(&st, []throttled.RateQuota{rq, {MaxRate: throttled.PerHour(1), MaxBurst: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each entry point charges quantity against key and reports
+	// whether it was limited
+	apis := []struct {
+		name string
+		fn   func(key string, quantity int) (bool, error)
+	}{
+		{"RateLimit", func(key string, quantity int) (bool, error) {
+			limited, _, err := rl.RateLimit(key, quantity)
+			return limited, err
+		}},
+		{"RateLimitBatch", func(key string, quantity int) (bool, error) {
+			_, limited, err := rl.RateLimitBatch([]string{key, key + "-other"}, quantity)
+			return limited, err
+		}},
+		{"MultiQuotaRateLimiter", func(key string, quantity int) (bool, error) {
+			limited, _, err := mq.RateLimit(key, quantity)
+			return limited, err
+		}},
+		{"RateLimitPartial", func(key string, quantity int) (bool, error) {
+			granted, _, err := rl.RateLimitPartial(key, quantity)
+			return granted < quantity, err
+		}},
+	}
+
+	cases := []struct {
+		quantity int
+		limited  bool
+		err      error
+		partial  error // The error of RateLimitPartial, which grants what it can
+	}{
+		0: {-5, false, throttled.ErrInvalidQuantity, throttled.ErrInvalidQuantity},
+		// A quantity of 0 neither writes nor creates the key
+		1: {0, false, nil, nil},
+		2: {3, true, throttled.ErrQuantityExceedsLimit, nil},
+	}
+
+	for _, api := range apis {
+		for i, c := range cases {
+			for _, exhausted := range []bool{false, true} {
+				key := fmt.Sprintf("%s-%d-%t", api.name, i, exhausted)
+				if exhausted {
+					if _, err := api.fn(key, 2); err != nil {
+						t.Fatalf("%s %d: %v", api.name, i, err)
+					}
+				}
+
+				want := c.err
+				if api.name == "RateLimitPartial" {
+					want = c.partial
+				}
+
+				st.updates = 0
+				limited, err := api.fn(key, c.quantity)
+				if !errors.Is(err, want) || (want == nil && err != nil) {
+					t.Errorf("%s %d: expected error %v but got %v", api.name, i, want, err)
+				}
+				if want != nil && limited != c.limited {
+					t.Errorf("%s %d: expected limited to be %t but got %t", api.name, i, c.limited, limited)
+				}
+				if want != nil || c.quantity == 0 {
+					if st.updates != 0 {
+						t.Errorf("%s %d: expected no update of the store but got %d", api.name, i, st.updates)
+					}
+				}
+				if v, _, err := mst.GetWithTime(key); err != nil {
+					t.Fatal(err)
+				} else if !exhausted && c.quantity == 0 && v != -1 {
+					t.Errorf("%s %d: expected a quantity of 0 not to create the key", api.name, i)
+				}
+			}
+		}
+	}
+
+	// A negative quantity can't give back a limited key's quota
+	if _, _, err := rl.RateLimit("limited", 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, api := range apis[:3] {
+		if _, err := api.fn("limited", -10); !errors.Is(err, throttled.ErrInvalidQuantity) {
+			t.Errorf("%s: expected ErrInvalidQuantity but got %v", api.name, err)
+		}
+	}
+	if limited, _, err := rl.RateLimit("limited", 1); err != nil || !limited {
+		t.Errorf("expected the key to remain limited but got %t, %v", limited, err)
+	}
+}
+
 func TestRateLimitUpdateFailures(t *testing.T) {
 	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
 	mst, err := memstore.New(0)
@@ -122,7 +287,726 @@ func TestRateLimitUpdateFailures(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, _, err := rl.RateLimit("foo", 1); err == nil {
-		t.Error("Expected limiting to fail when store updates fail")
+	if _, _, err := rl.RateLimit("foo", 1); err != throttled.ErrCASExhausted {
+		t.Errorf("Expected limiting to fail with ErrCASExhausted when store updates fail but got %v", err)
+	}
+	if have, want := st.updates, throttled.DefaultMaxCASAttempts; have != want {
+		t.Errorf("Expected %d attempts but got %d", want, have)
+	}
+
+	st.updates = 0
+	rl.SetMaxCASAttempts(3)
+	rl.SetCASBackoff(time.Microsecond)
+
+	if _, _, err := rl.RateLimit("foo", 1); err != throttled.ErrCASExhausted {
+		t.Errorf("Expected limiting to fail with ErrCASExhausted when store updates fail but got %v", err)
+	}
+	if have, want := st.updates, 3; have != want {
+		t.Errorf("Expected %d attempts but got %d", want, have)
+	}
+}
+
+func TestRateLimitCtx(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, _, err := rl.RateLimitCtx(context.Background(), "foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Error("expected the first request not to be limited")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != context.Canceled {
+		t.Errorf("expected a cancelled context to return %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestRateLimitersCtx(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := throttled.NewMultiQuotaRateLimiter(mst, []throttled.RateQuota{rq})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The wrapping limiters pass their context to the limiters they
+	// wrap
+	for name, fn := range map[string]func() error{
+		"CascadingLimiter": func() error {
+			_, _, err := throttled.NewCascadingLimiter(rl, func(key string) string { return key }, rl).RateLimitCtx(ctx, "foo", 1)
+			return err
+		},
+		"SoftLimitRateLimiter": func() error {
+			_, _, err := throttled.NewSoftLimitRateLimiter(rl, rl).RateLimitSoftCtx(ctx, "foo", 1)
+			return err
+		},
+		"HierarchicalLimiter": func() error {
+			_, _, err := throttled.NewHierarchicalLimiter(rl, rl).RateLimitCtx(ctx, "foo", 1)
+			return err
+		},
+		"MultiQuotaRateLimiter": func() error {
+			_, _, err := mq.RateLimitCtx(ctx, "foo", 1)
+			return err
+		},
+		"RateLimitWithQuotaCtx": func() error {
+			_, _, err := rl.RateLimitWithQuotaCtx(ctx, "foo", 1, rq)
+			return err
+		},
+	} {
+		if err := fn(); err != context.Canceled {
+			t.Errorf("%s: expected a cancelled context to return %v but got %v", name, context.Canceled, err)
+		}
+	}
+}
+
+// retryStore fails the first update and records the retry count seen
+// by each update.
+type retryStore struct {
+	*memstore.MemStore
+	retries []int
+}
+
+func (rs *retryStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	return rs.GetWithTime(key)
+}
+
+func (rs *retryStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	rs.retries = append(rs.retries, throttled.RetryFromContext(ctx))
+	if len(rs.retries) == 1 {
+		return false, nil
+	}
+	return rs.SetIfNotExistsWithTTL(key, value, ttl)
+}
+
+func (rs *retryStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	return rs.CompareAndSwapWithTTL(key, old, new, ttl)
+}
+
+func TestRetryFromContext(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &retryStore{MemStore: mst}
+	rl, err := throttled.NewGCRARateLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := rl.RateLimitCtx(context.Background(), "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := st.retries, []int{0, 1}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected the updates to see retries %v but got %v", want, have)
+	}
+}
+
+func TestWrapStoreWithContext(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := throttled.WrapStoreWithContext(mst)
+	ctx := context.Background()
+
+	if set, err := st.SetIfNotExistsWithTTLCtx(ctx, "foo", 1, 0); err != nil {
+		t.Fatal(err)
+	} else if !set {
+		t.Error("expected SetIfNotExistsWithTTLCtx on an empty key to succeed")
+	}
+
+	if swapped, err := st.CompareAndSwapWithTTLCtx(ctx, "foo", 1, 2, 0); err != nil {
+		t.Fatal(err)
+	} else if !swapped {
+		t.Error("expected CompareAndSwapWithTTLCtx to succeed")
+	}
+
+	if have, _, err := st.GetWithTimeCtx(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	} else if have != 2 {
+		t.Errorf("expected GetWithTimeCtx to return 2 but got %d", have)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	limit := 5
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: limit - 1}
+	start := time.Unix(0, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: start}
+
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		now, peekAt       time.Time
+		volume, remaining int
+		reset, retry      time.Duration
+	}{
+		// A missing key has the full burst available
+		0: {start, start, 0, 5, 0, -1},
+		1: {start, start, 2, 3, 2 * time.Second, -1},
+		2: {start, start, 3, 0, 5 * time.Second, time.Second},
+		3: {start, start.Add(1500 * time.Millisecond), 0, 1, 3500 * time.Millisecond, -1},
+	}
+
+	for i, c := range cases {
+		st.clock = c.now
+		if c.volume > 0 {
+			if _, _, err := rl.RateLimit("foo", c.volume); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		before, _, err := st.GetWithTime("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st.clock = c.peekAt
+		result, err := rl.Peek("foo")
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if have, want := result.Limit, limit; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+
+		if after, _, err := st.GetWithTime("foo"); err != nil {
+			t.Fatal(err)
+		} else if after != before {
+			t.Errorf("%d: expected Peek not to modify the store", i)
+		}
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	now := time.Unix(1000, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	if limited, _, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Fatal("expected the first request not to be limited")
+	}
+
+	if limited, result, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if !limited {
+		t.Fatal("expected the second request to be limited")
+	} else if result.RetryAfter != time.Minute {
+		t.Errorf("expected RetryAfter to be %s but got %s", time.Minute, result.RetryAfter)
+	}
+
+	// Advance the clock without sleeping
+	now = now.Add(time.Minute)
+
+	if limited, _, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Error("expected a request after the emission interval not to be limited")
+	}
+}
+
+func TestRateLimitWithQuota(t *testing.T) {
+	basic := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	premium := throttled.RateQuota{MaxRate: throttled.PerMin(10), MaxBurst: 4}
+	now := time.Unix(1000, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	for i := 0; i < 5; i++ {
+		limited, result, err := rl.RateLimitWithQuota("premium", 1, premium)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited {
+			t.Fatalf("%d: expected the premium quota to permit a burst of 5", i)
+		}
+		if have, want := result.Limit, 5; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+	}
+
+	if limited, _, err := rl.RateLimit("basic", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Fatal("expected the first basic request not to be limited")
+	}
+	if limited, _, err := rl.RateLimit("basic", 1); err != nil {
+		t.Fatal(err)
+	} else if !limited {
+		t.Fatal("expected the second basic request to be limited")
+	}
+
+	// The 60s backlog of the basic quota must drain to within the 30s
+	// tolerance of the premium quota, less one 6s emission interval
+	now = now.Add(36 * time.Second)
+
+	if limited, _, err := rl.RateLimit("basic", 1); err != nil {
+		t.Fatal(err)
+	} else if !limited {
+		t.Error("expected the key to still be limited under the basic quota")
+	}
+	if limited, _, err := rl.RateLimitWithQuota("basic", 1, premium); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Error("expected the upgraded key not to be limited")
+	}
+
+	invalid := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: -1}
+	if _, _, err := rl.RateLimitWithQuota("basic", 1, invalid); err == nil {
+		t.Error("expected an error for an invalid quota")
+	}
+}
+
+func TestDebugRateLimit(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerSec(10), MaxBurst: 2}
+	now := time.Unix(1000, 0)
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(func() time.Time { return now })
+
+	_, _, info, err := rl.DebugRateLimit("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.StoredTAT.IsZero() {
+		t.Errorf("expected no stored TAT for a new key but got %s", info.StoredTAT)
+	}
+	if have, want := info.EmissionInterval, 100*time.Millisecond; have != want {
+		t.Errorf("expected EmissionInterval to be %s but got %s", want, have)
+	}
+	if have, want := info.DelayVariationTolerance, 300*time.Millisecond; have != want {
+		t.Errorf("expected DelayVariationTolerance to be %s but got %s", want, have)
+	}
+
+	_, _, info, err = rl.DebugRateLimit("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := info.StoredTAT, now.Add(100*time.Millisecond); !have.Equal(want) {
+		t.Errorf("expected StoredTAT to be %s but got %s", want, have)
+	}
+	if have, want := info.NewTAT, now.Add(200*time.Millisecond); !have.Equal(want) {
+		t.Errorf("expected NewTAT to be %s but got %s", want, have)
+	}
+}
+
+type recordingObserver struct {
+	limited []bool
+	errs    []error
+}
+
+func (o *recordingObserver) ObserveRateLimit(key string, limited bool, latency time.Duration, err error) {
+	o.limited = append(o.limited, limited)
+	o.errs = append(o.errs, err)
+}
+
+func TestSetObserver(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(1000, 0)}
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var o recordingObserver
+	rl.SetObserver(&o)
+
+	rl.RateLimit("foo", 1)
+	rl.RateLimit("foo", 1)
+	st.failUpdates = true
+	rl.RateLimit("bar", 1)
+
+	if have, want := o.limited, []bool{false, true, false}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected the observer to see limited %v but got %v", want, have)
+	}
+	if o.errs[0] != nil || o.errs[1] != nil || o.errs[2] == nil {
+		t.Errorf("expected the observer to only see an error for the failed update but got %v", o.errs)
+	}
+}
+
+func TestResetRateLimit(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, _, err := rl.RateLimit("foo", 2); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Fatal("expected the full burst to be available")
+	}
+	if limited, _, _ := rl.RateLimit("foo", 1); !limited {
+		t.Fatal("expected the burst to be exhausted")
+	}
+
+	if err := rl.ResetRateLimit("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, result, err := rl.RateLimit("foo", 2); err != nil {
+		t.Fatal(err)
+	} else if limited || result.Remaining != 0 {
+		t.Errorf("expected the full burst to be available after a reset but got %#v", result)
+	}
+
+	// testStore doesn't implement Resetter
+	rl, err = throttled.NewGCRARateLimiter(&testStore{store: st}, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.ResetRateLimit("foo"); err == nil {
+		t.Error("expected an error for a store that can't reset keys")
+	}
+}
+
+func TestSetRetryAfterJitter(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	jitter := time.Second
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(1000, 0)}
+	rl, err := throttled.NewGCRARateLimiter(&st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetRetryAfterJitter(jitter)
+
+	if _, result, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if result.RetryAfter != -1 {
+		t.Errorf("expected no RetryAfter for a permitted request but got %s", result.RetryAfter)
+	}
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		limited, result, err := rl.RateLimit("foo", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !limited {
+			t.Fatal("expected the request to be limited")
+		}
+		if result.RetryAfter < time.Minute || result.RetryAfter > time.Minute+jitter {
+			t.Errorf("expected RetryAfter between %s and %s but got %s", time.Minute, time.Minute+jitter, result.RetryAfter)
+		}
+		seen[result.RetryAfter] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expected RetryAfter to vary between results")
+	}
+}
+
+func TestSetTTLPadding(t *testing.T) {
+	rq := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0}
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetClock(clock)
+	rl, err := throttled.NewGCRARateLimiter(st, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetClock(clock)
+	rl.SetTTLPadding(time.Second)
+
+	if _, result, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if result.ResetAfter != time.Minute {
+		t.Errorf("expected the padding not to change ResetAfter but got %s", result.ResetAfter)
+	}
+
+	if ttl, err := st.PeekTTL("foo"); err != nil {
+		t.Fatal(err)
+	} else if want := time.Minute + time.Second; ttl != want {
+		t.Errorf("expected a TTL of %s but got %s", want, ttl)
+	}
+}
+
+func TestPerDuration(t *testing.T) {
+	quota := throttled.NewRateQuota(throttled.PerDuration(150, 5*time.Minute))
+	if quota.MaxBurst != 149 {
+		t.Errorf("expected a MaxBurst of 149 but got %d", quota.MaxBurst)
+	}
+
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := testStore{store: mst, clock: time.Unix(1000, 0)}
+	rl, err := throttled.NewGCRARateLimiter(&st, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, result, err := rl.RateLimit("foo", 150); err != nil {
+		t.Fatal(err)
+	} else if limited || result.Remaining != 0 {
+		t.Errorf("expected a burst of 150 to be permitted but got %#v", result)
+	}
+	if _, result, _ := rl.RateLimit("foo", 1); result.RetryAfter != 2*time.Second {
+		t.Errorf("expected a RetryAfter of 2s but got %s", result.RetryAfter)
+	}
+
+	for _, rate := range []throttled.Rate{throttled.PerDuration(0, time.Minute), throttled.PerDuration(1, 0)} {
+		if _, err := throttled.NewGCRARateLimiter(&st, throttled.NewRateQuota(rate)); err == nil {
+			t.Errorf("expected an error for the invalid rate %#v", rate)
+		}
+	}
+}
+
+func TestRateQuotaValidate(t *testing.T) {
+	cases := []struct {
+		quota throttled.RateQuota
+		valid bool
+	}{
+		0: {throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 0}, true},
+		1: {throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 5}, true},
+		2: {throttled.RateQuota{}, false},
+		3: {throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: -1}, false},
+		4: {throttled.RateQuota{MaxRate: throttled.PerSec(1e9), MaxBurst: math.MaxInt64}, false},
+		5: {throttled.RateQuota{MaxRate: throttled.PerDay(1), MaxBurst: 1e6}, false},
+		6: {throttled.RateQuota{MaxRate: throttled.PerDay(1), MaxBurst: 1e5}, true},
+	}
+
+	for i, c := range cases {
+		if err := c.quota.Validate(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v but got error %v", i, c.valid, err)
+		}
+	}
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{}); err == nil {
+		t.Error("expected an error for the zero quota")
+	}
+
+	// A quantity large enough to overflow the arrival time is limited
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limited, _, err := rl.RateLimit("foo", math.MaxInt64); !errors.Is(err, throttled.ErrQuantityExceedsLimit) {
+		t.Errorf("expected ErrQuantityExceedsLimit but got %v", err)
+	} else if !limited {
+		t.Error("expected a huge quantity to be limited")
+	}
+	if err := rl.Refund("foo", math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateQuotaScale(t *testing.T) {
+	base := throttled.RateQuota{MaxRate: throttled.PerMin(60), MaxBurst: 9}
+
+	cases := []struct {
+		factor float64
+		limit  int
+		retry  time.Duration
+		valid  bool
+	}{
+		0: {1, 10, time.Second, true},
+		1: {1.5, 15, time.Second * 2 / 3, true},
+		2: {0.5, 5, 2 * time.Second, true},
+		// At least one request is permitted at once
+		3: {0.01, 1, 100 * time.Second, true},
+		4: {0, 0, 0, false},
+		5: {-1, 0, 0, false},
+		6: {1e12, 0, 0, false},
+	}
+
+	for i, c := range cases {
+		quota := base.Scale(c.factor)
+		if err := quota.Validate(); (err == nil) != c.valid {
+			t.Errorf("%d: expected valid to be %v but got error %v", i, c.valid, err)
+		}
+		if !c.valid {
+			continue
+		}
+
+		st, err := memstore.New(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.SetClock(func() time.Time { return time.Unix(1000, 0) })
+		rl, err := throttled.NewGCRARateLimiter(st, quota)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, result, err := rl.RateLimit("foo", c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Limit != c.limit {
+			t.Errorf("%d: expected a limit of %d but got %d", i, c.limit, result.Limit)
+		}
+		if _, result, _ := rl.RateLimit("foo", 1); result.RetryAfter != c.retry {
+			t.Errorf("%d: expected a RetryAfter of %s but got %s", i, c.retry, result.RetryAfter)
+		}
+	}
+
+	if have := base.WithBurst(2); have.MaxBurst != 2 || have.MaxRate != base.MaxRate || base.MaxBurst != 9 {
+		t.Errorf("expected a copy with a MaxBurst of 2 but got %#v", have)
+	}
+}
+
+func TestRateLimitResultJSON(t *testing.T) {
+	cases := []struct {
+		result throttled.RateLimitResult
+		json   string
+		back   throttled.RateLimitResult
+	}{
+		0: {
+			throttled.RateLimitResult{Limit: 10, Remaining: 4, ResetAfter: 800 * time.Millisecond, RetryAfter: -1},
+			`{"limit":10,"remaining":4,"reset_after_ms":800,"retry_after_ms":-1}`,
+			throttled.RateLimitResult{Limit: 10, Remaining: 4, ResetAfter: 800 * time.Millisecond, RetryAfter: -1},
+		},
+		// Durations are rounded up to the millisecond
+		1: {
+			throttled.RateLimitResult{Limit: 1, ResetAfter: time.Microsecond, RetryAfter: 1500 * time.Microsecond},
+			`{"limit":1,"remaining":0,"reset_after_ms":1,"retry_after_ms":2}`,
+			throttled.RateLimitResult{Limit: 1, ResetAfter: time.Millisecond, RetryAfter: 2 * time.Millisecond},
+		},
+		// Any negative value is unset
+		2: {
+			throttled.RateLimitResult{Limit: -1, Remaining: -5, ResetAfter: -time.Second, RetryAfter: -1},
+			`{"limit":-1,"remaining":-1,"reset_after_ms":-1,"retry_after_ms":-1}`,
+			throttled.RateLimitResult{Limit: -1, Remaining: -1, ResetAfter: -1, RetryAfter: -1},
+		},
+	}
+
+	for i, c := range cases {
+		b, err := json.Marshal(c.result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.json {
+			t.Errorf("%d: expected %s but got %s", i, c.json, b)
+		}
+
+		var back throttled.RateLimitResult
+		if err := json.Unmarshal(b, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back != c.back {
+			t.Errorf("%d: expected %+v but got %+v", i, c.back, back)
+		}
+	}
+
+	var result throttled.RateLimitResult
+	if err := json.Unmarshal([]byte(`{"limit":"ten"}`), &result); err == nil {
+		t.Error("expected invalid JSON to fail")
+	}
+}
+
+// Benchmarks the decisions of a GCRARateLimiter, which don't allocate
+// as long as the store doesn't.
+func BenchmarkGCRARateLimiter(b *testing.B) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(mst, throttled.RateQuota{MaxRate: throttled.PerSec(1e6), MaxBurst: 1e9})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rateLimit := func() {
+		if _, _, err := rl.RateLimit("foo", 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rateLimit()
+	}
+
+	if allocs := testing.AllocsPerRun(100, rateLimit); allocs > 0 {
+		b.Errorf("expected no allocations per request but got %.0f", allocs)
 	}
 }
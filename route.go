@@ -0,0 +1,160 @@
+package throttled
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RouteRegistry declares the quotas of the routes of an application in
+// one place and limits all of them with a single middleware, rather
+// than one HTTPRateLimiter per route. It is configured like an
+// HTTPRateLimiter, whose RateLimiter is set by the registry for each
+// route.
+type RouteRegistry struct {
+	HTTPRateLimiter
+
+	store    GCRAStore
+	routes   []route
+	def      RateLimiter
+	limiters map[RateQuota]*GCRARateLimiter
+}
+
+type route struct {
+	method   string
+	segments []string
+	prefix   bool
+	limiter  RateLimiter
+}
+
+// NewRouteRegistry creates a RouteRegistry whose limits share st. The
+// routes with the same quota share a GCRARateLimiter, and the keys
+// passed to it are prefixed with the method and pattern of their
+// route, so that each route has its own limit.
+func NewRouteRegistry(st GCRAStore) *RouteRegistry {
+	return &RouteRegistry{store: st, limiters: make(map[RateQuota]*GCRARateLimiter)}
+}
+
+// Register limits the requests matching method and pattern to quota.
+// An empty method matches all methods, and other methods must be upper
+// case, such as "POST". The pattern is a path whose segments in
+// braces, such as "{id}" in "/users/{id}", match any non-empty
+// segment. A pattern ending with a slash, such as "/static/", matches
+// all the paths starting with it, as with http.ServeMux.
+//
+// A request is limited by the first route it matches, in the order of
+// registration, or by the default quota set with SetDefault if it
+// matches none. Register must not be called concurrently with other
+// methods of the registry.
+func (rr *RouteRegistry) Register(method, pattern string, quota RateQuota) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("Invalid route pattern %q: it must start with a slash", pattern)
+	}
+
+	rl, err := rr.limiter(method+" "+pattern+":", quota)
+	if err != nil {
+		return err
+	}
+
+	rr.routes = append(rr.routes, route{
+		method:   method,
+		segments: strings.Split(pattern, "/"),
+		prefix:   strings.HasSuffix(pattern, "/"),
+		limiter:  rl,
+	})
+	return nil
+}
+
+// SetDefault limits the requests matching no route to quota. Without a
+// default quota, these requests are not limited.
+func (rr *RouteRegistry) SetDefault(quota RateQuota) error {
+	rl, err := rr.limiter("*:", quota)
+	if err != nil {
+		return err
+	}
+	rr.def = rl
+	return nil
+}
+
+// limiter returns a RateLimiter enforcing quota on keys prefixed with
+// prefix.
+func (rr *RouteRegistry) limiter(prefix string, quota RateQuota) (RateLimiter, error) {
+	rl, ok := rr.limiters[quota]
+	if !ok {
+		var err error
+		if rl, err = NewGCRARateLimiter(rr.store, quota); err != nil {
+			return nil, err
+		}
+		rr.limiters[quota] = rl
+	}
+
+	return &prefixRateLimiter{limiter: rl, prefix: prefix}, nil
+}
+
+// RateLimit wraps an http.Handler to limit incoming requests with the
+// quota of their route, as described by HTTPRateLimiter.RateLimit.
+// Routes registered after RateLimit is called have no effect on the
+// returned handler.
+func (rr *RouteRegistry) RateLimit(h http.Handler) http.Handler {
+	routes := make([]route, len(rr.routes))
+	copy(routes, rr.routes)
+
+	handlers := make([]http.Handler, len(routes))
+	for i, rt := range routes {
+		limiter := rr.HTTPRateLimiter
+		limiter.RateLimiter = rt.limiter
+		handlers[i] = limiter.RateLimit(h)
+	}
+
+	def := h
+	if rr.def != nil {
+		limiter := rr.HTTPRateLimiter
+		limiter.RateLimiter = rr.def
+		def = limiter.RateLimit(h)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range routes {
+			if routes[i].match(r) {
+				handlers[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		def.ServeHTTP(w, r)
+	})
+}
+
+func (rt *route) match(r *http.Request) bool {
+	if rt.method != "" && rt.method != r.Method {
+		return false
+	}
+
+	var path string
+	if r.URL != nil {
+		path = r.URL.Path
+	}
+	segments := strings.Split(path, "/")
+
+	n := len(rt.segments)
+	if rt.prefix {
+		// The empty segment after the final slash matches the rest of
+		// the path.
+		if len(segments) < n {
+			return false
+		}
+		n--
+	} else if len(segments) != n {
+		return false
+	}
+
+	for i, s := range rt.segments[:n] {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if segments[i] == "" {
+				return false
+			}
+		} else if s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package throttled_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+type routeCase struct {
+	method, path string
+	code         int
+}
+
+func TestRouteRegistry(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := throttled.RateQuota{MaxRate: throttled.PerMin(1)}
+	two := throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}
+
+	rr := throttled.NewRouteRegistry(st)
+	rr.VaryBy = &throttled.VaryBy{Path: true}
+	for i, c := range []struct {
+		method, pattern string
+		quota           throttled.RateQuota
+	}{
+		0: {"POST", "/users/{id}", one},
+		1: {"", "/users/{id}", two},
+		2: {"", "/static/", one},
+	} {
+		if err := rr.Register(c.method, c.pattern, c.quota); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	if err := rr.Register("GET", "users", one); err == nil {
+		t.Error("expected an error for a pattern without a leading slash")
+	}
+	if err := rr.Register("GET", "/bad", throttled.RateQuota{}); err == nil {
+		t.Error("expected an error for an invalid quota")
+	}
+
+	handler := rr.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	cases := []routeCase{
+		0: {"POST", "/users/1", 200},
+		1: {"POST", "/users/1", 429},
+		// Routes sharing a quota have separate limits
+		2: {"GET", "/users/1", 200},
+		3: {"GET", "/users/1", 200},
+		4: {"GET", "/users/1", 429},
+		5: {"GET", "/static/a/b.css", 200},
+		6: {"GET", "/static/a/b.css", 429},
+		// No default quota
+		7: {"GET", "/users/", 200},
+		8: {"GET", "/users/", 200},
+		9: {"GET", "/other", 200},
+	}
+
+	run := func(cases []routeCase) {
+		for i, c := range cases {
+			req, err := http.NewRequest(c.method, c.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			if rw.Code != c.code {
+				t.Errorf("%d: expected %s %s to return %d but got %d", i, c.method, c.path, c.code, rw.Code)
+			}
+		}
+	}
+	run(cases)
+
+	// The default quota applies to the paths matching no route
+	if err := rr.SetDefault(one); err != nil {
+		t.Fatal(err)
+	}
+	handler = rr.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	run([]routeCase{
+		0: {"GET", "/other", 200},
+		1: {"GET", "/other", 429},
+		2: {"GET", "/users/1", 429},
+	})
+}
+
+func TestRouteRegistryOptionalMethods(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := throttled.NewRouteRegistry(st)
+	rr.VaryBy = &throttled.VaryBy{Path: true}
+	rr.Probe = true
+	rr.QuotaProvider = func(key string) (throttled.RateQuota, bool) {
+		return throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1}, true
+	}
+	if err := rr.Register("", "/users/{id}", throttled.RateQuota{MaxRate: throttled.PerMin(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := rr.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	// Probes are answered with Peek and the quota of the QuotaProvider
+	// applies to the other requests
+	for i, c := range []routeCase{
+		0: {"HEAD", "/users/1", 200},
+		1: {"GET", "/users/1", 200},
+		2: {"GET", "/users/1", 200},
+		3: {"GET", "/users/1", 429},
+		4: {"HEAD", "/users/1", 200},
+	} {
+		req, err := http.NewRequest(c.method, c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != c.code {
+			t.Errorf("%d: expected %s %s to return %d but got %d", i, c.method, c.path, c.code, rw.Code)
+		}
+	}
+}
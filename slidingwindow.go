@@ -0,0 +1,79 @@
+package throttled
+
+import (
+	"fmt"
+	"time"
+)
+
+// SlidingWindowRateLimiter is a RateLimiter that counts the requests
+// made by each key within a window sliding with the current time. It
+// permits a request if no more than the limit of requests, including
+// that one, were made in the window ending at it. Unlike
+// GCRARateLimiter, which only stores a single timestamp per key, it
+// keeps the time of every request in the window, which makes its
+// counts exact at the cost of storage proportional to the limit.
+type SlidingWindowRateLimiter struct {
+	store  SlidingWindowStore
+	limit  int
+	window time.Duration
+}
+
+// NewSlidingWindowRateLimiter creates a SlidingWindowRateLimiter
+// permitting the number of requests in rate during any period of
+// that length. For example, PerMin(60) permits 60 requests in any
+// sliding minute, all of which may be made in a single burst.
+func NewSlidingWindowRateLimiter(st SlidingWindowStore, rate Rate) (*SlidingWindowRateLimiter, error) {
+	if rate.count <= 0 || rate.period <= 0 {
+		return nil, fmt.Errorf("Invalid Rate %#v. Rate must be greater than zero.", rate)
+	}
+
+	return &SlidingWindowRateLimiter{
+		store:  st,
+		limit:  rate.count,
+		window: rate.period * time.Duration(rate.count),
+	}, nil
+}
+
+// RateLimit checks whether a particular key has exceeded a rate
+// limit. It also returns a RateLimitResult to provide additional
+// information about the state of the RateLimiter.
+//
+// If the rate limit has not been exceeded, quantity requests are
+// recorded at the current time. If quantity is 0, nothing is recorded
+// allowing you to "peek" at the state of the RateLimiter for a given
+// key. A quantity greater than the limit is always limited, without
+// recording anything. A negative quantity returns an error wrapping
+// ErrInvalidQuantity.
+func (s *SlidingWindowRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	rlc := RateLimitResult{Limit: s.limit, RetryAfter: -1}
+
+	if err := checkQuantity(quantity, s.limit); err != nil && err != ErrQuantityExceedsLimit {
+		return false, rlc, err
+	}
+
+	added, times, now, err := s.store.AddWithinLimit(key, quantity, s.limit, s.window)
+	if err != nil {
+		return false, rlc, err
+	}
+
+	if n := s.limit - len(times); n > 0 {
+		rlc.Remaining = n
+	}
+	if len(times) > 0 {
+		rlc.ResetAfter = times[len(times)-1].Add(s.window).Sub(now)
+	}
+
+	if added {
+		return false, rlc, nil
+	}
+
+	// The requests are permitted once enough of the oldest ones have
+	// left the window to make room for them.
+	if quantity <= s.limit {
+		if need := len(times) + quantity - s.limit; need > 0 && need <= len(times) {
+			rlc.RetryAfter = times[need-1].Add(s.window).Sub(now)
+		}
+	}
+
+	return true, rlc, nil
+}
@@ -0,0 +1,80 @@
+package throttled_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func TestSlidingWindowRateLimit(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetClock(func() time.Time { return now })
+
+	rl, err := throttled.NewSlidingWindowRateLimiter(st, throttled.PerSec(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		now               time.Time
+		volume, remaining int
+		reset, retry      time.Duration
+		limited           bool
+	}{
+		0: {start, 1, 4, time.Second, -1, false},
+		1: {start.Add(200 * time.Millisecond), 3, 1, time.Second, -1, false},
+		2: {start.Add(400 * time.Millisecond), 2, 1, 800 * time.Millisecond, 600 * time.Millisecond, true},
+		3: {start.Add(500 * time.Millisecond), 1, 0, time.Second, -1, false},
+		4: {start.Add(600 * time.Millisecond), 1, 0, 900 * time.Millisecond, 400 * time.Millisecond, true},
+		5: {start.Add(1000 * time.Millisecond), 1, 0, time.Second, -1, false},
+		6: {start.Add(1000 * time.Millisecond), 6, 0, time.Second, -1, true},
+		7: {start.Add(3 * time.Second), 0, 5, 0, -1, false},
+	}
+
+	for i, c := range cases {
+		now = c.now
+
+		limited, result, err := rl.RateLimit("foo", c.volume)
+		if err != nil {
+			t.Fatalf("%d: %#v", i, err)
+		}
+
+		if limited != c.limited {
+			t.Errorf("%d: expected Limited to be %t but got %t", i, c.limited, limited)
+		}
+		if have, want := result.Limit, 5; have != want {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, want, have)
+		}
+		if have, want := result.Remaining, c.remaining; have != want {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, want, have)
+		}
+		if have, want := result.ResetAfter, c.reset; have != want {
+			t.Errorf("%d: expected ResetAfter to be %s but got %s", i, want, have)
+		}
+		if have, want := result.RetryAfter, c.retry; have != want {
+			t.Errorf("%d: expected RetryAfter to be %s but got %s", i, want, have)
+		}
+	}
+
+	// A negative quantity can't remove requests from the window
+	if _, _, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rl.RateLimit("foo", -3); !errors.Is(err, throttled.ErrInvalidQuantity) {
+		t.Errorf("expected ErrInvalidQuantity but got %v", err)
+	}
+	if _, result, err := rl.RateLimit("foo", 0); err != nil {
+		t.Fatal(err)
+	} else if result.Remaining != 4 {
+		t.Errorf("expected the window to be unchanged with 4 remaining but got %d", result.Remaining)
+	}
+}
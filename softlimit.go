@@ -0,0 +1,96 @@
+package throttled
+
+import "context"
+
+// SoftLimitWarning is the Warning header HTTPRateLimiter adds to the
+// responses to requests that are over their soft limit.
+const SoftLimitWarning = `299 - "Soft rate limit exceeded"`
+
+// SoftLimitResult is the result of SoftLimitRateLimiter.RateLimitSoft.
+type SoftLimitResult struct {
+	RateLimitResult
+
+	// SoftLimited is true if the request is over the soft limit but
+	// within the hard limit, and so is permitted with a warning.
+	SoftLimited bool
+}
+
+// SoftLimitRateLimiter is a RateLimiter with two tiers: requests over
+// a soft limit are still permitted but flagged, so that clients can be
+// warned before they are denied, and only requests over a hard limit
+// are denied. For example, the hard limit can be twice the soft one.
+//
+// When used by an HTTPRateLimiter, the responses to soft limited
+// requests carry a SoftLimitWarning header.
+type SoftLimitRateLimiter struct {
+	soft, hard RateLimiter
+}
+
+// NewSoftLimitRateLimiter creates a SoftLimitRateLimiter enforcing
+// the limits of hard and flagging the requests limited by soft. The
+// two RateLimiters are passed the same keys, so they must not share a
+// store unless one of them is given a namespacestore.
+func NewSoftLimitRateLimiter(soft, hard RateLimiter) *SoftLimitRateLimiter {
+	return &SoftLimitRateLimiter{soft: soft, hard: hard}
+}
+
+// RateLimit is like RateLimitSoft without the SoftLimited flag.
+func (s *SoftLimitRateLimiter) RateLimit(key string, quantity int) (bool, RateLimitResult, error) {
+	return s.RateLimitCtx(context.Background(), key, quantity)
+}
+
+// RateLimitCtx is the context-aware version of RateLimit.
+func (s *SoftLimitRateLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, RateLimitResult, error) {
+	limited, result, err := s.RateLimitSoftCtx(ctx, key, quantity)
+	return limited, result.RateLimitResult, err
+}
+
+// RateLimitSoft charges quantity to the hard limit of key and, if it
+// permits the request, to the soft limit. A request limited by the
+// soft limit is permitted with SoftLimited set. The result is that of
+// the hard limit for a limited request and that of the soft limit
+// otherwise, so that clients are told about the soft limit as long as
+// they are within the hard one.
+//
+// If the soft limit returns an error, quantity is given back to the
+// hard limit on a best effort basis, as by
+// CascadingLimiter.RateLimitCascade.
+func (s *SoftLimitRateLimiter) RateLimitSoft(key string, quantity int) (bool, SoftLimitResult, error) {
+	return s.RateLimitSoftCtx(context.Background(), key, quantity)
+}
+
+// RateLimitSoftCtx is the context-aware version of RateLimitSoft. ctx
+// is passed to the RateLimiters implementing RateLimiterCtx, and the
+// others are called with RateLimit.
+func (s *SoftLimitRateLimiter) RateLimitSoftCtx(ctx context.Context, key string, quantity int) (bool, SoftLimitResult, error) {
+	limited, hard, err := rateLimitCtx(ctx, s.hard, key, quantity)
+	if err != nil || limited {
+		return limited, SoftLimitResult{RateLimitResult: hard}, err
+	}
+
+	softLimited, soft, err := rateLimitCtx(ctx, s.soft, key, quantity)
+	if err != nil {
+		if r, ok := s.hard.(Refunder); ok && quantity > 0 {
+			r.Refund(key, quantity)
+		}
+		return false, SoftLimitResult{RateLimitResult: soft}, err
+	}
+
+	return false, SoftLimitResult{RateLimitResult: soft, SoftLimited: softLimited}, nil
+}
+
+// Refund gives quantity back to both limits of key, for the
+// RateLimiters implementing Refunder. It returns the first error,
+// after trying both.
+func (s *SoftLimitRateLimiter) Refund(key string, quantity int) error {
+	var first error
+	if r, ok := s.hard.(Refunder); ok {
+		first = r.Refund(key, quantity)
+	}
+	if r, ok := s.soft.(Refunder); ok {
+		if err := r.Refund(key, quantity); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,76 @@
+package throttled_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+)
+
+func newSoftLimitRateLimiter(t *testing.T) *throttled.SoftLimitRateLimiter {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	newLimiter := func(burst int) *throttled.GCRARateLimiter {
+		st, err := memstore.New(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: burst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl.SetClock(clock)
+		return rl
+	}
+
+	// The hard limit is twice the soft one
+	return throttled.NewSoftLimitRateLimiter(newLimiter(1), newLimiter(3))
+}
+
+func TestSoftLimitRateLimiter(t *testing.T) {
+	rl := newSoftLimitRateLimiter(t)
+
+	cases := []struct {
+		limited, softLimited bool
+		limit, remaining     int
+	}{
+		0: {false, false, 2, 1},
+		1: {false, false, 2, 0},
+		// Over the soft limit
+		2: {false, true, 2, 0},
+		3: {false, true, 2, 0},
+		// Over the hard limit
+		4: {true, false, 4, 0},
+	}
+
+	for i, c := range cases {
+		limited, result, err := rl.RateLimitSoft("foo", 1)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if limited != c.limited {
+			t.Errorf("%d: expected limited to be %t but got %t", i, c.limited, limited)
+		}
+		if result.SoftLimited != c.softLimited {
+			t.Errorf("%d: expected SoftLimited to be %t but got %t", i, c.softLimited, result.SoftLimited)
+		}
+		if result.Limit != c.limit {
+			t.Errorf("%d: expected Limit to be %d but got %d", i, c.limit, result.Limit)
+		}
+		if result.Remaining != c.remaining {
+			t.Errorf("%d: expected Remaining to be %d but got %d", i, c.remaining, result.Remaining)
+		}
+	}
+
+	// Refund gives back to both limits
+	if err := rl.Refund("foo", 2); err != nil {
+		t.Fatal(err)
+	}
+	if limited, result, err := rl.RateLimitSoft("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited || result.SoftLimited {
+		t.Errorf("expected a request after a refund to be within the soft limit")
+	}
+}
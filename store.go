@@ -1,6 +1,7 @@
 package throttled
 
 import (
+	"context"
 	"time"
 )
 
@@ -32,3 +33,220 @@ type GCRAStore interface {
 	// will expire after the provided ttl.
 	CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error)
 }
+
+// GCRAStoreCtx is the context-aware counterpart of GCRAStore. Its
+// methods have the same semantics as their GCRAStore equivalents but
+// accept a context.Context which should be passed through to the
+// underlying driver so that callers can cancel an operation or set
+// a deadline on it.
+//
+// A store may implement both GCRAStore and GCRAStoreCtx, in which
+// case GCRARateLimiter will prefer the context-aware methods.
+type GCRAStoreCtx interface {
+	// GetWithTimeCtx is the context-aware version of GetWithTime.
+	GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error)
+
+	// SetIfNotExistsWithTTLCtx is the context-aware version of
+	// SetIfNotExistsWithTTL.
+	SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error)
+
+	// CompareAndSwapWithTTLCtx is the context-aware version of
+	// CompareAndSwapWithTTL.
+	CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error)
+}
+
+// GCRABatchStore is an optional interface that a GCRAStore can
+// implement to update several keys atomically. GCRARateLimiter uses
+// it to make RateLimitBatch all-or-nothing even under concurrency.
+type GCRABatchStore interface {
+	// CompareAndSwapMultiWithTTL atomically compares the value of
+	// each key to the corresponding old value, where an old value of
+	// -1 means that the key must not exist. If all of them match, it
+	// sets each key to the corresponding new value, expiring after
+	// the corresponding ttl if the store supports expiring keys, and
+	// returns true. Otherwise, it modifies nothing and returns false.
+	// The slices all have the same length and keys are distinct.
+	// RateLimitBatch returns any error, so a store that can't always
+	// run the update as one operation, such as a Redis store without
+	// EVAL, must fall back to another atomic update rather than fail.
+	CompareAndSwapMultiWithTTL(keys []string, old, new []int64, ttl []time.Duration) (bool, error)
+}
+
+// GCRABatchReader is an optional interface that a GCRAStore can
+// implement to read several keys in a single operation. GCRARateLimiter
+// uses it to read the keys of RateLimitBatch, and of the quotas of a
+// MultiQuotaRateLimiter, in one round trip instead of one per key.
+type GCRABatchReader interface {
+	// BatchGetWithTime returns the value of each key, or -1 if it
+	// does not exist, in the same order as keys, along with the
+	// current time as returned by GetWithTime.
+	BatchGetWithTime(keys []string) ([]int64, time.Time, error)
+}
+
+// GCRAAtomicStore is an optional interface that a GCRAStore can
+// implement to apply the generic cell-rate algorithm to a key in a
+// single atomic operation, such as a server-side script. This saves
+// the round trip between reading and updating the key and never
+// requires retrying because of concurrent updates. GCRARateLimiter
+// uses it in place of the other methods when it is available.
+type GCRAAtomicStore interface {
+	// RateLimitAtomic reads the theoretical arrival time stored at key,
+	// in nanoseconds since the epoch, and the current time. Starting
+	// from the later of the two, it adds quantity emission intervals
+	// to get the new theoretical arrival time. Unless that is more
+	// than delayVariationTolerance after the current time, in which
+	// case the request is limited and nothing is written, it stores
+	// the new value, expiring once it is reached. All of this must
+	// happen atomically and with exact nanosecond arithmetic so that
+	// the result matches the limiter's computation.
+	//
+	// It returns the value of the key before the operation, or -1 if
+	// it didn't exist, and the current time used.
+	RateLimitAtomic(ctx context.Context, key string, quantity int, emissionInterval, delayVariationTolerance time.Duration) (int64, time.Time, error)
+}
+
+// TTLReader is an optional interface that a GCRAStore can implement
+// to report how long a key will live without modifying it. This is
+// useful for debugging and administrative tooling.
+type TTLReader interface {
+	// PeekTTL returns the time until key expires without modifying
+	// it. It returns 0 if the key does not exist and -1 if it exists
+	// but never expires.
+	PeekTTL(key string) (time.Duration, error)
+}
+
+// Resetter is an optional interface that a GCRAStore can implement to
+// remove keys, which GCRARateLimiter.ResetRateLimit relies on.
+type Resetter interface {
+	// Reset removes key from the store. It doesn't fail if the key
+	// doesn't exist.
+	Reset(key string) error
+}
+
+// Toucher is an optional interface that a GCRAStore can implement to
+// extend the life of keys without changing their value, for example
+// to keep the limits of a session for as long as it is active.
+type Toucher interface {
+	// Touch makes key expire after ttl, as if it had been updated with
+	// that ttl, without changing its value. It does nothing if the key
+	// doesn't exist.
+	Touch(key string, ttl time.Duration) error
+}
+
+// KeyScanner is an optional interface that a store can implement to
+// enumerate its keys, for example to list the clients currently being
+// limited in an administrative tool. Scanning may be expensive on a
+// large store, so rate limiters never do it.
+type KeyScanner interface {
+	// ScanKeys calls fn with each key in the store matching pattern,
+	// in which * matches any sequence of characters and ? any single
+	// character, while all other characters match themselves. An empty
+	// pattern matches all keys. Keys are passed as given to the other
+	// methods, without any prefix added by the store, and are streamed
+	// rather than loaded at once. A key may be skipped if it is added
+	// or removed during the scan, or passed more than once. If fn
+	// returns an error, the scan stops and ScanKeys returns it.
+	ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error
+}
+
+// Pinger is an optional interface that a store can implement to check
+// that its backend is reachable, for example from a readiness probe
+// before serving traffic.
+type Pinger interface {
+	// Ping returns an error if the store can't currently be used.
+	Ping(ctx context.Context) error
+}
+
+// PoolStats describes the connection pool of a store. When every
+// connection is in use, operations wait for one to be released, which
+// shows up as rate limiting latency.
+type PoolStats struct {
+	// Total is the number of open connections, idle or in use.
+	Total int
+
+	// Idle is the number of connections not in use.
+	Idle int
+
+	// Waits is the total number of times an operation found no idle
+	// connection.
+	Waits int64
+
+	// WaitDuration is the total time operations spent waiting for a
+	// connection, or 0 if the pool doesn't measure it.
+	WaitDuration time.Duration
+
+	// Timeouts is the total number of times an operation gave up
+	// waiting for a connection, or 0 if the pool doesn't count them.
+	Timeouts int64
+}
+
+// PoolStatsReader is an optional interface that a store using a
+// connection pool can implement to report its state, for example to
+// export it as metrics next to those of an Observer.
+type PoolStatsReader interface {
+	// PoolStats returns the current state of the connection pool.
+	PoolStats() PoolStats
+}
+
+// LocalClockStore is an optional interface that a GCRAStore can
+// implement to indicate whether the time returned by GetWithTime is
+// merely the local clock of the process rather than an authoritative
+// clock shared by every instance using the store. A GCRARateLimiter
+// with a clock set by SetClock uses that clock instead of the time
+// returned by such stores.
+type LocalClockStore interface {
+	// UsesLocalClock reports whether GetWithTime returns the local
+	// time of the process.
+	UsesLocalClock() bool
+}
+
+// SlidingWindowStore is the interface to implement to store state for
+// a SlidingWindowRateLimiter. It records the time of each permitted
+// request in the window, so its storage grows with the limit.
+type SlidingWindowStore interface {
+	// AddWithinLimit atomically discards the requests recorded for key
+	// at or before window ago, then records quantity requests at the
+	// current time unless that would bring the number of requests in
+	// the window above limit. It returns whether the requests were
+	// recorded, the times of the requests in the window in ascending
+	// order, including any just recorded, and the current time. The
+	// key should expire once all its requests have left the window.
+	AddWithinLimit(key string, quantity, limit int, window time.Duration) (bool, []time.Time, time.Time, error)
+}
+
+// CounterStore is the interface to implement to store state for a
+// FixedWindowRateLimiter.
+type CounterStore interface {
+	// IncrementWithTTL atomically adds delta to the value of key,
+	// which is treated as 0 if the key does not exist, and returns the
+	// new value. The key expires after ttl.
+	IncrementWithTTL(key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// WrapStoreWithContext returns a GCRAStoreCtx backed by st. If st
+// already implements GCRAStoreCtx it is returned as is. Otherwise the
+// returned store ignores the context and calls the corresponding
+// GCRAStore method, which allows existing stores to be used wherever
+// a GCRAStoreCtx is expected.
+func WrapStoreWithContext(st GCRAStore) GCRAStoreCtx {
+	if stc, ok := st.(GCRAStoreCtx); ok {
+		return stc
+	}
+	return &storeWithContext{st}
+}
+
+type storeWithContext struct {
+	store GCRAStore
+}
+
+func (s *storeWithContext) GetWithTimeCtx(_ context.Context, key string) (int64, time.Time, error) {
+	return s.store.GetWithTime(key)
+}
+
+func (s *storeWithContext) SetIfNotExistsWithTTLCtx(_ context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	return s.store.SetIfNotExistsWithTTL(key, value, ttl)
+}
+
+func (s *storeWithContext) CompareAndSwapWithTTLCtx(_ context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.store.CompareAndSwapWithTTL(key, old, new, ttl)
+}
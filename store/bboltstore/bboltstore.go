@@ -0,0 +1,273 @@
+// Package bboltstore offers a store implementation for throttled backed
+// by bbolt, an embedded key/value database persisted to a single file.
+package bboltstore // import "github.com/throttled/throttled/store/bboltstore"
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BBoltStore implements a store backed by a bucket of a bbolt database.
+// It keeps its state across restarts of the process but, since a bbolt
+// database can only be opened by one process at a time, doesn't share
+// it with other machines.
+type BBoltStore struct {
+	db     *bolt.DB
+	bucket []byte
+	prefix string
+}
+
+// New creates a new store using the bucket of db with the given name,
+// which is created if it doesn't exist. The keys will have the
+// specified keyPrefix, which may be an empty string.
+//
+// Every value is stored along with the time at which it expires. Since
+// bbolt has no notion of expiry, expired keys are treated as missing
+// and are deleted when they are next read or overwritten when they are
+// next written.
+func New(db *bolt.DB, bucket, keyPrefix string) (*BBoltStore, error) {
+	if bucket == "" {
+		return nil, errors.New("bbolt bucket name must not be empty")
+	}
+
+	b := []byte(bucket)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BBoltStore{
+		db:     db,
+		bucket: b,
+		prefix: keyPrefix,
+	}, nil
+}
+
+// UsesLocalClock always returns true since GetWithTime returns the
+// local time of the machine.
+func (s *BBoltStore) UsesLocalClock() bool {
+	return true
+}
+
+// GetWithTime returns the value of the key if it is in the store or
+// -1 if it does not exist. It also returns the current local time on
+// the machine. An expired key is deleted.
+func (s *BBoltStore) GetWithTime(key string) (int64, time.Time, error) {
+	now := time.Now()
+	k := []byte(s.prefix + key)
+
+	var e entry
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		e, found, err = get(tx.Bucket(s.bucket), k)
+		return err
+	})
+	if err != nil {
+		return 0, now, err
+	}
+	if !found {
+		return -1, now, nil
+	}
+
+	if e.expired(now) {
+		// Check again in a writable transaction since the key may have
+		// been updated in between.
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(s.bucket)
+			e, found, err := get(b, k)
+			if err != nil || !found || !e.expired(now) {
+				return err
+			}
+			return b.Delete(k)
+		})
+		return -1, now, err
+	}
+
+	return e.value, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the key expires after ttl unless ttl is
+// zero or negative.
+func (s *BBoltStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	k := []byte(s.prefix + key)
+
+	var set bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		e, found, err := get(b, k)
+		if err != nil {
+			return err
+		}
+		if found && !e.expired(now) {
+			return nil
+		}
+
+		set = true
+		return put(b, k, entry{value: value, expiry: expiry(now, ttl)})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return set, nil
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// key expires after ttl unless ttl is zero or negative.
+func (s *BBoltStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	k := []byte(s.prefix + key)
+
+	var swapped bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		e, found, err := get(b, k)
+		if err != nil {
+			return err
+		}
+		if !found || e.expired(now) || e.value != old {
+			return nil
+		}
+
+		swapped = true
+		return put(b, k, entry{value: new, expiry: expiry(now, ttl)})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return swapped, nil
+}
+
+// CompareAndSwapMultiWithTTL atomically compares the value of each key
+// to the corresponding old value, -1 meaning that the key must not
+// exist. If all of them match, it sets each key to its new value and
+// returns true. Otherwise, it modifies nothing and returns false. If
+// the swap succeeds, each key expires after its ttl unless that ttl is
+// zero or negative.
+func (s *BBoltStore) CompareAndSwapMultiWithTTL(keys []string, old, new []int64, ttl []time.Duration) (bool, error) {
+	now := time.Now()
+
+	var swapped bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+
+		for i, key := range keys {
+			e, found, err := get(b, []byte(s.prefix+key))
+			if err != nil {
+				return err
+			}
+
+			if !found || e.expired(now) {
+				if old[i] != -1 {
+					return nil
+				}
+			} else if e.value != old[i] {
+				return nil
+			}
+		}
+
+		for i, key := range keys {
+			if err := put(b, []byte(s.prefix+key), entry{value: new[i], expiry: expiry(now, ttl[i])}); err != nil {
+				return err
+			}
+		}
+
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return swapped, nil
+}
+
+// PeekTTL returns the time until key expires without modifying it.
+// It returns 0 if the key does not exist and -1 if it exists but
+// never expires.
+func (s *BBoltStore) PeekTTL(key string) (time.Duration, error) {
+	now := time.Now()
+
+	var ttl time.Duration
+	err := s.db.View(func(tx *bolt.Tx) error {
+		e, found, err := get(tx.Bucket(s.bucket), []byte(s.prefix+key))
+		if err != nil || !found || e.expired(now) {
+			return err
+		}
+
+		if e.expiry == 0 {
+			ttl = -1
+		} else {
+			ttl = time.Duration(e.expiry - now.UnixNano())
+		}
+		return nil
+	})
+
+	return ttl, err
+}
+
+// Reset removes key from the store.
+func (s *BBoltStore) Reset(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(s.prefix + key))
+	})
+}
+
+// An entry is the value of a key and the time at which it expires in
+// nanoseconds since the epoch, or 0 if it never expires. It is encoded
+// as both numbers in big endian order.
+type entry struct {
+	value  int64
+	expiry int64
+}
+
+const entrySize = 16
+
+func (e entry) expired(now time.Time) bool {
+	return e.expiry != 0 && e.expiry <= now.UnixNano()
+}
+
+func get(b *bolt.Bucket, k []byte) (entry, bool, error) {
+	v := b.Get(k)
+	if v == nil {
+		return entry{}, false, nil
+	}
+	if len(v) != entrySize {
+		return entry{}, false, errors.New("bbolt value has an unexpected size")
+	}
+
+	return entry{
+		value:  int64(binary.BigEndian.Uint64(v)),
+		expiry: int64(binary.BigEndian.Uint64(v[8:])),
+	}, true, nil
+}
+
+func put(b *bolt.Bucket, k []byte, e entry) error {
+	v := make([]byte, entrySize)
+	binary.BigEndian.PutUint64(v, uint64(e.value))
+	binary.BigEndian.PutUint64(v[8:], uint64(e.expiry))
+	return b.Put(k, v)
+}
+
+func expiry(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
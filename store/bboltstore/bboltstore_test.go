@@ -0,0 +1,124 @@
+package bboltstore_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/bboltstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+// Demonstrates how to initialize a RateLimiter with bbolt.
+func ExampleNew() {
+	// import bolt "go.etcd.io/bbolt"
+
+	db, err := bolt.Open("throttled.db", 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := bboltstore.New(db, "throttled", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestBBoltStore(t *testing.T) {
+	db, dir := openDB(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	st, err := bboltstore.New(db, "throttled", "test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestTTLReader(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestGCRABatchStore(t, st)
+}
+
+func TestBBoltStorePersistence(t *testing.T) {
+	db, dir := openDB(t)
+	defer os.RemoveAll(dir)
+	path := db.Path()
+
+	st, err := bboltstore.New(db, "throttled", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SetIfNotExistsWithTTL("kept", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SetIfNotExistsWithTTL("expired", 2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st, err = bboltstore.New(db, "throttled", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, _, err := st.GetWithTime("kept"); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected the key to survive reopening but got %d", have)
+	}
+	if have, _, err := st.GetWithTime("expired"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected the key to have expired but got %d", have)
+	}
+
+	// The expired key was deleted when read
+	err = db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("throttled")).Get([]byte("expired")); v != nil {
+			t.Error("expected the expired key to be deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openDB opens a database in a new temporary directory, which the
+// caller must remove.
+func openDB(t *testing.T) (*bolt.DB, string) {
+	dir, err := ioutil.TempDir("", "bboltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, "throttled.db"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, dir
+}
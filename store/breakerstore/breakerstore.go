@@ -0,0 +1,187 @@
+// Package breakerstore offers a store wrapper acting as a circuit
+// breaker, so that an unavailable store fails requests immediately
+// instead of making each of them wait for a timeout.
+package breakerstore // import "github.com/throttled/throttled/store/breakerstore"
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+// ErrOpen is returned by the operations of a BreakerStore while the
+// circuit is open, without calling the wrapped store. An
+// HTTPRateLimiter with the FailOpen FailureMode, or an Error function
+// checking for it with errors.Is, can then let requests through.
+var ErrOpen = errors.New("Store circuit breaker is open")
+
+// BreakerStore wraps a store to stop calling it after consecutive
+// failures. Once threshold operations in a row have failed, the
+// circuit opens and operations return ErrOpen for the cooldown. Then
+// the circuit is half-open: a single operation is let through as a
+// probe while the others keep returning ErrOpen. If the probe
+// succeeds, the circuit closes again, otherwise it opens for another
+// cooldown.
+//
+// Errors from a context that was canceled don't count as failures,
+// but those from a deadline being exceeded do since they are the
+// usual symptom of a degraded store.
+type BreakerStore struct {
+	store throttled.GCRAStoreCtx
+	local throttled.LocalClockStore
+
+	threshold int
+	cooldown  time.Duration
+	clock     func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// New creates a BreakerStore delegating to st, which opens the circuit
+// after threshold consecutive failures for cooldown. A threshold less
+// than 1 is treated as 1.
+func New(st throttled.GCRAStore, threshold int, cooldown time.Duration) *BreakerStore {
+	local, _ := st.(throttled.LocalClockStore)
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &BreakerStore{
+		store:     throttled.WrapStoreWithContext(st),
+		local:     local,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// SetClock sets the function used to get the current time, which
+// determines when the cooldown ends. It defaults to the local time of
+// the machine. SetClock must not be called concurrently with other
+// methods of the store.
+func (s *BreakerStore) SetClock(clock func() time.Time) {
+	s.clock = clock
+}
+
+// Open reports whether the circuit is open, including while it is
+// half-open and waiting for a probe to succeed.
+func (s *BreakerStore) Open() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failures >= s.threshold
+}
+
+// GetWithTime calls GetWithTimeCtx with a background context.
+func (s *BreakerStore) GetWithTime(key string) (int64, time.Time, error) {
+	return s.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx calls GetWithTimeCtx of the wrapped store unless the
+// circuit is open.
+func (s *BreakerStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	probe, err := s.allow()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	v, now, err := s.store.GetWithTimeCtx(ctx, key)
+	s.done(probe, err)
+	return v, now, err
+}
+
+// SetIfNotExistsWithTTL calls SetIfNotExistsWithTTLCtx with a
+// background context.
+func (s *BreakerStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return s.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx calls SetIfNotExistsWithTTLCtx of the
+// wrapped store unless the circuit is open.
+func (s *BreakerStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	probe, err := s.allow()
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := s.store.SetIfNotExistsWithTTLCtx(ctx, key, value, ttl)
+	s.done(probe, err)
+	return updated, err
+}
+
+// CompareAndSwapWithTTL calls CompareAndSwapWithTTLCtx with a
+// background context.
+func (s *BreakerStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx calls CompareAndSwapWithTTLCtx of the
+// wrapped store unless the circuit is open.
+func (s *BreakerStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	probe, err := s.allow()
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := s.store.CompareAndSwapWithTTLCtx(ctx, key, old, new, ttl)
+	s.done(probe, err)
+	return updated, err
+}
+
+// UsesLocalClock reports whether the wrapped store uses the local
+// clock, so that wrapping a store doesn't change how a
+// GCRARateLimiter with a clock treats it.
+func (s *BreakerStore) UsesLocalClock() bool {
+	return s.local != nil && s.local.UsesLocalClock()
+}
+
+// allow returns ErrOpen unless an operation may call the wrapped
+// store, in which case it must then call done with its result. It
+// reports whether the operation is the probe of a half-open circuit.
+func (s *BreakerStore) allow() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures < s.threshold {
+		return false, nil
+	}
+	if s.probing || s.now().Before(s.openUntil) {
+		return false, ErrOpen
+	}
+
+	s.probing = true
+	return true, nil
+}
+
+func (s *BreakerStore) done(probe bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if probe {
+		s.probing = false
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Says nothing about the store, so let the next operation probe
+	case err == nil:
+		s.failures = 0
+	default:
+		s.failures++
+		if probe || s.failures == s.threshold {
+			s.openUntil = s.now().Add(s.cooldown)
+		}
+	}
+}
+
+func (s *BreakerStore) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,110 @@
+package breakerstore_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/breakerstore"
+	"github.com/throttled/throttled/store/memstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+// Demonstrates how to stop waiting for an unavailable store.
+func ExampleNew() {
+	st, err := memstore.New(65536) // Or any other store, such as redigostore
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Fail immediately for 10 seconds after 5 failures in a row, which
+	// an HTTPRateLimiter with the FailOpen FailureMode lets through.
+	breaker := breakerstore.New(st, 5, 10*time.Second)
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(breaker, quota)
+}
+
+func TestBreakerStore(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, breakerstore.New(st, 1, time.Second))
+}
+
+func TestBreakerStoreTrips(t *testing.T) {
+	errStore := errors.New("store unavailable")
+	fake := &storetest.FakeStore{}
+
+	now := time.Unix(1000, 0)
+	st := breakerstore.New(fake, 2, time.Minute)
+	st.SetClock(func() time.Time { return now })
+
+	get := func() error {
+		_, _, err := st.GetWithTime("foo")
+		return err
+	}
+	calls := func() int { return len(fake.Calls()) }
+
+	// Isolated failures don't trip the circuit
+	fake.FailCall(1, errStore)
+	fake.FailCall(3, errStore)
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	if st.Open() {
+		t.Fatal("expected the circuit to be closed after isolated failures")
+	}
+
+	fake.FailCall(5, errStore)
+	fake.FailCall(6, errStore)
+	get()
+	get()
+	if !st.Open() {
+		t.Fatal("expected the circuit to open after consecutive failures")
+	}
+
+	if err := get(); err != breakerstore.ErrOpen {
+		t.Errorf("expected ErrOpen but got %v", err)
+	}
+	if have := calls(); have != 6 {
+		t.Errorf("expected the open circuit not to call the store but it was called %d times", have)
+	}
+
+	// A failed probe opens the circuit for another cooldown
+	now = now.Add(time.Minute)
+	fake.FailCall(7, errStore)
+	if err := get(); err != errStore {
+		t.Errorf("expected the probe to return the store error but got %v", err)
+	}
+	if err := get(); err != breakerstore.ErrOpen {
+		t.Errorf("expected ErrOpen after a failed probe but got %v", err)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Open() {
+		t.Error("expected the circuit to close after a successful probe")
+	}
+}
+
+func TestBreakerStoreCanceled(t *testing.T) {
+	fake := &storetest.FakeStore{}
+	fake.FailCall(1, context.Canceled)
+
+	st := breakerstore.New(fake, 1, time.Minute)
+	if _, _, err := st.GetWithTimeCtx(context.Background(), "foo"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+	if st.Open() {
+		t.Error("expected a canceled operation not to open the circuit")
+	}
+}
@@ -0,0 +1,133 @@
+// Package cassandrastore offers a Cassandra-based store implementation for throttled.
+package cassandrastore // import "github.com/throttled/throttled/store/cassandrastore"
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraStore implements a Cassandra-based store using gocql. It
+// also works with ScyllaDB.
+type CassandraStore struct {
+	session *gocql.Session
+	table   string
+	prefix  string
+
+	getQuery, setQuery, casQuery string
+}
+
+// New creates a new Cassandra-based store, using the provided session
+// to store keys in table, which can be created with CreateTable. The
+// table name is used verbatim, so it may be qualified by a keyspace
+// but must not come from untrusted input. The keys will have the
+// specified keyPrefix, which may be an empty string. Any updating
+// operations will reset the key TTL to the provided value rounded
+// down to the nearest second, with a minimum of one second.
+//
+// Updates are lightweight transactions, which take four round trips
+// between the replicas to reach consensus. They are much slower than
+// regular writes and contend with each other on the same key, so the
+// store is only suitable for low to moderate request rates, typically
+// up to a few hundred updates per second per key. Reads use the
+// consistency of the session, which should be at least QUORUM so that
+// they observe the latest update and don't cause needless retries.
+//
+// Cassandra has no query returning its clock, so GetWithTime uses the
+// local time of the machine. All instances sharing the store must keep
+// their clocks closely synchronized (e.g. with NTP); any skew between
+// them directly shifts the rate each of them enforces.
+func New(session *gocql.Session, table, keyPrefix string) (*CassandraStore, error) {
+	return &CassandraStore{
+		session: session,
+		table:   table,
+		prefix:  keyPrefix,
+
+		getQuery: `SELECT value FROM ` + table + ` WHERE key = ?`,
+		setQuery: `INSERT INTO ` + table + ` (key, value) VALUES (?, ?) IF NOT EXISTS USING TTL ?`,
+		casQuery: `UPDATE ` + table + ` USING TTL ? SET value = ? WHERE key = ? IF value = ?`,
+	}, nil
+}
+
+// CreateTable creates the table used by the store if it doesn't
+// exist yet, in the keyspace of the session unless the table name is
+// qualified.
+func (c *CassandraStore) CreateTable() error {
+	return c.session.Query(`CREATE TABLE IF NOT EXISTS ` + c.table + ` (
+	key text PRIMARY KEY,
+	value bigint
+)`).Exec()
+}
+
+// UsesLocalClock always returns true since GetWithTime returns the
+// local time of the machine.
+func (c *CassandraStore) UsesLocalClock() bool {
+	return true
+}
+
+// GetWithTime returns the value of the key if it is in the store or
+// -1 if it does not exist. It also returns the current local time on
+// the machine.
+func (c *CassandraStore) GetWithTime(key string) (int64, time.Time, error) {
+	return c.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (c *CassandraStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	now := time.Now()
+
+	var v int64
+	err := c.session.Query(c.getQuery, c.prefix+key).WithContext(ctx).Scan(&v)
+	if err == gocql.ErrNotFound {
+		return -1, now, nil
+	} else if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set atomically.
+func (c *CassandraStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return c.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (c *CassandraStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	q := c.session.Query(c.setQuery, c.prefix+key, value, ttlSeconds(ttl)).WithContext(ctx)
+
+	// The current row is returned when the insert isn't applied
+	return q.MapScanCAS(make(map[string]interface{}))
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// ttl for the key is updated atomically.
+func (c *CassandraStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return c.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (c *CassandraStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	q := c.session.Query(c.casQuery, ttlSeconds(ttl), new, c.prefix+key, old).WithContext(ctx)
+
+	// The current value, if any, is returned when the update isn't
+	// applied
+	return q.MapScanCAS(make(map[string]interface{}))
+}
+
+func ttlSeconds(ttl time.Duration) int {
+	// A TTL of 0 means that the row never expires, so make sure that
+	// we set expiry for a minimum of one second out.
+	if ttl < time.Second {
+		return 1
+	}
+	return int(ttl / time.Second)
+}
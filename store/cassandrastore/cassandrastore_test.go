@@ -0,0 +1,95 @@
+package cassandrastore_test
+
+import (
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/cassandrastore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+const cassandraTestTable = "throttled_test"
+
+// Demonstrates how to initialize a RateLimiter with Cassandra.
+func ExampleNew() {
+	// import "github.com/gocql/gocql"
+
+	cluster := gocql.NewCluster("localhost")
+	cluster.Keyspace = "app"
+	cluster.Consistency = gocql.Quorum
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+
+	store, err := cassandrastore.New(session, "throttled", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.CreateTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestCassandraStore(t *testing.T) {
+	session, st := setupCassandra(t)
+	defer session.Close()
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+}
+
+func BenchmarkCassandraStore(b *testing.B) {
+	session, st := setupCassandra(b)
+	defer session.Close()
+
+	storetest.BenchmarkGCRAStore(b, st)
+}
+
+// setupCassandra connects to the hosts given, separated by commas, by
+// the CASSANDRA_HOSTS environment variable, and creates the test table
+// in the keyspace given by CASSANDRA_KEYSPACE, which must exist.
+func setupCassandra(tb testing.TB) (*gocql.Session, *cassandrastore.CassandraStore) {
+	hosts := os.Getenv("CASSANDRA_HOSTS")
+	if hosts == "" {
+		tb.Skip("CASSANDRA_HOSTS not set")
+	}
+
+	cluster := gocql.NewCluster(strings.Split(hosts, ",")...)
+	cluster.Keyspace = os.Getenv("CASSANDRA_KEYSPACE")
+	cluster.Consistency = gocql.Quorum
+	cluster.Timeout = 5 * time.Second
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	st, err := cassandrastore.New(session, cassandraTestTable, "")
+	if err != nil {
+		session.Close()
+		tb.Fatal(err)
+	}
+
+	if err := session.Query(`DROP TABLE IF EXISTS ` + cassandraTestTable).Exec(); err != nil {
+		session.Close()
+		tb.Fatal(err)
+	}
+	if err := st.CreateTable(); err != nil {
+		session.Close()
+		tb.Fatal(err)
+	}
+
+	return session, st
+}
@@ -0,0 +1,221 @@
+// Package dynamodbstore offers a DynamoDB-based store implementation for throttled.
+package dynamodbstore // import "github.com/throttled/throttled/store/dynamodbstore"
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// KeyAttribute is the attribute holding the key, which must be the
+	// string partition key of the table.
+	KeyAttribute = "pk"
+
+	// TTLAttribute is the attribute holding the epoch in seconds after
+	// which the item expires. Enable DynamoDB's TTL on this attribute
+	// so that stale items are eventually deleted.
+	TTLAttribute = "ttl"
+
+	valueAttribute  = "v"
+	expiryAttribute = "exp"
+)
+
+// DynamoDBStore implements a DynamoDB-based store using aws-sdk-go-v2.
+type DynamoDBStore struct {
+	client *dynamodb.Client
+	table  string
+	prefix string
+}
+
+// New creates a new DynamoDB-based store, using the provided client
+// to access table. The table must have a partition key named by
+// KeyAttribute and no sort key. The keys will have the specified
+// keyPrefix, which may be an empty string. Any updating operations
+// will reset the key TTL to the provided value.
+//
+// DynamoDB has no notion of a server clock, so GetWithTime uses the
+// local time of the machine. All instances sharing the table must
+// keep their clocks closely synchronized; any skew between them
+// directly shifts the rate each of them enforces.
+//
+// DynamoDB's native TTL only deletes expired items eventually, in
+// practice up to a couple of days later, so the store additionally
+// records an exact expiry and treats items past it as missing.
+func New(client *dynamodb.Client, table, keyPrefix string) (*DynamoDBStore, error) {
+	return &DynamoDBStore{
+		client: client,
+		table:  table,
+		prefix: keyPrefix,
+	}, nil
+}
+
+// UsesLocalClock always returns true since GetWithTime returns the
+// local time of the machine.
+func (d *DynamoDBStore) UsesLocalClock() bool {
+	return true
+}
+
+// GetWithTime returns the value of the key if it is in the store or
+// -1 if it does not exist. It also returns the current local time on
+// the machine.
+func (d *DynamoDBStore) GetWithTime(key string) (int64, time.Time, error) {
+	return d.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (d *DynamoDBStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	now := time.Now()
+
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            d.itemKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, now, err
+	}
+	if out.Item == nil {
+		return -1, now, nil
+	}
+
+	exp, err := numberAttribute(out.Item, expiryAttribute)
+	if err != nil {
+		return 0, now, err
+	}
+	if exp <= now.UnixNano() {
+		return -1, now, nil
+	}
+
+	v, err := numberAttribute(out.Item, valueAttribute)
+	if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set atomically.
+func (d *DynamoDBStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return d.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (d *DynamoDBStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	exp, reapAt := expiry(now, ttl)
+
+	item := d.itemKey(key)
+	item[valueAttribute] = number(value)
+	item[expiryAttribute] = number(exp)
+	item[TTLAttribute] = number(reapAt)
+
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item:      item,
+		// An item that expired but wasn't deleted yet counts as missing.
+		ConditionExpression: aws.String("attribute_not_exists(#pk) OR #exp <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#pk":  KeyAttribute,
+			"#exp": expiryAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": number(now.UnixNano()),
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// ttl for the key is updated atomically.
+func (d *DynamoDBStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return d.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (d *DynamoDBStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	exp, reapAt := expiry(now, ttl)
+
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.table),
+		Key:                 d.itemKey(key),
+		UpdateExpression:    aws.String("SET #v = :new, #exp = :exp, #ttl = :ttl"),
+		ConditionExpression: aws.String("#v = :old AND #exp > :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#v":   valueAttribute,
+			"#exp": expiryAttribute,
+			"#ttl": TTLAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":old": number(old),
+			":new": number(new),
+			":now": number(now.UnixNano()),
+			":exp": number(exp),
+			":ttl": number(reapAt),
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (d *DynamoDBStore) itemKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		KeyAttribute: &types.AttributeValueMemberS{Value: d.prefix + key},
+	}
+}
+
+// expiry returns the exact expiry used by the store in nanoseconds
+// and the expiry used by DynamoDB's TTL, which must be in seconds and
+// is rounded up so that items are never reaped early.
+func expiry(now time.Time, ttl time.Duration) (int64, int64) {
+	// Keep results for a minimum of one second, like the other stores.
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	exp := now.Add(ttl)
+
+	return exp.UnixNano(), exp.Add(time.Second - 1).Unix()
+}
+
+func number(v int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+}
+
+func numberAttribute(item map[string]types.AttributeValue, name string) (int64, error) {
+	n, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("dynamodbstore: item attribute " + name + " is missing or not a number")
+	}
+	return strconv.ParseInt(n.Value, 10, 64)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var ccf *types.ConditionalCheckFailedException
+	return errors.As(err, &ccf)
+}
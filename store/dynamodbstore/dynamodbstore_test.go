@@ -0,0 +1,92 @@
+package dynamodbstore_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/dynamodbstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+const dynamoDBTestTable = "throttled-test"
+
+// Demonstrates how to initialize a RateLimiter with DynamoDB.
+func ExampleNew() {
+	// import "github.com/aws/aws-sdk-go-v2/config"
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := dynamodbstore.New(dynamodb.NewFromConfig(cfg), "throttled", "throttled:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	st := setupDynamoDB(t)
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+}
+
+func BenchmarkDynamoDBStore(b *testing.B) {
+	st := setupDynamoDB(b)
+	storetest.BenchmarkGCRAStore(b, st)
+}
+
+// setupDynamoDB connects to the DynamoDB-compatible endpoint, such as
+// DynamoDB Local, given by the DYNAMODB_ENDPOINT environment variable.
+func setupDynamoDB(tb testing.TB) *dynamodbstore.DynamoDBStore {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		tb.Skip("DYNAMODB_ENDPOINT not set")
+	}
+
+	client := dynamodb.New(dynamodb.Options{
+		BaseEndpoint: aws.String(endpoint),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+
+	_, err := client.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName: aws.String(dynamoDBTestTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(dynamodbstore.KeyAttribute), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(dynamodbstore.KeyAttribute), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	var inUse *types.ResourceInUseException
+	if err != nil && !errors.As(err, &inUse) {
+		tb.Fatal(err)
+	}
+
+	// Use a unique prefix so that keys from previous runs don't interfere.
+	prefix := "throttled-dynamodb:" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	st, err := dynamodbstore.New(client, dynamoDBTestTable, prefix)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return st
+}
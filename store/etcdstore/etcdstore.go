@@ -0,0 +1,220 @@
+// Package etcdstore offers an etcd-based store implementation for throttled.
+package etcdstore // import "github.com/throttled/throttled/store/etcdstore"
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdStore implements an etcd-based store using the v3 client.
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+}
+
+// New creates a new etcd-based store, using the provided client. The
+// keys will have the specified keyPrefix, which may be an empty
+// string. Any updating operations will reset the key TTL to the
+// provided value.
+//
+// Updates are transactions conditioned on the revision at which the
+// key was read, so they only succeed if nobody wrote the key since.
+// Keys are attached to a lease of the TTL rounded up to the second,
+// so that etcd deletes them once they expire. Since etcd enforces a
+// minimum lease TTL and only revokes leases eventually, the store
+// additionally records an exact expiry and treats keys past it as
+// missing.
+//
+// etcd doesn't expose its clock, so GetWithTime uses the local time of
+// the machine. All instances sharing the store must keep their clocks
+// closely synchronized (e.g. with NTP); any skew between them directly
+// shifts the rate each of them enforces.
+func New(client *clientv3.Client, keyPrefix string) (*EtcdStore, error) {
+	return &EtcdStore{
+		client: client,
+		prefix: keyPrefix,
+	}, nil
+}
+
+// UsesLocalClock always returns true since GetWithTime returns the
+// local time of the machine.
+func (e *EtcdStore) UsesLocalClock() bool {
+	return true
+}
+
+// GetWithTime returns the value of the key if it is in the store or
+// -1 if it does not exist. It also returns the current local time on
+// the machine.
+func (e *EtcdStore) GetWithTime(key string) (int64, time.Time, error) {
+	return e.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (e *EtcdStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	now := time.Now()
+
+	v, _, err := e.get(ctx, key, now)
+	if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set atomically.
+func (e *EtcdStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return e.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (e *EtcdStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	v, rev, err := e.get(ctx, key, now)
+	if err != nil {
+		return false, err
+	}
+	if v != -1 {
+		return false, nil
+	}
+
+	// rev is that of an expired key, or 0 if the key doesn't exist
+	return e.put(ctx, key, rev, value, now, ttl)
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// ttl for the key is updated atomically.
+func (e *EtcdStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return e.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (e *EtcdStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	v, rev, err := e.get(ctx, key, now)
+	if err != nil {
+		return false, err
+	}
+	if v == -1 || v != old {
+		return false, nil
+	}
+
+	return e.put(ctx, key, rev, new, now, ttl)
+}
+
+// Reset removes key from the store.
+func (e *EtcdStore) Reset(key string) error {
+	_, err := e.client.Delete(context.Background(), e.prefix+key)
+	return err
+}
+
+// get returns the value of key, or -1 if it doesn't exist or has
+// expired, and the revision at which the key was last modified, or 0
+// if it doesn't exist.
+func (e *EtcdStore) get(ctx context.Context, key string, now time.Time) (int64, int64, error) {
+	resp, err := e.client.Get(ctx, e.prefix+key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return -1, 0, nil
+	}
+
+	kv := resp.Kvs[0]
+	v, exp, err := parseValue(kv.Value)
+	if err != nil {
+		return 0, 0, err
+	}
+	if exp != 0 && exp <= now.UnixNano() {
+		return -1, kv.ModRevision, nil
+	}
+
+	return v, kv.ModRevision, nil
+}
+
+// put sets key to value only if it was last modified at rev, or
+// doesn't exist if rev is 0, and returns whether it did.
+func (e *EtcdStore) put(ctx context.Context, key string, rev, value int64, now time.Time, ttl time.Duration) (bool, error) {
+	k := e.prefix + key
+
+	var exp int64
+	var lease clientv3.LeaseID
+	var opts []clientv3.OpOption
+	if ttl > 0 {
+		exp = now.Add(ttl).UnixNano()
+
+		resp, err := e.client.Grant(ctx, leaseTTL(ttl))
+		if err != nil {
+			return false, err
+		}
+		lease = resp.ID
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+
+	var cmp clientv3.Cmp
+	if rev == 0 {
+		cmp = clientv3.Compare(clientv3.CreateRevision(k), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.ModRevision(k), "=", rev)
+	}
+
+	resp, err := e.client.Txn(ctx).
+		If(cmp).
+		Then(clientv3.OpPut(k, formatValue(value, exp), opts...)).
+		Commit()
+	if err == nil && resp.Succeeded {
+		return true, nil
+	}
+
+	// The lease would otherwise linger until it expires
+	if lease != clientv3.NoLease {
+		e.client.Revoke(context.Background(), lease)
+	}
+
+	return false, err
+}
+
+// Values are stored as the decimal representation of the value and of
+// the expiry in nanoseconds since the epoch, 0 meaning that the key
+// never expires, separated by a space.
+func formatValue(v, exp int64) string {
+	return strconv.FormatInt(v, 10) + " " + strconv.FormatInt(exp, 10)
+}
+
+func parseValue(b []byte) (int64, int64, error) {
+	s := string(b)
+
+	var exp int64
+	if i := strings.IndexByte(s, ' '); i != -1 {
+		var err error
+		if exp, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		s = s[:i]
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	return v, exp, err
+}
+
+// leaseTTL returns the TTL of a lease outliving ttl in seconds, the
+// unit of etcd leases.
+func leaseTTL(ttl time.Duration) int64 {
+	s := int64((ttl + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
@@ -0,0 +1,89 @@
+package etcdstore_test
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/etcdstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+const etcdTestPrefix = "throttled-etcd:"
+
+// Demonstrates how to initialize a RateLimiter with etcd.
+func ExampleNew() {
+	// import clientv3 "go.etcd.io/etcd/client/v3"
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"localhost:2379"},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	store, err := etcdstore.New(client, "throttled:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestEtcdStore(t *testing.T) {
+	client, st := setupEtcd(t)
+	defer client.Close()
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestResetter(t, st)
+}
+
+func BenchmarkEtcdStore(b *testing.B) {
+	client, st := setupEtcd(b)
+	defer client.Close()
+
+	storetest.BenchmarkGCRAStore(b, st)
+}
+
+// setupEtcd connects to the etcd endpoints given, separated by commas,
+// by the ETCD_ENDPOINTS environment variable.
+func setupEtcd(tb testing.TB) (*clientv3.Client, *etcdstore.EtcdStore) {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		tb.Skip("ETCD_ENDPOINTS not set")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Get(ctx, "ping"); err != nil {
+		client.Close()
+		tb.Skip("etcd server not available at " + endpoints)
+	}
+
+	// Use a unique prefix so that keys from previous runs don't interfere
+	st, err := etcdstore.New(client, etcdTestPrefix+strconv.FormatInt(time.Now().UnixNano(), 10)+":")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return client, st
+}
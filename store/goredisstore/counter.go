@@ -0,0 +1,29 @@
+package goredisstore
+
+import (
+	"context"
+	"time"
+)
+
+// IncrementWithTTL atomically adds delta to the value of key, which is
+// treated as 0 if the key does not exist, and returns the new value.
+// The key TTL is set to ttl, rounded down to the nearest millisecond,
+// in the same transaction.
+func (r *GoRedisStore) IncrementWithTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+	key = r.key(key)
+
+	// A `PEXPIRE 0` will delete the key immediately, as for EXPIRE
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	ctx := context.Background()
+	pipe := r.client.TxPipeline()
+	incrCmd := pipe.IncrBy(ctx, key, delta)
+	pipe.PExpire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	return incrCmd.Val(), nil
+}
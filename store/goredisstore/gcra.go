@@ -0,0 +1,53 @@
+package goredisstore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RateLimitAtomic applies the generic cell-rate algorithm to key in a
+// single script using the time of the Redis server, saving the round
+// trip between GetWithTime and CompareAndSwapWithTTL. The key TTL is
+// set to the time until the new theoretical arrival time, rounded up
+// to the nearest millisecond but no shorter than the MinTTL option,
+// as by New. Depends on Redis 3.2+ for script effects
+// replication.
+func (r *GoRedisStore) RateLimitAtomic(ctx context.Context, key string, quantity int, emissionInterval, delayVariationTolerance time.Duration) (int64, time.Time, error) {
+	var now time.Time
+
+	key = r.key(key)
+
+	result, err := gcraScript.Run(ctx, r.client, []string{key},
+		quantity, int64(emissionInterval), int64(delayVariationTolerance), r.ttlMilliseconds(0)).Result()
+	if err != nil {
+		return 0, now, err
+	}
+
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) != 2 {
+		return 0, now, fmt.Errorf("unexpected rate limit reply %v", result)
+	}
+	timeReply, ok := reply[1].([]interface{})
+	if !ok || len(timeReply) != 2 {
+		return 0, now, fmt.Errorf("unexpected rate limit reply %v", result)
+	}
+
+	sec, err := strconv.ParseInt(fmt.Sprint(timeReply[0]), 10, 64)
+	if err != nil {
+		return 0, now, err
+	}
+	usec, err := strconv.ParseInt(fmt.Sprint(timeReply[1]), 10, 64)
+	if err != nil {
+		return 0, now, err
+	}
+	now = time.Unix(sec, usec*int64(time.Microsecond))
+
+	tat, err := strconv.ParseInt(fmt.Sprint(reply[0]), 10, 64)
+	if err != nil {
+		return 0, now, err
+	}
+
+	return tat, now, nil
+}
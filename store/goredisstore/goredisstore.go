@@ -1,11 +1,16 @@
-// Package goredisstore offers Redis-based store implementation for throttled using go-redis.
+// Package goredisstore offers Redis-based store implementation for throttled using go-redis v8.
 package goredisstore // import "github.com/throttled/throttled/store/goredisstore"
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/throttled/throttled"
 )
 
 const (
@@ -18,40 +23,197 @@ end
 if v ~= ARGV[1] then
   return 0
 end
-redis.call('setex', KEYS[1], ARGV[3], ARGV[2])
+redis.call('psetex', KEYS[1], ARGV[3], ARGV[2])
 return 1
+`
+	redisCASMultiScript = `
+local n = #KEYS
+for i = 1, n do
+  local v = redis.call('get', KEYS[i])
+  if v == false then
+    if ARGV[i] ~= '-1' then
+      return 0
+    end
+  elseif v ~= ARGV[i] then
+    return 0
+  end
+end
+for i = 1, n do
+  redis.call('psetex', KEYS[i], ARGV[2*n+i], ARGV[n+i])
+end
+return 1
+`
+
+	// Each request is a member of a sorted set scored by its time in
+	// microseconds, which unlike nanoseconds fits exactly in a double.
+	// The members are made unique by the nonce in ARGV[4].
+	redisSlidingWindowScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[3])
+local quantity = tonumber(ARGV[1])
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - window)
+local added = 0
+if redis.call('zcard', KEYS[1]) + quantity <= tonumber(ARGV[2]) then
+  added = 1
+  for i = 1, quantity do
+    redis.call('zadd', KEYS[1], now, ARGV[4] .. ':' .. i)
+  end
+  if quantity > 0 then
+    redis.call('pexpire', KEYS[1], math.ceil(window / 1000))
+  end
+end
+local entries = redis.call('zrange', KEYS[1], 0, -1, 'withscores')
+local times = {}
+for i = 2, #entries, 2 do
+  times[#times + 1] = entries[i]
+end
+return {added, t, times}
+`
+
+	// The theoretical arrival times are split into seconds and
+	// nanoseconds since Lua numbers are doubles, which can't represent
+	// nanoseconds since the epoch exactly. Differences to the current
+	// time are exact as long as they are under about 100 days. The TTL
+	// is rounded up to the millisecond and no shorter than ARGV[4], as
+	// by ttlMilliseconds.
+	redisGCRAScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now_s = tonumber(t[1])
+local now_ns = tonumber(t[2]) * 1000
+local v = redis.call('get', KEYS[1])
+local diff = 0
+if v then
+  local s, ns = 0, tonumber(v)
+  if #v > 9 then
+    s = tonumber(string.sub(v, 1, -10))
+    ns = tonumber(string.sub(v, -9))
+  end
+  diff = (s - now_s) * 1000000000 + (ns - now_ns)
+end
+local off = math.max(diff, 0) + tonumber(ARGV[1]) * tonumber(ARGV[2])
+if off <= tonumber(ARGV[3]) then
+  local total = now_ns + off
+  local ns = tostring(total % 1000000000)
+  local tat = tostring(now_s + math.floor(total / 1000000000)) .. string.rep('0', 9 - #ns) .. ns
+  redis.call('set', KEYS[1], tat, 'px', math.max(math.ceil(off / 1000000), tonumber(ARGV[4])))
+end
+return {v or '-1', t}
 `
 )
 
-// GoRedisStore implements a Redis-based store using go-redis.
+// The scripts are run with EVALSHA, which saves sending their source
+// on every call, and sent with EVAL only when the server doesn't have
+// them cached, such as after a restart or SCRIPT FLUSH.
+var (
+	casScript           = redis.NewScript(redisCASScript)
+	casMultiScript      = redis.NewScript(redisCASMultiScript)
+	slidingWindowScript = redis.NewScript(redisSlidingWindowScript)
+	gcraScript          = redis.NewScript(redisGCRAScript)
+)
+
+// GoRedisStore implements a Redis-based store using go-redis. It
+// implements throttled.GCRAStoreCtx, passing contexts through to the
+// commands of the client.
 type GoRedisStore struct {
-	client *redis.Client
-	prefix string
+	client  redis.UniversalClient
+	prefix  string
+	keyFunc func(string) string
+	minTTL  time.Duration // Defaults to one second
+}
+
+// An Option configures a GoRedisStore.
+type Option func(*GoRedisStore)
+
+// MinTTL sets the shortest TTL the store gives a key, which defaults
+// to one second. TTLs are otherwise rounded up to the nearest
+// millisecond, so that a key never expires before the TTL asked for.
+// A shorter minimum, down to one millisecond, frees the keys of quotas
+// with emission intervals well under a second sooner, at the cost of a
+// key updated with a TTL of 0 expiring almost immediately.
+func MinTTL(d time.Duration) Option {
+	return func(r *GoRedisStore) {
+		r.minTTL = d
+	}
+}
+
+// KeyFunc makes the store pass every key through fn before prefixing
+// it with the keyPrefix of New, in all of its operations. This applies
+// a key policy uniformly, for example to add hash tags colocating the
+// keys of a tenant in Redis Cluster. fn must be deterministic, and
+// should map distinct keys to distinct results. ScanKeys matches and
+// reports the keys returned by fn.
+func KeyFunc(fn func(string) string) Option {
+	return func(r *GoRedisStore) {
+		r.keyFunc = fn
+	}
 }
 
 // New creates a new Redis-based store, using the provided pool to get
 // its connections. The keys will have the specified keyPrefix, which
 // may be an empty string, and the database index specified by db will
 // be selected to store the keys. Any updating operations will reset
-// the key TTL to the provided value rounded down to the nearest
-// second. Depends on Redis 2.6+ for EVAL support.
-func New(client *redis.Client, keyPrefix string) (*GoRedisStore, error) {
-	return &GoRedisStore{
+// the key TTL to the provided value rounded up to the nearest
+// millisecond, but no shorter than the MinTTL option. Depends on Redis
+// 2.6+ for EVAL support and millisecond TTLs.
+func New(client *redis.Client, keyPrefix string, opts ...Option) (*GoRedisStore, error) {
+	return NewRedisStoreClient(client, keyPrefix, opts...)
+}
+
+// NewRedisStoreClient creates a new Redis-based store like New, but
+// accepts any go-redis client implementing redis.UniversalClient such
+// as a *redis.Client, a *redis.ClusterClient or the failover client
+// returned by redis.NewFailoverClient. This allows an existing
+// connection pool, cluster or Sentinel setup to be used directly.
+func NewRedisStoreClient(client redis.UniversalClient, keyPrefix string, opts ...Option) (*GoRedisStore, error) {
+	r := &GoRedisStore{
 		client: client,
 		prefix: keyPrefix,
-	}, nil
+		minTTL: time.Second,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// NewCluster creates a new Redis-based store backed by a Redis
+// Cluster. Each operation is routed to the node owning the slot of
+// its key, while the TIME command used by GetWithTime, which has no
+// key, is sent to any node. Redis Cluster only supports database 0,
+// so the client must not be configured to select another one.
+//
+// If hashTag is true, keyPrefix is wrapped in a hash tag so that keys
+// look like {keyPrefix}key. All keys of the store then hash to the
+// same slot and are colocated on a single node, trading an even
+// distribution of keys across the cluster for the ability to
+// operate on several of them at once.
+func NewCluster(client *redis.ClusterClient, keyPrefix string, hashTag bool, opts ...Option) (*GoRedisStore, error) {
+	if hashTag {
+		keyPrefix = "{" + keyPrefix + "}"
+	}
+	return NewRedisStoreClient(client, keyPrefix, opts...)
 }
 
 // GetWithTime returns the value of the key if it is in the store
 // or -1 if it does not exist. It also returns the current time at
-// the redis server to microsecond precision.
+// the redis server to microsecond precision. TIME and GET are
+// pipelined, which against a cluster means that GET goes to the
+// key's slot owner and TIME to an arbitrary node.
 func (r *GoRedisStore) GetWithTime(key string) (int64, time.Time, error) {
-	key = r.prefix + key
+	return r.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (r *GoRedisStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	key = r.key(key)
 
 	pipe := r.client.Pipeline()
-	timeCmd := pipe.Time()
-	getKeyCmd := pipe.Get(key)
-	_, err := pipe.Exec()
+	timeCmd := pipe.Time(ctx)
+	getKeyCmd := pipe.Get(ctx, key)
+	_, err := pipe.Exec(ctx)
 
 	now, err := timeCmd.Result()
 	if err != nil {
@@ -68,29 +230,69 @@ func (r *GoRedisStore) GetWithTime(key string) (int64, time.Time, error) {
 	return v, now, nil
 }
 
-// SetIfNotExistsWithTTL sets the value of key only if it is not
-// already set in the store it returns whether a new value was set.
-// If a new value was set, the ttl in the key is also set, though this
-// operation is not performed atomically.
-func (r *GoRedisStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
-	key = r.prefix + key
+// BatchGetWithTime returns the value of each key, or -1 if it does not
+// exist, read with a single MGET. It also returns the current time at
+// the redis server to microsecond precision. Against a cluster, all
+// keys must hash to the same slot.
+func (r *GoRedisStore) BatchGetWithTime(keys []string) ([]int64, time.Time, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.key(key)
+	}
+
+	ctx := context.Background()
+	pipe := r.client.Pipeline()
+	timeCmd := pipe.Time(ctx)
+	mgetCmd := pipe.MGet(ctx, prefixed...)
+	_, err := pipe.Exec(ctx)
 
-	updated, err := r.client.SetNX(key, value, 0).Result()
+	now, err := timeCmd.Result()
 	if err != nil {
-		return false, err
+		return nil, now, err
 	}
 
-	ttlSeconds := time.Duration(ttl.Seconds())
+	replies, err := mgetCmd.Result()
+	if err != nil {
+		return nil, now, err
+	}
 
-	// An `EXPIRE 0` will delete the key immediately, so make sure that we set
-	// expiry for a minimum of one second out so that our results stay in the
-	// store.
-	if ttlSeconds < 1 {
-		ttlSeconds = 1
+	values := make([]int64, len(replies))
+	for i, reply := range replies {
+		if reply == nil {
+			values[i] = -1
+			continue
+		}
+
+		s, ok := reply.(string)
+		if !ok {
+			return nil, now, fmt.Errorf("unexpected MGET reply %T", reply)
+		}
+		if values[i], err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, now, err
+		}
 	}
 
-	err = r.client.Expire(key, ttlSeconds*time.Second).Err()
-	return updated, err
+	return values, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set in the same
+// command, so that a key is never left without a TTL.
+func (r *GoRedisStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return r.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (r *GoRedisStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	key = r.key(key)
+
+	// Sent as SET with the NX and PX options, which sets the TTL in the
+	// same command. go-redis sends PX for any duration that isn't a
+	// whole number of seconds, and EX otherwise.
+	ttl = time.Duration(r.ttlMilliseconds(ttl)) * time.Millisecond
+	return r.client.SetNX(ctx, key, value, ttl).Result()
 }
 
 // CompareAndSwapWithTTL atomically compares the value at key to the
@@ -99,19 +301,16 @@ func (r *GoRedisStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.D
 // store, it returns false with no error. If the swap succeeds, the
 // ttl for the key is updated atomically.
 func (r *GoRedisStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
-	key = r.prefix + key
-
-	ttlSeconds := int(ttl.Seconds())
+	return r.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
 
-	// An `EXPIRE 0` will delete the key immediately, so make sure that we set
-	// expiry for a minimum of one second out so that our results stay in the
-	// store.
-	if ttlSeconds < 1 {
-		ttlSeconds = 1
-	}
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (r *GoRedisStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	key = r.key(key)
 
 	// result will be 0 or 1
-	result, err := r.client.Eval(redisCASScript, []string{key}, old, new, ttlSeconds).Result()
+	result, err := casScript.Run(ctx, r.client, []string{key}, old, new, r.ttlMilliseconds(ttl)).Result()
 
 	var swapped bool
 	if s, ok := result.(int64); ok {
@@ -127,3 +326,168 @@ func (r *GoRedisStore) CompareAndSwapWithTTL(key string, old, new int64, ttl tim
 
 	return swapped, nil
 }
+
+// CompareAndSwapMultiWithTTL atomically compares the value of each key
+// to the corresponding old value, -1 meaning that the key must not
+// exist. If all of them match, it sets each key to its new value with
+// the corresponding ttl and returns true. Otherwise, it modifies
+// nothing and returns false. The comparison and the update are
+// performed by a single script, so against a cluster all keys must
+// hash to the same slot, as they do with NewCluster's hashTag option.
+func (r *GoRedisStore) CompareAndSwapMultiWithTTL(keys []string, old, new []int64, ttl []time.Duration) (bool, error) {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.key(key)
+	}
+
+	args := make([]interface{}, 0, 3*len(keys))
+	for _, v := range old {
+		args = append(args, v)
+	}
+	for _, v := range new {
+		args = append(args, v)
+	}
+	for _, d := range ttl {
+		args = append(args, r.ttlMilliseconds(d))
+	}
+
+	result, err := casMultiScript.Run(context.Background(), r.client, prefixed, args...).Result()
+	if err != nil {
+		return false, err
+	}
+
+	s, _ := result.(int64)
+	return s == 1, nil
+}
+
+// PeekTTL returns the time until key expires without modifying it.
+// It returns 0 if the key does not exist and -1 if it exists but
+// never expires.
+func (r *GoRedisStore) PeekTTL(key string) (time.Duration, error) {
+	key = r.key(key)
+
+	// Use the raw reply since go-redis scales PTTL's -1 and -2 markers
+	// as if they were milliseconds.
+	ctx := context.Background()
+	cmd := redis.NewIntCmd(ctx, "PTTL", key)
+	if err := r.client.Process(ctx, cmd); err != nil {
+		return 0, err
+	}
+
+	ms, err := cmd.Result()
+	if err != nil {
+		return 0, err
+	}
+
+	switch ms {
+	case -2:
+		return 0, nil
+	case -1:
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Touch makes key expire after ttl, rounded up to the nearest
+// millisecond but no shorter than the MinTTL option, without changing
+// its value. It does nothing if the key doesn't exist.
+func (r *GoRedisStore) Touch(key string, ttl time.Duration) error {
+	ttl = time.Duration(r.ttlMilliseconds(ttl)) * time.Millisecond
+	return r.client.PExpire(context.Background(), r.key(key), ttl).Err()
+}
+
+// Convert ttl to milliseconds for PEXPIRE, rounding up and applying
+// the minimum TTL. The minimum is at least one millisecond, since
+// PEXPIRE deletes the key immediately if given 0.
+func (r *GoRedisStore) ttlMilliseconds(ttl time.Duration) int64 {
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
+
+// Reset removes key from the store.
+func (r *GoRedisStore) Reset(key string) error {
+	return r.client.Del(context.Background(), r.key(key)).Err()
+}
+
+// ScanKeys calls fn with each key of the store matching pattern, as
+// described by throttled.KeyScanner, using SCAN with MATCH so that the
+// server is never blocked as with KEYS. Only the keys with the prefix
+// of the store are scanned. Against a cluster, only the keys of the
+// node the client sends the SCAN to are scanned.
+func (r *GoRedisStore) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	if pattern == "" {
+		pattern = "*"
+	}
+	match := escapeGlob(r.prefix, "*?[]\\") + escapeGlob(pattern, "[]\\")
+
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(ctx, cursor, match, 100).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(strings.TrimPrefix(key, r.prefix)); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters of s in special with a backslash,
+// so that they match themselves in a Redis pattern.
+func escapeGlob(s, special string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) != -1 {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// key returns the Redis key storing key.
+func (r *GoRedisStore) key(key string) string {
+	if r.keyFunc != nil {
+		key = r.keyFunc(key)
+	}
+	return r.prefix + key
+}
+
+// Ping checks that the server answers a PING.
+func (r *GoRedisStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// PoolStats returns the state of the connection pool of the client,
+// or the zero PoolStats if the client doesn't report it. Waits counts
+// the times no idle connection was available and Timeouts the times
+// waiting for one timed out.
+func (r *GoRedisStore) PoolStats() throttled.PoolStats {
+	c, ok := r.client.(interface {
+		PoolStats() *redis.PoolStats
+	})
+	if !ok {
+		return throttled.PoolStats{}
+	}
+
+	stats := c.PoolStats()
+	return throttled.PoolStats{
+		Total:    int(stats.TotalConns),
+		Idle:     int(stats.IdleConns),
+		Waits:    int64(stats.Misses),
+		Timeouts: int64(stats.Timeouts),
+	}
+}
@@ -1,11 +1,13 @@
 package goredisstore_test
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"testing"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 	"github.com/throttled/throttled"
 	"github.com/throttled/throttled/store/goredisstore"
 	"github.com/throttled/throttled/store/storetest"
@@ -19,7 +21,7 @@ const (
 // Demonstrates that how to initialize a RateLimiter with redis
 // using go-redis library.
 func ExampleNew() {
-	// import "github.com/go-redis/redis"
+	// import "github.com/go-redis/redis/v8"
 
 	// Initialize a redis client using go-redis
 	client := redis.NewClient(&redis.Options{
@@ -43,6 +45,48 @@ func ExampleNew() {
 	throttled.NewGCRARateLimiter(store, quota)
 }
 
+// Demonstrates how to initialize a RateLimiter with any go-redis
+// client, such as a cluster client.
+func ExampleNewRedisStoreClient() {
+	// import "github.com/go-redis/redis/v8"
+
+	// Initialize a cluster client using go-redis
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{"localhost:7000", "localhost:7001", "localhost:7002"},
+	})
+
+	// Setup store
+	store, err := goredisstore.NewRedisStoreClient(client, "throttled:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Setup quota
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+
+	// Then, use store and quota as arguments for NewGCRARateLimiter()
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+// Demonstrates how to initialize a RateLimiter backed by a Redis
+// Cluster with all of its keys colocated in a single slot.
+func ExampleNewCluster() {
+	// import "github.com/go-redis/redis/v8"
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{"localhost:7000", "localhost:7001", "localhost:7002"},
+	})
+
+	// Keys are stored as {throttled:}key
+	store, err := goredisstore.NewCluster(client, "throttled:", true)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
 func TestRedisStore(t *testing.T) {
 	c, st := setupRedis(t, 0)
 	defer c.Close()
@@ -51,6 +95,144 @@ func TestRedisStore(t *testing.T) {
 	clearRedis(c)
 	storetest.TestGCRAStore(t, st)
 	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestTTLReader(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestToucher(t, st)
+	storetest.TestGCRABatchStore(t, st)
+	storetest.TestGCRABatchReader(t, st)
+	storetest.TestKeyScanner(t, st)
+	storetest.TestSlidingWindowStore(t, st)
+	storetest.TestCounterStore(t, st)
+	storetest.TestGCRAAtomicStore(t, st)
+
+	if err := st.Ping(context.Background()); err != nil {
+		t.Errorf("expected Ping to succeed but got %v", err)
+	}
+
+	if have := st.PoolStats(); have.Total < 1 {
+		t.Errorf("expected at least one connection but got %+v", have)
+	}
+}
+
+func TestRedisStoreMillisecondTTL(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	shortTTL, err := goredisstore.New(c, redisTestPrefix, goredisstore.MinTTL(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		st       *goredisstore.GoRedisStore
+		ttl      time.Duration
+		min, max time.Duration
+	}{
+		// Not truncated to the second
+		0: {st, 1900 * time.Millisecond, 1800 * time.Millisecond, 1900 * time.Millisecond},
+		// The default minimum is one second
+		1: {st, 200 * time.Millisecond, 900 * time.Millisecond, time.Second},
+		2: {shortTTL, 200 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond},
+	}
+
+	for i, c := range cases {
+		key := fmt.Sprintf("ms-%d", i)
+		check := func(op string) {
+			if ttl, err := c.st.PeekTTL(key); err != nil {
+				t.Fatal(err)
+			} else if ttl < c.min || ttl > c.max {
+				t.Errorf("%d: expected a TTL between %s and %s after %s but got %s", i, c.min, c.max, op, ttl)
+			}
+		}
+
+		if _, err := c.st.SetIfNotExistsWithTTL(key, 1, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("SetIfNotExistsWithTTL")
+		if _, err := c.st.CompareAndSwapWithTTL(key, 1, 2, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("CompareAndSwapWithTTL")
+		if _, err := c.st.CompareAndSwapMultiWithTTL([]string{key}, []int64{2}, []int64{3}, []time.Duration{c.ttl}); err != nil {
+			t.Fatal(err)
+		}
+		check("CompareAndSwapMultiWithTTL")
+		if err := c.st.Touch(key, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("Touch")
+		if _, _, err := c.st.RateLimitAtomic(context.Background(), key, 1, c.ttl, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		check("RateLimitAtomic")
+	}
+}
+
+func TestRedisStoreCtx(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	var _ throttled.GCRAStoreCtx = st
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := st.GetWithTimeCtx(ctx, "foo"); err == nil {
+		t.Error("expected GetWithTimeCtx to fail with a cancelled context")
+	}
+	if _, err := st.SetIfNotExistsWithTTLCtx(ctx, "foo", 1, time.Second); err == nil {
+		t.Error("expected SetIfNotExistsWithTTLCtx to fail with a cancelled context")
+	}
+	if _, err := st.CompareAndSwapWithTTLCtx(ctx, "foo", 1, 2, time.Second); err == nil {
+		t.Error("expected CompareAndSwapWithTTLCtx to fail with a cancelled context")
+	}
+}
+
+func TestRedisStoreUniversal(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	var client redis.UniversalClient = c
+	st, err := goredisstore.NewRedisStoreClient(client, redisTestPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+}
+
+func TestRedisStoreKeyFunc(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	st, err := goredisstore.New(c, redisTestPrefix, goredisstore.KeyFunc(func(key string) string {
+		return "{tenant}" + key
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestGCRABatchStore(t, st)
+
+	if v, err := c.Get(context.Background(), redisTestPrefix+"{tenant}foo").Int64(); err != nil {
+		t.Fatal(err)
+	} else if v != 2 {
+		t.Errorf("expected the key to be transformed but got %d", v)
+	}
 }
 
 func BenchmarkRedisStore(b *testing.B) {
@@ -62,12 +244,12 @@ func BenchmarkRedisStore(b *testing.B) {
 }
 
 func clearRedis(c *redis.Client) error {
-	keys, err := c.Keys(redisTestPrefix + "*").Result()
+	keys, err := c.Keys(context.Background(), redisTestPrefix+"*").Result()
 	if err != nil {
 		return err
 	}
 
-	return c.Del(keys...).Err()
+	return c.Del(context.Background(), keys...).Err()
 }
 
 func setupRedis(tb testing.TB, ttl time.Duration) (*redis.Client, *goredisstore.GoRedisStore) {
@@ -79,7 +261,7 @@ func setupRedis(tb testing.TB, ttl time.Duration) (*redis.Client, *goredisstore.
 		DB:          redisTestDB, // use default DB
 	})
 
-	if err := client.Ping().Err(); err != nil {
+	if err := client.Ping(context.Background()).Err(); err != nil {
 		client.Close()
 		tb.Skip("redis server not available on localhost port 6379")
 	}
@@ -0,0 +1,71 @@
+package goredisstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// AddWithinLimit discards the requests recorded for key at or before
+// window ago, then records quantity requests at the current time of
+// the Redis server unless that would bring the number of requests in
+// the window above limit. It returns whether the requests were
+// recorded, the times of the requests in the window and the current
+// time. The requests are stored in a sorted set, with microsecond
+// precision, by a single script. Depends on Redis 3.2+ for script
+// effects replication.
+func (r *GoRedisStore) AddWithinLimit(key string, quantity, limit int, window time.Duration) (bool, []time.Time, time.Time, error) {
+	var now time.Time
+
+	key = r.key(key)
+
+	result, err := slidingWindowScript.Run(context.Background(), r.client, []string{key},
+		quantity, limit, int64(window/time.Microsecond), rand.Int63()).Result()
+	if err != nil {
+		return false, nil, now, err
+	}
+
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) != 3 {
+		return false, nil, now, fmt.Errorf("unexpected sliding window reply %v", result)
+	}
+
+	added, _ := reply[0].(int64)
+	timeReply, _ := reply[1].([]interface{})
+	scores, _ := reply[2].([]interface{})
+
+	if len(timeReply) != 2 {
+		return false, nil, now, fmt.Errorf("unexpected sliding window reply %v", result)
+	}
+	sec, err := strconv.ParseInt(fmt.Sprint(timeReply[0]), 10, 64)
+	if err != nil {
+		return false, nil, now, err
+	}
+	usec, err := strconv.ParseInt(fmt.Sprint(timeReply[1]), 10, 64)
+	if err != nil {
+		return false, nil, now, err
+	}
+	now = time.Unix(sec, usec*int64(time.Microsecond))
+
+	times := make([]time.Time, len(scores))
+	for i, s := range scores {
+		score, _ := s.(string)
+		if times[i], err = parseMicroseconds(score); err != nil {
+			return false, nil, now, err
+		}
+	}
+
+	return added == 1, times, now, nil
+}
+
+// Parse a time in microseconds since the epoch as formatted by Redis,
+// which may use an exponent for sorted set scores.
+func parseMicroseconds(s string) (time.Time, error) {
+	us, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q in sliding window", s)
+	}
+	return time.Unix(0, int64(us)*int64(time.Microsecond)), nil
+}
@@ -0,0 +1,146 @@
+// Package memcachestore offers a Memcached-based store implementation for throttled.
+package memcachestore // import "github.com/throttled/throttled/store/memcachestore"
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Memcached interprets expirations of more than 30 days as an absolute
+// Unix timestamp rather than a number of seconds from now.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// MemcacheStore implements a Memcached-based store using gomemcache.
+type MemcacheStore struct {
+	client *memcache.Client
+	prefix string
+}
+
+// New creates a new Memcached-based store, using the provided client
+// to reach the servers. The keys will have the specified keyPrefix,
+// which may be an empty string. Any updating operations will reset
+// the key TTL to the provided value rounded up to the nearest second,
+// so that a key never expires before its theoretical arrival time.
+//
+// Memcached has no command returning its clock, so GetWithTime uses
+// the local time of the machine. All instances sharing the store
+// must therefore keep their clocks closely synchronized (e.g. with
+// NTP); any skew between them directly shifts the rate each of them
+// enforces.
+func New(client *memcache.Client, keyPrefix string) (*MemcacheStore, error) {
+	return &MemcacheStore{
+		client: client,
+		prefix: keyPrefix,
+	}, nil
+}
+
+// UsesLocalClock always returns true since GetWithTime returns the
+// local time of the machine.
+func (m *MemcacheStore) UsesLocalClock() bool {
+	return true
+}
+
+// GetWithTime returns the value of the key if it is in the store or
+// -1 if it does not exist. It also returns the current local time on
+// the machine.
+func (m *MemcacheStore) GetWithTime(key string) (int64, time.Time, error) {
+	now := time.Now()
+
+	item, err := m.client.Get(m.prefix + key)
+	if err == memcache.ErrCacheMiss {
+		return -1, now, nil
+	} else if err != nil {
+		return 0, now, err
+	}
+
+	v, err := parseValue(item)
+	if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set atomically.
+func (m *MemcacheStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	err := m.client.Add(&memcache.Item{
+		Key:        m.prefix + key,
+		Value:      formatValue(value),
+		Expiration: expiration(ttl),
+	})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// ttl for the key is updated atomically.
+func (m *MemcacheStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	// The CAS token used below is the one returned along with the item
+	// by Get, so the swap only succeeds if nobody wrote the key since.
+	item, err := m.client.Get(m.prefix + key)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	v, err := parseValue(item)
+	if err != nil {
+		return false, err
+	}
+	if v != old {
+		return false, nil
+	}
+
+	item.Value = formatValue(new)
+	item.Expiration = expiration(ttl)
+
+	err = m.client.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Values are stored in their decimal representation, which round-trips
+// every int64 through the text protocol.
+func formatValue(v int64) []byte {
+	return []byte(strconv.FormatInt(v, 10))
+}
+
+func parseValue(item *memcache.Item) (int64, error) {
+	return strconv.ParseInt(string(item.Value), 10, 64)
+}
+
+func expiration(ttl time.Duration) int32 {
+	// An expiration of 0 means that the item never expires, so make sure
+	// that we set expiry for a minimum of one second out.
+	if ttl < time.Second {
+		return 1
+	}
+
+	// Round up, since an item expiring early would give the client back
+	// its burst before the bucket has drained.
+	ttl += time.Second - 1
+
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+
+	return int32(ttl / time.Second)
+}
@@ -0,0 +1,76 @@
+package memcachestore_test
+
+import (
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memcachestore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+const memcacheTestPrefix = "throttled-memcache:"
+
+// Demonstrates how to initialize a RateLimiter with Memcached.
+func ExampleNew() {
+	// import "github.com/bradfitz/gomemcache/memcache"
+
+	client := memcache.New("localhost:11211")
+
+	store, err := memcachestore.New(client, "throttled:")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestMemcacheStore(t *testing.T) {
+	// Use a unique prefix so that keys from previous runs, which can't
+	// be enumerated in Memcached, don't interfere.
+	st := setupMemcache(t, strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+}
+
+func TestMemcacheStoreLargeValues(t *testing.T) {
+	st := setupMemcache(t, strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	want := time.Now().Add(time.Hour).UnixNano()
+	if _, err := st.SetIfNotExistsWithTTL("large", want, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, _, err := st.GetWithTime("large"); err != nil {
+		t.Fatal(err)
+	} else if have != want {
+		t.Errorf("expected GetWithTime to return %d but got %d", want, have)
+	}
+}
+
+func BenchmarkMemcacheStore(b *testing.B) {
+	st := setupMemcache(b, strconv.FormatInt(time.Now().UnixNano(), 10))
+	storetest.BenchmarkGCRAStore(b, st)
+}
+
+func setupMemcache(tb testing.TB, suffix string) *memcachestore.MemcacheStore {
+	client := memcache.New("localhost:11211")
+	client.Timeout = time.Second
+
+	if _, err := client.Get("ping"); err != nil && err != memcache.ErrCacheMiss {
+		tb.Skip("memcached server not available on localhost port 11211")
+	}
+
+	st, err := memcachestore.New(client, memcacheTestPrefix+suffix+":")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return st
+}
@@ -0,0 +1,25 @@
+package memstore
+
+import "time"
+
+// IncrementWithTTL atomically adds delta to the value of key, which is
+// treated as 0 if the key does not exist, and returns the new value.
+// The key expires after ttl unless ttl is zero or negative.
+func (ms *MemStore) IncrementWithTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+	now := ms.now()
+
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok || e.expired(now) {
+		e = &entry{}
+		s.add(key, e)
+	}
+
+	e.value += delta
+	e.expiry = expiry(now, ttl)
+
+	return e.value, nil
+}
@@ -2,8 +2,8 @@
 package memstore // import "github.com/throttled/throttled/store/memstore"
 
 import (
+	"context"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/golang-lru"
@@ -13,10 +13,45 @@ import (
 // supports evicting the least recently used keys to control memory
 // usage. It is stored in memory in the current process and thus
 // doesn't share state with other rate limiters.
+//
+// Without a limit on the number of keys, the keys are spread over
+// shards with a lock each, so that operations on unrelated keys don't
+// contend with each other. With a limit, all keys share the embedded
+// mutex since the order in which they are used is global.
 type MemStore struct {
 	sync.RWMutex
+	shards []shard
+	clock  func() time.Time
+}
+
+// shardCount is the number of shards of a MemStore without a limit on
+// the number of keys.
+const shardCount = 64
+
+// A shard holds some of the keys of a MemStore, either in an LRU or in
+// a map, along with the mutex guarding them.
+type shard struct {
+	mu   *sync.RWMutex
 	keys *lru.Cache
-	m    map[string]*int64
+	m    map[string]*entry
+}
+
+// An entry is the state of a key. Its fields are guarded by the
+// mutex of its shard.
+type entry struct {
+	value int64
+
+	// Time at which the entry expires in nanoseconds since the epoch,
+	// or 0 if it never expires.
+	expiry int64
+
+	// Requests recorded by AddWithinLimit, if the key is used by a
+	// sliding window rate limiter.
+	window *ring
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.expiry != 0 && e.expiry <= now.UnixNano()
 }
 
 // New initializes a Store. If maxKeys > 0, the number of different
@@ -24,8 +59,21 @@ type MemStore struct {
 // an LRU algorithm to evict older keys to make room for newer
 // ones. If maxKeys <= 0, there is no limit on the number of keys,
 // which may use an unbounded amount of memory.
+//
+// Setting maxKeys is recommended whenever keys are derived from client
+// input, such as per-IP limits, since flooding the store with distinct
+// keys would otherwise exhaust memory. Every read or update of a key
+// marks it as recently used. Note that evicting a key forgets its
+// state, effectively resetting the limit of that caller, so maxKeys
+// should comfortably exceed the number of keys expected to be active
+// within one rate limit period.
+//
+// Keys expire after the ttl given when they were last updated, or
+// never if that ttl was zero or negative. Expired keys are treated as
+// missing and their memory is reclaimed when they are next written
+// or evicted.
 func New(maxKeys int) (*MemStore, error) {
-	var m *MemStore
+	m := &MemStore{}
 
 	if maxKeys > 0 {
 		keys, err := lru.New(maxKeys)
@@ -33,59 +81,86 @@ func New(maxKeys int) (*MemStore, error) {
 			return nil, err
 		}
 
-		m = &MemStore{
-			keys: keys,
-		}
+		m.shards = []shard{{mu: &m.RWMutex, keys: keys}}
 	} else {
-		m = &MemStore{
-			m: make(map[string]*int64),
+		m.shards = make([]shard, shardCount)
+		for i := range m.shards {
+			m.shards[i] = shard{mu: &sync.RWMutex{}, m: make(map[string]*entry)}
 		}
 	}
 	return m, nil
 }
 
+// SetClock sets the function used by the store to get the current
+// time, both for GetWithTime and to expire keys, in place of the
+// local time of the machine. This is mostly useful to control time in
+// tests. A nil clock restores the local time. SetClock must not be
+// called concurrently with other methods of the store.
+func (ms *MemStore) SetClock(clock func() time.Time) {
+	ms.clock = clock
+}
+
+// UsesLocalClock reports whether the store uses the local time of the
+// machine, which is the case unless a clock was set with SetClock.
+func (ms *MemStore) UsesLocalClock() bool {
+	return ms.clock == nil
+}
+
 // GetWithTime returns the value of the key if it is in the store or
 // -1 if it does not exist. It also returns the current local time on
-// the machine.
+// the machine, or the time given by the clock set with SetClock.
 func (ms *MemStore) GetWithTime(key string) (int64, time.Time, error) {
-	now := time.Now()
-	valP, ok := ms.get(key, false)
+	now := ms.now()
 
-	if !ok {
+	s := ms.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.get(key)
+	if !ok || e.expired(now) {
 		return -1, now, nil
 	}
 
-	return atomic.LoadInt64(valP), now, nil
+	return e.value, now, nil
 }
 
-// SetIfNotExistsWithTTL sets the value of key only if it is not
-// already set in the store it returns whether a new value was set. It
-// ignores the ttl.
-func (ms *MemStore) SetIfNotExistsWithTTL(key string, value int64, _ time.Duration) (bool, error) {
-	_, ok := ms.get(key, false)
+// BatchGetWithTime returns the value of each key, or -1 if it does not
+// exist, as read at once. It also returns the current time as
+// GetWithTime does.
+func (ms *MemStore) BatchGetWithTime(keys []string) ([]int64, time.Time, error) {
+	now := ms.now()
+	values := make([]int64, len(keys))
 
-	if ok {
-		return false, nil
+	defer ms.lockKeys(keys, false)()
+
+	for i, key := range keys {
+		e, ok := ms.shard(key).get(key)
+		if !ok || e.expired(now) {
+			values[i] = -1
+		} else {
+			values[i] = e.value
+		}
 	}
 
-	ms.Lock()
-	defer ms.Unlock()
+	return values, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the key expires after ttl unless ttl is
+// zero or negative.
+func (ms *MemStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	now := ms.now()
 
-	_, ok = ms.get(key, true)
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if ok {
+	if e, ok := s.get(key); ok && !e.expired(now) {
 		return false, nil
 	}
 
-	// Store a pointer to a new instance so that the caller
-	// can't mutate the value after setting
-	v := value
-
-	if ms.keys != nil {
-		ms.keys.Add(key, &v)
-	} else {
-		ms.m[key] = &v
-	}
+	s.add(key, &entry{value: value, expiry: expiry(now, ttl)})
 
 	return true, nil
 }
@@ -93,35 +168,313 @@ func (ms *MemStore) SetIfNotExistsWithTTL(key string, value int64, _ time.Durati
 // CompareAndSwapWithTTL atomically compares the value at key to the
 // old value. If it matches, it sets it to the new value and returns
 // true. Otherwise, it returns false. If the key does not exist in the
-// store, it returns false with no error. It ignores the ttl.
-func (ms *MemStore) CompareAndSwapWithTTL(key string, old, new int64, _ time.Duration) (bool, error) {
-	valP, ok := ms.get(key, false)
+// store, it returns false with no error. If the swap succeeds, the
+// key expires after ttl unless ttl is zero or negative.
+func (ms *MemStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	now := ms.now()
 
-	if !ok {
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok || e.expired(now) || e.value != old {
 		return false, nil
 	}
 
-	return atomic.CompareAndSwapInt64(valP, old, new), nil
+	e.value = new
+	e.expiry = expiry(now, ttl)
+
+	return true, nil
+}
+
+// CompareAndSwapMultiWithTTL atomically compares the value of each key
+// to the corresponding old value, -1 meaning that the key must not
+// exist. If all of them match, it sets each key to its new value and
+// returns true. Otherwise, it modifies nothing and returns false. If
+// the swap succeeds, each key expires after its ttl unless that ttl is
+// zero or negative.
+func (ms *MemStore) CompareAndSwapMultiWithTTL(keys []string, old, new []int64, ttl []time.Duration) (bool, error) {
+	now := ms.now()
+
+	defer ms.lockKeys(keys, true)()
+
+	entries := make([]*entry, len(keys))
+	for i, key := range keys {
+		e, ok := ms.shard(key).get(key)
+		if !ok || e.expired(now) {
+			if old[i] != -1 {
+				return false, nil
+			}
+			continue
+		}
+		if e.value != old[i] {
+			return false, nil
+		}
+		entries[i] = e
+	}
+
+	for i, e := range entries {
+		if e == nil {
+			e = &entry{}
+			ms.shard(keys[i]).add(keys[i], e)
+		}
+		e.value = new[i]
+		e.expiry = expiry(now, ttl[i])
+	}
+
+	return true, nil
+}
+
+// PeekTTL returns the time until key expires without modifying it.
+// It returns 0 if the key does not exist and -1 if it exists but
+// never expires.
+func (ms *MemStore) PeekTTL(key string) (time.Duration, error) {
+	now := ms.now()
+
+	s := ms.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.get(key)
+	if !ok || e.expired(now) {
+		return 0, nil
+	}
+	if e.expiry == 0 {
+		return -1, nil
+	}
+
+	return time.Duration(e.expiry - now.UnixNano()), nil
+}
+
+// Touch makes key expire after ttl, or never if ttl is zero or
+// negative, without changing its value. It does nothing if the key
+// doesn't exist.
+func (ms *MemStore) Touch(key string, ttl time.Duration) error {
+	now := ms.now()
+
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.get(key); ok && !e.expired(now) {
+		e.expiry = expiry(now, ttl)
+	}
+
+	return nil
+}
+
+// Reset removes key from the store.
+func (ms *MemStore) Reset(key string) error {
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys != nil {
+		s.keys.Remove(key)
+	} else {
+		delete(s.m, key)
+	}
+
+	return nil
+}
+
+// ScanKeys calls fn with each key that hasn't expired and matches
+// pattern, as described by throttled.KeyScanner. The keys are listed
+// when the scan starts but fn is called without holding the lock, so
+// that it may use the store.
+func (ms *MemStore) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	var keys []string
+	for i := range ms.shards {
+		s := &ms.shards[i]
+		s.mu.RLock()
+		s.each(func(key string, e *entry) {
+			keys = append(keys, key)
+		})
+		s.mu.RUnlock()
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if pattern != "" && !matchKey(pattern, key) {
+			continue
+		}
+
+		now := ms.now()
+		s := ms.shard(key)
+		s.mu.RLock()
+		e, ok := s.peek(key)
+		live := ok && !e.expired(now)
+		s.mu.RUnlock()
+
+		if live {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchKey reports whether key matches pattern, in which * matches any
+// sequence of bytes and ? any single byte.
+func matchKey(pattern, key string) bool {
+	// Backtrack to just after the last * when the rest doesn't match
+	p, k := 0, 0
+	star, starKey := -1, 0
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] != '*' && pattern[p] == key[k]):
+			p++
+			k++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starKey = p, k
+			p++
+		case star != -1:
+			starKey++
+			p, k = star+1, starKey
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Ping always succeeds since the store is in memory.
+func (ms *MemStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (ms *MemStore) now() time.Time {
+	if ms.clock != nil {
+		return ms.clock()
+	}
+	return time.Now()
+}
+
+// shard returns the shard holding key.
+func (ms *MemStore) shard(key string) *shard {
+	return &ms.shards[ms.shardIndex(key)]
+}
+
+func (ms *MemStore) shardIndex(key string) int {
+	if len(ms.shards) == 1 {
+		return 0
+	}
+
+	// FNV-1a, inlined to avoid allocating a hash.Hash
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(ms.shards)))
+}
+
+// lockKeys locks the shards holding keys, for writing if write is true,
+// and returns a function unlocking them. The shards are locked in
+// order so that concurrent calls can't deadlock.
+func (ms *MemStore) lockKeys(keys []string, write bool) (unlock func()) {
+	used := make([]bool, len(ms.shards))
+	for _, key := range keys {
+		used[ms.shardIndex(key)] = true
+	}
+	return ms.lockShards(used, write)
+}
+
+// lockShards locks the shards whose index is true in used, or all of
+// them if used is nil, and returns a function unlocking them.
+func (ms *MemStore) lockShards(used []bool, write bool) (unlock func()) {
+	var locked []*sync.RWMutex
+	for i := range ms.shards {
+		if used != nil && !used[i] {
+			continue
+		}
+		mu := ms.shards[i].mu
+		if write {
+			mu.Lock()
+		} else {
+			mu.RLock()
+		}
+		locked = append(locked, mu)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			if write {
+				locked[i].Unlock()
+			} else {
+				locked[i].RUnlock()
+			}
+		}
+	}
 }
 
-func (ms *MemStore) get(key string, locked bool) (*int64, bool) {
-	var valP *int64
-	var ok bool
+// get must be called with the mutex of the shard held.
+func (s *shard) get(key string) (*entry, bool) {
+	if s.keys != nil {
+		e, ok := s.keys.Get(key)
+		if !ok {
+			return nil, false
+		}
+		return e.(*entry), true
+	}
 
-	if ms.keys != nil {
-		var valI interface{}
+	e, ok := s.m[key]
+	return e, ok
+}
 
-		valI, ok = ms.keys.Get(key)
-		if ok {
-			valP = valI.(*int64)
+// peek is like get but doesn't mark the key as recently used. It must
+// be called with the mutex of the shard held.
+func (s *shard) peek(key string) (*entry, bool) {
+	if s.keys != nil {
+		e, ok := s.keys.Peek(key)
+		if !ok {
+			return nil, false
 		}
+		return e.(*entry), true
+	}
+
+	e, ok := s.m[key]
+	return e, ok
+}
+
+// add must be called with the mutex of the shard held for writing.
+func (s *shard) add(key string, e *entry) {
+	if s.keys != nil {
+		s.keys.Add(key, e)
 	} else {
-		if !locked {
-			ms.RLock()
-			defer ms.RUnlock()
+		s.m[key] = e
+	}
+}
+
+// each calls fn with each key of the shard and its entry, from the
+// least to the most recently used with an LRU, without marking them as
+// used. It must be called with the mutex of the shard held.
+func (s *shard) each(fn func(key string, e *entry)) {
+	if s.keys != nil {
+		for _, k := range s.keys.Keys() {
+			if e, ok := s.keys.Peek(k); ok {
+				fn(k.(string), e.(*entry))
+			}
 		}
-		valP, ok = ms.m[key]
+		return
 	}
 
-	return valP, ok
+	for k, e := range s.m {
+		fn(k, e)
+	}
+}
+
+func expiry(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
 }
@@ -1,7 +1,14 @@
 package memstore_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/throttled/throttled/store/memstore"
 	"github.com/throttled/throttled/store/storetest"
@@ -13,14 +20,106 @@ func TestMemStoreLRU(t *testing.T) {
 		t.Fatal(err)
 	}
 	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestTTLReader(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestToucher(t, st)
+	storetest.TestGCRABatchStore(t, st)
+	storetest.TestGCRABatchReader(t, st)
+	storetest.TestKeyScanner(t, st)
+	storetest.TestSlidingWindowStore(t, st)
+	storetest.TestCounterStore(t, st)
 }
 
 func TestMemStoreUnlimited(t *testing.T) {
-	st, err := memstore.New(10)
+	st, err := memstore.New(0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestTTLReader(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestToucher(t, st)
+	storetest.TestGCRABatchStore(t, st)
+	storetest.TestGCRABatchReader(t, st)
+	storetest.TestKeyScanner(t, st)
+}
+
+func TestMemStoreLRUEviction(t *testing.T) {
+	st, err := memstore.New(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := st.SetIfNotExistsWithTTL(key, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Accessing "a" makes "b" the least recently used key
+	if _, _, err := st.GetWithTime("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SetIfNotExistsWithTTL("c", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]int64{"a": 1, "b": -1, "c": 1} {
+		if have, _, err := st.GetWithTime(key); err != nil {
+			t.Fatal(err)
+		} else if have != want {
+			t.Errorf("expected GetWithTime(%q) to return %d but got %d", key, want, have)
+		}
+	}
+}
+
+func TestMemStorePeekTTLWithoutExpiry(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := st.PeekTTL("foo"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected PeekTTL to return -1 for a key without expiry but got %s", have)
+	}
+}
+
+func TestMemStoreSetClock(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1000, 0)
+	st.SetClock(func() time.Time { return now })
+
+	if st.UsesLocalClock() {
+		t.Error("expected UsesLocalClock to be false once a clock is set")
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, have, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	} else if !have.Equal(now) {
+		t.Errorf("expected GetWithTime to return the time %s but got %s", now, have)
+	}
+
+	now = now.Add(time.Second)
+
+	if have, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected the key to expire with the clock but got %d", have)
+	}
 }
 
 func BenchmarkMemStoreLRU(b *testing.B) {
@@ -38,3 +137,116 @@ func BenchmarkMemStoreUnlimited(b *testing.B) {
 	}
 	storetest.BenchmarkGCRAStore(b, st)
 }
+
+// Runs many goroutines updating distinct keys, which only contend for
+// locks with an LRU since its keys share one.
+func BenchmarkMemStoreParallel(b *testing.B) {
+	for _, c := range []struct {
+		name    string
+		maxKeys int
+	}{
+		{"LRU", 1 << 16},
+		{"Sharded", 0},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			st, err := memstore.New(c.maxKeys)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var n int64
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				key := strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+				if _, err := st.SetIfNotExistsWithTTL(key, 0, 0); err != nil {
+					b.Error(err)
+				}
+
+				for pb.Next() {
+					v, _, err := st.GetWithTime(key)
+					if err != nil {
+						b.Error(err)
+					}
+					if _, err := st.CompareAndSwapWithTTL(key, v, v+1, 0); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestMemStoreSnapshot(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	st, err := memstore.New(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetClock(clock)
+
+	st.SetIfNotExistsWithTTL("a", 1, time.Minute)
+	st.SetIfNotExistsWithTTL("b", 2, time.Second)
+	st.SetIfNotExistsWithTTL("c", 3, 0)
+	st.AddWithinLimit("d", 2, 5, time.Minute)
+
+	dir, err := ioutil.TempDir("", "memstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "memstore.json")
+	if err := st.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// b expires while the process is down
+	now = now.Add(2 * time.Second)
+
+	loaded, err := memstore.New(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.SetClock(clock)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := loaded.LoadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loaded.LoadFrom(strings.NewReader("{}")); err == nil {
+		t.Error("expected LoadFrom to reject a snapshot without a version")
+	}
+
+	// a was evicted by d in the LRU of size 3
+	for key, want := range map[string]int64{"a": -1, "b": -1, "c": 3} {
+		if have, _, err := loaded.GetWithTime(key); err != nil {
+			t.Fatal(err)
+		} else if have != want {
+			t.Errorf("expected %s to be %d after loading but got %d", key, want, have)
+		}
+	}
+
+	if added, times, _, err := loaded.AddWithinLimit("d", 0, 5, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !added || len(times) != 2 {
+		t.Errorf("expected the sliding window of d to be restored but got %d requests", len(times))
+	}
+
+	// Open uses the local time, at which only c hasn't expired
+	if opened, err := memstore.Open(3, path); err != nil {
+		t.Fatal(err)
+	} else if have, _, _ := opened.GetWithTime("c"); have != 3 {
+		t.Errorf("expected Open to load c but got %d", have)
+	}
+
+	if _, err := memstore.Open(3, filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("expected Open to accept a missing file but got %v", err)
+	}
+}
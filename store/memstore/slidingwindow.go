@@ -0,0 +1,90 @@
+package memstore
+
+import "time"
+
+// AddWithinLimit discards the requests recorded for key at or before
+// window ago, then records quantity requests at the current time
+// unless that would bring the number of requests in the window above
+// limit. It returns whether the requests were recorded, the times of
+// the requests in the window and the current time. The requests of
+// each key are kept in a ring buffer holding up to limit of them.
+func (ms *MemStore) AddWithinLimit(key string, quantity, limit int, window time.Duration) (bool, []time.Time, time.Time, error) {
+	now := ms.now()
+
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key)
+	if !ok || e.expired(now) || e.window == nil {
+		e, ok = &entry{window: &ring{}}, false
+	}
+
+	r := e.window
+	r.trim(now.Add(-window).UnixNano())
+	r.resize(limit)
+
+	added := quantity <= limit-r.n
+	if added && quantity > 0 {
+		for i := 0; i < quantity; i++ {
+			r.push(now.UnixNano())
+		}
+		e.expiry = expiry(now, window)
+		if !ok {
+			s.add(key, e)
+		}
+	}
+
+	return added, r.list(), now, nil
+}
+
+// A ring is a circular buffer of request times in nanoseconds since the
+// epoch, in ascending order. Its fields are guarded by the mutex of
+// the shard of its key.
+type ring struct {
+	times []int64
+	start int // Index of the oldest time
+	n     int // Number of times in the buffer
+}
+
+// trim discards the times at or before cutoff.
+func (r *ring) trim(cutoff int64) {
+	for r.n > 0 && r.times[r.start] <= cutoff {
+		r.start = (r.start + 1) % len(r.times)
+		r.n--
+	}
+}
+
+// resize changes the capacity of the buffer, keeping the most recent
+// times if it shrinks.
+func (r *ring) resize(capacity int) {
+	if capacity == len(r.times) {
+		return
+	}
+
+	times := make([]int64, capacity)
+	skip := 0
+	if r.n > capacity {
+		skip = r.n - capacity
+	}
+	for i := skip; i < r.n; i++ {
+		times[i-skip] = r.times[(r.start+i)%len(r.times)]
+	}
+
+	r.times, r.start, r.n = times, 0, r.n-skip
+}
+
+// push appends t, which must be no earlier than the times in the
+// buffer. The buffer must not be full.
+func (r *ring) push(t int64) {
+	r.times[(r.start+r.n)%len(r.times)] = t
+	r.n++
+}
+
+func (r *ring) list() []time.Time {
+	times := make([]time.Time, r.n)
+	for i := range times {
+		times[i] = time.Unix(0, r.times[(r.start+i)%len(r.times)])
+	}
+	return times
+}
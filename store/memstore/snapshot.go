@@ -0,0 +1,174 @@
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotVersion identifies the format written by SaveTo.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int             `json:"version"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key    string  `json:"key"`
+	Value  int64   `json:"value"`
+	Expiry int64   `json:"expiry,omitempty"`
+	Window []int64 `json:"window,omitempty"`
+	Limit  int     `json:"limit,omitempty"`
+}
+
+// SaveTo writes the keys of the store that haven't expired, along with
+// their values and expiry times, to w as JSON. With an LRU, keys are
+// written from the least to the most recently used so that LoadFrom
+// preserves their order.
+func (ms *MemStore) SaveTo(w io.Writer) error {
+	now := ms.now()
+
+	unlock := ms.lockShards(nil, false)
+	s := snapshot{Version: snapshotVersion}
+	add := func(key string, e *entry) {
+		if e.expired(now) {
+			return
+		}
+		se := snapshotEntry{Key: key, Value: e.value, Expiry: e.expiry}
+		if e.window != nil {
+			se.Limit = len(e.window.times)
+			for _, t := range e.window.list() {
+				se.Window = append(se.Window, t.UnixNano())
+			}
+		}
+		s.Entries = append(s.Entries, se)
+	}
+	for i := range ms.shards {
+		ms.shards[i].each(add)
+	}
+	unlock()
+
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// LoadFrom reads keys written by SaveTo from r and adds them to the
+// store, replacing any existing keys with the same names. Keys that
+// have expired since they were saved are dropped.
+func (ms *MemStore) LoadFrom(r io.Reader) error {
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("memstore: unsupported snapshot version %d", s.Version)
+	}
+
+	now := ms.now()
+
+	defer ms.lockShards(nil, true)()
+
+	for _, se := range s.Entries {
+		e := &entry{value: se.Value, expiry: se.Expiry}
+		if e.expired(now) {
+			continue
+		}
+		if se.Limit > 0 {
+			e.window = &ring{}
+			e.window.resize(se.Limit)
+			for _, t := range se.Window {
+				if e.window.n < se.Limit {
+					e.window.push(t)
+				}
+			}
+		}
+		ms.shard(se.Key).add(se.Key, e)
+	}
+
+	return nil
+}
+
+// Open creates a store like New and loads the keys saved to path by
+// SaveFile, if it exists. Together with StartSnapshots, this lets
+// limits survive restarts of a single instance.
+func Open(maxKeys int, path string) (*MemStore, error) {
+	ms, err := New(maxKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ms, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := ms.LoadFrom(f); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// SaveFile saves the store to path with SaveTo. The snapshot is
+// written to a temporary file in the same directory, which then
+// replaces path, so that path always holds a complete snapshot.
+func (ms *MemStore) SaveFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := ms.SaveTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// StartSnapshots calls SaveFile with path every interval in a background
+// goroutine until the returned function is called, which saves the
+// store a last time. Errors returned by SaveFile are passed to
+// errorHandler unless it is nil.
+func (ms *MemStore) StartSnapshots(path string, interval time.Duration, errorHandler func(error)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	save := func() {
+		if err := ms.SaveFile(path); err != nil && errorHandler != nil {
+			errorHandler(err)
+		}
+	}
+
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				save()
+				return
+			case <-ticker.C:
+				save()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
@@ -0,0 +1,94 @@
+// Package namespacestore offers a store wrapper transforming the keys
+// passed to another throttled store, for example to isolate the keys
+// of several services sharing a Redis server.
+package namespacestore // import "github.com/throttled/throttled/store/namespacestore"
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+// Prefix returns a transform prepending prefix to keys.
+func Prefix(prefix string) func(string) string {
+	return func(key string) string {
+		return prefix + key
+	}
+}
+
+// Hashed returns a transform replacing keys by prefix followed by the
+// hexadecimal SHA-1 digest of the key. This bounds the length of the
+// keys in the store and keeps identifiers used as keys, such as email
+// addresses, out of it.
+func Hashed(prefix string) func(string) string {
+	return func(key string) string {
+		sum := sha1.Sum([]byte(key))
+		return prefix + hex.EncodeToString(sum[:])
+	}
+}
+
+// NamespaceStore wraps a store to transform the keys of all its
+// operations.
+type NamespaceStore struct {
+	store     throttled.GCRAStoreCtx
+	local     throttled.LocalClockStore
+	transform func(string) string
+}
+
+// New creates a store passing the keys of its operations through
+// transform before delegating them to st. transform must be
+// deterministic, and should map distinct keys to distinct results.
+func New(st throttled.GCRAStore, transform func(string) string) *NamespaceStore {
+	local, _ := st.(throttled.LocalClockStore)
+
+	return &NamespaceStore{
+		store:     throttled.WrapStoreWithContext(st),
+		local:     local,
+		transform: transform,
+	}
+}
+
+// GetWithTime calls GetWithTimeCtx with a background context.
+func (s *NamespaceStore) GetWithTime(key string) (int64, time.Time, error) {
+	return s.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx calls GetWithTimeCtx of the wrapped store with the
+// transformed key.
+func (s *NamespaceStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	return s.store.GetWithTimeCtx(ctx, s.transform(key))
+}
+
+// SetIfNotExistsWithTTL calls SetIfNotExistsWithTTLCtx with a
+// background context.
+func (s *NamespaceStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return s.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx calls SetIfNotExistsWithTTLCtx of the
+// wrapped store with the transformed key.
+func (s *NamespaceStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	return s.store.SetIfNotExistsWithTTLCtx(ctx, s.transform(key), value, ttl)
+}
+
+// CompareAndSwapWithTTL calls CompareAndSwapWithTTLCtx with a
+// background context.
+func (s *NamespaceStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx calls CompareAndSwapWithTTLCtx of the
+// wrapped store with the transformed key.
+func (s *NamespaceStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.store.CompareAndSwapWithTTLCtx(ctx, s.transform(key), old, new, ttl)
+}
+
+// UsesLocalClock reports whether the wrapped store uses the local
+// clock, so that wrapping a store doesn't change how a
+// GCRARateLimiter with a clock treats it.
+func (s *NamespaceStore) UsesLocalClock() bool {
+	return s.local != nil && s.local.UsesLocalClock()
+}
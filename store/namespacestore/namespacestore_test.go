@@ -0,0 +1,69 @@
+package namespacestore_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"github.com/throttled/throttled/store/namespacestore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+// Demonstrates how to keep email addresses used as keys out of a
+// shared store.
+func ExampleNew() {
+	store, err := memstore.New(65536)
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter, err := throttled.NewGCRARateLimiter(namespacestore.New(store, namespacestore.Hashed("signup:")), throttled.RateQuota{
+		MaxRate:  throttled.PerHour(5),
+		MaxBurst: 1,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter.RateLimit("user@example.com", 1)
+}
+
+func TestNamespaceStore(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := namespacestore.New(mst, namespacestore.Prefix("ns:"))
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+
+	if _, err := st.SetIfNotExistsWithTTL("namespaced", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if have, _, _ := mst.GetWithTime("ns:namespaced"); have != 1 {
+		t.Errorf("expected the key to be prefixed in the wrapped store but got %d", have)
+	}
+	if !st.UsesLocalClock() {
+		t.Error("expected UsesLocalClock to be forwarded")
+	}
+}
+
+func TestHashed(t *testing.T) {
+	transform := namespacestore.Hashed("ns:")
+
+	key := transform("user@example.com")
+	if have, want := key, transform("user@example.com"); have != want {
+		t.Errorf("expected the transform to be deterministic but got %s and %s", have, want)
+	}
+	if !strings.HasPrefix(key, "ns:") || len(key) != len("ns:")+40 {
+		t.Errorf("expected a prefixed SHA-1 digest but got %s", key)
+	}
+	if strings.Contains(key, "example") {
+		t.Errorf("expected the key not to be readable but got %s", key)
+	}
+	if transform("other@example.com") == key {
+		t.Error("expected distinct keys to be hashed differently")
+	}
+}
@@ -0,0 +1,44 @@
+// Package noopstore offers a store that stores nothing, to disable
+// rate limiting without changing the code using a rate limiter.
+package noopstore // import "github.com/throttled/throttled/store/noopstore"
+
+import (
+	"time"
+)
+
+// NoopStore is a store whose operations succeed without storing
+// anything. Every key is always missing, so a GCRARateLimiter using it
+// permits every request with a quantity within its burst and reports
+// its full limit as remaining.
+type NoopStore struct{}
+
+// New creates a NoopStore.
+func New() *NoopStore {
+	return &NoopStore{}
+}
+
+// GetWithTime returns -1, as for a missing key, and the local time.
+func (*NoopStore) GetWithTime(key string) (int64, time.Time, error) {
+	return -1, time.Now(), nil
+}
+
+// SetIfNotExistsWithTTL does nothing and returns true.
+func (*NoopStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+// CompareAndSwapWithTTL does nothing and returns true.
+func (*NoopStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+// Reset does nothing.
+func (*NoopStore) Reset(key string) error {
+	return nil
+}
+
+// UsesLocalClock reports that the store uses the local time of the
+// machine.
+func (*NoopStore) UsesLocalClock() bool {
+	return true
+}
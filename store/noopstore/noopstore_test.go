@@ -0,0 +1,36 @@
+package noopstore_test
+
+import (
+	"testing"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/noopstore"
+)
+
+// Demonstrates disabling rate limiting, for example in development.
+func ExampleNew() {
+	rateLimiter, err := throttled.NewGCRARateLimiter(noopstore.New(), throttled.RateQuota{
+		MaxRate:  throttled.PerMin(20),
+		MaxBurst: 5,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter.RateLimit("foo", 1)
+}
+
+func TestNoopStore(t *testing.T) {
+	rl, err := throttled.NewGCRARateLimiter(noopstore.New(), throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if limited, result, err := rl.RateLimit("foo", 1); err != nil {
+			t.Fatal(err)
+		} else if limited || result.Remaining != 2 {
+			t.Fatalf("%d: expected the request to be permitted with 2 remaining but got %#v", i, result)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package otelstore offers a store wrapper tracing the operations of
+// another throttled store with OpenTelemetry.
+package otelstore // import "github.com/throttled/throttled/store/otelstore"
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/throttled/throttled"
+)
+
+const instrumentationName = "github.com/throttled/throttled/store/otelstore"
+
+// Attribute keys set on the spans.
+const (
+	StoreTypeKey = attribute.Key("throttled.store.type")
+	KeyPrefixKey = attribute.Key("throttled.key_prefix")
+	SwappedKey   = attribute.Key("throttled.cas.swapped")
+	RetriesKey   = attribute.Key("throttled.cas.retries")
+)
+
+// OTelStore wraps a store to start a span for each of its operations.
+type OTelStore struct {
+	store  throttled.GCRAStoreCtx
+	local  throttled.LocalClockStore
+	tracer trace.Tracer
+	attrs  []attribute.KeyValue
+}
+
+// New creates a store tracing the operations of st with the tracer
+// provider tp, or the global one if tp is nil. The spans are children
+// of the span in the context passed to RateLimitCtx, and have
+// attributes for the type of st and keyPrefix, which should be the
+// prefix st was configured with. Keys themselves are not recorded
+// since they often identify users.
+//
+// Updates record whether they succeeded and how many times the rate
+// limiter had already retried after concurrent changes, as reported by
+// throttled.RetryFromContext. Failed operations mark their span as
+// errored.
+func New(st throttled.GCRAStore, keyPrefix string, tp trace.TracerProvider) *OTelStore {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	local, _ := st.(throttled.LocalClockStore)
+
+	return &OTelStore{
+		store:  throttled.WrapStoreWithContext(st),
+		local:  local,
+		tracer: tp.Tracer(instrumentationName),
+		attrs: []attribute.KeyValue{
+			StoreTypeKey.String(fmt.Sprintf("%T", st)),
+			KeyPrefixKey.String(keyPrefix),
+		},
+	}
+}
+
+// GetWithTime calls GetWithTimeCtx with a background context.
+func (s *OTelStore) GetWithTime(key string) (int64, time.Time, error) {
+	return s.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx traces GetWithTimeCtx of the wrapped store.
+func (s *OTelStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	ctx, span := s.start(ctx, "GetWithTime")
+	defer span.End()
+
+	v, now, err := s.store.GetWithTimeCtx(ctx, key)
+	setError(span, err)
+
+	return v, now, err
+}
+
+// SetIfNotExistsWithTTL calls SetIfNotExistsWithTTLCtx with a
+// background context.
+func (s *OTelStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return s.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx traces SetIfNotExistsWithTTLCtx of the
+// wrapped store.
+func (s *OTelStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	ctx, span := s.start(ctx, "SetIfNotExistsWithTTL")
+	defer span.End()
+
+	updated, err := s.store.SetIfNotExistsWithTTLCtx(ctx, key, value, ttl)
+	setUpdated(ctx, span, updated, err)
+
+	return updated, err
+}
+
+// CompareAndSwapWithTTL calls CompareAndSwapWithTTLCtx with a
+// background context.
+func (s *OTelStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return s.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx traces CompareAndSwapWithTTLCtx of the
+// wrapped store.
+func (s *OTelStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	ctx, span := s.start(ctx, "CompareAndSwapWithTTL")
+	defer span.End()
+
+	swapped, err := s.store.CompareAndSwapWithTTLCtx(ctx, key, old, new, ttl)
+	setUpdated(ctx, span, swapped, err)
+
+	return swapped, err
+}
+
+// UsesLocalClock reports whether the wrapped store uses the local
+// clock, so that wrapping a store doesn't change how a
+// GCRARateLimiter with a clock treats it.
+func (s *OTelStore) UsesLocalClock() bool {
+	return s.local != nil && s.local.UsesLocalClock()
+}
+
+func (s *OTelStore) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "throttled."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(s.attrs...),
+	)
+}
+
+func setUpdated(ctx context.Context, span trace.Span, updated bool, err error) {
+	span.SetAttributes(
+		SwappedKey.Bool(updated),
+		RetriesKey.Int(throttled.RetryFromContext(ctx)),
+	)
+	setError(span, err)
+}
+
+func setError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,94 @@
+package otelstore_test
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"github.com/throttled/throttled/store/otelstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+// Demonstrates how to trace the store operations of a rate limiter
+// with the global OpenTelemetry tracer provider.
+func ExampleNew() {
+	store, err := memstore.New(65536)
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter, err := throttled.NewGCRARateLimiter(otelstore.New(store, "", nil), throttled.RateQuota{
+		MaxRate:  throttled.PerMin(20),
+		MaxBurst: 5,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Pass the context of the request to create child spans
+	rateLimiter.RateLimitCtx(context.Background(), "key", 1)
+}
+
+func TestOTelStore(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, otelstore.New(mst, "", nil))
+}
+
+func TestOTelStoreSpans(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	st := otelstore.New(mst, "prefix:", tp)
+
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	if _, _, err := rl.RateLimitCtx(ctx, "foo", 1); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := rec.Ended()
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	if len(spans) != 3 || names[0] != "throttled.GetWithTime" || names[1] != "throttled.SetIfNotExistsWithTTL" {
+		t.Fatalf("expected spans for GetWithTime and SetIfNotExistsWithTTL but got %v", names)
+	}
+
+	update := spans[1]
+	if update.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected the store spans to be children of the request span")
+	}
+
+	attrs := map[string]interface{}{}
+	for _, kv := range update.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	for k, want := range map[string]interface{}{
+		"throttled.store.type":  "*memstore.MemStore",
+		"throttled.key_prefix":  "prefix:",
+		"throttled.cas.swapped": true,
+		"throttled.cas.retries": int64(0),
+	} {
+		if have := attrs[k]; have != want {
+			t.Errorf("expected attribute %s to be %v but got %v", k, want, have)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package postgresstore offers a PostgreSQL-based store implementation for throttled.
+package postgresstore // import "github.com/throttled/throttled/store/postgresstore"
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PostgresStore implements a PostgreSQL-based store using
+// database/sql. It works with any PostgreSQL driver.
+type PostgresStore struct {
+	db     *sql.DB
+	table  string
+	prefix string
+
+	getQuery, setQuery, casQuery, sweepQuery string
+}
+
+// New creates a new PostgreSQL-based store, using the provided
+// database handle to store keys in table, which can be created with
+// CreateTable. The table name is quoted and used as a single
+// identifier. The keys will have the specified keyPrefix, which may
+// be an empty string. Any updating operations will reset the key TTL
+// to the provided value, with a minimum of one second.
+//
+// GetWithTime returns the time of the database server so that every
+// instance sharing the table uses the same clock. PostgreSQL has no
+// native expiry, so expired rows are ignored by every operation and
+// must be deleted with Sweep or StartSweeper to reclaim space.
+// Depends on PostgreSQL 9.5+ for INSERT ... ON CONFLICT support.
+func New(db *sql.DB, table, keyPrefix string) (*PostgresStore, error) {
+	t := quoteIdentifier(table)
+
+	return &PostgresStore{
+		db:     db,
+		table:  t,
+		prefix: keyPrefix,
+
+		getQuery: `SELECT now(), (SELECT value FROM ` + t + ` WHERE key = $1 AND expires_at > now())`,
+		setQuery: `INSERT INTO ` + t + ` AS t (key, value, expires_at)
+VALUES ($1, $2, now() + $3::float8 * interval '1 microsecond')
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at
+WHERE t.expires_at <= now()
+RETURNING key`,
+		casQuery: `UPDATE ` + t + ` SET value = $3, expires_at = now() + $4::float8 * interval '1 microsecond'
+WHERE key = $1 AND value = $2 AND expires_at > now()`,
+		sweepQuery: `DELETE FROM ` + t + ` WHERE expires_at <= now()`,
+	}, nil
+}
+
+// CreateTable creates the table used by the store if it doesn't
+// exist yet.
+func (p *PostgresStore) CreateTable() error {
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS ` + p.table + ` (
+	key TEXT PRIMARY KEY,
+	value BIGINT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+)`)
+	return err
+}
+
+// GetWithTime returns the value of the key if it is in the store
+// or -1 if it does not exist. It also returns the current time at
+// the database server to microsecond precision.
+func (p *PostgresStore) GetWithTime(key string) (int64, time.Time, error) {
+	var now time.Time
+	var v sql.NullInt64
+
+	if err := p.db.QueryRow(p.getQuery, p.prefix+key).Scan(&now, &v); err != nil {
+		return 0, now, err
+	}
+
+	if !v.Valid {
+		return -1, now, nil
+	}
+
+	return v.Int64, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store it returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set atomically.
+func (p *PostgresStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	var k string
+
+	err := p.db.QueryRow(p.setQuery, p.prefix+key, value, ttlMicroseconds(ttl)).Scan(&k)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the
+// ttl for the key is updated atomically.
+func (p *PostgresStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	res, err := p.db.Exec(p.casQuery, p.prefix+key, old, new, ttlMicroseconds(ttl))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// Sweep deletes all expired rows from the table and returns how many
+// were deleted.
+func (p *PostgresStore) Sweep() (int64, error) {
+	res, err := p.db.Exec(p.sweepQuery)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StartSweeper calls Sweep every interval in a background goroutine
+// until the returned function is called. Errors returned by Sweep are
+// passed to errorHandler unless it is nil.
+func (p *PostgresStore) StartSweeper(interval time.Duration, errorHandler func(error)) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := p.Sweep(); err != nil && errorHandler != nil {
+					errorHandler(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func ttlMicroseconds(ttl time.Duration) int64 {
+	// Keep results for a minimum of one second, like the other stores.
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return int64(ttl / time.Microsecond)
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,97 @@
+package postgresstore_test
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/postgresstore"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+const postgresTestTable = "throttled_test"
+
+// Demonstrates how to initialize a RateLimiter with PostgreSQL.
+func ExampleNew() {
+	// import _ "github.com/lib/pq"
+
+	db, err := sql.Open("postgres", "postgres://localhost/app?sslmode=disable")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := postgresstore.New(db, "throttled", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.CreateTable(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Delete expired rows every minute
+	stop := store.StartSweeper(time.Minute, func(err error) { log.Print(err) })
+	defer stop()
+
+	quota := throttled.RateQuota{MaxRate: throttled.PerMin(20), MaxBurst: 5}
+	throttled.NewGCRARateLimiter(store, quota)
+}
+
+func TestPostgresStore(t *testing.T) {
+	db, st := setupPostgres(t)
+	defer db.Close()
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+
+	if _, err := st.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if have, _, err := st.GetWithTime("ttl"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected the swept key to be missing but got %d", have)
+	}
+}
+
+func BenchmarkPostgresStore(b *testing.B) {
+	db, st := setupPostgres(b)
+	defer db.Close()
+
+	storetest.BenchmarkGCRAStore(b, st)
+}
+
+// setupPostgres connects to the database given by the POSTGRES_DSN
+// environment variable.
+func setupPostgres(tb testing.TB) (*sql.DB, *postgresstore.PostgresStore) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("POSTGRES_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	st, err := postgresstore.New(db, postgresTestTable, "")
+	if err != nil {
+		db.Close()
+		tb.Fatal(err)
+	}
+
+	if _, err := db.Exec(`DROP TABLE IF EXISTS ` + postgresTestTable); err != nil {
+		db.Close()
+		tb.Fatal(err)
+	}
+	if err := st.CreateTable(); err != nil {
+		db.Close()
+		tb.Fatal(err)
+	}
+
+	return db, st
+}
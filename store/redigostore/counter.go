@@ -0,0 +1,44 @@
+package redigostore
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// IncrementWithTTL atomically adds delta to the value of key, which is
+// treated as 0 if the key does not exist, and returns the new value.
+// The key TTL is set to ttl, rounded down to the nearest millisecond,
+// in the same transaction.
+func (r *RedigoStore) IncrementWithTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+	key = r.key(key)
+
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	ttlMilliseconds := int64(ttl / time.Millisecond)
+
+	// A `PEXPIRE 0` will delete the key immediately, as for EXPIRE
+	if ttlMilliseconds < 1 {
+		ttlMilliseconds = 1
+	}
+
+	conn.Send("MULTI")
+	conn.Send("INCRBY", key, delta)
+	conn.Send("PEXPIRE", key, ttlMilliseconds)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	var v int64
+	if _, err := redis.Scan(reply, &v); err != nil {
+		return 0, err
+	}
+
+	return v, nil
+}
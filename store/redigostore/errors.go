@@ -0,0 +1,67 @@
+package redigostore
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// ErrStoreKeyMissing matches the error reply of the
+	// compare-and-swap script for a missing key, which
+	// CompareAndSwapWithTTL reports as a failed swap rather than an
+	// error.
+	ErrStoreKeyMissing = errors.New("redigostore: key does not exist")
+
+	// ErrEvalUnsupported matches the errors returned when the server
+	// doesn't know the EVAL command, as with some proxies and managed
+	// Redis offerings. CompareAndSwapWithTTL,
+	// CompareAndSwapMultiWithTTL and RateLimitAtomic then fall back
+	// to transactions with WATCH, unless the store was
+	// created with RequireEval, while the operations that only exist
+	// as scripts return the error.
+	ErrEvalUnsupported = errors.New("redigostore: the server does not support EVAL")
+
+	// ErrUnexpectedReply matches the errors returned when a reply to
+	// a pipelined command doesn't have the type of its command, as
+	// when the connection receives a message it didn't ask for. The
+	// connection is resynchronized before the error is returned, so
+	// that the following commands get their own replies.
+	ErrUnexpectedReply = errors.New("redigostore: unexpected reply")
+)
+
+// A replyError is an error reply from Redis identified as one of the
+// sentinel errors of the package, which errors.Is matches.
+type replyError struct {
+	sentinel error
+	reply    redis.Error
+}
+
+func (e *replyError) Error() string        { return string(e.reply) }
+func (e *replyError) Is(target error) bool { return target == e.sentinel }
+func (e *replyError) Unwrap() error        { return e.reply }
+
+// Identify the error replies to EVAL that have a sentinel error,
+// leaving other errors unchanged.
+func classify(err error) error {
+	reply, ok := err.(redis.Error)
+	if !ok {
+		return err
+	}
+
+	switch {
+	case string(reply) == redisCASMissingKey:
+		return &replyError{sentinel: ErrStoreKeyMissing, reply: reply}
+	case isUnknownCommand(reply):
+		return &replyError{sentinel: ErrEvalUnsupported, reply: reply}
+	}
+	return err
+}
+
+// Report whether err is the error reply of a server that doesn't know
+// the command, or has it disabled with rename-command.
+func isUnknownCommand(err error) bool {
+	reply, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(reply), "ERR unknown command")
+}
@@ -0,0 +1,137 @@
+package redigostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/throttled/throttled"
+)
+
+// RateLimitAtomic applies the generic cell-rate algorithm to key in a
+// single script using the time of the Redis server, saving the round
+// trip between GetWithTime and CompareAndSwapWithTTL. The key TTL is
+// set to the time until the new theoretical arrival time, rounded up
+// to the nearest millisecond but no shorter than the MinTTL option,
+// as by New. Depends on Redis 3.2+ for script effects
+// replication. If the server doesn't support EVAL, the same update is
+// made in a transaction with WATCH, retried until no other client
+// modifies the key in between.
+func (r *RedigoStore) RateLimitAtomic(ctx context.Context, key string, quantity int, emissionInterval, delayVariationTolerance time.Duration) (int64, time.Time, error) {
+	var now time.Time
+
+	key = r.key(key)
+
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return 0, now, err
+	}
+	defer conn.Close()
+
+	if !r.evalSupported() {
+		return r.rateLimitWatch(ctx, conn, key, quantity, emissionInterval, delayVariationTolerance)
+	}
+
+	reply, err := redis.Values(gcraScript.DoContext(ctx, conn, key,
+		quantity, int64(emissionInterval), int64(delayVariationTolerance), r.ttlMilliseconds(0)))
+	if err = r.checkEval(err); errors.Is(err, ErrEvalUnsupported) && !r.requireEval {
+		return r.rateLimitWatch(ctx, conn, key, quantity, emissionInterval, delayVariationTolerance)
+	}
+	r.observeCAS(throttled.CASPathEval, err)
+	if err != nil {
+		return 0, now, err
+	}
+
+	// The reply is parsed by hand since redis.Scan allocates, which
+	// matters on the path taken by every request.
+	if len(reply) != 2 {
+		return 0, now, fmt.Errorf("%w to EVAL: %v", ErrUnexpectedReply, reply)
+	}
+	if now, err = parseTime(reply[1]); err != nil {
+		return 0, now, fmt.Errorf("%w to EVAL: %v", ErrUnexpectedReply, reply)
+	}
+	throttled.RecordStoreTime(ctx, now)
+
+	tat, err := parseInt(reply[0])
+	if err != nil {
+		return 0, now, fmt.Errorf("%w to EVAL: %v", ErrUnexpectedReply, reply)
+	}
+
+	return tat, now, nil
+}
+
+// Apply the same update as redisGCRAScript in a transaction, which is
+// retried whenever it is discarded because the key was modified after
+// being watched. If ctx is done in the middle of the transaction, the
+// connection is marked as broken and closed by the pool, so that the
+// server drops the watch and the queued commands.
+func (r *RedigoStore) rateLimitWatch(ctx context.Context, conn redis.Conn, key string, quantity int, emissionInterval, delayVariationTolerance time.Duration) (int64, time.Time, error) {
+	tat, now, err := r.rateLimitWatchLoop(ctx, conn, key, quantity, emissionInterval, delayVariationTolerance)
+	r.observeCAS(throttled.CASPathWatch, err)
+	return tat, now, err
+}
+
+func (r *RedigoStore) rateLimitWatchLoop(ctx context.Context, conn redis.Conn, key string, quantity int, emissionInterval, delayVariationTolerance time.Duration) (int64, time.Time, error) {
+	for {
+		var now time.Time
+
+		if err := ctx.Err(); err != nil {
+			return 0, now, err
+		}
+
+		if _, err := redis.DoContext(conn, ctx, "WATCH", key); err != nil {
+			return 0, now, err
+		}
+
+		useTime := r.readTime(ctx)
+		if useTime {
+			if err := conn.Send("TIME"); err != nil {
+				return 0, now, err
+			}
+			if err := conn.Flush(); err != nil {
+				return 0, now, err
+			}
+		}
+		now, err := r.receiveTime(ctx, conn, useTime)
+		if err != nil {
+			return 0, now, err
+		}
+
+		tat, err := redis.Int64(redis.DoContext(conn, ctx, "GET", key))
+		if err == redis.ErrNil {
+			tat = -1
+		} else if err != nil {
+			return 0, now, err
+		}
+
+		var off time.Duration
+		if tat != -1 && tat > now.UnixNano() {
+			off = time.Duration(tat - now.UnixNano())
+		}
+		off += time.Duration(quantity) * emissionInterval
+
+		if off > delayVariationTolerance {
+			_, err := redis.DoContext(conn, ctx, "UNWATCH")
+			return tat, now, err
+		}
+
+		ttl := r.ttlMilliseconds(off)
+
+		if _, err := redis.DoContext(conn, ctx, "MULTI"); err != nil {
+			return 0, now, err
+		}
+		if _, err := redis.DoContext(conn, ctx, "SET", key, now.Add(off).UnixNano(), "PX", ttl); err != nil {
+			return 0, now, err
+		}
+
+		// EXEC replies nil if the transaction was discarded
+		if reply, err := redis.DoContext(conn, ctx, "EXEC"); err != nil {
+			return 0, now, err
+		} else if reply != nil {
+			return tat, now, nil
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package redigostore
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// The TTL of the hash is only ever extended, so that updating one
+	// of its fields never shortens the life of the others.
+	redisPackedSetNXScript = `
+local set = redis.call('hsetnx', KEYS[1], ARGV[1], ARGV[2])
+if set == 1 and redis.call('pttl', KEYS[1]) < tonumber(ARGV[3]) then
+  redis.call('pexpire', KEYS[1], ARGV[3])
+end
+return set
+`
+	redisPackedCASScript = `
+local v = redis.call('hget', KEYS[1], ARGV[1])
+if v == false or v ~= ARGV[2] then
+  return 0
+end
+redis.call('hset', KEYS[1], ARGV[1], ARGV[3])
+if redis.call('pttl', KEYS[1]) < tonumber(ARGV[4]) then
+  redis.call('pexpire', KEYS[1], ARGV[4])
+end
+return 1
+`
+)
+
+var (
+	packedSetNXScript = redis.NewScript(1, redisPackedSetNXScript)
+	packedCASScript   = redis.NewScript(1, redisPackedCASScript)
+)
+
+// PackedStore implements a Redis-based store that packs several keys
+// into the fields of one hash, to reduce the number of keys in Redis
+// and their memory overhead when there are many related limits, such
+// as one per user and endpoint.
+//
+// The TTL applies to the hash rather than to each key: an update
+// extends the TTL of the hash to the TTL of the update if it is
+// longer, and a key is only removed when its whole hash expires or by
+// Reset. A key that outlives its TTL in this way holds a theoretical
+// arrival time in the past, which GCRARateLimiter treats as a missing
+// key, so limits are unaffected, but the hash of a group that is
+// constantly updated keeps growing with the keys it has ever held.
+type PackedStore struct {
+	store *RedigoStore
+	group func(key string) string
+}
+
+// NewPacked creates a new Redis-based store packing keys into hashes.
+// The hash holding key is named by group(key), prefixed with
+// keyPrefix and passed through the KeyFunc option if given, and key
+// is its field. For example, a group returning the
+// user part of "user:endpoint" keys stores all the limits of a user
+// in one hash. The pool, db and options are used as by New, except
+// that the store requires EVAL: its updates return ErrEvalUnsupported
+// if the server doesn't support it or DisableEval is given.
+func NewPacked(pool *redis.Pool, keyPrefix string, db int, group func(key string) string, opts ...Option) (*PackedStore, error) {
+	st, err := New(pool, keyPrefix, db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &PackedStore{store: st, group: group}, nil
+}
+
+// GetWithTime returns the value of the key if it is in the store
+// or -1 if it does not exist. It also returns the current time at
+// the redis server to microsecond precision.
+func (p *PackedStore) GetWithTime(key string) (int64, time.Time, error) {
+	return p.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (p *PackedStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	var v int64
+	var now time.Time
+	err := p.store.retry(ctx, func() (err error) {
+		v, now, err = p.getWithTime(ctx, key)
+		return err
+	})
+	return v, now, err
+}
+
+func (p *PackedStore) getWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	var now time.Time
+
+	conn, err := p.store.getConn(ctx)
+	if err != nil {
+		return 0, now, err
+	}
+	defer conn.Close()
+
+	useTime := p.store.readTime(ctx)
+	if useTime {
+		conn.Send("TIME")
+	}
+	conn.Send("HGET", p.hash(key), key)
+	conn.Flush()
+	now, err = p.store.receiveTime(ctx, conn, useTime)
+	if err != nil {
+		return 0, now, err
+	}
+
+	v, err := receiveValue(ctx, conn, "HGET")
+	if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store and returns whether a new value was set.
+// If a new value was set, the TTL of the hash holding key is extended
+// to ttl, rounded as by New, if it is shorter.
+func (p *PackedStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return p.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (p *PackedStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	var updated bool
+	err := p.store.retry(ctx, func() (err error) {
+		updated, err = p.eval(ctx, packedSetNXScript, key, value, p.store.ttlMilliseconds(ttl))
+		return err
+	})
+	return updated, err
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the TTL
+// of the hash holding key is extended to ttl, rounded as by New, if it
+// is shorter.
+func (p *PackedStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return p.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (p *PackedStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := p.store.retry(ctx, func() (err error) {
+		swapped, err = p.eval(ctx, packedCASScript, key, old, new, p.store.ttlMilliseconds(ttl))
+		return err
+	})
+	return swapped, err
+}
+
+// Reset removes key from the store, leaving the other keys of its
+// hash untouched.
+func (p *PackedStore) Reset(key string) error {
+	conn, err := p.store.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HDEL", p.hash(key), key)
+	return err
+}
+
+// Run script on the hash holding key, with key and args as arguments.
+func (p *PackedStore) eval(ctx context.Context, script *redis.Script, key string, args ...interface{}) (bool, error) {
+	if !p.store.evalSupported() {
+		return false, ErrEvalUnsupported
+	}
+
+	conn, err := p.store.getConn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	keysAndArgs := append([]interface{}{p.hash(key), key}, args...)
+	ok, err := redis.Bool(script.DoContext(ctx, conn, keysAndArgs...))
+	return ok, p.store.checkEval(err)
+}
+
+func (p *PackedStore) hash(key string) string {
+	return p.store.key(p.group(key))
+}
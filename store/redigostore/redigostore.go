@@ -2,10 +2,19 @@
 package redigostore // import "github.com/throttled/throttled/store/redigostore"
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+
+	"github.com/throttled/throttled"
 )
 
 const (
@@ -18,104 +27,425 @@ end
 if v ~= ARGV[1] then
   return 0
 end
-redis.call('setex', KEYS[1], ARGV[3], ARGV[2])
+redis.call('psetex', KEYS[1], ARGV[3], ARGV[2])
+return 1
+`
+	redisCASMultiScript = `
+local n = #KEYS
+for i = 1, n do
+  local v = redis.call('get', KEYS[i])
+  if v == false then
+    if ARGV[i] ~= '-1' then
+      return 0
+    end
+  elseif v ~= ARGV[i] then
+    return 0
+  end
+end
+for i = 1, n do
+  redis.call('psetex', KEYS[i], ARGV[2*n+i], ARGV[n+i])
+end
 return 1
 `
+
+	// Each request is a member of a sorted set scored by its time in
+	// microseconds, which unlike nanoseconds fits exactly in a double.
+	// The members are made unique by the nonce in ARGV[4].
+	redisSlidingWindowScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[3])
+local quantity = tonumber(ARGV[1])
+redis.call('zremrangebyscore', KEYS[1], '-inf', now - window)
+local added = 0
+if redis.call('zcard', KEYS[1]) + quantity <= tonumber(ARGV[2]) then
+  added = 1
+  for i = 1, quantity do
+    redis.call('zadd', KEYS[1], now, ARGV[4] .. ':' .. i)
+  end
+  if quantity > 0 then
+    redis.call('pexpire', KEYS[1], math.ceil(window / 1000))
+  end
+end
+local entries = redis.call('zrange', KEYS[1], 0, -1, 'withscores')
+local times = {}
+for i = 2, #entries, 2 do
+  times[#times + 1] = entries[i]
+end
+return {added, t, times}
+`
+
+	// The theoretical arrival times are split into seconds and
+	// nanoseconds since Lua numbers are doubles, which can't represent
+	// nanoseconds since the epoch exactly. Differences to the current
+	// time are exact as long as they are under about 100 days. The TTL
+	// is rounded up to the millisecond and no shorter than ARGV[4], as
+	// by ttlMilliseconds.
+	redisGCRAScript = `
+redis.replicate_commands()
+local t = redis.call('time')
+local now_s = tonumber(t[1])
+local now_ns = tonumber(t[2]) * 1000
+local v = redis.call('get', KEYS[1])
+local diff = 0
+if v then
+  local s, ns = 0, tonumber(v)
+  if #v > 9 then
+    s = tonumber(string.sub(v, 1, -10))
+    ns = tonumber(string.sub(v, -9))
+  end
+  diff = (s - now_s) * 1000000000 + (ns - now_ns)
+end
+local off = math.max(diff, 0) + tonumber(ARGV[1]) * tonumber(ARGV[2])
+if off <= tonumber(ARGV[3]) then
+  local total = now_ns + off
+  local ns = tostring(total % 1000000000)
+  local tat = tostring(now_s + math.floor(total / 1000000000)) .. string.rep('0', 9 - #ns) .. ns
+  redis.call('set', KEYS[1], tat, 'px', math.max(math.ceil(off / 1000000), tonumber(ARGV[4])))
+end
+return {v or '-1', t}
+`
+)
+
+// The scripts are run with EVALSHA, which saves sending their source
+// on every call, and sent with EVAL only when the server doesn't have
+// them cached, such as after a restart or SCRIPT FLUSH.
+var (
+	casScript           = redis.NewScript(1, redisCASScript)
+	casMultiScript      = redis.NewScript(-1, redisCASMultiScript)
+	slidingWindowScript = redis.NewScript(1, redisSlidingWindowScript)
+	gcraScript          = redis.NewScript(1, redisGCRAScript)
 )
 
 // RedigoStore implements a Redis-based store using redigo.
 type RedigoStore struct {
-	pool   *redis.Pool
-	prefix string
-	db     int
+	pool       *redis.Pool
+	prefix     string
+	keyFunc    func(string) string
+	db         int
+	selectArgs []interface{} // Built once as they escape to the heap
+	skipSelect bool
+	retries    int
+
+	requireEval bool
+
+	// Set to 1 once the server rejected EVAL, or by DisableEval,
+	// accessed atomically.
+	noEval int32
+
+	// Set to 1 once the server rejected the options of SET, accessed
+	// atomically.
+	legacySet int32
+
+	// Set to 1 once the server rejected TIME, accessed atomically.
+	noTime int32
+
+	minTTL time.Duration // Defaults to one second
+
+	observer throttled.CASObserver
+}
+
+// An Option configures a RedigoStore.
+type Option func(*RedigoStore)
+
+// SkipSelect makes the store use connections as they come from the
+// pool without selecting a database, for pools whose connections are
+// already on the right database, for example because they are dialed
+// with redis.DialDatabase. The db argument of New is then ignored.
+func SkipSelect() Option {
+	return func(r *RedigoStore) {
+		r.skipSelect = true
+	}
+}
+
+// DisableEval makes the store use transactions with WATCH instead of
+// scripts from the start, for servers or proxies known not to support
+// EVAL. This saves the failed EVAL the store otherwise makes before
+// falling back. The operations that only exist as scripts, such as
+// AddWithinLimit, return ErrEvalUnsupported without being attempted.
+func DisableEval() Option {
+	return func(r *RedigoStore) {
+		r.noEval = 1
+	}
+}
+
+// RequireEval makes the store return ErrEvalUnsupported instead of
+// falling back to transactions with WATCH when the server doesn't
+// support EVAL, to fail fast if scripting is expected to be available.
+func RequireEval() Option {
+	return func(r *RedigoStore) {
+		r.requireEval = true
+	}
+}
+
+// CASObserver makes the store notify o of the path taken by each of
+// its atomic updates, which are CompareAndSwapWithTTL and
+// RateLimitAtomic, and of the fallback from EVAL to WATCH if the server
+// rejects EVAL.
+func CASObserver(o throttled.CASObserver) Option {
+	return func(r *RedigoStore) {
+		r.observer = o
+	}
+}
+
+// MinTTL sets the shortest TTL the store gives a key, which defaults
+// to one second. TTLs are otherwise rounded up to the nearest
+// millisecond, so that a key never expires before the TTL asked for.
+// A shorter minimum, down to one millisecond, frees the keys of quotas
+// with emission intervals well under a second sooner, such as 5 per
+// second without burst, at the cost of a key updated with a TTL of 0
+// expiring almost immediately.
+func MinTTL(d time.Duration) Option {
+	return func(r *RedigoStore) {
+		r.minTTL = d
+	}
+}
+
+// KeyFunc makes the store pass every key through fn before prefixing
+// it with the keyPrefix of New, in all of its operations. This applies
+// a key policy uniformly, for example to add hash tags colocating the
+// keys of a tenant in Redis Cluster. fn must be deterministic, and
+// should map distinct keys to distinct results. ScanKeys matches and
+// reports the keys returned by fn.
+func KeyFunc(fn func(string) string) Option {
+	return func(r *RedigoStore) {
+		r.keyFunc = fn
+	}
 }
 
 // New creates a new Redis-based store, using the provided pool to get
 // its connections. The keys will have the specified keyPrefix, which
 // may be an empty string, and the database index specified by db will
 // be selected to store the keys. Any updating operations will reset
-// the key TTL to the provided value rounded down to the nearest
-// second. Depends on Redis 2.6+ for EVAL support.
-func New(pool *redis.Pool, keyPrefix string, db int) (*RedigoStore, error) {
-	return &RedigoStore{
-		pool:   pool,
-		prefix: keyPrefix,
-		db:     db,
-	}, nil
+// the key TTL to the provided value rounded up to the nearest
+// millisecond, but no shorter than the MinTTL option. Depends on Redis
+// 2.6+ for EVAL support and millisecond TTLs.
+//
+// The pool must connect to a single Redis server. Redis Cluster
+// rejects SELECT and requires db to be 0; use goredisstore.NewCluster
+// for a cluster-aware store. If a connection can't select db, for
+// example because of a restricted ACL user, operations return an error
+// naming the database rather than running against the wrong one. TLS
+// and authentication are configured when the pool dials, for example
+// with redis.DialUseTLS and redis.DialPassword.
+//
+// A server listening on a Unix socket, or reached through a custom
+// dialer such as a tunnel, is also configured when the pool dials, as
+// with redis.Dial("unix", "/var/run/redis.sock") or redis.DialNetDial.
+// No SELECT is sent when db is 0. For another database, dial with
+// redis.DialDatabase and pass SkipSelect, so that connections are
+// pinned to the database when they are created rather than sent
+// SELECT every time they are taken from the pool, or pass CacheSelect
+// to send SELECT once per connection.
+//
+// Some proxies and Redis-compatible services don't support the TIME
+// command. When TIME is rejected as an unknown command, the store
+// switches to the local clock of the machine for good, which
+// UsesLocalClock then reports, instead of failing. The limits are then
+// only as accurate as the clocks of the machines sharing the store are
+// synchronized: a machine whose clock is ahead sees the requests of the
+// others as older than they are and permits more of them, and one
+// whose clock is behind permits fewer. Scripts such as the one of
+// RateLimitAtomic still use the time of the server, so the clocks
+// should also be close to it.
+func New(pool *redis.Pool, keyPrefix string, db int, opts ...Option) (*RedigoStore, error) {
+	r := &RedigoStore{
+		pool:       pool,
+		prefix:     keyPrefix,
+		db:         db,
+		selectArgs: []interface{}{db},
+		minTTL:     time.Second,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// RetryTransientErrors makes the store retry GetWithTime,
+// SetIfNotExistsWithTTL and CompareAndSwapWithTTL when they fail with a
+// transient error up to retries times, each time with a new connection
+// from the pool. This helps ride out a Sentinel failover or a server
+// restart. Transient errors are network errors, such as a reset or
+// closed connection, and replies indicating that the server is
+// temporarily unable to serve the command: LOADING, BUSY, TRYAGAIN,
+// CLUSTERDOWN, MASTERDOWN and READONLY. Other errors, including the
+// context being done, are returned immediately. The redirections of
+// Redis Cluster, MOVED and ASK, aren't retried since the pool connects
+// to a single server.
+//
+// Before retry n, the store waits for a random duration of up to
+// 100ms * 2^(n-1), capped at two seconds, so that a few retries span a
+// failover. The wait ends early with the last error when the context
+// of the operation is done.
+//
+// A command may have been applied before its connection failed, in
+// which case retrying can count a request twice. This errs on the side
+// of limiting.
+func RetryTransientErrors(retries int) Option {
+	return func(r *RedigoStore) {
+		r.retries = retries
+	}
+}
+
+// UsesLocalClock reports whether GetWithTime returns the local time
+// of the machine, which is the case once the server rejected the TIME
+// command.
+func (r *RedigoStore) UsesLocalClock() bool {
+	return !r.timeSupported()
 }
 
 // GetWithTime returns the value of the key if it is in the store
 // or -1 if it does not exist. It also returns the current time at
-// the redis server to microsecond precision.
+// the redis server to microsecond precision, or the local time if the
+// server doesn't support TIME.
 func (r *RedigoStore) GetWithTime(key string) (int64, time.Time, error) {
+	return r.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime. If ctx
+// was returned by throttled.WithSharedStoreTime, the time of the
+// server is only read if no earlier operation given ctx recorded it.
+func (r *RedigoStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	var v int64
+	var now time.Time
+	err := r.retry(ctx, func() (err error) {
+		v, now, err = r.getWithTime(ctx, key)
+		return err
+	})
+	return v, now, err
+}
+
+func (r *RedigoStore) getWithTime(ctx context.Context, key string) (int64, time.Time, error) {
 	var now time.Time
 
-	key = r.prefix + key
+	key = r.key(key)
 
-	conn, err := r.getConn()
+	conn, err := r.getConn(ctx)
 	if err != nil {
 		return 0, now, err
 	}
 	defer conn.Close()
 
-	conn.Send("TIME")
+	useTime := r.readTime(ctx)
+	if useTime {
+		conn.Send("TIME")
+	}
 	conn.Send("GET", key)
 	conn.Flush()
-	timeReply, err := redis.Values(conn.Receive())
+	now, err = r.receiveTime(ctx, conn, useTime)
 	if err != nil {
 		return 0, now, err
 	}
 
-	var s, us int64
-	if _, err := redis.Scan(timeReply, &s, &us); err != nil {
+	v, err := receiveValue(ctx, conn, "GET")
+	if err != nil {
 		return 0, now, err
 	}
-	now = time.Unix(s, us*int64(time.Microsecond))
 
-	v, err := redis.Int64(conn.Receive())
-	if err == redis.ErrNil {
-		return -1, now, nil
-	} else if err != nil {
-		return 0, now, err
+	return v, now, nil
+}
+
+// BatchGetWithTime returns the value of each key, or -1 if it does not
+// exist, read with a single MGET. It also returns the current time at
+// the redis server to microsecond precision.
+func (r *RedigoStore) BatchGetWithTime(keys []string) ([]int64, time.Time, error) {
+	ctx := context.Background()
+
+	var values []int64
+	var now time.Time
+	err := r.retry(ctx, func() (err error) {
+		values, now, err = r.batchGetWithTime(ctx, keys)
+		return err
+	})
+	return values, now, err
+}
+
+func (r *RedigoStore) batchGetWithTime(ctx context.Context, keys []string) ([]int64, time.Time, error) {
+	var now time.Time
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = r.key(key)
 	}
 
-	return v, now, nil
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return nil, now, err
+	}
+	defer conn.Close()
+
+	useTime := r.readTime(ctx)
+	if useTime {
+		conn.Send("TIME")
+	}
+	conn.Send("MGET", args...)
+	conn.Flush()
+	now, err = r.receiveTime(ctx, conn, useTime)
+	if err != nil {
+		return nil, now, err
+	}
+
+	values, err := receiveValues(ctx, conn, len(keys))
+	if err != nil {
+		return nil, now, err
+	}
+
+	return values, now, nil
 }
 
 // SetIfNotExistsWithTTL sets the value of key only if it is not
 // already set in the store it returns whether a new value was set.
-// If a new value was set, the ttl in the key is also set, though this
-// operation is not performed atomically.
+// If a new value was set, the ttl in the key is also set in the same
+// SET command, so that a key is never left without a TTL. Servers
+// older than Redis 2.6.12, which don't support the options of SET,
+// are sent SETNX followed by PEXPIRE instead.
 func (r *RedigoStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
-	key = r.prefix + key
+	return r.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
 
-	conn, err := r.getConn()
-	if err != nil {
-		return false, err
-	}
-	defer conn.Close()
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (r *RedigoStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	var updated bool
+	err := r.retry(ctx, func() (err error) {
+		updated, err = r.setIfNotExistsWithTTL(ctx, key, value, ttl)
+		return err
+	})
+	return updated, err
+}
+
+func (r *RedigoStore) setIfNotExistsWithTTL(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	key = r.key(key)
 
-	v, err := redis.Int64(conn.Do("SETNX", key, value))
+	conn, err := r.getConn(ctx)
 	if err != nil {
 		return false, err
 	}
+	defer conn.Close()
 
-	updated := v == 1
+	ttlMilliseconds := r.ttlMilliseconds(ttl)
 
-	ttlSeconds := int(ttl.Seconds())
+	if atomic.LoadInt32(&r.legacySet) == 0 {
+		// SET replies nil if the key already exists
+		reply, err := redis.DoContext(conn, ctx, "SET", key, value, "NX", "PX", ttlMilliseconds)
+		if e, ok := err.(redis.Error); !ok || !strings.HasPrefix(string(e), "ERR syntax error") {
+			return reply != nil, err
+		}
+		atomic.StoreInt32(&r.legacySet, 1)
+	}
 
-	// An `EXPIRE 0` will delete the key immediately, so make sure that we set
-	// expiry for a minimum of one second out so that our results stay in the
-	// store.
-	if ttlSeconds < 1 {
-		ttlSeconds = 1
+	v, err := redis.Int64(redis.DoContext(conn, ctx, "SETNX", key, value))
+	if err != nil || v != 1 {
+		return false, err
 	}
 
-	if _, err := conn.Do("EXPIRE", key, ttlSeconds); err != nil {
-		return updated, err
+	if _, err := redis.DoContext(conn, ctx, "PEXPIRE", key, ttlMilliseconds); err != nil {
+		return true, err
 	}
 
-	return updated, nil
+	return true, nil
 }
 
 // CompareAndSwapWithTTL atomically compares the value at key to the
@@ -124,43 +454,464 @@ func (r *RedigoStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Du
 // store, it returns false with no error. If the swap succeeds, the
 // ttl for the key is updated atomically.
 func (r *RedigoStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
-	key = r.prefix + key
-	conn, err := r.getConn()
+	return r.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (r *RedigoStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := r.retry(ctx, func() (err error) {
+		swapped, err = r.compareAndSwapWithTTL(ctx, key, old, new, ttl)
+		return err
+	})
+	return swapped, err
+}
+
+func (r *RedigoStore) compareAndSwapWithTTL(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	key = r.key(key)
+	conn, err := r.getConn(ctx)
 	if err != nil {
 		return false, err
 	}
 	defer conn.Close()
 
-	ttlSeconds := int(ttl.Seconds())
+	ttlMilliseconds := r.ttlMilliseconds(ttl)
+
+	if r.evalSupported() {
+		swapped, err := redis.Bool(casScript.DoContext(ctx, conn, key, old, new, ttlMilliseconds))
+		err = r.checkEval(err)
+		if errors.Is(err, ErrStoreKeyMissing) {
+			r.observeCAS(throttled.CASPathEval, nil)
+			return false, nil
+		} else if !errors.Is(err, ErrEvalUnsupported) || r.requireEval {
+			r.observeCAS(throttled.CASPathEval, err)
+			return swapped, err
+		}
+	}
+
+	swapped, err := compareAndSwapWatch(ctx, conn, key, old, new, ttlMilliseconds)
+	r.observeCAS(throttled.CASPathWatch, err)
+	return swapped, err
+}
+
+// Compare and swap the value of key in a transaction, which is
+// discarded if the key is modified after being watched.
+func compareAndSwapWatch(ctx context.Context, conn redis.Conn, key string, old, new int64, ttlMilliseconds int64) (bool, error) {
+	if _, err := redis.DoContext(conn, ctx, "WATCH", key); err != nil {
+		return false, err
+	}
 
-	// An `EXPIRE 0` will delete the key immediately, so make sure that we set
-	// expiry for a minimum of one second out so that our results stay in the
-	// store.
-	if ttlSeconds < 1 {
-		ttlSeconds = 1
+	v, err := redis.Int64(redis.DoContext(conn, ctx, "GET", key))
+	if err != nil || v != old {
+		redis.DoContext(conn, ctx, "UNWATCH")
+		if err == redis.ErrNil {
+			err = nil
+		}
+		return false, err
 	}
 
-	swapped, err := redis.Bool(conn.Do("EVAL", redisCASScript, 1, key, old, new, ttlSeconds))
+	if _, err := redis.DoContext(conn, ctx, "MULTI"); err != nil {
+		return false, err
+	}
+	if _, err := redis.DoContext(conn, ctx, "PSETEX", key, ttlMilliseconds, new); err != nil {
+		return false, err
+	}
+
+	// EXEC replies nil if the transaction was discarded
+	reply, err := redis.DoContext(conn, ctx, "EXEC")
+	return reply != nil, err
+}
+
+// CompareAndSwapMultiWithTTL atomically compares the value of each key
+// to the corresponding old value, -1 meaning that the key must not
+// exist. If all of them match, it sets each key to its new value with
+// the corresponding ttl and returns true. Otherwise, it modifies
+// nothing and returns false. The comparison and the update are
+// performed by a single script or, if the server doesn't support EVAL
+// or the store was created with DisableEval, by a transaction watching
+// all of the keys. With RequireEval, it returns ErrEvalUnsupported
+// instead of falling back.
+func (r *RedigoStore) CompareAndSwapMultiWithTTL(keys []string, old, new []int64, ttl []time.Duration) (bool, error) {
+	ctx := context.Background()
+	if !r.evalSupported() && r.requireEval {
+		return false, ErrEvalUnsupported
+	}
+
+	conn, err := r.getConn(ctx)
 	if err != nil {
-		if strings.Contains(err.Error(), redisCASMissingKey) {
-			return false, nil
+		return false, err
+	}
+	defer conn.Close()
+
+	redisKeys := make([]interface{}, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = r.key(key)
+	}
+	ttlMilliseconds := make([]int64, len(ttl))
+	for i, d := range ttl {
+		ttlMilliseconds[i] = r.ttlMilliseconds(d)
+	}
+
+	if r.evalSupported() {
+		args := make([]interface{}, 0, 1+4*len(keys))
+		args = append(args, len(keys))
+		args = append(args, redisKeys...)
+		for _, v := range old {
+			args = append(args, v)
+		}
+		for _, v := range new {
+			args = append(args, v)
+		}
+		for _, ms := range ttlMilliseconds {
+			args = append(args, ms)
 		}
 
+		swapped, err := redis.Bool(casMultiScript.Do(conn, args...))
+		if err = r.checkEval(err); !errors.Is(err, ErrEvalUnsupported) || r.requireEval {
+			return swapped, err
+		}
+	}
+
+	return compareAndSwapMultiWatch(ctx, conn, redisKeys, old, new, ttlMilliseconds)
+}
+
+// Compare and swap the values of keys in a transaction, which is
+// discarded if any of them is modified after being watched.
+func compareAndSwapMultiWatch(ctx context.Context, conn redis.Conn, keys []interface{}, old, new []int64, ttlMilliseconds []int64) (bool, error) {
+	if _, err := redis.DoContext(conn, ctx, "WATCH", keys...); err != nil {
+		return false, err
+	}
+
+	values, err := redis.Values(redis.DoContext(conn, ctx, "MGET", keys...))
+	if err == nil && len(values) != len(keys) {
+		err = fmt.Errorf("%w to MGET: %v", ErrUnexpectedReply, values)
+	}
+	if err != nil {
+		redis.DoContext(conn, ctx, "UNWATCH")
+		return false, err
+	}
+	for i, reply := range values {
+		v, err := parseValue(reply)
+		if err != nil || v != old[i] {
+			redis.DoContext(conn, ctx, "UNWATCH")
+			return false, err
+		}
+	}
+
+	if _, err := redis.DoContext(conn, ctx, "MULTI"); err != nil {
 		return false, err
 	}
+	for i, key := range keys {
+		if _, err := redis.DoContext(conn, ctx, "PSETEX", key, ttlMilliseconds[i], new[i]); err != nil {
+			return false, err
+		}
+	}
+
+	// EXEC replies nil if the transaction was discarded
+	reply, err := redis.DoContext(conn, ctx, "EXEC")
+	return reply != nil, err
+}
+
+// PeekTTL returns the time until key expires without modifying it.
+// It returns 0 if the key does not exist and -1 if it exists but
+// never expires.
+func (r *RedigoStore) PeekTTL(key string) (time.Duration, error) {
+	key = r.key(key)
+
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	ms, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return 0, err
+	}
 
-	return swapped, nil
+	return pttlToDuration(ms), nil
 }
 
-// Select the specified database index.
-func (r *RedigoStore) getConn() (redis.Conn, error) {
-	conn := r.pool.Get()
+// Touch makes key expire after ttl, rounded up to the nearest
+// millisecond but no shorter than the MinTTL option, without changing
+// its value. It does nothing if the key doesn't exist.
+func (r *RedigoStore) Touch(key string, ttl time.Duration) error {
+	key = r.key(key)
+
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PEXPIRE", key, r.ttlMilliseconds(ttl))
+	return err
+}
+
+// Reset removes key from the store.
+func (r *RedigoStore) Reset(key string) error {
+	key = r.key(key)
+
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", key)
+	return err
+}
+
+// ScanKeys calls fn with each key of the store matching pattern, as
+// described by throttled.KeyScanner, using SCAN with MATCH so that the
+// server is never blocked as with KEYS. Only the keys with the prefix
+// of the store are scanned.
+func (r *RedigoStore) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	if pattern == "" {
+		pattern = "*"
+	}
+	match := escapeGlob(r.prefix, "*?[]\\") + escapeGlob(pattern, "[]\\")
+
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		reply, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", match, "COUNT", 100))
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(strings.TrimPrefix(key, r.prefix)); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters of s in special with a backslash,
+// so that they match themselves in a Redis pattern.
+func escapeGlob(s, special string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) != -1 {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// key returns the Redis key storing key.
+func (r *RedigoStore) key(key string) string {
+	if r.keyFunc != nil {
+		key = r.keyFunc(key)
+	}
+	return r.prefix + key
+}
+
+// Ping checks that a connection to Redis can be obtained from the pool,
+// with the database selected, and that the server answers a PING.
+func (r *RedigoStore) Ping(ctx context.Context) error {
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.String(redis.DoContext(conn, ctx, "PING"))
+	return err
+}
+
+// PoolStats returns the state of the pool of the store. Waits and
+// WaitDuration only count waits for a connection in pools with Wait
+// set, since other pools fail immediately when exhausted.
+func (r *RedigoStore) PoolStats() throttled.PoolStats {
+	stats := r.pool.Stats()
+	return throttled.PoolStats{
+		Total:        stats.ActiveCount,
+		Idle:         stats.IdleCount,
+		Waits:        stats.WaitCount,
+		WaitDuration: stats.WaitDuration,
+	}
+}
+
+// Convert the reply of PTTL, which is -2 for a missing key and -1 for
+// a key without expiry, to the values returned by PeekTTL.
+func pttlToDuration(ms int64) time.Duration {
+	switch ms {
+	case -2:
+		return 0
+	case -1:
+		return -1
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (r *RedigoStore) evalSupported() bool {
+	return atomic.LoadInt32(&r.noEval) == 0
+}
+
+// Convert ttl to milliseconds for PEXPIRE, rounding up and applying
+// the minimum TTL. The minimum is at least one millisecond, since
+// PEXPIRE deletes the key immediately if given 0.
+func (r *RedigoStore) ttlMilliseconds(ttl time.Duration) int64 {
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
+
+func (r *RedigoStore) timeSupported() bool {
+	return atomic.LoadInt32(&r.noTime) == 0
+}
+
+// Report whether TIME should be sent, which it needn't be if ctx holds
+// a time shared by the operations of a request.
+func (r *RedigoStore) readTime(ctx context.Context) bool {
+	if _, ok := throttled.SharedStoreTime(ctx); ok {
+		return false
+	}
+	return r.timeSupported()
+}
+
+// Receive the reply to TIME if sent, recording it as the shared time
+// of ctx. Otherwise return the shared time or the local time, to which
+// the store switches for good if the server doesn't know TIME.
+func (r *RedigoStore) receiveTime(ctx context.Context, conn redis.Conn, sent bool) (time.Time, error) {
+	if !sent {
+		if now, ok := throttled.SharedStoreTime(ctx); ok {
+			return now, nil
+		}
+		return time.Now(), nil
+	}
+
+	now, err := receiveTime(ctx, conn)
+	if isUnknownCommand(err) {
+		atomic.StoreInt32(&r.noTime, 1)
+		return time.Now(), nil
+	}
+	if err == nil {
+		throttled.RecordStoreTime(ctx, now)
+	}
+	return now, err
+}
+
+// Classify an error returned by EVAL, remembering if the server
+// doesn't support it unless the store requires EVAL.
+func (r *RedigoStore) checkEval(err error) error {
+	err = classify(err)
+	if errors.Is(err, ErrEvalUnsupported) && !r.requireEval {
+		if atomic.CompareAndSwapInt32(&r.noEval, 0, 1) && r.observer != nil {
+			r.observer.ObserveEvalDisabled()
+		}
+	}
+	return err
+}
+
+func (r *RedigoStore) observeCAS(path throttled.CASPath, err error) {
+	if r.observer != nil {
+		r.observer.ObserveCAS(path, err)
+	}
+}
+
+// The base and the maximum of the backoff between retries of
+// RetryTransientErrors.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+// Run op, retrying it as configured by RetryTransientErrors.
+func (r *RedigoStore) retry(ctx context.Context, op func() error) error {
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i >= r.retries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		max := retryBackoff << uint(i)
+		if max <= 0 || max > maxRetryBackoff {
+			max = maxRetryBackoff
+		}
+
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(max)) + 1))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// A selectError is returned when a connection can't select the
+// database of the store.
+type selectError struct {
+	db  int
+	err error
+}
+
+func (e *selectError) Error() string {
+	return fmt.Sprintf("redigostore: failed to select database %d, which Redis Cluster and ACL users without the SELECT permission reject: %v", e.db, e.err)
+}
+
+func (e *selectError) Unwrap() error { return e.err }
+
+// Report whether err is a network error or a reply from a server that
+// is temporarily unable to serve the command.
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case *selectError:
+		return isTransient(err.err)
+	case redis.Error:
+		for _, prefix := range transientErrorPrefixes {
+			if strings.HasPrefix(string(err), prefix) {
+				return true
+			}
+		}
+		return false
+	case net.Error:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+var transientErrorPrefixes = []string{
+	"LOADING ", "BUSY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "READONLY ",
+}
+
+// Get a connection from the pool, waiting no longer than ctx allows,
+// and select the specified database index.
+func (r *RedigoStore) getConn(ctx context.Context) (redis.Conn, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// Select the specified database
-	if r.db > 0 {
-		if _, err := redis.String(conn.Do("SELECT", r.db)); err != nil {
+	if r.db > 0 && !r.skipSelect {
+		if _, err := redis.String(redis.DoContext(conn, ctx, "SELECT", r.selectArgs...)); err != nil {
 			conn.Close()
-			return nil, err
+			return nil, &selectError{db: r.db, err: err}
 		}
 	}
 
@@ -1,11 +1,20 @@
 package redigostore_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
 	"github.com/throttled/throttled/store/redigostore"
 	"github.com/throttled/throttled/store/storetest"
 )
@@ -38,6 +47,1093 @@ func TestRedisStore(t *testing.T) {
 	clearRedis(c)
 	storetest.TestGCRAStore(t, st)
 	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestTTLReader(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestToucher(t, st)
+	storetest.TestGCRABatchStore(t, st)
+	storetest.TestGCRABatchReader(t, st)
+	storetest.TestKeyScanner(t, st)
+	storetest.TestSlidingWindowStore(t, st)
+	storetest.TestCounterStore(t, st)
+	storetest.TestGCRAAtomicStore(t, st)
+}
+
+func TestRedisStoreCtx(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, err := st.GetWithTimeCtx(ctx, "foo"); err == nil {
+		t.Error("expected GetWithTimeCtx to fail with a cancelled context")
+	}
+	if _, err := st.SetIfNotExistsWithTTLCtx(ctx, "foo", 1, 0); err == nil {
+		t.Error("expected SetIfNotExistsWithTTLCtx to fail with a cancelled context")
+	}
+	if _, err := st.CompareAndSwapWithTTLCtx(ctx, "foo", 1, 2, 0); err == nil {
+		t.Error("expected CompareAndSwapWithTTLCtx to fail with a cancelled context")
+	}
+}
+
+func TestRedisStoreSkipSelect(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		return redis.Dial("tcp", ":6379", redis.DialDatabase(redisTestDB))
+	}
+
+	// db would be out of range if it were selected
+	st, err := redigostore.New(pool, redisTestPrefix, 1<<20, redigostore.SkipSelect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := redis.Int64(c.Do("GET", redisTestPrefix+"foo")); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Errorf("expected the pool's database to be used but got %d", v)
+	}
+}
+
+func TestRedisStoreNoSelect(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+
+	selects := 0
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379", redis.DialDatabase(redisTestDB))
+		return countingConn{conn, []string{"SELECT"}, &selects}, err
+	}
+
+	// Database 0 is never selected, nor a database pinned by the pool
+	for _, cfg := range []struct {
+		db   int
+		opts []redigostore.Option
+	}{
+		{0, nil},
+		{redisTestDB, []redigostore.Option{redigostore.SkipSelect()}},
+	} {
+		st, err := redigostore.New(pool, redisTestPrefix, cfg.db, cfg.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := st.SetIfNotExistsWithTTL("noselect", 1, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := st.GetWithTime("noselect"); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.Reset("noselect"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if selects != 0 {
+		t.Errorf("expected no SELECT but got %d", selects)
+	}
+}
+
+func TestRedisStoreCacheSelect(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	selects := 0
+	pool := getPool()
+	pool.MaxIdle = 1
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return countingConn{conn, []string{"SELECT"}, &selects}, err
+	}
+
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.CacheSelect())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := st.GetWithTime("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := redis.Int64(c.Do("GET", redisTestPrefix+"foo")); err != nil {
+		t.Fatal(err)
+	} else if v != 1 {
+		t.Errorf("expected the store's database to be used but got %d", v)
+	}
+	if selects != 1 {
+		t.Errorf("expected a single SELECT on the reused connection but got %d", selects)
+	}
+
+	// A connection moved to another database is selected again
+	conn := pool.Get()
+	if _, err := conn.Do("SELECT", 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if selects != 3 {
+		t.Errorf("expected the database to be selected again but got %d SELECTs", selects)
+	}
+}
+
+// noSelectConn is a connection rejecting SELECT like Redis Cluster.
+type noSelectConn struct {
+	redis.Conn
+}
+
+func (c noSelectConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c noSelectConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "SELECT" {
+		return nil, redis.Error("ERR SELECT is not allowed in cluster mode")
+	}
+	return nil, errors.New("unexpected command " + cmd)
+}
+
+func (c noSelectConn) Close() error { return nil }
+func (c noSelectConn) Err() error   { return nil }
+
+func TestRedisStoreSelectError(t *testing.T) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return noSelectConn{}, nil },
+	}
+
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := st.GetWithTime("foo"); err == nil || !strings.Contains(err.Error(), "select database 1") {
+		t.Errorf("expected an error about selecting the database but got %v", err)
+	}
+}
+
+// brokenConn fails every command like a connection dropped during a
+// failover.
+type brokenConn struct{}
+
+func (brokenConn) Close() error                                        { return nil }
+func (brokenConn) Err() error                                          { return io.EOF }
+func (brokenConn) Do(string, ...interface{}) (interface{}, error)      { return nil, io.EOF }
+func (brokenConn) Send(string, ...interface{}) error                   { return io.EOF }
+func (brokenConn) Flush() error                                        { return io.EOF }
+func (brokenConn) Receive() (interface{}, error)                       { return nil, io.EOF }
+func (brokenConn) ReceiveContext(context.Context) (interface{}, error) { return nil, io.EOF }
+func (brokenConn) DoContext(context.Context, string, ...interface{}) (interface{}, error) {
+	return nil, io.EOF
+}
+
+func TestRedisStoreRetryTransientErrors(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	for _, retries := range []int{0, 1} {
+		pool := getPool()
+		pool.TestOnBorrow = nil
+
+		// The first connection is broken
+		dials := 0
+		pool.Dial = func() (redis.Conn, error) {
+			dials++
+			if dials == 1 {
+				return brokenConn{}, nil
+			}
+			return redis.Dial("tcp", ":6379")
+		}
+
+		st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.RetryTransientErrors(retries))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = st.GetWithTime("foo")
+		if retries == 0 && err == nil {
+			t.Error("expected GetWithTime to fail without retries")
+		}
+		if retries == 1 && err != nil {
+			t.Errorf("expected GetWithTime to succeed after a retry but got %v", err)
+		}
+	}
+
+	// The backoff between retries ends with the context
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return brokenConn{}, nil }}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.RetryTransientErrors(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := st.GetWithTimeCtx(ctx, "foo"); err == nil {
+		t.Error("expected GetWithTimeCtx to fail with a broken connection")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the retries to stop with the context but they took %s", elapsed)
+	}
+}
+
+// noEvalConn rejects EVAL like a proxy without scripting support.
+type noEvalConn struct {
+	redis.Conn
+}
+
+func (c noEvalConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c noEvalConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "EVAL" || cmd == "EVALSHA" {
+		return nil, redis.Error("ERR unknown command 'EVAL'")
+	}
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c noEvalConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStoreWithoutEval(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return noEvalConn{conn}, err
+	}
+
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := st.AddWithinLimit("window", 1, 1, time.Second); !errors.Is(err, redigostore.ErrEvalUnsupported) {
+		t.Errorf("expected ErrEvalUnsupported from a script-only operation but got %v", err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAAtomicStore(t, st)
+
+	st, err = redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.RequireEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CompareAndSwapWithTTL("foo", 1, 2, time.Second); !errors.Is(err, redigostore.ErrEvalUnsupported) {
+		t.Errorf("expected ErrEvalUnsupported with RequireEval but got %v", err)
+	}
+}
+
+// casObserver counts the atomic updates of a store by path.
+type casObserver struct {
+	paths        map[throttled.CASPath]int
+	evalDisabled int
+}
+
+func (o *casObserver) ObserveCAS(path throttled.CASPath, err error) {
+	if err == nil {
+		o.paths[path]++
+	}
+}
+
+func (o *casObserver) ObserveEvalDisabled() {
+	o.evalDisabled++
+}
+
+func TestRedisStoreCASObserver(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	noEvalPool := getPool()
+	noEvalPool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return noEvalConn{conn}, err
+	}
+
+	for i, pool := range []*redis.Pool{getPool(), noEvalPool} {
+		o := &casObserver{paths: make(map[throttled.CASPath]int)}
+		st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.CASObserver(o))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := fmt.Sprintf("cas-%d", i)
+		if _, err := st.SetIfNotExistsWithTTL(key, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			if _, err := st.CompareAndSwapWithTTL(key, int64(j+1), int64(j+2), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := st.RateLimitAtomic(context.Background(), key+"-atomic", 1, time.Second, time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		path, disabled := throttled.CASPathEval, 0
+		if i == 1 {
+			path, disabled = throttled.CASPathWatch, 1
+		}
+		if o.paths[path] != 3 || len(o.paths) != 1 {
+			t.Errorf("%d: expected 3 updates with %s but got %v", i, path, o.paths)
+		}
+		if o.evalDisabled != disabled {
+			t.Errorf("%d: expected EVAL to be disabled %d times but got %d", i, disabled, o.evalDisabled)
+		}
+	}
+}
+
+// legacySetConn rejects the options of SET like Redis before 2.6.12.
+type legacySetConn struct {
+	redis.Conn
+}
+
+func (c legacySetConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c legacySetConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "SET" && len(args) > 2 {
+		return nil, redis.Error("ERR syntax error")
+	}
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c legacySetConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStoreSetIfNotExistsTTL(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return legacySetConn{conn}, err
+	}
+	legacy, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, st := range []*redigostore.RedigoStore{st, legacy} {
+		key := fmt.Sprintf("setnx-%d", i)
+		if set, err := st.SetIfNotExistsWithTTL(key, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		} else if !set {
+			t.Errorf("%d: expected SetIfNotExists on an empty key to succeed", i)
+		}
+
+		// The TTL of an existing key is left unchanged
+		if set, err := st.SetIfNotExistsWithTTL(key, 2, time.Hour); err != nil {
+			t.Fatal(err)
+		} else if set {
+			t.Errorf("%d: expected SetIfNotExists on an existing key to fail", i)
+		}
+
+		if ttl, err := st.PeekTTL(key); err != nil {
+			t.Fatal(err)
+		} else if ttl <= 0 || ttl > time.Minute {
+			t.Errorf("%d: expected a TTL of up to a minute but got %s", i, ttl)
+		}
+	}
+}
+
+// strayReplyConn reads a subscription message, which no command asked
+// for, before the next reply whenever stray is set.
+type strayReplyConn struct {
+	net.Conn
+	stray *bool
+}
+
+func (c strayReplyConn) Read(p []byte) (int, error) {
+	if *c.stray {
+		*c.stray = false
+		return copy(p, "*3\r\n$7\r\nmessage\r\n$7\r\nchannel\r\n$1\r\n1\r\n"), nil
+	}
+	return c.Conn.Read(p)
+}
+
+func TestRedisStoreUnexpectedReply(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+	if _, err := c.Do("SET", redisTestPrefix+"foo", 42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do("SET", redisTestPrefix+"bar", 43); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := new(bool)
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		return redis.Dial("tcp", ":6379", redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return strayReplyConn{Conn: conn, stray: stray}, err
+		}))
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dial and select the database before any stray reply
+	if _, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		*stray = true
+		if _, _, err := st.GetWithTime("foo"); !errors.Is(err, redigostore.ErrUnexpectedReply) {
+			t.Errorf("%d: expected ErrUnexpectedReply but got %v", i, err)
+		}
+
+		// The same connection gets the right replies again
+		*stray = false
+		if v, _, err := st.GetWithTime("foo"); err != nil {
+			t.Fatal(err)
+		} else if v != 42 {
+			t.Errorf("%d: expected 42 but got %d", i, v)
+		}
+		if values, _, err := st.BatchGetWithTime([]string{"bar", "baz"}); err != nil {
+			t.Fatal(err)
+		} else if len(values) != 2 || values[0] != 43 || values[1] != -1 {
+			t.Errorf("%d: expected [43 -1] but got %v", i, values)
+		}
+	}
+
+	if stats := pool.Stats(); stats.ActiveCount != 1 {
+		t.Errorf("expected the pool to reuse one connection but it has %d", stats.ActiveCount)
+	}
+}
+
+// noEchoConn rejects ECHO like a connection in subscribe mode.
+type noEchoConn struct {
+	redis.Conn
+}
+
+func (c noEchoConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "ECHO" {
+		cmd = "NOECHO"
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c noEchoConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c noEchoConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c noEchoConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStoreUnexpectedReplyEchoError(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+	if _, err := c.Do("SET", redisTestPrefix+"foo", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := new(bool)
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379", redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return strayReplyConn{Conn: conn, stray: stray}, err
+		}))
+		return noEchoConn{conn}, err
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a deadline, reading past the failed ECHO would block
+	// forever
+	*stray = true
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := st.GetWithTime("foo")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, redigostore.ErrUnexpectedReply) {
+			t.Errorf("expected ErrUnexpectedReply but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the resync to stop at the reply to ECHO")
+	}
+
+	// The connection is closed rather than reused out of sync
+	*stray = false
+	if v, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	} else if v != 42 {
+		t.Errorf("expected 42 but got %d", v)
+	}
+}
+
+// noTimeConn rejects TIME like some Redis-compatible services.
+type noTimeConn struct {
+	redis.Conn
+}
+
+func (c noTimeConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "TIME" {
+		cmd = "NOTIME"
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c noTimeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c noTimeConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "TIME" {
+		cmd = "NOTIME"
+	}
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c noTimeConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStoreWithoutTime(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return noTimeConn{conn}, err
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.DisableEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.UsesLocalClock() {
+		t.Error("expected the store to use the time of the server until TIME is rejected")
+	}
+
+	start := time.Now()
+	if v, now, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	} else if v != -1 || now.Before(start) || now.After(time.Now()) {
+		t.Errorf("expected -1 at the local time but got %d at %s", v, now)
+	}
+	if !st.UsesLocalClock() {
+		t.Error("expected the store to use the local clock once TIME is rejected")
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAAtomicStore(t, st)
+}
+
+func TestRedisStoreMillisecondTTL(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	noEval, err := redigostore.New(getPool(), redisTestPrefix, redisTestDB, redigostore.DisableEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortTTL, err := redigostore.New(getPool(), redisTestPrefix, redisTestDB, redigostore.MinTTL(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	longTTL, err := redigostore.New(getPool(), redisTestPrefix, redisTestDB, redigostore.MinTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		st       *redigostore.RedigoStore
+		ttl      time.Duration
+		min, max time.Duration
+	}{
+		0: {st, 1500 * time.Millisecond, time.Second, 1500 * time.Millisecond},
+		1: {noEval, 1500 * time.Millisecond, time.Second, 1500 * time.Millisecond},
+		// The default minimum is one second
+		2: {st, 200 * time.Millisecond, 900 * time.Millisecond, time.Second},
+		3: {shortTTL, 200 * time.Millisecond, time.Millisecond, 200 * time.Millisecond},
+		4: {longTTL, 200 * time.Millisecond, 59 * time.Second, time.Minute},
+	}
+
+	for i, c := range cases {
+		key := fmt.Sprintf("ms-%d", i)
+		check := func(op string) {
+			if ttl, err := c.st.PeekTTL(key); err != nil {
+				t.Fatal(err)
+			} else if ttl < c.min || ttl > c.max {
+				t.Errorf("%d: expected a TTL between %s and %s after %s but got %s", i, c.min, c.max, op, ttl)
+			}
+		}
+
+		if _, err := c.st.SetIfNotExistsWithTTL(key, 1, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("SetIfNotExistsWithTTL")
+		if _, err := c.st.CompareAndSwapWithTTL(key, 1, 2, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("CompareAndSwapWithTTL")
+		if err := c.st.Touch(key, c.ttl); err != nil {
+			t.Fatal(err)
+		}
+		check("Touch")
+		if _, _, err := c.st.RateLimitAtomic(context.Background(), key, 1, c.ttl, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		check("RateLimitAtomic")
+	}
+
+	// A sub-second TTL expires the key before a second
+	time.Sleep(250 * time.Millisecond)
+	if v, _, err := st.GetWithTime("ms-3"); err != nil {
+		t.Fatal(err)
+	} else if v != -1 {
+		t.Errorf("expected the key to expire after 200ms but got %d", v)
+	}
+}
+
+func TestRedisStoreDisableEval(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	pool := getPool()
+	evals := 0
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return countingConn{conn, []string{"EVAL", "EVALSHA"}, &evals}, err
+	}
+
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.DisableEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAAtomicStore(t, st)
+	storetest.TestGCRABatchStore(t, st)
+
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{false, false, true} {
+		if _, limited, err := rl.RateLimitBatch([]string{"user", "tenant"}, 1); err != nil {
+			t.Fatal(err)
+		} else if limited != want {
+			t.Errorf("%d: expected the batch to be limited %v but got %v", i, want, limited)
+		}
+	}
+
+	if evals != 0 {
+		t.Errorf("expected no EVAL with DisableEval but got %d", evals)
+	}
+}
+
+func TestRedisStoreScriptCache(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+	if _, err := c.Do("SCRIPT", "FLUSH"); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := getPool()
+	evals := 0
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return countingConn{conn, []string{"EVAL"}, &evals}, err
+	}
+
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if swapped, err := st.CompareAndSwapWithTTL("foo", i, i+1, time.Minute); err != nil {
+			t.Fatal(err)
+		} else if !swapped {
+			t.Errorf("expected CompareAndSwap %d to succeed", i)
+		}
+	}
+
+	if evals != 1 {
+		t.Errorf("expected the script source to be sent once but it was sent %d times", evals)
+	}
+}
+
+// countingConn counts the calls of some commands.
+type countingConn struct {
+	redis.Conn
+	cmds  []string
+	count *int
+}
+
+func (c countingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c countingConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	for _, name := range c.cmds {
+		if cmd == name {
+			*c.count++
+		}
+	}
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c countingConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStorePoolStats(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+
+	if _, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection of setupRedis is in use and the one of
+	// GetWithTime was returned to the pool
+	if have := st.PoolStats(); have.Total != 2 || have.Idle != 1 {
+		t.Errorf("expected 2 connections with 1 idle but got %+v", have)
+	}
+}
+
+func TestRedisStorePing(t *testing.T) {
+	c, st := setupRedis(t, 0)
+	defer c.Close()
+
+	if err := st.Ping(context.Background()); err != nil {
+		t.Errorf("expected Ping to succeed but got %v", err)
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return brokenConn{}, nil },
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Ping(context.Background()); err == nil {
+		t.Error("expected Ping to fail on a broken connection")
+	}
+}
+
+func TestRedisStoreKeyFunc(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	st, err := redigostore.New(getPool(), redisTestPrefix, redisTestDB, redigostore.KeyFunc(func(key string) string {
+		return "{tenant}" + key
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, st)
+	storetest.TestResetter(t, st)
+	storetest.TestGCRABatchStore(t, st)
+
+	if v, err := redis.Int64(c.Do("GET", redisTestPrefix+"{tenant}foo")); err != nil {
+		t.Fatal(err)
+	} else if v != 2 {
+		t.Errorf("expected the key to be transformed but got %d", v)
+	}
+}
+
+func TestPackedStore(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	// All the keys in one hash
+	st, err := redigostore.NewPacked(getPool(), redisTestPrefix, redisTestDB, func(key string) string {
+		return "packed"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestGCRAStore(t, st)
+
+	if n, err := redis.Int(c.Do("HLEN", redisTestPrefix+"packed")); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("expected the keys to be packed into one hash but got %d fields", n)
+	}
+	storetest.TestResetter(t, st)
+
+	// One key per hash, so that their TTLs are independent
+	st, err = redigostore.NewPacked(getPool(), redisTestPrefix, redisTestDB, func(key string) string {
+		return key
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestGCRAStoreTTL(t, st)
+}
+
+func TestRichStore(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	st, err := redigostore.NewRich(getPool(), redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestGCRAStore(t, st)
+	storetest.TestGCRAStoreTTL(t, st)
+	storetest.TestResetter(t, st)
+
+	clearRedis(c)
+
+	if md, err := st.Metadata("foo"); err != nil {
+		t.Fatal(err)
+	} else if md.Value != -1 || md.Updates != 0 {
+		t.Errorf("expected no metadata for a missing key but got %+v", md)
+	}
+
+	_, now, err := st.GetWithTime("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CompareAndSwapWithTTL("foo", 1, 2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// A failed swap is not an update
+	if _, err := st.CompareAndSwapWithTTL("foo", 1, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := st.Metadata("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Value != 2 || md.Updates != 2 {
+		t.Errorf("expected a value of 2 after 2 updates but got %+v", md)
+	}
+	if d := md.Updated.Sub(now); d < 0 || d > time.Second {
+		t.Errorf("expected the key to be updated just after %s but got %s", now, md.Updated)
+	}
+
+	if n, err := redis.Int(c.Do("HLEN", redisTestPrefix+"foo")); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Errorf("expected the key to be a hash of 3 fields but got %d", n)
+	}
+}
+
+func TestRWStore(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	writePool, readPool := getPool(), getPool()
+	st, err := redigostore.NewRW(writePool, readPool, redisTestPrefix, redisTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := st.GetWithTime("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.PeekTTL("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if have := writePool.Stats().ActiveCount; have != 0 {
+		t.Errorf("expected reads not to use the write pool but it has %d connections", have)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("foo", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CompareAndSwapWithTTL("foo", 1, 2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if have := writePool.Stats().ActiveCount; have != 1 {
+		t.Errorf("expected updates to use the write pool but it has %d connections", have)
+	}
+	if have := readPool.Stats().ActiveCount; have != 1 {
+		t.Errorf("expected updates not to use the read pool but it has %d connections", have)
+	}
+
+	// Both pools reach the same server, as a replica without lag
+	clearRedis(c)
+	storetest.TestGCRAStore(t, st)
+}
+
+func TestStreamLog(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	mem, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcra, err := throttled.NewGCRARateLimiter(mem, throttled.RateQuota{MaxRate: throttled.PerMin(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream is on the database 0 of the connections of the pool
+	stream := redisTestPrefix + "decisions"
+
+	log := redigostore.NewStreamLog(getPool(), stream, 100, 0)
+	rl := log.Wrap(gcra)
+	for i := 0; i < 3; i++ {
+		if _, _, err := rl.RateLimit("foo", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decisions made after Close are still made but not logged
+	if limited, _, err := rl.RateLimit("bar", 1); err != nil || limited {
+		t.Errorf("expected a decision after Close to be made but got %v, %v", limited, err)
+	}
+	if have := log.Dropped(); have != 1 {
+		t.Errorf("expected 1 dropped event but got %d", have)
+	}
+
+	conn, err := redis.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	entries, err := redis.Values(conn.Do("XRANGE", stream, "-", "+"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 events but got %d", len(entries))
+	}
+
+	for i, want := range []string{"allow", "deny", "deny"} {
+		entry, err := redis.Values(entries[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, err := redis.StringMap(entry[1], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields["key"] != "foo" || fields["decision"] != want || fields["remaining"] != "0" || fields["ts"] == "" {
+			t.Errorf("%d: expected a %s decision for foo but got %v", i, want, fields)
+		}
+	}
+	conn.Do("DEL", stream)
+
+	// Events rejected by the server are dropped
+	if _, err := conn.Do("SET", stream, "not a stream"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Do("DEL", stream)
+
+	log = redigostore.NewStreamLog(getPool(), stream, 100, 0)
+	rl = log.Wrap(gcra)
+	for i := 0; i < 2; i++ {
+		if _, _, err := rl.RateLimit("foo", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have := log.Dropped(); have != 2 {
+		t.Errorf("expected 2 events rejected by the server to be dropped but got %d", have)
+	}
 }
 
 func BenchmarkRedisStore(b *testing.B) {
@@ -48,6 +1144,57 @@ func BenchmarkRedisStore(b *testing.B) {
 	storetest.BenchmarkGCRAStore(b, st)
 }
 
+// Benchmarks a GCRARateLimiter on each path of the store, failing if
+// a request allocates more than the path is known to.
+func BenchmarkRedisStoreRateLimit(b *testing.B) {
+	c, _ := setupRedis(b, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	for _, bc := range []struct {
+		name      string
+		opts      []redigostore.Option
+		atomic    bool
+		maxAllocs float64
+	}{
+		{"Atomic", nil, true, 25},
+		{"CompareAndSwap", nil, false, 40},
+		{"Watch", []redigostore.Option{redigostore.DisableEval()}, false, 65},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			st, err := redigostore.New(getPool(), redisTestPrefix, redisTestDB, bc.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// Hide RateLimitAtomic to get and swap the key instead
+			var gs throttled.GCRAStore = st
+			if !bc.atomic {
+				gs = struct{ throttled.GCRAStore }{st}
+			}
+			rl, err := throttled.NewGCRARateLimiter(gs, throttled.RateQuota{MaxRate: throttled.PerSec(1e6), MaxBurst: 1e9})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			rateLimit := func() {
+				if _, _, err := rl.RateLimit("bench", 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rateLimit()
+			}
+
+			if allocs := testing.AllocsPerRun(100, rateLimit); allocs > bc.maxAllocs {
+				b.Errorf("expected at most %.0f allocations per request but got %.0f", bc.maxAllocs, allocs)
+			}
+		})
+	}
+}
+
 func clearRedis(c redis.Conn) error {
 	keys, err := redis.Values(c.Do("KEYS", redisTestPrefix+"*"))
 	if err != nil {
@@ -83,3 +1230,191 @@ func setupRedis(tb testing.TB, ttl time.Duration) (redis.Conn, *redigostore.Redi
 
 	return c, st
 }
+
+// slowMultiConn delays the replies read after a MULTI is written
+// whenever slow is set.
+type slowMultiConn struct {
+	net.Conn
+	slow, inMulti *int32
+}
+
+func (c slowMultiConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(c.slow) == 1 && strings.Contains(string(p), "MULTI") {
+		atomic.StoreInt32(c.inMulti, 1)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c slowMultiConn) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(c.inMulti) == 1 {
+		time.Sleep(time.Second)
+	}
+	return c.Conn.Read(p)
+}
+
+func TestRedisStoreCancelTransaction(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+	if _, err := c.Do("SET", redisTestPrefix+"foo", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	slow, inMulti := new(int32), new(int32)
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		return redis.Dial("tcp", ":6379", redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return slowMultiConn{Conn: conn, slow: slow, inMulti: inMulti}, err
+		}))
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.DisableEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []func(ctx context.Context) error{
+		0: func(ctx context.Context) error {
+			_, err := st.CompareAndSwapWithTTLCtx(ctx, "foo", 42, 43, time.Minute)
+			return err
+		},
+		1: func(ctx context.Context) error {
+			_, _, err := st.RateLimitAtomic(ctx, "foo", 1, time.Second, time.Hour)
+			return err
+		},
+	}
+
+	for i, update := range cases {
+		atomic.StoreInt32(slow, 1)
+		atomic.StoreInt32(inMulti, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := update(ctx)
+		cancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%d: expected context.DeadlineExceeded but got %v", i, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%d: expected the transaction to be abandoned but it took %s", i, elapsed)
+		}
+
+		// The connection in the middle of the transaction is closed, so
+		// that the server discards it, rather than reused.
+		if stats := pool.Stats(); stats.ActiveCount != 0 {
+			t.Errorf("%d: expected the connection to be closed but the pool has %d", i, stats.ActiveCount)
+		}
+		if v, err := redis.Int64(c.Do("GET", redisTestPrefix+"foo")); err != nil {
+			t.Fatal(err)
+		} else if v != 42 {
+			t.Errorf("%d: expected the key to be unchanged but got %d", i, v)
+		}
+	}
+
+	atomic.StoreInt32(slow, 0)
+	atomic.StoreInt32(inMulti, 0)
+	if swapped, err := st.CompareAndSwapWithTTL("foo", 42, 43, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !swapped {
+		t.Error("expected a new connection to complete the transaction")
+	}
+}
+
+// timeCountConn counts the TIME commands sent to the server.
+type timeCountConn struct {
+	redis.Conn
+	n *int32
+}
+
+func (c timeCountConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "TIME" {
+		atomic.AddInt32(c.n, 1)
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c timeCountConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c timeCountConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "TIME" {
+		atomic.AddInt32(c.n, 1)
+	}
+	return redis.DoContext(c.Conn, ctx, cmd, args...)
+}
+
+func (c timeCountConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func TestRedisStoreSharedTime(t *testing.T) {
+	c, _ := setupRedis(t, 0)
+	defer c.Close()
+	defer clearRedis(c)
+
+	clearRedis(c)
+
+	n := new(int32)
+	pool := getPool()
+	pool.Dial = func() (redis.Conn, error) {
+		conn, err := redis.Dial("tcp", ":6379")
+		return timeCountConn{Conn: conn, n: n}, err
+	}
+	st, err := redigostore.New(pool, redisTestPrefix, redisTestDB, redigostore.DisableEval())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := throttled.WithSharedStoreTime(context.Background())
+	_, first, err := st.GetWithTimeCtx(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, second, err := st.GetWithTimeCtx(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	} else if !second.Equal(first) {
+		t.Errorf("expected the shared time %s but got %s", first, second)
+	}
+	if have := atomic.LoadInt32(n); have != 1 {
+		t.Errorf("expected TIME to be sent once but it was sent %d times", have)
+	}
+
+	newLimiter := func(quota throttled.RateQuota) *throttled.GCRARateLimiter {
+		rl, err := throttled.NewGCRARateLimiter(st, quota)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rl
+	}
+	rl := throttled.NewCompositeRateLimiter(
+		throttled.CompositeLimit{
+			RateLimiter: newLimiter(throttled.RateQuota{MaxRate: throttled.PerSec(100), MaxBurst: 100}),
+			KeyFunc:     func(string) string { return "global" },
+		},
+		throttled.CompositeLimit{RateLimiter: newLimiter(throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 1})},
+	)
+
+	cases := []struct {
+		ctx   context.Context
+		times int32
+	}{
+		0: {context.Background(), 2},
+		1: {throttled.WithSharedStoreTime(context.Background()), 1},
+	}
+
+	for i, c := range cases {
+		atomic.StoreInt32(n, 0)
+		if limited, _, err := rl.RateLimitCtx(c.ctx, "user", 1); err != nil {
+			t.Fatal(err)
+		} else if limited {
+			t.Errorf("%d: expected the request not to be limited", i)
+		}
+		if have := atomic.LoadInt32(n); have != c.times {
+			t.Errorf("%d: expected TIME to be sent %d times but it was sent %d times", i, c.times, have)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package redigostore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// The replies to pipelined commands are matched to the commands by
+// their order, so a reply the server sends unsolicited, such as a
+// message of a subscription or of client tracking with redirection,
+// would shift every following reply onto the wrong command. The
+// receive functions below check that each reply has the exact shape
+// expected of its command rather than converting whatever comes, and
+// resynchronize the connection before reporting ErrUnexpectedReply.
+// RESP3 push replies can't be received this way, since redigo only
+// speaks RESP2: it fails with a protocol error and closes the
+// connection. Client tracking should still be left off on the
+// connections of the pool.
+
+var (
+	sentinel     []byte
+	sentinelOnce sync.Once
+)
+
+func initSentinel() {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		b = []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	sentinel = []byte("redigostore-" + hex.EncodeToString(b))
+}
+
+// Receive the reply to TIME as a time with microsecond precision.
+func receiveTime(ctx context.Context, conn redis.Conn) (time.Time, error) {
+	reply, err := redis.ReceiveContext(conn, ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now, err := parseTime(reply)
+	if err != nil {
+		return time.Time{}, unexpectedReply(ctx, conn, "TIME", reply)
+	}
+	return now, nil
+}
+
+// Parse a reply to TIME, of seconds and microseconds, without the
+// allocations of redis.Scan.
+func parseTime(reply interface{}) (time.Time, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return time.Time{}, fmt.Errorf("unexpected type %T", reply)
+	}
+	s, err := parseInt(values[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	us, err := parseInt(values[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(s, us*int64(time.Microsecond)), nil
+}
+
+// Receive the reply to GET or HGET as an integer, or -1 for a missing
+// key.
+func receiveValue(ctx context.Context, conn redis.Conn, cmd string) (int64, error) {
+	reply, err := redis.ReceiveContext(conn, ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := parseValue(reply)
+	if err != nil {
+		return 0, unexpectedReply(ctx, conn, cmd, reply)
+	}
+	return v, nil
+}
+
+// Receive the reply to MGET of n keys as integers, or -1 for missing
+// keys.
+func receiveValues(ctx context.Context, conn redis.Conn, n int) ([]int64, error) {
+	reply, err := redis.ReceiveContext(conn, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != n {
+		return nil, unexpectedReply(ctx, conn, "MGET", reply)
+	}
+
+	values := make([]int64, n)
+	for i, r := range replies {
+		if values[i], err = parseValue(r); err != nil {
+			return nil, unexpectedReply(ctx, conn, "MGET", reply)
+		}
+	}
+	return values, nil
+}
+
+// Parse a bulk string reply holding an integer, or nil for -1. Unlike
+// redis.Int64, an integer reply is rejected, since GET never sends
+// one.
+func parseValue(reply interface{}) (int64, error) {
+	if reply == nil {
+		return -1, nil
+	}
+	return parseInt(reply)
+}
+
+// Parse a bulk string reply holding an integer. The conversion of the
+// bytes to a string doesn't allocate.
+func parseInt(reply interface{}) (int64, error) {
+	b, ok := reply.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("unexpected type %T", reply)
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+// The number of replies unexpectedReply reads at most before giving
+// up on the connection.
+const maxResyncReplies = 100
+
+// Skip the replies still pending on conn after an unexpected reply, by
+// reading until the echo of a sentinel, and return an error describing
+// the reply. If the connection can't be resynchronized, its error is
+// set and the pool closes it instead of reusing it. That's the case
+// when an error reply is read, since the reply to ECHO can't be told
+// from the replies to the pending commands if ECHO itself fails, as in
+// subscribe mode, and when the sentinel isn't read within
+// maxResyncReplies replies.
+func unexpectedReply(ctx context.Context, conn redis.Conn, cmd string, reply interface{}) error {
+	sentinelOnce.Do(initSentinel)
+
+	synced := false
+	if err := conn.Send("ECHO", sentinel); err == nil && conn.Flush() == nil {
+		for i := 0; i < maxResyncReplies; i++ {
+			p, err := redis.ReceiveContext(conn, ctx)
+			if err != nil {
+				break
+			}
+			if p, ok := p.([]byte); ok && bytes.Equal(p, sentinel) {
+				synced = true
+				break
+			}
+		}
+	}
+	if !synced {
+		discardConn(conn)
+	}
+
+	return fmt.Errorf("%w to %s: %v", ErrUnexpectedReply, cmd, reply)
+}
+
+// Set the error of conn, so that the pool closes it rather than reuse
+// it, by receiving with a context that is already done.
+func discardConn(conn redis.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	redis.ReceiveContext(conn, ctx)
+}
@@ -0,0 +1,228 @@
+package redigostore
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// The metadata is written with the time of the server, which
+	// requires replicating the effects of the scripts rather than the
+	// scripts themselves on servers before Redis 5.
+	redisRichSetNXScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+if redis.call('hsetnx', KEYS[1], 'tat', ARGV[1]) == 0 then
+  return 0
+end
+local t = redis.call('time')
+redis.call('hset', KEYS[1], 'updated', t[1] .. string.format('%06d', tonumber(t[2])), 'updates', 1)
+redis.call('pexpire', KEYS[1], ARGV[2])
+return 1
+`
+	redisRichCASScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local v = redis.call('hget', KEYS[1], 'tat')
+if v == false or v ~= ARGV[1] then
+  return 0
+end
+local t = redis.call('time')
+redis.call('hset', KEYS[1], 'tat', ARGV[2], 'updated', t[1] .. string.format('%06d', tonumber(t[2])))
+redis.call('hincrby', KEYS[1], 'updates', 1)
+redis.call('pexpire', KEYS[1], ARGV[3])
+return 1
+`
+)
+
+var (
+	richSetNXScript = redis.NewScript(1, redisRichSetNXScript)
+	richCASScript   = redis.NewScript(1, redisRichCASScript)
+)
+
+// Metadata describes a key of a RichStore.
+type Metadata struct {
+	// Value is the value of the key, which is the theoretical arrival
+	// time in nanoseconds for GCRARateLimiter, or -1 if the key does
+	// not exist.
+	Value int64
+
+	// Updated is the time at the redis server of the last update of
+	// the key, to microsecond precision.
+	Updated time.Time
+
+	// Updates is the number of times the key was updated since it
+	// was created, including its creation.
+	Updates int64
+}
+
+// RichStore implements a Redis-based store that keeps, alongside the
+// value of each key, the time of its last update and its number of
+// updates, to help analyze abusive clients after the fact. Each key is a hash whose "tat" field holds the value and whose
+// "updated" and "updates" fields hold the metadata, which Metadata
+// reads. Only the value is compared by CompareAndSwapWithTTL.
+//
+// The store only sees the values a rate limiter writes rather than
+// the quantities it charges, so it counts the updates of a key instead.
+//
+// A hash takes more memory than a plain value, which is why this store
+// is separate from RedigoStore rather than its default.
+type RichStore struct {
+	store *RedigoStore
+}
+
+// NewRich creates a new Redis-based store keeping metadata about its
+// keys. The pool, keyPrefix, db and options are used as by New, except
+// that the store requires EVAL: its updates return ErrEvalUnsupported
+// if the server doesn't support it or DisableEval is given. The keys
+// can't be shared with a RedigoStore, which stores plain values.
+func NewRich(pool *redis.Pool, keyPrefix string, db int, opts ...Option) (*RichStore, error) {
+	st, err := New(pool, keyPrefix, db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &RichStore{store: st}, nil
+}
+
+// GetWithTime returns the value of the key if it is in the store
+// or -1 if it does not exist. It also returns the current time at
+// the redis server to microsecond precision.
+func (r *RichStore) GetWithTime(key string) (int64, time.Time, error) {
+	return r.GetWithTimeCtx(context.Background(), key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (r *RichStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	var v int64
+	var now time.Time
+	err := r.store.retry(ctx, func() (err error) {
+		v, now, err = r.getWithTime(ctx, key)
+		return err
+	})
+	return v, now, err
+}
+
+func (r *RichStore) getWithTime(ctx context.Context, key string) (int64, time.Time, error) {
+	var now time.Time
+
+	conn, err := r.store.getConn(ctx)
+	if err != nil {
+		return 0, now, err
+	}
+	defer conn.Close()
+
+	useTime := r.store.readTime(ctx)
+	if useTime {
+		conn.Send("TIME")
+	}
+	conn.Send("HGET", r.store.key(key), "tat")
+	conn.Flush()
+	now, err = r.store.receiveTime(ctx, conn, useTime)
+	if err != nil {
+		return 0, now, err
+	}
+
+	v, err := receiveValue(ctx, conn, "HGET")
+	if err != nil {
+		return 0, now, err
+	}
+
+	return v, now, nil
+}
+
+// Metadata returns the value and the metadata of key. The Value of the
+// result is -1 if the key does not exist.
+func (r *RichStore) Metadata(key string) (Metadata, error) {
+	var md Metadata
+	err := r.store.retry(context.Background(), func() (err error) {
+		md, err = r.metadata(key)
+		return err
+	})
+	return md, err
+}
+
+func (r *RichStore) metadata(key string) (Metadata, error) {
+	conn, err := r.store.getConn(context.Background())
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer conn.Close()
+
+	replies, err := redis.Values(conn.Do("HMGET", r.store.key(key), "tat", "updated", "updates"))
+	if err != nil {
+		return Metadata{}, err
+	}
+	if replies[0] == nil {
+		return Metadata{Value: -1}, nil
+	}
+
+	var md Metadata
+	var updated int64
+	if _, err := redis.Scan(replies, &md.Value, &updated, &md.Updates); err != nil {
+		return Metadata{}, err
+	}
+	md.Updated = time.Unix(0, updated*int64(time.Microsecond))
+
+	return md, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key only if it is not
+// already set in the store and returns whether a new value was set.
+// If a new value was set, the ttl in the key is also set, rounded as
+// by New.
+func (r *RichStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	return r.SetIfNotExistsWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetIfNotExistsWithTTLCtx is the context-aware version of
+// SetIfNotExistsWithTTL.
+func (r *RichStore) SetIfNotExistsWithTTLCtx(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	var updated bool
+	err := r.store.retry(ctx, func() (err error) {
+		updated, err = r.eval(ctx, richSetNXScript, key, value, r.store.ttlMilliseconds(ttl))
+		return err
+	})
+	return updated, err
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key to the
+// old value. If it matches, it sets it to the new value and returns
+// true. Otherwise, it returns false. If the key does not exist in the
+// store, it returns false with no error. If the swap succeeds, the ttl
+// of the key is updated, rounded as by New.
+func (r *RichStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	return r.CompareAndSwapWithTTLCtx(context.Background(), key, old, new, ttl)
+}
+
+// CompareAndSwapWithTTLCtx is the context-aware version of
+// CompareAndSwapWithTTL.
+func (r *RichStore) CompareAndSwapWithTTLCtx(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := r.store.retry(ctx, func() (err error) {
+		swapped, err = r.eval(ctx, richCASScript, key, old, new, r.store.ttlMilliseconds(ttl))
+		return err
+	})
+	return swapped, err
+}
+
+// Reset removes key and its metadata from the store.
+func (r *RichStore) Reset(key string) error {
+	return r.store.Reset(key)
+}
+
+// Run script on key with args as arguments.
+func (r *RichStore) eval(ctx context.Context, script *redis.Script, key string, args ...interface{}) (bool, error) {
+	if !r.store.evalSupported() {
+		return false, ErrEvalUnsupported
+	}
+
+	conn, err := r.store.getConn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	keysAndArgs := append([]interface{}{r.store.key(key)}, args...)
+	ok, err := redis.Bool(script.DoContext(ctx, conn, keysAndArgs...))
+	return ok, r.store.checkEval(err)
+}
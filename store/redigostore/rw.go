@@ -0,0 +1,63 @@
+package redigostore
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// RWStore implements a Redis-based store that reads the values and
+// TTLs of keys from a replica and makes every update on the primary,
+// to take the traffic of read-heavy endpoints displaying the state of
+// limits off the primary.
+//
+// Replicas lag behind the primary, so the values read are only good
+// for display, as with GCRARateLimiter.Peek. The decisions of
+// RateLimit are still made on the primary by RateLimitAtomic, and
+// those of the other operations reading the store before updating it,
+// such as LeakyBucketLimiter.Wait, can't be made on a stale value
+// since the update compares it to the value of the primary. Such
+// operations are retried and may fail with ErrCASExhausted while the
+// replica catches up, though, so they should be given a store on the
+// primary alone.
+type RWStore struct {
+	*RedigoStore
+	read *RedigoStore
+}
+
+// NewRW creates a new Redis-based store making its updates with
+// connections from writePool, which must connect to the primary, and
+// reading GetWithTime, GetWithTimeCtx and PeekTTL with connections
+// from readPool, such as one connecting to a replica. The keyPrefix,
+// db and options are used as by New for both pools.
+func NewRW(writePool, readPool *redis.Pool, keyPrefix string, db int, opts ...Option) (*RWStore, error) {
+	write, err := New(writePool, keyPrefix, db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	read, err := New(readPool, keyPrefix, db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &RWStore{RedigoStore: write, read: read}, nil
+}
+
+// GetWithTime returns the value of the key if it is in the replica
+// or -1 if it does not exist. It also returns the current time at the
+// replica to microsecond precision.
+func (r *RWStore) GetWithTime(key string) (int64, time.Time, error) {
+	return r.read.GetWithTime(key)
+}
+
+// GetWithTimeCtx is the context-aware version of GetWithTime.
+func (r *RWStore) GetWithTimeCtx(ctx context.Context, key string) (int64, time.Time, error) {
+	return r.read.GetWithTimeCtx(ctx, key)
+}
+
+// PeekTTL returns the time until key expires in the replica. It
+// returns 0 if the key does not exist and -1 if it exists but never
+// expires.
+func (r *RWStore) PeekTTL(key string) (time.Duration, error) {
+	return r.read.PeekTTL(key)
+}
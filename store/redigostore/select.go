@@ -0,0 +1,133 @@
+package redigostore
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// CacheSelect makes the store remember the database each connection of
+// its pool has selected, so that SELECT is only sent the first time a
+// connection is used by the store rather than every time it is taken
+// from the pool. It is an alternative to SkipSelect for pools that
+// can't dial with redis.DialDatabase, such as pools shared with code
+// using other databases.
+//
+// The Dial and DialContext functions of the pool are wrapped to track
+// the database of the connections they create, so the option must be
+// passed before the pool is used, and connections that are already
+// idle in the pool keep being sent SELECT. A connection forgets its
+// database whenever it might have changed without a confirmed reply,
+// as when SELECT fails, is pipelined or queued in a transaction, or
+// when the connection is reset, so that the store never runs against
+// the wrong one. Commands sent by TestOnBorrow go through the tracking
+// as well.
+func CacheSelect() Option {
+	return func(r *RedigoStore) {
+		if r.pool == nil {
+			return
+		}
+		if dial := r.pool.Dial; dial != nil {
+			r.pool.Dial = func() (redis.Conn, error) {
+				return trackSelect(dial())
+			}
+		}
+		if dial := r.pool.DialContext; dial != nil {
+			r.pool.DialContext = func(ctx context.Context) (redis.Conn, error) {
+				return trackSelect(dial(ctx))
+			}
+		}
+	}
+}
+
+func trackSelect(conn redis.Conn, err error) (redis.Conn, error) {
+	if err != nil {
+		return conn, err
+	}
+	return &selectConn{Conn: conn, db: -1}, nil
+}
+
+// selectConn is a connection replying to the SELECT of the database it
+// is known to be on without sending it. Connections aren't used
+// concurrently, so db isn't synchronized.
+type selectConn struct {
+	redis.Conn
+	db int // -1 if unknown
+}
+
+// Report whether the command might change the selected database.
+func changesDB(cmd string) bool {
+	return strings.EqualFold(cmd, "SELECT") || strings.EqualFold(cmd, "RESET")
+}
+
+// The database selected by args, or -1 if it can't be told.
+func selectedDB(args []interface{}) int {
+	if len(args) != 1 {
+		return -1
+	}
+	switch db := args[0].(type) {
+	case int:
+		return db
+	case int64:
+		return int(db)
+	}
+	return -1
+}
+
+func (c *selectConn) do(cmd string, args []interface{}, do func() (interface{}, error)) (interface{}, error) {
+	if !changesDB(cmd) {
+		return do()
+	}
+
+	db := -1
+	if strings.EqualFold(cmd, "SELECT") {
+		db = selectedDB(args)
+		if db >= 0 && db == c.db {
+			return "OK", nil
+		}
+	}
+
+	c.db = -1
+	reply, err := do()
+	if err == nil && db >= 0 {
+		if s, ok := reply.(string); ok && s == "OK" {
+			c.db = db
+		}
+	}
+	return reply, err
+}
+
+func (c *selectConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(cmd, args, func() (interface{}, error) {
+		return c.Conn.Do(cmd, args...)
+	})
+}
+
+func (c *selectConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(cmd, args, func() (interface{}, error) {
+		return redis.DoContext(c.Conn, ctx, cmd, args...)
+	})
+}
+
+func (c *selectConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(cmd, args, func() (interface{}, error) {
+		return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	})
+}
+
+func (c *selectConn) Send(cmd string, args ...interface{}) error {
+	if changesDB(cmd) {
+		c.db = -1
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *selectConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(c.Conn, ctx)
+}
+
+func (c *selectConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(c.Conn, timeout)
+}
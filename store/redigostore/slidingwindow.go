@@ -0,0 +1,73 @@
+package redigostore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// AddWithinLimit discards the requests recorded for key at or before
+// window ago, then records quantity requests at the current time of
+// the Redis server unless that would bring the number of requests in
+// the window above limit. It returns whether the requests were
+// recorded, the times of the requests in the window and the current
+// time. The requests are stored in a sorted set, with microsecond
+// precision, by a single script. Depends on Redis 3.2+ for script
+// effects replication.
+func (r *RedigoStore) AddWithinLimit(key string, quantity, limit int, window time.Duration) (bool, []time.Time, time.Time, error) {
+	var now time.Time
+
+	if !r.evalSupported() {
+		return false, nil, now, ErrEvalUnsupported
+	}
+
+	key = r.key(key)
+
+	conn, err := r.getConn(context.Background())
+	if err != nil {
+		return false, nil, now, err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(slidingWindowScript.Do(conn, key,
+		quantity, limit, int64(window/time.Microsecond), rand.Int63()))
+	if err != nil {
+		return false, nil, now, r.checkEval(err)
+	}
+
+	var added int
+	var timeReply []interface{}
+	var scores []string
+	if _, err := redis.Scan(reply, &added, &timeReply, &scores); err != nil {
+		return false, nil, now, err
+	}
+
+	var s, us int64
+	if _, err := redis.Scan(timeReply, &s, &us); err != nil {
+		return false, nil, now, err
+	}
+	now = time.Unix(s, us*int64(time.Microsecond))
+
+	times := make([]time.Time, len(scores))
+	for i, score := range scores {
+		if times[i], err = parseMicroseconds(score); err != nil {
+			return false, nil, now, err
+		}
+	}
+
+	return added == 1, times, now, nil
+}
+
+// Parse a time in microseconds since the epoch as formatted by Redis,
+// which may use an exponent for sorted set scores.
+func parseMicroseconds(s string) (time.Time, error) {
+	us, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q in sliding window", s)
+	}
+	return time.Unix(0, int64(us)*int64(time.Microsecond)), nil
+}
@@ -0,0 +1,215 @@
+package redigostore
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/throttled/throttled"
+)
+
+// DefaultStreamLogBuffer is the number of events a StreamLog holds
+// before dropping new ones, unless changed by NewStreamLog.
+const DefaultStreamLogBuffer = 1024
+
+// The most events sent to the stream in one pipeline.
+const streamLogBatch = 128
+
+// StreamLog appends an event for each decision of the rate limiters it
+// wraps to a capped Redis Stream, as an auditable log of the decisions
+// across the instances sharing the stream from which consumers can
+// build analytics. It is independent of the store of the limiters,
+// which can be any store.
+//
+// Each event has the fields key, decision, which is "allow", "deny" or
+// "error", ts, the time of the decision in Unix milliseconds, and
+// remaining, the Remaining of its RateLimitResult. The stream is
+// capped to about maxLen events with XADD MAXLEN ~, which requires
+// Redis 5.0+.
+//
+// Events are written by a background goroutine, so logging never
+// blocks or fails a decision: when the events come faster than they
+// are written, or the writes fail, the events that don't fit in the
+// buffer are dropped and counted by Dropped.
+type StreamLog struct {
+	pool   *redis.Pool
+	stream string
+	maxLen int
+
+	mu     sync.RWMutex // Guards closed and sending to events
+	closed bool
+	events chan streamEvent
+	done   chan struct{}
+
+	dropped uint64 // Accessed atomically
+}
+
+type streamEvent struct {
+	key       string
+	decision  string
+	ts        int64
+	remaining int
+}
+
+// NewStreamLog creates a StreamLog appending to stream with
+// connections from pool and starts its goroutine, which Close stops.
+// buffer is the number of events held while waiting to be written,
+// DefaultStreamLogBuffer if zero or negative.
+func NewStreamLog(pool *redis.Pool, stream string, maxLen, buffer int) *StreamLog {
+	if buffer <= 0 {
+		buffer = DefaultStreamLogBuffer
+	}
+	s := &StreamLog{
+		pool:   pool,
+		stream: stream,
+		maxLen: maxLen,
+		events: make(chan streamEvent, buffer),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Wrap returns a RateLimiter making the decisions of rl and logging
+// them. The returned limiter only has the RateLimit and RateLimitCtx
+// methods, so it can't be used where rl is required to implement other
+// optional methods such as Peek.
+func (s *StreamLog) Wrap(rl throttled.RateLimiter) throttled.RateLimiter {
+	return &streamLogLimiter{log: s, limiter: rl}
+}
+
+// Dropped returns the number of events dropped so far.
+func (s *StreamLog) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close writes the events still buffered and stops the goroutine of
+// the log. The events of the decisions made after Close are dropped.
+func (s *StreamLog) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// Queue e without blocking, dropping it if the buffer is full.
+func (s *StreamLog) emit(e streamEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+
+	select {
+	case s.events <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *StreamLog) run() {
+	defer close(s.done)
+
+	batch := make([]streamEvent, 0, streamLogBatch)
+	for e := range s.events {
+		batch = append(batch[:0], e)
+	fill:
+		for len(batch) < streamLogBatch {
+			select {
+			case e, ok := <-s.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, e)
+			default:
+				break fill
+			}
+		}
+
+		if n := s.write(batch); n > 0 {
+			atomic.AddUint64(&s.dropped, uint64(n))
+		}
+	}
+}
+
+// Send batch to the stream in one pipeline and return the number of
+// events that weren't added. Each XADD gets its own reply, so an error
+// reply, as on a server older than 5.0 or when the key of the stream
+// holds another type, only drops its event.
+func (s *StreamLog) write(batch []streamEvent) int {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for _, e := range batch {
+		conn.Send("XADD", s.stream, "MAXLEN", "~", s.maxLen, "*",
+			"key", e.key,
+			"decision", e.decision,
+			"ts", strconv.FormatInt(e.ts, 10),
+			"remaining", e.remaining)
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return len(batch)
+	}
+
+	failed := len(batch) - len(replies)
+	for _, reply := range replies {
+		if _, ok := reply.(redis.Error); ok {
+			failed++
+		}
+	}
+	return failed
+}
+
+type streamLogLimiter struct {
+	log     *StreamLog
+	limiter throttled.RateLimiter
+}
+
+func (l *streamLogLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	limited, result, err := l.limiter.RateLimit(key, quantity)
+	l.record(key, limited, result, err)
+	return limited, result, err
+}
+
+// RateLimitCtx passes ctx to the wrapped limiter if it implements
+// RateLimiterCtx.
+func (l *streamLogLimiter) RateLimitCtx(ctx context.Context, key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	var limited bool
+	var result throttled.RateLimitResult
+	var err error
+	if lc, ok := l.limiter.(throttled.RateLimiterCtx); ok {
+		limited, result, err = lc.RateLimitCtx(ctx, key, quantity)
+	} else {
+		limited, result, err = l.limiter.RateLimit(key, quantity)
+	}
+	l.record(key, limited, result, err)
+	return limited, result, err
+}
+
+// Emit the event of a decision.
+func (l *streamLogLimiter) record(key string, limited bool, result throttled.RateLimitResult, err error) {
+	decision := "allow"
+	if err != nil {
+		decision = "error"
+	} else if limited {
+		decision = "deny"
+	}
+	l.log.emit(streamEvent{
+		key:       key,
+		decision:  decision,
+		ts:        time.Now().UnixNano() / int64(time.Millisecond),
+		remaining: result.Remaining,
+	})
+}
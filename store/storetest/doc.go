@@ -1,2 +1,19 @@
-// Package storetest provides a helper for testing throttled stores.
+// Package storetest provides helpers for testing throttled stores and
+// a fake store for testing code that uses them.
+//
+// The Test functions are an executable specification of the contract
+// of the store interfaces. An implementation, including one outside
+// of this repository, validates its behavior by calling those matching
+// the interfaces it implements from its own tests, with a store that
+// is empty or at least holds none of the keys the functions use:
+//
+//	func TestMyStore(t *testing.T) {
+//		st := newEmptyStore(t)
+//		storetest.TestGCRAStore(t, st)
+//		storetest.TestGCRAStoreTTL(t, st)
+//	}
+//
+// TestGCRAStore covers reading missing keys, SetIfNotExistsWithTTL on
+// new and existing keys and CompareAndSwapWithTTL on missing, matching
+// and mismatching values, while TestGCRAStoreTTL covers expiry.
 package storetest // import "github.com/throttled/throttled/store/storetest"
@@ -0,0 +1,183 @@
+package storetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the operations recorded in a Call.
+const (
+	OpGetWithTime           = "GetWithTime"
+	OpSetIfNotExistsWithTTL = "SetIfNotExistsWithTTL"
+	OpCompareAndSwapWithTTL = "CompareAndSwapWithTTL"
+)
+
+// A Call is an operation performed on a FakeStore.
+type Call struct {
+	Op  string
+	Key string
+}
+
+func (c Call) String() string {
+	return fmt.Sprintf("%s(%s)", c.Op, c.Key)
+}
+
+// FakeStore is an in-memory throttled.GCRAStore for testing code that
+// uses a store, such as the error handling of a rate limiter. Besides
+// storing keys, it can fail chosen calls, reject updates as if the key
+// had been modified concurrently and report a fixed time. It records
+// every call so that tests can check the sequence of operations.
+//
+// The zero value is an empty store ready to use. It is safe for
+// concurrent use.
+type FakeStore struct {
+	mu          sync.Mutex
+	entries     map[string]fakeEntry
+	now         time.Time
+	calls       []Call
+	errs        map[int]error
+	failUpdates int
+}
+
+type fakeEntry struct {
+	value  int64
+	expiry time.Time
+}
+
+// SetTime pins the time returned by GetWithTime and used to expire
+// keys to now. The zero time, the default, uses the local time.
+func (f *FakeStore) SetTime(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+// FailCall makes the nth call to the store, counting from 1 across all
+// operations, return err without modifying the store.
+func (f *FakeStore) FailCall(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[int]error)
+	}
+	f.errs[n] = err
+}
+
+// FailUpdates makes the next n calls to SetIfNotExistsWithTTL and
+// CompareAndSwapWithTTL report that the key was modified concurrently,
+// which causes a GCRARateLimiter to retry.
+func (f *FakeStore) FailUpdates(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failUpdates = n
+}
+
+// Calls returns the calls made to the store so far, in order.
+func (f *FakeStore) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// GetWithTime returns the value of key, or -1 if it does not exist,
+// and the pinned or local time.
+func (f *FakeStore) GetWithTime(key string) (int64, time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.time()
+	if err := f.record(OpGetWithTime, key); err != nil {
+		return 0, now, err
+	}
+
+	e, ok := f.get(key, now)
+	if !ok {
+		return -1, now, nil
+	}
+	return e.value, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key if it does not exist and
+// reports whether it did.
+func (f *FakeStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record(OpSetIfNotExistsWithTTL, key); err != nil {
+		return false, err
+	}
+	if f.rejectUpdate() {
+		return false, nil
+	}
+
+	now := f.time()
+	if _, ok := f.get(key, now); ok {
+		return false, nil
+	}
+
+	f.set(key, value, now, ttl)
+	return true, nil
+}
+
+// CompareAndSwapWithTTL sets the value of key to new if it is old and
+// reports whether it did.
+func (f *FakeStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record(OpCompareAndSwapWithTTL, key); err != nil {
+		return false, err
+	}
+	if f.rejectUpdate() {
+		return false, nil
+	}
+
+	now := f.time()
+	if e, ok := f.get(key, now); !ok || e.value != old {
+		return false, nil
+	}
+
+	f.set(key, new, now, ttl)
+	return true, nil
+}
+
+// record logs a call and returns the error injected for it, if any.
+func (f *FakeStore) record(op, key string) error {
+	f.calls = append(f.calls, Call{Op: op, Key: key})
+	return f.errs[len(f.calls)]
+}
+
+func (f *FakeStore) rejectUpdate() bool {
+	if f.failUpdates > 0 {
+		f.failUpdates--
+		return true
+	}
+	return false
+}
+
+func (f *FakeStore) time() time.Time {
+	if f.now.IsZero() {
+		return time.Now()
+	}
+	return f.now
+}
+
+func (f *FakeStore) get(key string, now time.Time) (fakeEntry, bool) {
+	e, ok := f.entries[key]
+	if !ok || (!e.expiry.IsZero() && !e.expiry.After(now)) {
+		return fakeEntry{}, false
+	}
+	return e, true
+}
+
+func (f *FakeStore) set(key string, value int64, now time.Time, ttl time.Duration) {
+	if f.entries == nil {
+		f.entries = make(map[string]fakeEntry)
+	}
+	e := fakeEntry{value: value}
+	if ttl > 0 {
+		e.expiry = now.Add(ttl)
+	}
+	f.entries[key] = e
+}
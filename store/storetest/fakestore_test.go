@@ -0,0 +1,56 @@
+package storetest_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/storetest"
+)
+
+func TestFakeStore(t *testing.T) {
+	var st storetest.FakeStore
+	storetest.TestGCRAStore(t, &st)
+	storetest.TestGCRAStoreTTL(t, &st)
+}
+
+func TestFakeStoreFailures(t *testing.T) {
+	var st storetest.FakeStore
+	now := time.Unix(1000, 0)
+	st.SetTime(now)
+
+	rl, err := throttled.NewGCRARateLimiter(&st, throttled.RateQuota{MaxRate: throttled.PerSec(1), MaxBurst: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reject the first update so that the limiter retries
+	st.FailUpdates(1)
+	if _, _, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the read of the next attempt
+	errStore := errors.New("store is down")
+	st.FailCall(5, errStore)
+	if _, _, err := rl.RateLimit("foo", 1); err != errStore {
+		t.Errorf("expected the injected error but got %v", err)
+	}
+
+	want := []storetest.Call{
+		{Op: storetest.OpGetWithTime, Key: "foo"},
+		{Op: storetest.OpSetIfNotExistsWithTTL, Key: "foo"},
+		{Op: storetest.OpGetWithTime, Key: "foo"},
+		{Op: storetest.OpSetIfNotExistsWithTTL, Key: "foo"},
+		{Op: storetest.OpGetWithTime, Key: "foo"},
+	}
+	if have := st.Calls(); !reflect.DeepEqual(have, want) {
+		t.Errorf("expected calls %v but got %v", want, have)
+	}
+
+	if _, now, _ := st.GetWithTime("foo"); !now.Equal(time.Unix(1000, 0)) {
+		t.Errorf("expected the pinned time but got %s", now)
+	}
+}
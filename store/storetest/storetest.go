@@ -1,8 +1,13 @@
-// Package storetest provides a helper for testing throttled stores.
+// Package storetest provides helpers for testing throttled stores and
+// a fake store for testing code that uses them.
 package storetest // import "github.com/throttled/throttled/store/storetest"
 
 import (
+	"context"
+	"errors"
 	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync/atomic"
 	"testing"
@@ -105,16 +110,29 @@ func TestGCRAStore(t *testing.T, st throttled.GCRAStore) {
 	}
 }
 
-// TestGCRAStoreTTL tests the behavior of TTLs in a GCRAStore implementation.
+// TestGCRAStoreTTL tests the behavior of TTLs in a GCRAStore
+// implementation: keys expire after their TTL, a successful
+// CompareAndSwapWithTTL replaces the TTL of the key and an expired key
+// can be set again.
 func TestGCRAStoreTTL(t *testing.T, st throttled.GCRAStore) {
 	ttl := time.Second
 	want := int64(1)
 	key := "ttl"
+	extended := "ttl-extended"
 
 	if _, err := st.SetIfNotExistsWithTTL(key, want, ttl); err != nil {
 		t.Fatal(err)
 	}
 
+	if _, err := st.SetIfNotExistsWithTTL(extended, want, ttl); err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := st.CompareAndSwapWithTTL(extended, want, want+1, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !swapped {
+		t.Errorf("expected CompareAndSwap to succeed")
+	}
+
 	if have, _, err := st.GetWithTime(key); err != nil {
 		t.Fatal(err)
 	} else if have != want {
@@ -129,6 +147,18 @@ func TestGCRAStoreTTL(t *testing.T, st throttled.GCRAStore) {
 	} else if have != -1 {
 		t.Errorf("expected GetWithTime to fail on an expired key but got %d", have)
 	}
+
+	if have, _, err := st.GetWithTime(extended); err != nil {
+		t.Fatal(err)
+	} else if have != want+1 {
+		t.Errorf("expected CompareAndSwap to extend the TTL of the key but got %d", have)
+	}
+
+	if set, err := st.SetIfNotExistsWithTTL(key, want, ttl); err != nil {
+		t.Fatal(err)
+	} else if !set {
+		t.Errorf("expected SetIfNotExists on an expired key to succeed")
+	}
 }
 
 // BenchmarkGCRAStore runs parallel benchmarks against a GCRAStore implementation.
@@ -174,3 +204,359 @@ func BenchmarkGCRAStore(b *testing.B, st throttled.GCRAStore) {
 
 	b.Logf("%d/%d update operations succeeed", updates, attempts)
 }
+
+// TestTTLReader tests the behavior of a TTLReader implementation. The
+// store must support TTLs.
+func TestTTLReader(t *testing.T, st throttled.GCRAStore) {
+	tr, ok := st.(throttled.TTLReader)
+	if !ok {
+		t.Fatalf("expected %T to implement TTLReader", st)
+	}
+
+	if have, err := tr.PeekTTL("peek"); err != nil {
+		t.Fatal(err)
+	} else if have != 0 {
+		t.Errorf("expected PeekTTL to return 0 for a missing key but got %s", have)
+	}
+
+	ttl := 10 * time.Second
+	if _, err := st.SetIfNotExistsWithTTL("peek", 1, ttl); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, err := tr.PeekTTL("peek"); err != nil {
+		t.Fatal(err)
+	} else if have <= ttl-time.Second || have > ttl {
+		t.Errorf("expected PeekTTL to return about %s but got %s", ttl, have)
+	}
+
+	if have, _, err := st.GetWithTime("peek"); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected PeekTTL not to modify the value but got %d", have)
+	}
+}
+
+// TestResetter tests the behavior of a Resetter implementation.
+func TestResetter(t *testing.T, st throttled.GCRAStore) {
+	rs, ok := st.(throttled.Resetter)
+	if !ok {
+		t.Fatalf("expected %T to implement Resetter", st)
+	}
+
+	if err := rs.Reset("reset"); err != nil {
+		t.Fatalf("expected Reset to accept a missing key but got %v", err)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("reset", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Reset("reset"); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, _, err := st.GetWithTime("reset"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected Reset to remove the key but got %d", have)
+	}
+
+	if set, err := st.SetIfNotExistsWithTTL("reset", 2, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !set {
+		t.Error("expected SetIfNotExistsWithTTL to succeed after Reset")
+	}
+}
+
+// TestToucher tests the behavior of a store implementing
+// throttled.Toucher. The store must support TTLs and, if it implements
+// throttled.TTLReader, the extended TTL is checked with PeekTTL.
+func TestToucher(t *testing.T, st throttled.GCRAStore) {
+	tc, ok := st.(throttled.Toucher)
+	if !ok {
+		t.Fatalf("expected %T to implement Toucher", st)
+	}
+
+	if err := tc.Touch("touch", time.Minute); err != nil {
+		t.Fatalf("expected Touch to accept a missing key but got %v", err)
+	}
+	if have, _, err := st.GetWithTime("touch"); err != nil {
+		t.Fatal(err)
+	} else if have != -1 {
+		t.Errorf("expected Touch not to create a missing key but got %d", have)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("touch", 1, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Touch("touch", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, _, err := st.GetWithTime("touch"); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected Touch to keep the value of the key but got %d", have)
+	}
+
+	if tr, ok := st.(throttled.TTLReader); ok {
+		if ttl, err := tr.PeekTTL("touch"); err != nil {
+			t.Fatal(err)
+		} else if ttl <= time.Minute || ttl > time.Hour {
+			t.Errorf("expected Touch to extend the TTL to an hour but got %s", ttl)
+		}
+	}
+}
+
+// TestKeyScanner tests the behavior of a store implementing
+// throttled.KeyScanner. The store must not hold other keys starting
+// with "scan".
+func TestKeyScanner(t *testing.T, st throttled.GCRAStore) {
+	ks, ok := st.(throttled.KeyScanner)
+	if !ok {
+		t.Fatalf("expected %T to implement KeyScanner", st)
+	}
+
+	for _, key := range []string{"scan:a", "scan:b", "scan[c]", "scanner"} {
+		if _, err := st.SetIfNotExistsWithTTL(key, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scan := func(pattern string) []string {
+		var keys []string
+		err := ks.ScanKeys(context.Background(), pattern, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	if have, want := scan("scan:*"), []string{"scan:a", "scan:b"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected ScanKeys to return %v but got %v", want, have)
+	}
+	if have, want := scan("scan?c?"), []string{"scan[c]"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected ScanKeys to return %v but got %v", want, have)
+	}
+	if have, want := scan("scan[c]"), []string{"scan[c]"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected brackets to match themselves but got %v", have)
+	}
+
+	all := scan("")
+	for _, want := range []string{"scan:a", "scan:b", "scan[c]", "scanner"} {
+		if i := sort.SearchStrings(all, want); i == len(all) || all[i] != want {
+			t.Errorf("expected ScanKeys with an empty pattern to return %s but got %v", want, all)
+		}
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err := ks.ScanKeys(context.Background(), "scan*", func(key string) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("expected ScanKeys to stop at the first error but got %v after %d keys", err, n)
+	}
+}
+
+// TestGCRABatchStore tests the behavior of a store implementing
+// throttled.GCRABatchStore.
+func TestGCRABatchStore(t *testing.T, st throttled.GCRAStore) {
+	bs, ok := st.(throttled.GCRABatchStore)
+	if !ok {
+		t.Fatalf("expected %T to implement GCRABatchStore", st)
+	}
+
+	keys := []string{"batch1", "batch2"}
+	ttls := []time.Duration{time.Minute, time.Minute}
+
+	if _, err := st.SetIfNotExistsWithTTL("batch1", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// batch2 doesn't exist, so a mismatch must not change batch1
+	if swapped, err := bs.CompareAndSwapMultiWithTTL(keys, []int64{1, 2}, []int64{3, 4}, ttls); err != nil {
+		t.Fatal(err)
+	} else if swapped {
+		t.Error("expected CompareAndSwapMultiWithTTL to fail when a key is missing")
+	}
+
+	if swapped, err := bs.CompareAndSwapMultiWithTTL(keys, []int64{1, -1}, []int64{3, 4}, ttls); err != nil {
+		t.Fatal(err)
+	} else if !swapped {
+		t.Error("expected CompareAndSwapMultiWithTTL to succeed when all values match")
+	}
+
+	if swapped, err := bs.CompareAndSwapMultiWithTTL(keys, []int64{3, 5}, []int64{6, 7}, ttls); err != nil {
+		t.Fatal(err)
+	} else if swapped {
+		t.Error("expected CompareAndSwapMultiWithTTL to fail when a value doesn't match")
+	}
+
+	for i, want := range []int64{3, 4} {
+		if have, _, err := st.GetWithTime(keys[i]); err != nil {
+			t.Fatal(err)
+		} else if have != want {
+			t.Errorf("expected %s to be %d but got %d", keys[i], want, have)
+		}
+	}
+}
+
+// TestGCRABatchReader tests the behavior of a store implementing
+// throttled.GCRABatchReader.
+func TestGCRABatchReader(t *testing.T, st throttled.GCRAStore) {
+	br, ok := st.(throttled.GCRABatchReader)
+	if !ok {
+		t.Fatalf("expected %T to implement GCRABatchReader", st)
+	}
+
+	if _, err := st.SetIfNotExistsWithTTL("batchget1", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.SetIfNotExistsWithTTL("batchget3", 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	values, now, err := br.BatchGetWithTime([]string{"batchget1", "batchget2", "batchget3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := values, []int64{1, -1, 3}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected BatchGetWithTime to return %v but got %v", want, have)
+	}
+	if now.Sub(before) > time.Second || before.Sub(now) > time.Second {
+		t.Errorf("expected BatchGetWithTime to return about %s but got %s", before, now)
+	}
+}
+
+// TestSlidingWindowStore tests the behavior of a
+// throttled.SlidingWindowStore implementation. It relies on the store
+// using the actual current time.
+func TestSlidingWindowStore(t *testing.T, st throttled.SlidingWindowStore) {
+	window := time.Second
+
+	added, times, now, err := st.AddWithinLimit("window", 2, 3, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Error("expected AddWithinLimit to record requests below the limit")
+	}
+	if len(times) != 2 {
+		t.Fatalf("expected 2 requests in the window but got %d", len(times))
+	}
+	if d := now.Sub(times[1]); d < 0 || d > time.Millisecond {
+		t.Errorf("expected the requests to be recorded at %s but got %s", now, times[1])
+	}
+
+	if added, times, _, err = st.AddWithinLimit("window", 2, 3, window); err != nil {
+		t.Fatal(err)
+	} else if added {
+		t.Error("expected AddWithinLimit not to exceed the limit")
+	} else if len(times) != 2 {
+		t.Errorf("expected a refused call to leave 2 requests but got %d", len(times))
+	}
+
+	if added, times, _, err = st.AddWithinLimit("window", 0, 3, window); err != nil {
+		t.Fatal(err)
+	} else if !added || len(times) != 2 {
+		t.Errorf("expected a quantity of 0 to peek at 2 requests but got %v, %d", added, len(times))
+	}
+
+	time.Sleep(window + 10*time.Millisecond)
+
+	if added, times, _, err = st.AddWithinLimit("window", 3, 3, window); err != nil {
+		t.Fatal(err)
+	} else if !added {
+		t.Error("expected AddWithinLimit to discard the requests that left the window")
+	} else if len(times) != 3 {
+		t.Errorf("expected 3 requests in the window but got %d", len(times))
+	}
+}
+
+// TestCounterStore tests the behavior of a throttled.CounterStore
+// implementation.
+func TestCounterStore(t *testing.T, st throttled.CounterStore) {
+	for i, c := range []struct {
+		delta, want int64
+	}{
+		{3, 3},
+		{2, 5},
+		{-4, 1},
+		{0, 1},
+	} {
+		if have, err := st.IncrementWithTTL("counter", c.delta, time.Second); err != nil {
+			t.Fatal(err)
+		} else if have != c.want {
+			t.Errorf("%d: expected IncrementWithTTL to return %d but got %d", i, c.want, have)
+		}
+	}
+
+	if _, err := st.IncrementWithTTL("counter-ttl", 1, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if have, err := st.IncrementWithTTL("counter-ttl", 1, time.Second); err != nil {
+		t.Fatal(err)
+	} else if have != 1 {
+		t.Errorf("expected the counter to restart from 0 after expiring but got %d", have)
+	}
+}
+
+// TestGCRAAtomicStore tests the behavior of a store implementing
+// throttled.GCRAAtomicStore by rate limiting with a GCRARateLimiter,
+// which uses RateLimitAtomic, and checking that the store agrees with
+// the limiter to the nanosecond.
+func TestGCRAAtomicStore(t *testing.T, st throttled.GCRAStore) {
+	if _, ok := st.(throttled.GCRAAtomicStore); !ok {
+		t.Fatalf("expected %T to implement GCRAAtomicStore", st)
+	}
+
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(7), MaxBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start from a time that isn't a round number of microseconds
+	_, now, err := st.GetWithTime("atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := now.Add(time.Second).UnixNano() + 123
+	if _, err := st.SetIfNotExistsWithTTL("atomic", start, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		limited, _, info, err := rl.DebugRateLimit("atomic", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := i == 2; limited != want {
+			t.Errorf("%d: expected limited to be %t but got %t", i, want, limited)
+		}
+		if i == 0 && info.StoredTAT.UnixNano() != start {
+			t.Errorf("expected the stored TAT to be %d but got %d", start, info.StoredTAT.UnixNano())
+		}
+
+		want := info.NewTAT.UnixNano()
+		if limited {
+			want = info.StoredTAT.UnixNano()
+		}
+		if have, _, err := st.GetWithTime("atomic"); err != nil {
+			t.Fatal(err)
+		} else if have != want {
+			t.Errorf("%d: expected the store to hold %d but got %d", i, want, have)
+		}
+	}
+}
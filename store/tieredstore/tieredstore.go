@@ -0,0 +1,124 @@
+// Package tieredstore offers a store caching the values of a shared
+// throttled store in a faster local one.
+package tieredstore // import "github.com/throttled/throttled/store/tieredstore"
+
+import (
+	"errors"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+// Value stored in the local tier for a key that was invalidated, since
+// a GCRAStore has no way to delete keys.
+const invalidated = -2
+
+// TieredStore is a GCRAStore reading from a local store, such as an
+// LRU memstore, before falling back to a shared store, such as Redis.
+// Updates always go to the shared store.
+type TieredStore struct {
+	local, shared throttled.GCRAStore
+	maxStaleness  time.Duration
+}
+
+// New creates a store caching the values read from and written to
+// shared in local for up to maxStaleness. local must support TTLs and
+// is usually an LRU memstore dedicated to this purpose.
+//
+// GetWithTime returns a cached value when there is one, along with the
+// time of the local store. This saves a round
+// trip to the shared store for every request that the cached value is
+// enough to decide: for a hot key that is limited, the limiter can
+// deny requests without contacting the shared store at all.
+//
+// Updates are compare-and-swaps against the shared store, so a stale
+// value can't admit a request by itself: the swap fails, the cached
+// value is dropped and the limiter retries with a fresh one. Since
+// theoretical arrival times only increase, a stale value can't cause
+// wrongful denials either, unless keys are lowered in the shared
+// store, such as by an administrator resetting them. The remaining
+// risk of over-admission comes from the clocks: decisions from the
+// cache use the local time, so the local clock should be synchronized
+// with the shared store's, and any skew between them is added to the
+// tolerance for the cached keys. A short maxStaleness, such as a
+// second, bounds how long either effect lasts.
+func New(local, shared throttled.GCRAStore, maxStaleness time.Duration) (*TieredStore, error) {
+	if maxStaleness <= 0 {
+		return nil, errors.New("tieredstore: maxStaleness must be greater than zero")
+	}
+
+	return &TieredStore{
+		local:        local,
+		shared:       shared,
+		maxStaleness: maxStaleness,
+	}, nil
+}
+
+// GetWithTime returns the value of the key cached in the local store,
+// if any, or otherwise in the shared store, in which case it is cached.
+// It returns -1 if the key does not exist. It also returns the current
+// time of the store the value came from.
+func (s *TieredStore) GetWithTime(key string) (int64, time.Time, error) {
+	if v, now, err := s.local.GetWithTime(key); err == nil && v >= 0 {
+		return v, now, nil
+	}
+
+	v, now, err := s.shared.GetWithTime(key)
+	if err != nil {
+		return v, now, err
+	}
+
+	if v >= 0 {
+		s.cache(key, v)
+	}
+
+	return v, now, nil
+}
+
+// SetIfNotExistsWithTTL sets the value of key in the shared store only
+// if it is not already set there and returns whether a new value was
+// set. The new value is cached, while a failure drops the cached one.
+func (s *TieredStore) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	updated, err := s.shared.SetIfNotExistsWithTTL(key, value, ttl)
+	s.updated(key, value, updated, err)
+	return updated, err
+}
+
+// CompareAndSwapWithTTL atomically compares the value at key in the
+// shared store to the old value and, if it matches, sets it to the new
+// value and returns true. The new value is cached, while a failure
+// drops the cached one.
+func (s *TieredStore) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	swapped, err := s.shared.CompareAndSwapWithTTL(key, old, new, ttl)
+	s.updated(key, new, swapped, err)
+	return swapped, err
+}
+
+func (s *TieredStore) updated(key string, value int64, updated bool, err error) {
+	if err == nil && updated {
+		s.cache(key, value)
+	} else {
+		s.cache(key, invalidated)
+	}
+}
+
+// cache sets the value of key in the local store. Concurrent updates
+// may overwrite each other, which is harmless since the cache is only
+// used to skip reads.
+func (s *TieredStore) cache(key string, value int64) {
+	ttl := s.maxStaleness
+	if value == invalidated {
+		// Don't keep invalidated keys longer than needed
+		ttl = time.Nanosecond
+	}
+
+	cur, _, err := s.local.GetWithTime(key)
+	if err != nil {
+		return
+	}
+	if cur == -1 {
+		s.local.SetIfNotExistsWithTTL(key, value, ttl)
+	} else {
+		s.local.CompareAndSwapWithTTL(key, cur, value, ttl)
+	}
+}
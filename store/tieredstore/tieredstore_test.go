@@ -0,0 +1,114 @@
+package tieredstore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"github.com/throttled/throttled/store/storetest"
+	"github.com/throttled/throttled/store/tieredstore"
+)
+
+// countingStore counts the reads of the shared store.
+type countingStore struct {
+	throttled.GCRAStore
+	reads int
+}
+
+func (cs *countingStore) GetWithTime(key string) (int64, time.Time, error) {
+	cs.reads++
+	return cs.GCRAStore.GetWithTime(key)
+}
+
+func newTieredStore(t *testing.T, shared throttled.GCRAStore) *tieredstore.TieredStore {
+	local, err := memstore.New(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := tieredstore.New(local, shared, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// Demonstrates how to cache the state of a Redis store in memory.
+func ExampleNew() {
+	local, err := memstore.New(65536)
+	if err != nil {
+		panic(err)
+	}
+
+	// Use a Redis store such as redigostore in practice
+	var shared throttled.GCRAStore = local
+
+	store, err := tieredstore.New(local, shared, time.Second)
+	if err != nil {
+		panic(err)
+	}
+
+	throttled.NewGCRARateLimiter(store, throttled.RateQuota{
+		MaxRate:  throttled.PerMin(20),
+		MaxBurst: 5,
+	})
+}
+
+func TestTieredStore(t *testing.T) {
+	shared, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestGCRAStore(t, newTieredStore(t, shared))
+}
+
+func TestTieredStoreCache(t *testing.T) {
+	mst, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := &countingStore{GCRAStore: mst}
+	st := newTieredStore(t, shared)
+
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if limited, _, err := rl.RateLimit("foo", 1); err != nil {
+		t.Fatal(err)
+	} else if limited {
+		t.Fatal("expected the first request not to be limited")
+	}
+	for i := 0; i < 5; i++ {
+		if limited, _, err := rl.RateLimit("foo", 1); err != nil {
+			t.Fatal(err)
+		} else if !limited {
+			t.Fatal("expected the following requests to be limited")
+		}
+	}
+
+	if shared.reads != 1 {
+		t.Errorf("expected limited requests to be decided from the cache but the shared store was read %d times", shared.reads)
+	}
+
+	// Another instance updates the shared store behind the cache
+	if _, err := st.SetIfNotExistsWithTTL("bar", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mst.CompareAndSwapWithTTL("bar", 1, 2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if swapped, err := st.CompareAndSwapWithTTL("bar", 1, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if swapped {
+		t.Fatal("expected a swap against a stale value to fail")
+	}
+	if have, _, err := st.GetWithTime("bar"); err != nil {
+		t.Fatal(err)
+	} else if have != 2 {
+		t.Errorf("expected a failed swap to drop the cached value but got %d", have)
+	}
+}
@@ -0,0 +1,78 @@
+package throttled
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type sharedStoreTimeKey struct{}
+
+type sharedStoreTime struct {
+	mu  sync.Mutex
+	now time.Time
+	set bool
+}
+
+// WithSharedStoreTime returns a copy of ctx in which the time of the
+// store is only read once: the first store operation that reads the
+// time of its server records it with RecordStoreTime, and the
+// following operations given ctx use that time rather than reading it
+// again. This saves a round-trip for each additional limiter applied
+// to a request, such as a global and a per-user one, when their store
+// supports it, as redigostore does.
+//
+// The recorded time doesn't advance, so ctx should only be passed to
+// the limiters applied to a request at once. The time is shared by all
+// the stores given ctx, which must then share the same clock, as the
+// instances sharing a store do.
+func WithSharedStoreTime(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(sharedStoreTimeKey{}).(*sharedStoreTime); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, sharedStoreTimeKey{}, &sharedStoreTime{})
+}
+
+// SharedStoreTime returns the store time recorded in ctx, if ctx was
+// returned by WithSharedStoreTime and a time was recorded.
+func SharedStoreTime(ctx context.Context) (time.Time, bool) {
+	st, ok := ctx.Value(sharedStoreTimeKey{}).(*sharedStoreTime)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.now, st.set
+}
+
+// RecordStoreTime records now, read from the server of a store, as
+// the store time of ctx if ctx was returned by WithSharedStoreTime and
+// no time was recorded yet. It is meant to be called by stores, which
+// should call SharedStoreTime before reading the time of their server.
+func RecordStoreTime(ctx context.Context, now time.Time) {
+	st, ok := ctx.Value(sharedStoreTimeKey{}).(*sharedStoreTime)
+	if !ok {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.set {
+		st.now, st.set = now, true
+	}
+}
+
+// ShareStoreTime wraps an http.Handler to pass it requests whose
+// context was returned by WithSharedStoreTime. Wrapping several
+// HTTPRateLimiters with it makes them read the time of the store only
+// once per request, provided that their RateLimiters implement
+// RateLimiterCtx. Since the time doesn't advance, handlers applying
+// limits long after the request started shouldn't pass them its
+// context.
+func ShareStoreTime(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(WithSharedStoreTime(r.Context())))
+	})
+}
@@ -0,0 +1,43 @@
+package throttled_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled"
+)
+
+func TestSharedStoreTime(t *testing.T) {
+	first, second := time.Unix(1000, 0), time.Unix(2000, 0)
+
+	// Nothing is recorded without WithSharedStoreTime
+	throttled.RecordStoreTime(context.Background(), first)
+	if _, ok := throttled.SharedStoreTime(context.Background()); ok {
+		t.Error("expected no shared time in a plain context")
+	}
+
+	ctx := throttled.WithSharedStoreTime(context.Background())
+	if _, ok := throttled.SharedStoreTime(ctx); ok {
+		t.Error("expected no shared time before one is recorded")
+	}
+
+	// Only the first time is recorded
+	throttled.RecordStoreTime(ctx, first)
+	throttled.RecordStoreTime(throttled.WithSharedStoreTime(ctx), second)
+	if now, ok := throttled.SharedStoreTime(ctx); !ok || !now.Equal(first) {
+		t.Errorf("expected the shared time to be %s but got %s (%t)", first, now, ok)
+	}
+
+	var shared bool
+	handler := throttled.ShareStoreTime(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		throttled.RecordStoreTime(r.Context(), first)
+		_, shared = throttled.SharedStoreTime(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !shared {
+		t.Error("expected ShareStoreTime to pass a context sharing the store time")
+	}
+}
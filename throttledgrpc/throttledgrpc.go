@@ -0,0 +1,118 @@
+// Package throttledgrpc offers gRPC server interceptors limiting the
+// rate of calls with a throttled.RateLimiter.
+package throttledgrpc // import "github.com/throttled/throttled/throttledgrpc"
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/throttled/throttled"
+)
+
+// UnaryServerInterceptor returns an interceptor limiting unary calls
+// with limiter. keyFunc is called for each call to generate the key
+// for the limiter, for example from the incoming metadata or the peer
+// address in ctx. If it is nil, all calls use an empty string key.
+//
+// Limited calls fail with codes.ResourceExhausted and, when the limiter
+// reports when to retry, a google.rpc.RetryInfo detail. If the limiter
+// fails, calls fail with codes.Internal. Otherwise x-ratelimit-limit,
+// x-ratelimit-remaining, x-ratelimit-reset and retry-after headers are
+// sent like the headers of throttled.HTTPRateLimiter. If limiter implements
+// throttled.RateLimiterCtx, the context of the call is passed to it.
+func UnaryServerInterceptor(limiter throttled.RateLimiter, keyFunc func(ctx context.Context, info *grpc.UnaryServerInfo) string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var key string
+		if keyFunc != nil {
+			key = keyFunc(ctx, info)
+		}
+
+		if err := rateLimit(ctx, limiter, key, grpc.SetHeader); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor limiting the opening
+// of streams with limiter, like UnaryServerInterceptor. Messages on
+// streams that were opened are not limited.
+func StreamServerInterceptor(limiter throttled.RateLimiter, keyFunc func(ctx context.Context, info *grpc.StreamServerInfo) string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+
+		var key string
+		if keyFunc != nil {
+			key = keyFunc(ctx, info)
+		}
+
+		setHeader := func(_ context.Context, md metadata.MD) error {
+			return ss.SetHeader(md)
+		}
+		if err := rateLimit(ctx, limiter, key, setHeader); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func rateLimit(ctx context.Context, limiter throttled.RateLimiter, key string, setHeader func(context.Context, metadata.MD) error) error {
+	var limited bool
+	var result throttled.RateLimitResult
+	var err error
+	if lc, ok := limiter.(throttled.RateLimiterCtx); ok {
+		limited, result, err = lc.RateLimitCtx(ctx, key, 1)
+	} else {
+		limited, result, err = limiter.RateLimit(key, 1)
+	}
+
+	if err != nil {
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	setHeader(ctx, rateLimitMetadata(result))
+
+	if !limited {
+		return nil
+	}
+
+	st := status.New(codes.ResourceExhausted, "limit exceeded")
+	if result.RetryAfter >= 0 {
+		if withDetails, err := st.WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(result.RetryAfter),
+		}); err == nil {
+			st = withDetails
+		}
+	}
+	return st.Err()
+}
+
+func rateLimitMetadata(result throttled.RateLimitResult) metadata.MD {
+	md := metadata.MD{}
+
+	if v := result.Limit; v >= 0 {
+		md.Set("x-ratelimit-limit", strconv.Itoa(v))
+	}
+
+	if v := result.Remaining; v >= 0 {
+		md.Set("x-ratelimit-remaining", strconv.Itoa(v))
+	}
+
+	if v := result.ResetAfter; v >= 0 {
+		md.Set("x-ratelimit-reset", strconv.Itoa(int(math.Ceil(v.Seconds()))))
+	}
+
+	if v := result.RetryAfter; v >= 0 {
+		md.Set("retry-after", strconv.Itoa(int(math.Ceil(v.Seconds()))))
+	}
+
+	return md
+}
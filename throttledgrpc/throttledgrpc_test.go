@@ -0,0 +1,157 @@
+package throttledgrpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"github.com/throttled/throttled/throttledgrpc"
+)
+
+// Demonstrates how to limit the calls of each peer to a gRPC server.
+func ExampleUnaryServerInterceptor() {
+	store, err := memstore.New(65536)
+	if err != nil {
+		panic(err)
+	}
+
+	rateLimiter, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota{
+		MaxRate:  throttled.PerMin(20),
+		MaxBurst: 5,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	byPeer := func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		if p, ok := peer.FromContext(ctx); ok {
+			return p.Addr.String()
+		}
+		return ""
+	}
+
+	grpc.NewServer(grpc.UnaryInterceptor(throttledgrpc.UnaryServerInterceptor(rateLimiter, byPeer)))
+}
+
+// transportStream records the headers set by a handler.
+type transportStream struct {
+	header metadata.MD
+}
+
+func (s *transportStream) Method() string { return "/test/Method" }
+func (s *transportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+func (s *transportStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+func (s *transportStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	interceptor := throttledgrpc.UnaryServerInterceptor(rl, func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		keys = append(keys, info.FullMethod)
+		return info.FullMethod
+	})
+
+	calls := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return "ok", nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+
+	ts := &transportStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), ts)
+
+	if resp, err := interceptor(ctx, nil, info, handler); err != nil {
+		t.Fatal(err)
+	} else if resp != "ok" {
+		t.Errorf("expected the handler's response but got %v", resp)
+	}
+	if have, want := ts.header.Get("x-ratelimit-limit"), []string{"1"}; len(have) != 1 || have[0] != want[0] {
+		t.Errorf("expected x-ratelimit-limit to be %v but got %v", want, have)
+	}
+
+	_, err = interceptor(ctx, nil, info, handler)
+	s := status.Convert(err)
+	if s.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected a limited call to fail with ResourceExhausted but got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the handler to be called once but got %d", calls)
+	}
+
+	var retry *errdetails.RetryInfo
+	for _, d := range s.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil {
+		t.Fatal("expected a RetryInfo detail")
+	}
+	if have := retry.RetryDelay.AsDuration(); have <= 0 || have > time.Minute {
+		t.Errorf("expected a retry delay of up to a minute but got %s", have)
+	}
+
+	if len(keys) != 2 || keys[0] != "/test/Method" {
+		t.Errorf("expected the key function to be called for each call but got %v", keys)
+	}
+}
+
+// serverStream is a grpc.ServerStream with a context.
+type serverStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+}
+
+func (s *serverStream) Context() context.Context { return s.ctx }
+func (s *serverStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	st, err := memstore.New(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := throttled.NewGCRARateLimiter(st, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interceptor := throttledgrpc.StreamServerInterceptor(rl, nil)
+	handler := func(srv interface{}, stream grpc.ServerStream) error { return nil }
+	ss := &serverStream{ctx: context.Background()}
+	info := &grpc.StreamServerInfo{FullMethod: "/test/Stream"}
+
+	if err := interceptor(nil, ss, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if len(ss.header.Get("x-ratelimit-remaining")) != 1 {
+		t.Errorf("expected x-ratelimit-remaining to be set but got %v", ss.header)
+	}
+	if err := interceptor(nil, ss, info, handler); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected a limited stream to fail with ResourceExhausted but got %v", err)
+	}
+}
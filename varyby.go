@@ -2,15 +2,38 @@ package throttled
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 )
 
 // VaryBy defines the criteria to use to group requests.
 type VaryBy struct {
+	// Bucket, if not nil, returns a coarse group of the request to
+	// vary by, such as the country or the autonomous system of the
+	// client found with a GeoIP database. It comes first in the key, so
+	// that the quotas returned by BucketQuotas apply to the whole
+	// group, whatever the other criteria, while the requests of the
+	// group are still limited separately by them. To limit a group as a
+	// whole, set no other criteria.
+	Bucket func(r *http.Request) string
+
 	// Vary by the RemoteAddr as specified by the net/http.Request field.
 	RemoteAddr bool
 
+	// TrustedProxies lists the networks of the proxies, such as load
+	// balancers, whose X-Forwarded-For and X-Real-IP headers are
+	// trusted when varying by RemoteAddr. If the RemoteAddr of a
+	// request is in one of them, the client address is the last one in
+	// X-Forwarded-For that isn't, or else X-Real-IP. Otherwise, or if
+	// the headers hold no valid address, the RemoteAddr is used, so
+	// clients can't evade their limit by forging the headers.
+	TrustedProxies []*net.IPNet
+
 	// Vary by the HTTP Method as specified by the net/http.Request field.
 	Method bool
 
@@ -18,6 +41,14 @@ type VaryBy struct {
 	// URL field.
 	Path bool
 
+	// PathNormalizer, if not nil, is applied to the URL's Path when varying
+	// by Path, so that the paths of a route share a key. For example, it
+	// could return the route template matched by the mux, or use
+	// NormalizePathIDs to map /users/123 and /users/456 to /users/:id.
+	// The query string is never part of the path; vary by Params to
+	// include some of its parameters.
+	PathNormalizer func(path string) string
+
 	// Vary by this list of header names, read from the net/http.Request Header field.
 	Headers []string
 
@@ -27,10 +58,35 @@ type VaryBy struct {
 	// Vary by this list of cookie names, read from the net/http.Request Cookie method.
 	Cookies []string
 
+	// Vary by the SHA-256 hash of the request body, for example to
+	// limit the replay of identical POST requests. The body is buffered
+	// in memory and then replaced by a reader of the same content, so
+	// that handlers can still read it. A body longer than MaxBodySize,
+	// or that fails to be read, isn't hashed, so the key only varies by
+	// the other criteria.
+	Body bool
+
+	// MaxBodySize is the maximum number of bytes of the body that are
+	// read to vary by Body. Defaults to DefaultMaxBodySize if zero or
+	// negative.
+	MaxBodySize int64
+
 	// Use this separator string to concatenate the various criteria of the VaryBy struct.
-	// Defaults to a newline character if empty (\n).
+	// Defaults to a newline character if empty (\n). Each criterion is
+	// followed by the separator, and backslashes and occurrences of the
+	// first byte of the separator within values are escaped with a
+	// backslash, so that distinct values never produce the same key. A
+	// missing header, parameter or cookie is treated as an empty value.
 	Separator string
 
+	// MaxKeyLength, if greater than zero, is the length beyond which keys
+	// are replaced by the hex-encoded SHA-256 hash of the key, which is 64
+	// bytes long. This bounds the size of keys in the store, such as to
+	// stay within the 250 bytes limit of Memcached, while keeping shorter
+	// keys readable. The hash is the same across processes. The Bucket,
+	// if any, is kept before the hash for BucketQuotas.
+	MaxKeyLength int
+
 	// DEPRECATED. Custom specifies the custom-generated key to use for this request.
 	// If not nil, the value returned by this function is used instead of any
 	// VaryBy criteria.
@@ -39,20 +95,96 @@ type VaryBy struct {
 
 // Key returns the key for this request based on the criteria defined by the VaryBy struct.
 func (vb *VaryBy) Key(r *http.Request) string {
-	var buf bytes.Buffer
-
 	if vb == nil {
 		return "" // Special case for no vary-by option
 	}
+
+	var key string
 	if vb.Custom != nil {
 		// A custom key generator is specified
-		return vb.Custom(r)
+		key = vb.Custom(r)
+	} else {
+		key = vb.key(r)
 	}
-	sep := vb.Separator
-	if sep == "" {
-		sep = "\n" // Separator defaults to newline
+
+	if vb.MaxKeyLength > 0 && len(key) > vb.MaxKeyLength {
+		if n := vb.bucketLen(key); n > 0 {
+			// Keep the bucket readable by BucketQuotas
+			return key[:n] + hashKey([]byte(key))
+		}
+		return hashKey([]byte(key))
 	}
-	if vb.RemoteAddr && len(r.RemoteAddr) > 0 {
+	return key
+}
+
+// BucketQuotas returns a function to use as the QuotaProvider of an
+// HTTPRateLimiter with vb as its VaryBy, which looks up the quota of a
+// request in quotas by the Bucket of the request. The requests of the
+// buckets missing from quotas, or of all requests if Bucket is nil or
+// Custom is set, get the quota of the RateLimiter. For example, quotas could
+// hold a strict quota for the autonomous systems of abusive clients
+// and a generous one for a region with many clients behind shared
+// addresses. The map must not be modified after the call.
+func (vb *VaryBy) BucketQuotas(quotas map[string]RateQuota) func(key string) (RateQuota, bool) {
+	return func(key string) (RateQuota, bool) {
+		n := vb.bucketLen(key)
+		if n <= 0 {
+			return RateQuota{}, false
+		}
+		quota, ok := quotas[unescapeKey(key[:n-len(vb.separator())])]
+		return quota, ok
+	}
+}
+
+// bucketLen returns the length of the bucket at the start of key,
+// including its separator, or 0 if the key has no bucket.
+func (vb *VaryBy) bucketLen(key string) int {
+	if vb == nil || vb.Bucket == nil || vb.Custom != nil {
+		return 0
+	}
+
+	sep := vb.separator()
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case sep[0]:
+			return i + len(sep)
+		}
+	}
+	return 0
+}
+
+// isEmptyKey reports whether key, returned by Key, has only empty
+// fields. Values are escaped, so such a key is made of separators
+// only.
+func (vb *VaryBy) isEmptyKey(key string) bool {
+	if vb == nil || vb.Custom != nil {
+		return key == ""
+	}
+	return strings.Replace(key, vb.separator(), "", -1) == ""
+}
+
+func (vb *VaryBy) separator() string {
+	if vb.Separator == "" {
+		return "\n" // Separator defaults to newline
+	}
+	return vb.Separator
+}
+
+func (vb *VaryBy) key(r *http.Request) string {
+	var buf bytes.Buffer
+
+	sep := vb.separator()
+	write := func(v string) {
+		buf.WriteString(escapeKey(v, sep[0]))
+		buf.WriteString(sep)
+	}
+
+	if vb.Bucket != nil {
+		write(vb.Bucket(r))
+	}
+	if vb.RemoteAddr {
 		// RemoteAddr usually looks something like `IP:port`. For example,
 		// `[::]:1234`. However, it seems to occasionally degenerately appear
 		// as just IP (or other), so be conservative with how we extract it.
@@ -65,26 +197,210 @@ func (vb *VaryBy) Key(r *http.Request) string {
 			ip = r.RemoteAddr[:index]
 		}
 
-		buf.WriteString(strings.ToLower(ip) + sep)
+		if forwarded := vb.forwardedFor(r, ip); forwarded != nil {
+			ip = formatIP(forwarded)
+		}
+
+		write(strings.ToLower(ip))
 	}
 	if vb.Method {
-		buf.WriteString(strings.ToLower(r.Method) + sep)
+		write(strings.ToLower(r.Method))
 	}
 	for _, h := range vb.Headers {
-		buf.WriteString(strings.ToLower(r.Header.Get(h)) + sep)
+		write(strings.ToLower(r.Header.Get(h)))
 	}
 	if vb.Path {
-		buf.WriteString(r.URL.Path + sep)
+		path := r.URL.Path
+		if vb.PathNormalizer != nil {
+			path = vb.PathNormalizer(path)
+		}
+		write(path)
 	}
 	for _, p := range vb.Params {
-		buf.WriteString(r.FormValue(p) + sep)
+		write(r.FormValue(p))
 	}
 	for _, c := range vb.Cookies {
-		ck, err := r.Cookie(c)
-		if err == nil {
-			buf.WriteString(ck.Value)
+		var v string
+		if ck, err := r.Cookie(c); err == nil {
+			v = ck.Value
 		}
-		buf.WriteString(sep) // Write the separator anyway, whether or not the cookie exists
+		write(v) // Write the separator anyway, whether or not the cookie exists
+	}
+	if vb.Body {
+		write(vb.bodyHash(r))
 	}
 	return buf.String()
 }
+
+// DefaultMaxBodySize is the default value of VaryBy.MaxBodySize.
+const DefaultMaxBodySize = 1 << 20
+
+// bodyHash returns the hex-encoded SHA-256 hash of the body of r, or
+// an empty string if the body is too large or can't be read, and
+// restores the body so that it can be read again.
+func (vb *VaryBy) bodyHash(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return hashKey(nil)
+	}
+
+	max := vb.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+
+	// Read one more byte than allowed to tell a body of exactly the
+	// maximum size from a larger one.
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(b), r.Body), Closer: r.Body}
+	if err != nil || int64(len(b)) > max {
+		return ""
+	}
+
+	return hashKey(b)
+}
+
+// replayedBody reads the part of a body buffered by VaryBy and then
+// the rest of it, and closes the original body.
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func hashKey(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// escapeKey escapes backslashes and occurrences of sep in v with a
+// backslash. Since unescaped occurrences of sep then only come from
+// separators, keys can be split back into their values unambiguously.
+func escapeKey(v string, sep byte) string {
+	if strings.IndexByte(v, '\\') == -1 && strings.IndexByte(v, sep) == -1 {
+		return v
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' || v[i] == sep {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// unescapeKey reverses escapeKey.
+func unescapeKey(v string) string {
+	if strings.IndexByte(v, '\\') == -1 {
+		return v
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// NormalizePathIDs replaces the segments of path that look like
+// identifiers, that is decimal numbers and UUIDs, by ":id". It is meant
+// to be used as a PathNormalizer.
+func NormalizePathIDs(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isDecimal(s) || isUUID(s) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isDecimal(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// forwardedFor returns the client address given by the headers of r
+// if peer, the host of its RemoteAddr, is a trusted proxy, or nil.
+func (vb *VaryBy) forwardedFor(r *http.Request, peer string) net.IP {
+	if len(vb.TrustedProxies) == 0 || !vb.trusted(parseIP(peer)) {
+		return nil
+	}
+
+	var hops []string
+	for _, h := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		if !vb.trusted(ip) {
+			return ip
+		}
+	}
+
+	return parseIP(r.Header.Get("X-Real-IP"))
+}
+
+func (vb *VaryBy) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range vb.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an address with or without a port, and with or
+// without brackets around an IPv6 address.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// formatIP formats ip like the host of a RemoteAddr, with brackets
+// around an IPv6 address, so that a client has the same key whether
+// or not it connects through a proxy.
+func formatIP(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.To4().String()
+	}
+	return "[" + ip.String() + "]"
+}
@@ -1,8 +1,11 @@
 package throttled_test
 
 import (
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/throttled/throttled"
@@ -71,3 +74,190 @@ func TestVaryBy(t *testing.T) {
 		}
 	}
 }
+
+func TestVaryByTrustedProxies(t *testing.T) {
+	_, lb, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vb := &throttled.VaryBy{RemoteAddr: true, TrustedProxies: []*net.IPNet{lb}}
+
+	cases := []struct {
+		remoteAddr string
+		headers    http.Header
+		k          string
+	}{
+		// Headers from an untrusted peer are ignored
+		0: {"1.2.3.4:1234", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "1.2.3.4\n"},
+		1: {"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "5.6.7.8\n"},
+		// Only the hops added by trusted proxies are skipped
+		2: {"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8", "10.0.0.2"}}, "5.6.7.8\n"},
+		3: {"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"2001:DB8::1"}}, "[2001:db8::1]\n"},
+		4: {"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"[2001:db8::1]:443"}}, "[2001:db8::1]\n"},
+		5: {"10.0.0.1:1234", http.Header{"X-Real-Ip": {"5.6.7.8"}}, "5.6.7.8\n"},
+		// Invalid headers fall back to the peer
+		6: {"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"garbage"}}, "10.0.0.1\n"},
+		7: {"10.0.0.1:1234", nil, "10.0.0.1\n"},
+	}
+
+	for i, c := range cases {
+		r := &http.Request{RemoteAddr: c.remoteAddr, Header: c.headers}
+		if got := vb.Key(r); got != c.k {
+			t.Errorf("%d: expected '%s', got '%s'", i, c.k, got)
+		}
+	}
+}
+
+func TestVaryByPathNormalizer(t *testing.T) {
+	vb := &throttled.VaryBy{Path: true, PathNormalizer: throttled.NormalizePathIDs}
+
+	cases := []struct {
+		path, k string
+	}{
+		0: {"/users/123", "/users/:id\n"},
+		1: {"/users/456/posts/7", "/users/:id/posts/:id\n"},
+		2: {"/orders/123e4567-e89b-12d3-a456-426614174000", "/orders/:id\n"},
+		3: {"/users/me", "/users/me\n"},
+		4: {"/", "/\n"},
+	}
+
+	for i, c := range cases {
+		r := &http.Request{URL: &url.URL{Path: c.path, RawQuery: "page=2"}}
+		if got := vb.Key(r); got != c.k {
+			t.Errorf("%d: expected '%s', got '%s'", i, c.k, got)
+		}
+	}
+}
+
+func TestVaryByNoCollisions(t *testing.T) {
+	vb := &throttled.VaryBy{Separator: ",", Headers: []string{"A", "B"}}
+	cases := []http.Header{
+		{"A": {"x,"}, "B": {"y"}},
+		{"A": {"x"}, "B": {",y"}},
+		{"A": {"x,y"}},
+		{"B": {"x,y"}},
+		{"A": {`x\`}, "B": {"y"}},
+		{"A": {`x\,`}, "B": {"y"}},
+		{"A": {"x"}, "B": {`\,y`}},
+		{"A": {""}, "B": {"x,,y"}},
+	}
+
+	seen := make(map[string]int)
+	for i, h := range cases {
+		k := vb.Key(&http.Request{Header: h})
+		if j, ok := seen[k]; ok {
+			t.Errorf("%d: expected a distinct key but got '%s' like %d", i, k, j)
+		}
+		seen[k] = i
+	}
+
+	// A missing header is treated as an empty one
+	if have, want := vb.Key(&http.Request{Header: http.Header{"A": {""}}}), vb.Key(&http.Request{}); have != want {
+		t.Errorf("expected '%s' for a missing header but got '%s'", want, have)
+	}
+}
+
+func TestVaryByMaxKeyLength(t *testing.T) {
+	vb := &throttled.VaryBy{Headers: []string{"A"}, MaxKeyLength: 8}
+
+	key := func(v string) string {
+		return vb.Key(&http.Request{Header: http.Header{"A": {v}}})
+	}
+
+	if have, want := key("short"), "short\n"; have != want {
+		t.Errorf("expected '%s' but got '%s'", want, have)
+	}
+
+	// sha256("long value\n")
+	want := "34c74236ff0d0565bac197286ca15037333745c654ebbb26649c6aba7c711014"
+	if have := key("long value"); have != want {
+		t.Errorf("expected '%s' but got '%s'", want, have)
+	}
+	if key("long value") == key("other long value") {
+		t.Error("expected distinct long values to have distinct keys")
+	}
+}
+
+func TestVaryByBody(t *testing.T) {
+	vb := &throttled.VaryBy{Method: true, Body: true, MaxBodySize: 8}
+
+	cases := []struct {
+		body, k string
+	}{
+		// sha256("")
+		0: {"", "post\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n"},
+		// sha256("12345678")
+		1: {"12345678", "post\nef797c8118f02dfb649607dd5d3f8c7623048c9c063d532cc95c5ed7a898a64f\n"},
+		// Too long to be hashed
+		2: {"123456789", "post\n\n"},
+	}
+
+	for i, c := range cases {
+		r, err := http.NewRequest("POST", "/", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := vb.Key(r); got != c.k {
+			t.Errorf("%d: expected '%s', got '%s'", i, c.k, got)
+		}
+
+		// The body can still be read in full
+		if b, err := ioutil.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		} else if string(b) != c.body {
+			t.Errorf("%d: expected the body to be '%s' but got '%s'", i, c.body, b)
+		}
+	}
+}
+
+func TestVaryByBucket(t *testing.T) {
+	asn := func(r *http.Request) string { return r.Header.Get("Asn") }
+	vb := &throttled.VaryBy{Bucket: asn, Separator: ",", Headers: []string{"User"}, MaxKeyLength: 16}
+
+	strict := throttled.RateQuota{MaxRate: throttled.PerMin(1)}
+	generous := throttled.RateQuota{MaxRate: throttled.PerSec(100), MaxBurst: 10}
+	provider := vb.BucketQuotas(map[string]throttled.RateQuota{
+		"AS1":   strict,
+		"AS,2":  generous,
+		"":      generous,
+		"other": strict,
+	})
+
+	cases := []struct {
+		asn, user, k string
+		quota        throttled.RateQuota
+		ok           bool
+	}{
+		0: {"AS1", "a", "AS1,a,", strict, true},
+		1: {"AS,2", "a", `AS\,2,a,`, generous, true},
+		2: {"", "a", ",a,", generous, true},
+		3: {"AS3", "a", "AS3,a,", throttled.RateQuota{}, false},
+		// The bucket is kept when the rest of the key is hashed
+		4: {"AS1", "a long user name", "", strict, true},
+	}
+
+	for i, c := range cases {
+		r := &http.Request{Header: http.Header{"Asn": {c.asn}, "User": {c.user}}}
+		k := vb.Key(r)
+		if c.k == "" && (!strings.HasPrefix(k, "AS1,") || len(k) != len("AS1,")+64) {
+			t.Errorf("%d: expected the bucket followed by a hash but got '%s'", i, k)
+		} else if c.k != "" && k != c.k {
+			t.Errorf("%d: expected '%s', got '%s'", i, c.k, k)
+		}
+		if quota, ok := provider(k); ok != c.ok || quota != c.quota {
+			t.Errorf("%d: expected quota %v (%v) but got %v (%v)", i, c.quota, c.ok, quota, ok)
+		}
+	}
+
+	// Keys without a bucket never get a quota
+	for i, vb := range []*throttled.VaryBy{
+		{Headers: []string{"Asn"}},
+		{Bucket: asn, Custom: func(r *http.Request) string { return "AS1,a," }},
+	} {
+		r := &http.Request{Header: http.Header{"Asn": {"AS1"}}}
+		if _, ok := vb.BucketQuotas(map[string]throttled.RateQuota{"AS1": strict})(vb.Key(r)); ok {
+			t.Errorf("%d: expected no quota for a key without a bucket", i)
+		}
+	}
+}